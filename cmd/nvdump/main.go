@@ -0,0 +1,128 @@
+// nvdump prints nvlists as JSON annotated with the nvpair types and converts such JSON back into
+// nvlists. It reads zpool.cache files, captured ioctl buffers or the nvlists of on-disk vdev labels
+// (which start 16KiB into each label, use -offset) from a file or stdin. It can also print nvlists in
+// the text formats of libnvpair and convert them back, for example to turn the output of zdb -C into
+// test fixtures.
+//
+//	nvdump /etc/zfs/zpool.cache > pools.json
+//	nvdump -offset 16384 /dev/sda1
+//	nvdump -format dump /etc/zfs/zpool.cache
+//	nvdump -r -xdr pools.json > zpool.cache
+//	zdb -C tank | nvdump -r > config.bin
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist/nvjson"
+)
+
+var (
+	offset    = flag.Int64("offset", 0, "byte offset of the nvlist in the input")
+	format    = flag.String("format", "json", "output format: json, print (nvlist_print) or dump (dump_nvlist)")
+	reverse   = flag.Bool("r", false, "convert annotated JSON or text printed by libnvpair back into an nvlist")
+	xdr       = flag.Bool("xdr", false, "write the nvlist in XDR encoding (with -r)")
+	bigEndian = flag.Bool("be", false, "write the nvlist in big endian byte order (with -r)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if flag.NArg() == 1 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if *offset > 0 {
+		if _, err := in.Seek(*offset, io.SeekStart); err != nil {
+			// Pipes can't seek
+			if _, err := io.CopyN(ioutil.Discard, in, *offset); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	var err error
+	if *reverse {
+		err = encode(in, os.Stdout)
+	} else {
+		err = dump(in, os.Stdout)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// dump decodes a single nvlist from r and writes it in the selected format to w
+func dump(r io.Reader, w io.Writer) error {
+	var l nvlist.List
+	if err := nvlist.NewDecoder(bufio.NewReader(r)).Decode(&l); err != nil {
+		return err
+	}
+	switch *format {
+	case "print":
+		return l.Fprint(w, nvlist.PrintOptions{Format: nvlist.FormatNvlistPrint})
+	case "dump":
+		return l.Fprint(w, nvlist.PrintOptions{Format: nvlist.FormatDumpNvlist})
+	case "json":
+		out, err := nvjson.MarshalIndent(&l, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+// encode reads annotated JSON or text printed by libnvpair from r and writes it as an nvlist to w
+func encode(r io.Reader, w io.Writer) error {
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var l *nvlist.List
+	if trimmed := bytes.TrimSpace(in); len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		l, err = nvjson.Unmarshal(in)
+	} else {
+		l, err = nvlist.ParseText(in)
+	}
+	if err != nil {
+		return err
+	}
+	var opts nvlist.EncoderOptions
+	if *xdr {
+		opts.Encoding = nvlist.EncodingXDR
+	}
+	if *bigEndian {
+		opts.ByteOrder = binary.BigEndian
+	}
+	enc := nvlist.NewEncoder(w)
+	enc.SetOptions(opts)
+	return enc.Encode(l)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "nvdump: %v\n", err)
+	os.Exit(1)
+}
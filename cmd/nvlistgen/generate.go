@@ -0,0 +1,807 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const nvlistPath = "git.dolansoft.org/lorenz/go-zfs/nvlist"
+
+// fieldKind is how a field is encoded and decoded by the generated code
+type fieldKind int
+
+const (
+	kindOther     fieldKind = iota // handled with reflection by the nvlist package
+	kindInt                        // signed integers and Hrtime
+	kindUint                       // unsigned integers
+	kindFloat                      // floating point numbers
+	kindString                     // strings
+	kindBool                       // bool and Flag, encoded as boolean
+	kindBoolValue                  // BoolValue, encoded as boolean_value
+)
+
+// basicType describes a type which the generated code handles without reflection
+type basicType struct {
+	kind fieldKind
+	// bits is the size of numbers, 0 for int and uint
+	bits int
+	// nvType is the nvpair type numbers are encoded as, empty if they can't be encoded
+	nvType string
+	// goType is the type as written in the generated code
+	goType string
+}
+
+var basicTypes = map[string]basicType{
+	"bool":    {kind: kindBool},
+	"string":  {kind: kindString},
+	"int":     {kind: kindInt},
+	"int8":    {kind: kindInt, bits: 8, nvType: "TypeInt8"},
+	"int16":   {kind: kindInt, bits: 16, nvType: "TypeInt16"},
+	"int32":   {kind: kindInt, bits: 32, nvType: "TypeInt32"},
+	"int64":   {kind: kindInt, bits: 64, nvType: "TypeInt64"},
+	"uint":    {kind: kindUint},
+	"uint8":   {kind: kindUint, bits: 8, nvType: "TypeByte"},
+	"byte":    {kind: kindUint, bits: 8, nvType: "TypeByte"},
+	"uint16":  {kind: kindUint, bits: 16, nvType: "TypeUint16"},
+	"uint32":  {kind: kindUint, bits: 32, nvType: "TypeUint32"},
+	"uint64":  {kind: kindUint, bits: 64, nvType: "TypeUint64"},
+	"float32": {kind: kindFloat, bits: 32},
+	"float64": {kind: kindFloat, bits: 64, nvType: "TypeDouble"},
+}
+
+var nvlistTypes = map[string]basicType{
+	"Flag":      {kind: kindBool},
+	"BoolValue": {kind: kindBoolValue},
+	"Hrtime":    {kind: kindInt, bits: 64, nvType: "TypeHrtime"},
+}
+
+// typeDecl is a type declared in the package
+type typeDecl struct {
+	spec *ast.TypeSpec
+	// nvlistName is the name the nvlist package is imported as in the declaring file
+	nvlistName string
+}
+
+// pkg contains the declarations of the package the methods are generated for
+type pkg struct {
+	name    string
+	types   map[string]typeDecl
+	methods map[string]map[string]bool
+}
+
+// loadPackage parses the Go files of the package in dir, except for the file exclude which is
+// overwritten with the generated code
+func loadPackage(dir, exclude string) (*pkg, error) {
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &pkg{name: bp.Name, types: make(map[string]typeDecl), methods: make(map[string]map[string]bool)}
+	fset := token.NewFileSet()
+	for _, name := range bp.GoFiles {
+		path := filepath.Join(dir, name)
+		if filepath.Clean(path) == filepath.Clean(exclude) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		nvlistName := ""
+		for _, imp := range f.Imports {
+			if imp.Path.Value == strconv.Quote(nvlistPath) {
+				nvlistName = "nvlist"
+				if imp.Name != nil {
+					nvlistName = imp.Name.Name
+				}
+			}
+		}
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					if ts, ok := spec.(*ast.TypeSpec); ok {
+						p.types[ts.Name.Name] = typeDecl{spec: ts, nvlistName: nvlistName}
+					}
+				}
+			case *ast.FuncDecl:
+				if decl.Recv == nil || len(decl.Recv.List) == 0 {
+					continue
+				}
+				recv := decl.Recv.List[0].Type
+				if star, ok := recv.(*ast.StarExpr); ok {
+					recv = star.X
+				}
+				if ident, ok := recv.(*ast.Ident); ok {
+					if p.methods[ident.Name] == nil {
+						p.methods[ident.Name] = make(map[string]bool)
+					}
+					p.methods[ident.Name][decl.Name.Name] = true
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// hasNvlistMethods checks if the named type already controls its encoding or decoding
+func (p *pkg) hasNvlistMethods(name string) bool {
+	return p.methods[name]["MarshalNvlist"] || p.methods[name]["UnmarshalNvlist"]
+}
+
+// basicType returns how values of the type expr can be handled without reflection. nvlistName is
+// the name of the nvlist package in the file containing expr.
+func (p *pkg) basicType(expr ast.Expr, nvlistName string) (basicType, bool) {
+	switch expr := expr.(type) {
+	case *ast.ParenExpr:
+		return p.basicType(expr.X, nvlistName)
+	case *ast.Ident:
+		if decl, ok := p.types[expr.Name]; ok {
+			if p.hasNvlistMethods(expr.Name) {
+				return basicType{}, false
+			}
+			t, ok := p.basicType(decl.spec.Type, decl.nvlistName)
+			t.goType = expr.Name
+			return t, ok
+		}
+		t, ok := basicTypes[expr.Name]
+		t.goType = expr.Name
+		return t, ok
+	case *ast.SelectorExpr:
+		if pkgIdent, ok := expr.X.(*ast.Ident); ok && nvlistName != "" && pkgIdent.Name == nvlistName {
+			t, ok := nvlistTypes[expr.Sel.Name]
+			t.goType = "nvlist." + expr.Sel.Name
+			return t, ok
+		}
+	}
+	return basicType{}, false
+}
+
+// structField is a field of a struct as configured by its nvlist tag, see the nvlist package for the
+// meaning of the options
+type structField struct {
+	// goName selects the field in the struct, it contains dots for promoted fields
+	goName string
+	name   string
+	typ    ast.Expr
+	basic  basicType
+	// fast is set if basic applies to the field
+	fast bool
+	// ptrs are the embedded struct pointers a promoted field is accessed through
+	ptrs []embeddedPtr
+	// depth is the number of structs the field is embedded in
+	depth int
+	// tagged is set if the name comes from the tag
+	tagged bool
+
+	omitEmpty    bool
+	readOnly     bool
+	extra        bool
+	asUint64     bool
+	nvflag       bool
+	hasDefault   bool
+	defaultValue string
+}
+
+// embeddedPtr is an embedded pointer to a struct
+type embeddedPtr struct {
+	// goName selects the pointer in the outermost struct
+	goName string
+	// typ is the name of the struct type
+	typ string
+}
+
+// parseTag applies the nvlist tag to f, it returns false if the field should be skipped. It follows
+// the rules of the nvlist package.
+func (f *structField) parseTag(tag *ast.BasicLit) bool {
+	if tag == nil {
+		return true
+	}
+	raw, err := strconv.Unquote(tag.Value)
+	if err != nil {
+		return true
+	}
+	value, ok := reflect.StructTag(raw).Lookup("nvlist")
+	if !ok {
+		return true
+	}
+	parts := strings.Split(value, ",")
+	if parts[0] != "" {
+		f.name = parts[0]
+		f.tagged = true
+	}
+	for _, opt := range parts[1:] {
+		switch {
+		case opt == "omitempty":
+			f.omitEmpty = true
+		case opt == "ro":
+			f.readOnly = true
+		case opt == "extra":
+			f.extra = true
+		case opt == "asuint64":
+			f.asUint64 = true
+		case opt == "nvflag":
+			f.nvflag = true
+		case strings.HasPrefix(opt, "default="):
+			f.hasDefault = true
+			f.defaultValue = strings.TrimPrefix(opt, "default=")
+		}
+	}
+	return parts[0] != "-" || f.extra || f.nvflag
+}
+
+// embeddedName returns the field name of an embedded field of type expr
+func embeddedName(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.StarExpr:
+		return embeddedName(expr.X)
+	case *ast.SelectorExpr:
+		return expr.Sel.Name
+	case *ast.Ident:
+		return expr.Name
+	}
+	return ""
+}
+
+// tagName returns the name set in the nvlist tag, if any
+func tagName(tag *ast.BasicLit) string {
+	if tag == nil {
+		return ""
+	}
+	raw, err := strconv.Unquote(tag.Value)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(reflect.StructTag(raw).Get("nvlist"), ",", 2)[0]
+}
+
+// structType returns the struct type the type expr refers to, if it is declared in the package
+func (p *pkg) structType(expr ast.Expr) (*ast.StructType, typeDecl, bool) {
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return nil, typeDecl{}, false
+	}
+	decl, ok := p.types[ident.Name]
+	if !ok {
+		return nil, typeDecl{}, false
+	}
+	if st, ok := decl.spec.Type.(*ast.StructType); ok {
+		return st, decl, true
+	}
+	return p.structType(decl.spec.Type)
+}
+
+// structFields returns all fields of the struct type name which take part in encoding and decoding,
+// including the promoted fields of embedded structs
+func (p *pkg) structFields(name string) ([]structField, error) {
+	decl, ok := p.types[name]
+	if !ok {
+		return nil, fmt.Errorf("type %v not found", name)
+	}
+	st, ok := decl.spec.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("type %v is not a struct", name)
+	}
+	if p.hasNvlistMethods(name) {
+		return nil, fmt.Errorf("type %v already has MarshalNvlist or UnmarshalNvlist methods", name)
+	}
+	fields, err := p.appendFields(nil, name, st, decl, structField{}, map[string]bool{name: true})
+	if err != nil {
+		return nil, err
+	}
+	return dominantFields(fields), nil
+}
+
+// appendFields appends the fields of the struct st, which is embedded as described by outer, and
+// those promoted from its embedded structs to fields. name is used in errors, seen contains the struct
+// types st is embedded in to break cycles of embedded pointers.
+func (p *pkg) appendFields(fields []structField, name string, st *ast.StructType, decl typeDecl, outer structField, seen map[string]bool) ([]structField, error) {
+	for _, astField := range st.Fields.List {
+		names := make([]string, len(astField.Names))
+		for i, n := range astField.Names {
+			names[i] = n.Name
+		}
+		if len(names) == 0 {
+			goName := embeddedName(astField.Type)
+			typ := astField.Type
+			star, isPtr := typ.(*ast.StarExpr)
+			if isPtr {
+				typ = star.X
+			}
+			embedded, embeddedDecl, isStruct := p.structType(typ)
+			if !ast.IsExported(goName) && (isPtr || !isStruct) {
+				// Like in the nvlist package, only the fields of unexported embedded structs are used
+				continue
+			}
+			if tagName(astField.Tag) == "" {
+				if sel, ok := typ.(*ast.SelectorExpr); ok {
+					if _, ok := nvlistTypes[sel.Sel.Name]; !ok || embeddedName(sel.X) != decl.nvlistName {
+						return nil, fmt.Errorf("field %v.%v: embedded types from other packages are not supported", name, goName)
+					}
+				}
+			}
+			if isStruct && tagName(astField.Tag) == "" {
+				typeName := embeddedName(typ)
+				if seen[typeName] {
+					continue
+				}
+				inner := outer
+				inner.goName = join(outer.goName, goName)
+				inner.depth++
+				if isPtr {
+					inner.ptrs = append(outer.ptrs[:len(outer.ptrs):len(outer.ptrs)], embeddedPtr{goName: inner.goName, typ: typeName})
+				}
+				seen[typeName] = true
+				var err error
+				fields, err = p.appendFields(fields, name+"."+goName, embedded, embeddedDecl, inner, seen)
+				delete(seen, typeName)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			names = []string{goName}
+		}
+		for _, goName := range names {
+			if !ast.IsExported(goName) {
+				continue
+			}
+			f := structField{goName: join(outer.goName, goName), name: goName, typ: astField.Type, ptrs: outer.ptrs, depth: outer.depth}
+			if !f.parseTag(astField.Tag) {
+				continue
+			}
+			if len(astField.Names) > 0 {
+				f.basic, f.fast = p.basicType(astField.Type, decl.nvlistName)
+			}
+			if err := f.check(); err != nil {
+				return nil, fmt.Errorf("field %v.%v: %v", name, goName, err)
+			}
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// join joins Go selectors with a dot
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// dominantFields resolves conflicts between fields with the same name like the nvlist package does,
+// following the rules of encoding/json for promoted fields
+func dominantFields(fields []structField) []structField {
+	type fieldKey struct {
+		name          string
+		extra, nvflag bool
+	}
+	key := func(f *structField) fieldKey {
+		if f.extra || f.nvflag {
+			return fieldKey{extra: f.extra, nvflag: f.nvflag}
+		}
+		return fieldKey{name: f.name}
+	}
+	byKey := make(map[fieldKey][]int)
+	for i := range fields {
+		k := key(&fields[i])
+		byKey[k] = append(byKey[k], i)
+	}
+	keep := make([]bool, len(fields))
+	for k, candidates := range byKey {
+		depth := fields[candidates[0]].depth
+		for _, i := range candidates {
+			if fields[i].depth < depth {
+				depth = fields[i].depth
+			}
+		}
+		var shallowest, tagged []int
+		for _, i := range candidates {
+			if fields[i].depth == depth {
+				shallowest = append(shallowest, i)
+				if fields[i].tagged {
+					tagged = append(tagged, i)
+				}
+			}
+		}
+		switch {
+		case depth == 0 || k.extra || k.nvflag:
+			for _, i := range shallowest {
+				keep[i] = true
+			}
+		case len(tagged) == 1:
+			keep[tagged[0]] = true
+		case len(tagged) == 0 && len(shallowest) == 1:
+			keep[shallowest[0]] = true
+		}
+	}
+	var out []structField
+	for i, f := range fields {
+		if keep[i] {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// check rejects tags which the nvlist package would reject at runtime with ErrInvalidTag
+func (f *structField) check() error {
+	if f.extra {
+		if m, ok := f.typ.(*ast.MapType); ok {
+			if key, ok := m.Key.(*ast.Ident); !ok || key.Name != "string" {
+				return fmt.Errorf("extra field needs to be a map with string keys")
+			}
+		}
+	}
+	if f.nvflag && (!f.fast || f.basic.kind != kindUint || f.basic.bits != 0 && f.basic.bits < 32) {
+		return fmt.Errorf("nvflag field needs to be a uint, uint32 or uint64")
+	}
+	if f.hasDefault && !f.extra && !f.nvflag {
+		if _, err := f.defaultLiteral(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultLiteral returns the Go literal for the default option of the field, parsed like the nvlist
+// package does
+func (f *structField) defaultLiteral() (string, error) {
+	invalid := fmt.Errorf("default %q is not supported for this field", f.defaultValue)
+	if !f.fast {
+		return "", invalid
+	}
+	bits := f.basic.bits
+	if bits == 0 {
+		bits = 64
+	}
+	switch f.basic.kind {
+	case kindString:
+		return strconv.Quote(f.defaultValue), nil
+	case kindBool, kindBoolValue:
+		b, err := strconv.ParseBool(f.defaultValue)
+		if err != nil {
+			return "", invalid
+		}
+		return strconv.FormatBool(b), nil
+	case kindInt:
+		i, err := strconv.ParseInt(f.defaultValue, 0, bits)
+		if err != nil {
+			b, boolErr := strconv.ParseBool(f.defaultValue)
+			if boolErr != nil {
+				return "", invalid
+			}
+			i = boolToInt(b)
+		}
+		return strconv.FormatInt(i, 10), nil
+	case kindUint:
+		u, err := strconv.ParseUint(f.defaultValue, 0, bits)
+		if err != nil {
+			b, boolErr := strconv.ParseBool(f.defaultValue)
+			if boolErr != nil {
+				return "", invalid
+			}
+			u = uint64(boolToInt(b))
+		}
+		return strconv.FormatUint(u, 10), nil
+	case kindFloat:
+		v, err := strconv.ParseFloat(f.defaultValue, bits)
+		if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+			return "", invalid
+		}
+		return strconv.FormatFloat(v, 'g', -1, bits), nil
+	}
+	return "", invalid
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// convert returns expr of type from converted into the type of the field
+func (f *structField) convert(expr, from string) string {
+	if f.basic.goType == from {
+		return expr
+	}
+	return f.basic.goType + "(" + expr + ")"
+}
+
+// convertTo returns the field value selected by expr converted into the type to
+func (f *structField) convertTo(expr, to string) string {
+	if f.basic.goType == to {
+		return expr
+	}
+	return to + "(" + expr + ")"
+}
+
+// isBool checks if the field is handled without reflection and has a boolean type
+func (f *structField) isBool() bool {
+	return f.fast && (f.basic.kind == kindBool || f.basic.kind == kindBoolValue)
+}
+
+// generate returns the formatted source of the methods for the given struct types in the package in
+// dir, which get written to outPath
+func generate(dir, outPath string, typeNames []string) ([]byte, error) {
+	p, err := loadPackage(dir, outPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by nvlistgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %v\n\n", p.name)
+	fmt.Fprintf(&buf, "import %q\n", nvlistPath)
+	for _, name := range typeNames {
+		fields, err := p.structFields(name)
+		if err != nil {
+			return nil, err
+		}
+		writeMarshal(&buf, name, fields)
+		writeUnmarshal(&buf, name, fields)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v", err)
+	}
+	return src, nil
+}
+
+// writeMarshal writes MarshalNvlist for the struct type name and the PairMarshaler it returns
+func writeMarshal(buf *bytes.Buffer, name string, fields []structField) {
+	m := "nvlistMarshaler" + name
+	fmt.Fprintf(buf, "\n// MarshalNvlist encodes v using code generated from its nvlist tags\n")
+	fmt.Fprintf(buf, "func (v %v) MarshalNvlist() (interface{}, error) {\n", name)
+	fmt.Fprintf(buf, "return %v{&v}, nil\n}\n", m)
+	fmt.Fprintf(buf, "\ntype %v struct{ v *%v }\n", m, name)
+
+	fmt.Fprintf(buf, "\nfunc (m %v) NvlistFlags() (uint32, bool) {\n", m)
+	// Like in the nvlist package, the first nvflag field which isn't promoted through a nil pointer
+	// is used
+	returned := false
+	for _, f := range fields {
+		if !f.nvflag {
+			continue
+		}
+		if check := f.nilCheck("m.v"); check != "" {
+			fmt.Fprintf(buf, "if %v {\nreturn uint32(m.v.%v), true\n}\n", check, f.goName)
+			continue
+		}
+		fmt.Fprintf(buf, "return uint32(m.v.%v), true\n", f.goName)
+		returned = true
+		break
+	}
+	if !returned {
+		fmt.Fprintf(buf, "return 0, false\n")
+	}
+	fmt.Fprintf(buf, "}\n")
+
+	fmt.Fprintf(buf, "\nfunc (m %v) MarshalNvpairs(w *nvlist.PairWriter) error {\n", m)
+	hasExtra := false
+	for _, f := range fields {
+		if f.readOnly || f.nvflag {
+			continue
+		}
+		if f.extra {
+			hasExtra = true
+			continue
+		}
+		writeMarshalField(buf, f)
+	}
+	for _, f := range fields {
+		if f.extra && !f.readOnly {
+			check := f.nilCheck("m.v")
+			if check != "" {
+				fmt.Fprintf(buf, "if %v {\n", check)
+			}
+			fmt.Fprintf(buf, "if err := w.Extra(m.v.%v, m.isField); err != nil {\nreturn err\n}\n", f.goName)
+			if check != "" {
+				fmt.Fprintf(buf, "}\n")
+			}
+		}
+	}
+	fmt.Fprintf(buf, "return nil\n}\n")
+
+	if hasExtra {
+		fmt.Fprintf(buf, "\n// isField checks if there is a field for the given nvpair name\n")
+		fmt.Fprintf(buf, "func (m %v) isField(name string) bool {\n", m)
+		var names []string
+		seen := make(map[string]bool)
+		for _, f := range fields {
+			if !f.extra && !f.nvflag && !seen[f.name] {
+				seen[f.name] = true
+				names = append(names, strconv.Quote(f.name))
+			}
+		}
+		if len(names) > 0 {
+			fmt.Fprintf(buf, "switch name {\ncase %v:\nreturn true\n}\n", strings.Join(names, ", "))
+		}
+		fmt.Fprintf(buf, "return false\n}\n")
+	}
+}
+
+// writeMarshalField writes the code encoding a single regular field
+func writeMarshalField(buf *bytes.Buffer, f structField) {
+	name := strconv.Quote(f.name)
+	val := "m.v." + f.goName
+	var call string
+	cond := ""
+	switch {
+	case f.isBool() && f.asUint64:
+		call = fmt.Sprintf("w.BoolUint64(%v, %v)", name, f.convertTo(val, "bool"))
+		if f.omitEmpty {
+			cond = f.convertTo(val, "bool")
+		}
+	case f.fast && f.basic.kind == kindBool:
+		call = fmt.Sprintf("w.Bool(%v, %v)", name, f.convertTo(val, "bool"))
+	case f.fast && f.basic.kind == kindBoolValue:
+		call = fmt.Sprintf("w.BoolValue(%v, %v)", name, f.convertTo(val, "bool"))
+		if f.omitEmpty {
+			cond = val
+		}
+	case f.fast && f.basic.kind == kindString:
+		call = fmt.Sprintf("w.String(%v, %v)", name, f.convertTo(val, "string"))
+		if f.omitEmpty {
+			cond = val + ` != ""`
+		}
+	case f.fast && f.basic.nvType != "":
+		switch f.basic.kind {
+		case kindInt:
+			call = fmt.Sprintf("w.Int(%v, nvlist.%v, %v)", name, f.basic.nvType, f.convertTo(val, "int64"))
+		case kindUint:
+			call = fmt.Sprintf("w.Uint(%v, nvlist.%v, %v)", name, f.basic.nvType, f.convertTo(val, "uint64"))
+		default:
+			call = fmt.Sprintf("w.Float(%v, %v)", name, f.convertTo(val, "float64"))
+		}
+		if f.omitEmpty {
+			cond = val + " != 0"
+		}
+	default:
+		call = fmt.Sprintf("w.Value(%v, %v, %v, %v)", name, val, f.omitEmpty, f.asUint64)
+	}
+	if check := f.nilCheck("m.v"); check != "" {
+		if cond != "" {
+			cond = check + " && " + cond
+		} else {
+			cond = check
+		}
+	}
+	if cond != "" {
+		fmt.Fprintf(buf, "if %v {\n", cond)
+	}
+	fmt.Fprintf(buf, "if err := %v; err != nil {\nreturn err\n}\n", call)
+	if cond != "" {
+		fmt.Fprintf(buf, "}\n")
+	}
+}
+
+// writeUnmarshal writes UnmarshalNvlist for the struct type name and the PairUnmarshaler it uses
+func writeUnmarshal(buf *bytes.Buffer, name string, fields []structField) {
+	u := "nvlistUnmarshaler" + name
+	fmt.Fprintf(buf, "\n// UnmarshalNvlist decodes v using code generated from its nvlist tags\n")
+	fmt.Fprintf(buf, "func (v *%v) UnmarshalNvlist(unmarshal func(interface{}) error) error {\n", name)
+	fmt.Fprintf(buf, "return unmarshal(&%v{v: v})\n}\n", u)
+
+	// Like in the nvlist package, the last field with a name receives the nvpair
+	byName := make(map[string]int)
+	extra := -1
+	for i, f := range fields {
+		switch {
+		case f.extra:
+			extra = i
+		case !f.nvflag:
+			byName[f.name] = i
+		}
+	}
+	// seen tracks the nvpairs with the names of fields having defaults
+	seen := make(map[string]string)
+	for _, f := range fields {
+		if f.hasDefault && !f.extra && !f.nvflag {
+			seen[f.name] = "seen" + strings.Replace(fields[byName[f.name]].goName, ".", "_", -1)
+		}
+	}
+
+	fmt.Fprintf(buf, "\ntype %v struct {\nv *%v\n", u, name)
+	for i, f := range fields {
+		if s, ok := seen[f.name]; ok && !f.extra && !f.nvflag && byName[f.name] == i {
+			fmt.Fprintf(buf, "%v bool\n", s)
+		}
+	}
+	fmt.Fprintf(buf, "}\n")
+
+	fmt.Fprintf(buf, "\nfunc (u *%v) UnmarshalNvpair(p *nvlist.PairReader) error {\n", u)
+	fmt.Fprintf(buf, "switch p.Name() {\n")
+	for i, f := range fields {
+		if f.extra || f.nvflag || byName[f.name] != i {
+			continue
+		}
+		fmt.Fprintf(buf, "case %q:\n", f.name)
+		if s, ok := seen[f.name]; ok {
+			fmt.Fprintf(buf, "u.%v = true\n", s)
+		}
+		writeAlloc(buf, "u.v", f)
+		writeUnmarshalField(buf, f)
+	}
+	fmt.Fprintf(buf, "default:\n")
+	if extra >= 0 {
+		writeAlloc(buf, "u.v", fields[extra])
+		fmt.Fprintf(buf, "return p.DecodeExtra(&u.v.%v)\n", fields[extra].goName)
+	} else {
+		fmt.Fprintf(buf, "return p.Unknown()\n")
+	}
+	fmt.Fprintf(buf, "}\nreturn nil\n}\n")
+
+	fmt.Fprintf(buf, "\nfunc (u *%v) EndNvlist(flags uint32) error {\n", u)
+	for _, f := range fields {
+		if f.nvflag {
+			writeAlloc(buf, "u.v", f)
+			fmt.Fprintf(buf, "u.v.%v = %v\n", f.goName, f.convert("flags", "uint32"))
+		}
+	}
+	for _, f := range fields {
+		if !f.hasDefault || f.extra || f.nvflag {
+			continue
+		}
+		lit, _ := f.defaultLiteral()
+		fmt.Fprintf(buf, "if !u.%v {\n", seen[f.name])
+		writeAlloc(buf, "u.v", f)
+		fmt.Fprintf(buf, "u.v.%v = %v\n}\n", f.goName, lit)
+	}
+	fmt.Fprintf(buf, "return nil\n}\n")
+}
+
+// nilCheck returns the condition under which the embedded pointers a promoted field is accessed
+// through are all set, it is empty if there are none
+func (f *structField) nilCheck(recv string) string {
+	var conds []string
+	for _, ptr := range f.ptrs {
+		conds = append(conds, recv+"."+ptr.goName+" != nil")
+	}
+	return strings.Join(conds, " && ")
+}
+
+// writeAlloc writes code allocating the nil embedded pointers a promoted field is accessed through
+func writeAlloc(buf *bytes.Buffer, recv string, f structField) {
+	for _, ptr := range f.ptrs {
+		fmt.Fprintf(buf, "if %v.%v == nil {\n%v.%v = new(%v)\n}\n", recv, ptr.goName, recv, ptr.goName, ptr.typ)
+	}
+}
+
+// writeUnmarshalField writes the case body decoding a single regular field
+func writeUnmarshalField(buf *bytes.Buffer, f structField) {
+	dst := "u.v." + f.goName
+	if !f.fast {
+		fmt.Fprintf(buf, "return p.Decode(&%v, %v)\n", dst, f.asUint64)
+		return
+	}
+	bits := strconv.Itoa(f.basic.bits)
+	switch f.basic.kind {
+	case kindInt:
+		fmt.Fprintf(buf, "if x, ok := p.Int(%v); ok {\n%v = %v\n}\n", bits, dst, f.convert("x", "int64"))
+	case kindUint:
+		fmt.Fprintf(buf, "if x, ok := p.Uint(%v); ok {\n%v = %v\n}\n", bits, dst, f.convert("x", "uint64"))
+	case kindFloat:
+		fmt.Fprintf(buf, "if x, ok := p.Float(%v); ok {\n%v = %v\n}\n", bits, dst, f.convert("x", "float64"))
+	case kindString:
+		fmt.Fprintf(buf, "if x, ok := p.String(); ok {\n%v = %v\n}\n", dst, f.convert("x", "string"))
+	default:
+		if f.asUint64 {
+			fmt.Fprintf(buf, "if p.Type() == nvlist.TypeUint64 {\n")
+			fmt.Fprintf(buf, "if x, ok := p.Uint(64); ok {\n%v = %v\n}\n", dst, f.convert("x != 0", "bool"))
+			fmt.Fprintf(buf, "} else ")
+		}
+		fmt.Fprintf(buf, "if x, ok := p.Bool(); ok {\n%v = %v\n}\n", dst, f.convert("x", "bool"))
+	}
+}
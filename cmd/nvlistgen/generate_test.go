@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateExample(t *testing.T) {
+	dir := filepath.Join("internal", "example")
+	out := filepath.Join(dir, "example_nvlist.go")
+	src, err := generate(dir, out, []string{"Pool", "Vdev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, committed) {
+		t.Errorf("%v is outdated, run go generate", out)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	dir := filepath.Join("internal", "example")
+	out := filepath.Join(dir, "example_nvlist.go")
+	tests := []struct {
+		types []string
+		err   string
+	}{
+		{[]string{"Missing"}, "not found"},
+		{[]string{"State"}, "not a struct"},
+		{[]string{"Health"}, "not a struct"},
+	}
+	for _, test := range tests {
+		_, err := generate(dir, out, test.types)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: expected error containing %q, got %v", test.types, test.err, err)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "nvlistgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	src := "package p\n\nimport \"" + nvlistPath + "\"\n\ntype T struct {\n\tnvlist.List\n}\n"
+	if err := ioutil.WriteFile(filepath.Join(tmp, "p.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = generate(tmp, filepath.Join(tmp, "p_nvlist.go"), []string{"T"})
+	if err == nil || !strings.Contains(err.Error(), "other packages") {
+		t.Errorf("expected an error for embedding a struct from another package, got %v", err)
+	}
+
+	f := structField{name: "x", fast: true, basic: basicTypes["uint64"], hasDefault: true, defaultValue: "abc"}
+	if err := f.check(); err == nil {
+		t.Errorf("invalid default accepted")
+	}
+	f = structField{name: "-", fast: true, basic: basicTypes["uint16"], nvflag: true}
+	if err := f.check(); err == nil {
+		t.Errorf("uint16 nvflag field accepted")
+	}
+}
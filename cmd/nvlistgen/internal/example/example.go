@@ -0,0 +1,78 @@
+// Package example contains structs with methods generated by nvlistgen, its tests compare them with
+// the reflective encoding and decoding of the nvlist package.
+package example
+
+import "git.dolansoft.org/lorenz/go-zfs/nvlist"
+
+//go:generate go run ../.. -type Pool,Vdev -output example_nvlist.go
+
+// Health has its own methods, so fields of it fall back to reflection
+type Health uint64
+
+// MarshalNvlist encodes the health as a string
+func (h Health) MarshalNvlist() (interface{}, error) {
+	if h == 0 {
+		return "ONLINE", nil
+	}
+	return "DEGRADED", nil
+}
+
+// UnmarshalNvlist decodes the health from a string
+func (h *Health) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	*h = 0
+	if s != "ONLINE" {
+		*h = 1
+	}
+	return nil
+}
+
+// State is handled without reflection like its underlying type
+type State uint64
+
+// Common is embedded into Pool, its fields are promoted unless Pool has fields with the same names
+type Common struct {
+	GUID    uint64 `nvlist:"guid,omitempty"`
+	Comment string `nvlist:"comment"`
+}
+
+// Stats is embedded into Vdev as a pointer, which is allocated when decoding one of its fields
+type Stats struct {
+	Path   string `nvlist:"path,omitempty"`
+	Errors uint64 `nvlist:"errors,omitempty"`
+}
+
+type Pool struct {
+	Common
+	Name     string           `nvlist:"name"`
+	Version  uint64           `nvlist:"version,omitempty"`
+	State    State            `nvlist:"state"`
+	Health   Health           `nvlist:"health"`
+	ReadOnly bool             `nvlist:"readonly,asuint64,omitempty"`
+	Atime    bool             `nvlist:"atime,asuint64,default=true"`
+	Autotrim nvlist.Flag      `nvlist:"autotrim"`
+	Enabled  nvlist.BoolValue `nvlist:"enabled,omitempty"`
+	Delta    int32            `nvlist:"delta,default=-1"`
+	Small    int8             `nvlist:"small,omitempty"`
+	Ratio    float64          `nvlist:"ratio,omitempty"`
+	Created  nvlist.Hrtime    `nvlist:"created,omitempty"`
+	Comment  string           `nvlist:"comment,omitempty,default=none"`
+	Size     uint64           `nvlist:"size,ro"`
+	Root     *Vdev            `nvlist:"root,omitempty"`
+	Tags     []string         `nvlist:"tags,omitempty"`
+
+	Flags uint32            `nvlist:"-,nvflag"`
+	User  map[string]string `nvlist:"-,extra"`
+}
+
+type Vdev struct {
+	*Stats
+	Type     string  `nvlist:"type"`
+	GUID     uint64  `nvlist:"guid"`
+	Count    int     `nvlist:"count,omitempty"`
+	Weight   float32 `nvlist:"weight,omitempty"`
+	Children []Vdev  `nvlist:"children,omitempty"`
+}
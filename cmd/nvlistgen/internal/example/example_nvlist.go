@@ -0,0 +1,296 @@
+// Code generated by nvlistgen. DO NOT EDIT.
+
+package example
+
+import "git.dolansoft.org/lorenz/go-zfs/nvlist"
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v Pool) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerPool{&v}, nil
+}
+
+type nvlistMarshalerPool struct{ v *Pool }
+
+func (m nvlistMarshalerPool) NvlistFlags() (uint32, bool) {
+	return uint32(m.v.Flags), true
+}
+
+func (m nvlistMarshalerPool) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if m.v.Common.GUID != 0 {
+		if err := w.Uint("guid", nvlist.TypeUint64, m.v.Common.GUID); err != nil {
+			return err
+		}
+	}
+	if err := w.String("name", m.v.Name); err != nil {
+		return err
+	}
+	if m.v.Version != 0 {
+		if err := w.Uint("version", nvlist.TypeUint64, m.v.Version); err != nil {
+			return err
+		}
+	}
+	if err := w.Uint("state", nvlist.TypeUint64, uint64(m.v.State)); err != nil {
+		return err
+	}
+	if err := w.Value("health", m.v.Health, false, false); err != nil {
+		return err
+	}
+	if m.v.ReadOnly {
+		if err := w.BoolUint64("readonly", m.v.ReadOnly); err != nil {
+			return err
+		}
+	}
+	if err := w.BoolUint64("atime", m.v.Atime); err != nil {
+		return err
+	}
+	if err := w.Bool("autotrim", bool(m.v.Autotrim)); err != nil {
+		return err
+	}
+	if m.v.Enabled {
+		if err := w.BoolValue("enabled", bool(m.v.Enabled)); err != nil {
+			return err
+		}
+	}
+	if err := w.Int("delta", nvlist.TypeInt32, int64(m.v.Delta)); err != nil {
+		return err
+	}
+	if m.v.Small != 0 {
+		if err := w.Int("small", nvlist.TypeInt8, int64(m.v.Small)); err != nil {
+			return err
+		}
+	}
+	if m.v.Ratio != 0 {
+		if err := w.Float("ratio", m.v.Ratio); err != nil {
+			return err
+		}
+	}
+	if m.v.Created != 0 {
+		if err := w.Int("created", nvlist.TypeHrtime, int64(m.v.Created)); err != nil {
+			return err
+		}
+	}
+	if m.v.Comment != "" {
+		if err := w.String("comment", m.v.Comment); err != nil {
+			return err
+		}
+	}
+	if err := w.Value("root", m.v.Root, true, false); err != nil {
+		return err
+	}
+	if err := w.Value("tags", m.v.Tags, true, false); err != nil {
+		return err
+	}
+	if err := w.Extra(m.v.User, m.isField); err != nil {
+		return err
+	}
+	return nil
+}
+
+// isField checks if there is a field for the given nvpair name
+func (m nvlistMarshalerPool) isField(name string) bool {
+	switch name {
+	case "guid", "name", "version", "state", "health", "readonly", "atime", "autotrim", "enabled", "delta", "small", "ratio", "created", "comment", "size", "root", "tags":
+		return true
+	}
+	return false
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *Pool) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerPool{v: v})
+}
+
+type nvlistUnmarshalerPool struct {
+	v           *Pool
+	seenAtime   bool
+	seenDelta   bool
+	seenComment bool
+}
+
+func (u *nvlistUnmarshalerPool) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "guid":
+		if x, ok := p.Uint(64); ok {
+			u.v.Common.GUID = x
+		}
+	case "name":
+		if x, ok := p.String(); ok {
+			u.v.Name = x
+		}
+	case "version":
+		if x, ok := p.Uint(64); ok {
+			u.v.Version = x
+		}
+	case "state":
+		if x, ok := p.Uint(64); ok {
+			u.v.State = State(x)
+		}
+	case "health":
+		return p.Decode(&u.v.Health, false)
+	case "readonly":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.ReadOnly = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.ReadOnly = x
+		}
+	case "atime":
+		u.seenAtime = true
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Atime = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Atime = x
+		}
+	case "autotrim":
+		if x, ok := p.Bool(); ok {
+			u.v.Autotrim = nvlist.Flag(x)
+		}
+	case "enabled":
+		if x, ok := p.Bool(); ok {
+			u.v.Enabled = nvlist.BoolValue(x)
+		}
+	case "delta":
+		u.seenDelta = true
+		if x, ok := p.Int(32); ok {
+			u.v.Delta = int32(x)
+		}
+	case "small":
+		if x, ok := p.Int(8); ok {
+			u.v.Small = int8(x)
+		}
+	case "ratio":
+		if x, ok := p.Float(64); ok {
+			u.v.Ratio = x
+		}
+	case "created":
+		if x, ok := p.Int(64); ok {
+			u.v.Created = nvlist.Hrtime(x)
+		}
+	case "comment":
+		u.seenComment = true
+		if x, ok := p.String(); ok {
+			u.v.Comment = x
+		}
+	case "size":
+		if x, ok := p.Uint(64); ok {
+			u.v.Size = x
+		}
+	case "root":
+		return p.Decode(&u.v.Root, false)
+	case "tags":
+		return p.Decode(&u.v.Tags, false)
+	default:
+		return p.DecodeExtra(&u.v.User)
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerPool) EndNvlist(flags uint32) error {
+	u.v.Flags = flags
+	if !u.seenAtime {
+		u.v.Atime = true
+	}
+	if !u.seenDelta {
+		u.v.Delta = -1
+	}
+	if !u.seenComment {
+		u.v.Comment = "none"
+	}
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v Vdev) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerVdev{&v}, nil
+}
+
+type nvlistMarshalerVdev struct{ v *Vdev }
+
+func (m nvlistMarshalerVdev) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerVdev) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if m.v.Stats != nil && m.v.Stats.Path != "" {
+		if err := w.String("path", m.v.Stats.Path); err != nil {
+			return err
+		}
+	}
+	if m.v.Stats != nil && m.v.Stats.Errors != 0 {
+		if err := w.Uint("errors", nvlist.TypeUint64, m.v.Stats.Errors); err != nil {
+			return err
+		}
+	}
+	if err := w.String("type", m.v.Type); err != nil {
+		return err
+	}
+	if err := w.Uint("guid", nvlist.TypeUint64, m.v.GUID); err != nil {
+		return err
+	}
+	if err := w.Value("count", m.v.Count, true, false); err != nil {
+		return err
+	}
+	if err := w.Value("weight", m.v.Weight, true, false); err != nil {
+		return err
+	}
+	if err := w.Value("children", m.v.Children, true, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *Vdev) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerVdev{v: v})
+}
+
+type nvlistUnmarshalerVdev struct {
+	v *Vdev
+}
+
+func (u *nvlistUnmarshalerVdev) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "path":
+		if u.v.Stats == nil {
+			u.v.Stats = new(Stats)
+		}
+		if x, ok := p.String(); ok {
+			u.v.Stats.Path = x
+		}
+	case "errors":
+		if u.v.Stats == nil {
+			u.v.Stats = new(Stats)
+		}
+		if x, ok := p.Uint(64); ok {
+			u.v.Stats.Errors = x
+		}
+	case "type":
+		if x, ok := p.String(); ok {
+			u.v.Type = x
+		}
+	case "guid":
+		if x, ok := p.Uint(64); ok {
+			u.v.GUID = x
+		}
+	case "count":
+		if x, ok := p.Int(0); ok {
+			u.v.Count = int(x)
+		}
+	case "weight":
+		if x, ok := p.Float(32); ok {
+			u.v.Weight = float32(x)
+		}
+	case "children":
+		return p.Decode(&u.v.Children, false)
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerVdev) EndNvlist(flags uint32) error {
+	return nil
+}
@@ -0,0 +1,198 @@
+package example
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+)
+
+// reflectPool and reflectVdev have the same fields without the generated methods
+type reflectPool Pool
+type reflectVdev Vdev
+
+func testPool() Pool {
+	return Pool{
+		Common:   Common{GUID: 7, Comment: "hidden"},
+		Name:     "tank",
+		Version:  5000,
+		State:    2,
+		Health:   1,
+		ReadOnly: true,
+		Autotrim: true,
+		Delta:    -3,
+		Small:    -1,
+		Ratio:    1.5,
+		Created:  42,
+		Size:     1 << 40,
+		Root: &Vdev{Type: "root", GUID: 1, Children: []Vdev{
+			{Stats: &Stats{Path: "/dev/sda"}, Type: "disk", GUID: 2},
+			{Type: "mirror", GUID: 3, Children: []Vdev{{Type: "disk", GUID: 4}}},
+		}},
+		Tags:  []string{"a", "b"},
+		Flags: nvlist.UniqueName,
+		User:  map[string]string{"com.example:owner": "me", "com.example:group": "us", "name": "ignored"},
+	}
+}
+
+func TestMarshalMatchesReflection(t *testing.T) {
+	values := []Pool{testPool(), {}, {Enabled: true, Atime: true, Comment: "x"}}
+	// Canonical encoding makes the order of the extra map entries comparable
+	for _, opts := range []nvlist.EncoderOptions{{Canonical: true}, {Encoding: nvlist.EncodingXDR, Canonical: true}} {
+		for _, val := range values {
+			generated, err := nvlist.MarshalWithOptions(val, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := nvlist.MarshalWithOptions(reflectPool(val), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(generated, expected) {
+				t.Errorf("generated encoding of %+v differs from the reflective one", val)
+			}
+		}
+	}
+
+	vdev := reflectVdev{Type: "disk", Count: 1}
+	_, expected := nvlist.Marshal(vdev)
+	if _, err := nvlist.Marshal(Vdev(vdev)); err == nil || err.Error() != expected.Error() {
+		t.Errorf("expected error %v, got %v", expected, err)
+	}
+}
+
+func TestUnmarshalMatchesReflection(t *testing.T) {
+	in := nvlist.NewList().
+		AddString("name", "tank").
+		AddUint64("guid", 9).
+		AddUint64("state", 3).
+		AddString("health", "DEGRADED").
+		AddUint64("readonly", 1).
+		AddFlag("atime").
+		Add("enabled", nvlist.TypeBooleanValue, true).
+		Add("small", nvlist.TypeInt64, int64(-7)).
+		Add("ratio", nvlist.TypeUint64, uint64(3)).
+		Add("created", nvlist.TypeHrtime, nvlist.Hrtime(5)).
+		AddUint64("size", 100).
+		AddList("root", nvlist.NewList().
+			AddString("type", "root").
+			AddList("unknown", nvlist.NewList().AddUint64("x", 1)).
+			AddLists("children", []*nvlist.List{nvlist.NewList().AddString("type", "disk").AddString("path", "/dev/sda").Add("weight", nvlist.TypeDouble, 0.5)})).
+		Add("tags", nvlist.TypeStringArray, []string{"a"}).
+		AddString("com.example:owner", "me")
+
+	for _, opts := range []nvlist.EncoderOptions{{}, {Encoding: nvlist.EncodingXDR}} {
+		data, err := nvlist.MarshalWithOptions(in, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generated Pool
+		if err := nvlist.Unmarshal(data, &generated); err != nil {
+			t.Fatal(err)
+		}
+		var expected reflectPool
+		if err := nvlist.Unmarshal(data, &expected); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(generated, Pool(expected)) {
+			t.Errorf("generated decoding %+v differs from the reflective one %+v", generated, expected)
+		}
+		if generated.Delta != -1 || generated.Comment != "none" || !generated.Atime || generated.Health != 1 || generated.GUID != 9 {
+			t.Errorf("unexpected result %+v", generated)
+		}
+
+		// Unknown nvlists are skipped
+		var root Vdev
+		rootList, _ := in.GetList("root")
+		rootData, err := nvlist.MarshalWithOptions(rootList, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nvlist.Unmarshal(rootData, &root); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&root, generated.Root) || len(root.Children) != 1 || root.Children[0].Weight != 0.5 || root.Stats != nil || root.Children[0].Path != "/dev/sda" {
+			t.Errorf("unexpected result %+v", root)
+		}
+	}
+
+	// Mismatches are recorded and leave the fields untouched, like with reflection
+	data, err := nvlist.Marshal(nvlist.NewList().
+		AddString("state", "bad").
+		Add("small", nvlist.TypeInt64, int64(1000)).
+		AddUint64("version", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generated Pool
+	genErr := nvlist.Unmarshal(data, &generated)
+	var expected reflectPool
+	reflErr := nvlist.Unmarshal(data, &expected)
+	if !errors.Is(genErr, nvlist.ErrTypeMismatch) || !errors.Is(reflErr, nvlist.ErrTypeMismatch) {
+		t.Errorf("expected type mismatches, got %v and %v", genErr, reflErr)
+	}
+	if !reflect.DeepEqual(generated, Pool(expected)) || generated.Version != 3 {
+		t.Errorf("generated decoding %+v differs from the reflective one %+v", generated, expected)
+	}
+
+	data, err = nvlist.Marshal(nvlist.NewList().AddList("root", nvlist.NewList().AddUint64("unknown", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nvlist.UnmarshalWithOptions(data, &generated, nvlist.DecoderOptions{Strict: true})
+	if !errors.Is(err, nvlist.ErrUnknownField) {
+		t.Errorf("expected ErrUnknownField in strict mode, got %v", err)
+	}
+}
+
+func BenchmarkUnmarshalGenerated(b *testing.B) {
+	data, err := nvlist.Marshal(testPool())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out Pool
+		if err := nvlist.Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalReflection(b *testing.B) {
+	data, err := nvlist.Marshal(testPool())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out reflectPool
+		if err := nvlist.Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalGenerated(b *testing.B) {
+	val := testPool()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := nvlist.Marshal(val); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalReflection(b *testing.B) {
+	val := reflectPool(testPool())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := nvlist.Marshal(val); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// nvlistgen generates MarshalNvlist and UnmarshalNvlist methods for structs which encode and decode
+// them without reflection, following the same nvlist struct tags as the reflective path of the
+// nvlist package. Numbers, strings and booleans are handled directly, all other fields fall back to
+// reflection. Fields of embedded structs are promoted like in the nvlist package, as long as the
+// embedded structs are declared in the same package. It is meant to be used with go:generate in the
+// package declaring the structs:
+//
+//	//go:generate go run git.dolansoft.org/lorenz/go-zfs/cmd/nvlistgen -type PoolConfig,VDev
+//
+// By default the methods are written to <first type>_nvlist.go in lower case.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	typeNames = flag.String("type", "", "comma-separated list of struct types, required")
+	output    = flag.String("output", "", "output file name, default <first type>_nvlist.go")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v -type T[,T...] [flags] [directory]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *typeNames == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	types := strings.Split(*typeNames, ",")
+	outName := *output
+	if outName == "" {
+		outName = strings.ToLower(types[0]) + "_nvlist.go"
+	}
+	outPath := filepath.Join(dir, outName)
+
+	src, err := generate(dir, outPath, types)
+	if err != nil {
+		fatal(err)
+	}
+	if err := ioutil.WriteFile(outPath, src, 0644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "nvlistgen: %v\n", err)
+	os.Exit(1)
+}
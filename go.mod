@@ -1,5 +1,7 @@
 module git.dolansoft.org/lorenz/go-zfs
 
+go 1.18
+
 require (
 	github.com/ghishadow/color v1.7.0
 	github.com/lunixbochs/struc v0.0.0-20180408203800-02e4c2afbb2a
@@ -0,0 +1,133 @@
+package ioctl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrClosed is returned by all methods of a Client after it has been closed
+var ErrClosed = errors.New("ZFS client has been closed")
+
+// Client issues the wrapped ioctls on a Transport, usually an open ZFS device node. It is safe for
+// concurrent use, one process can have several of them.
+type Client struct {
+	mu        sync.Mutex
+	transport Transport
+	// err is returned instead of issuing ioctls if transport is nil
+	err error
+	// running counts the ioctls issued on transport, after Close the last of them closes it
+	running int
+}
+
+// NewClient returns a Client issuing all ioctls on t
+func NewClient(t Transport) *Client {
+	return &Client{transport: t}
+}
+
+// Open opens a ZFS device node like OpenDevice and returns a Client using it
+func Open(nodePath string) (*Client, error) {
+	t, err := OpenDevice(nodePath)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(t), nil
+}
+
+// Close makes all later calls fail with ErrClosed and closes the Transport if it implements
+// io.Closer. Running ioctls, including those of open send and receive streams, aren't interrupted.
+// The Transport is only closed once they have finished, its error is then dropped.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	t := c.transport
+	if t == nil {
+		defer c.mu.Unlock()
+		return c.closedErr()
+	}
+	c.transport = nil
+	c.err = ErrClosed
+	running := c.running
+	c.mu.Unlock()
+	if running > 0 {
+		return nil
+	}
+	return closeTransport(t)
+}
+
+func (c *Client) closedErr() error {
+	if c.err != nil {
+		return c.err
+	}
+	return ErrClosed
+}
+
+func closeTransport(t Transport) error {
+	if closer, ok := t.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ioctl encodes the request and config nvlists, issues the ioctl on the Transport and decodes the
+// response nvlist
+func (c *Client) ioctl(ioctl Ioctl, name string, cmd *Cmd, request interface{}, response interface{}, config interface{}) error {
+	c.mu.Lock()
+	t := c.transport
+	if t == nil {
+		defer c.mu.Unlock()
+		return c.closedErr()
+	}
+	c.running++
+	c.mu.Unlock()
+	defer c.done(t)
+	return transportIoctl(t, ioctl, name, cmd, request, response, config)
+}
+
+// done is called after every ioctl issued on t, it closes t if it was the last one after Close
+func (c *Client) done(t Transport) {
+	c.mu.Lock()
+	c.running--
+	last := c.running == 0 && c.transport == nil
+	c.mu.Unlock()
+	if last {
+		closeTransport(t)
+	}
+}
+
+// DeviceTransport issues ioctls with the ioctl syscall on a ZFS device node
+type DeviceTransport struct {
+	file *os.File
+}
+
+// OpenDevice opens a ZFS device node, by default at "/dev/zfs", overridable by nodePath. If the node
+// doesn't exist it is created.
+func OpenDevice(nodePath string) (*DeviceTransport, error) {
+	if nodePath == "" {
+		nodePath = "/dev/zfs"
+	}
+	file, err := os.Open(nodePath)
+	if os.IsNotExist(err) {
+		if err := unix.Mknod(nodePath, unix.S_IFCHR|0666, int(unix.Mkdev(10, 54))); err != nil && err != unix.EEXIST {
+			return nil, fmt.Errorf("Failed to create ZFS device node: %v", err)
+		}
+		file, err = os.Open(nodePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open or create ZFS device node: %v", err)
+	}
+	return &DeviceTransport{file: file}, nil
+}
+
+// Ioctl issues the ioctl syscall on the device node
+func (t *DeviceTransport) Ioctl(ioctl Ioctl, cmd *Cmd, src, dst, conf []byte) error {
+	return fdTransport(t.file.Fd()).Ioctl(ioctl, cmd, src, dst, conf)
+}
+
+// Close closes the device node
+func (t *DeviceTransport) Close() error {
+	return t.file.Close()
+}
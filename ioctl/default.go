@@ -0,0 +1,192 @@
+package ioctl
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrNotInitialized is returned by the package-level wrappers if Init hasn't been called
+var ErrNotInitialized = errors.New("ZFS device node has not been opened with Init")
+
+var (
+	defaultMu sync.Mutex
+	// defaultHandle is the client used by the package-level wrappers
+	defaultHandle = &Client{err: ErrNotInitialized}
+)
+
+// Init opens the ZFS device node used by the package-level wrappers like Open does. Calling it
+// again switches them to the new node and closes the previous one.
+func Init(nodePath string) error {
+	c, err := Open(nodePath)
+	if err != nil {
+		return err
+	}
+	setDefaultClient(c)
+	return nil
+}
+
+// InitTransport makes the package-level wrappers issue their ioctls on t, for example on a fake for
+// testing. Like with Init, a previously used device node is closed.
+func InitTransport(t Transport) {
+	setDefaultClient(NewClient(t))
+}
+
+func setDefaultClient(c *Client) {
+	defaultMu.Lock()
+	previous := defaultHandle
+	defaultHandle = c
+	defaultMu.Unlock()
+	previous.Close()
+}
+
+func defaultClient() *Client {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultHandle
+}
+
+// DatasetListNext calls Client.DatasetListNext on the device node opened by Init
+func DatasetListNext(name string, cursor uint64) (string, uint64, DMUObjectSetStats, DatasetPropsWithSource, error) {
+	return defaultClient().DatasetListNext(name, cursor)
+}
+
+// SnapshotListNext calls Client.SnapshotListNext on the device node opened by Init
+func SnapshotListNext(name string, cursor uint64, props interface{}) (string, uint64, DMUObjectSetStats, error) {
+	return defaultClient().SnapshotListNext(name, cursor, props)
+}
+
+// PoolCreate calls Client.PoolCreate on the device node opened by Init
+func PoolCreate(name string, features map[string]uint64, config VDev) error {
+	return defaultClient().PoolCreate(name, features, config)
+}
+
+// PoolDestroy calls Client.PoolDestroy on the device node opened by Init
+func PoolDestroy(name string) error {
+	return defaultClient().PoolDestroy(name)
+}
+
+// PoolConfigs calls Client.PoolConfigs on the device node opened by Init
+func PoolConfigs() (map[string]interface{}, error) {
+	return defaultClient().PoolConfigs()
+}
+
+// PoolStats calls Client.PoolStats on the device node opened by Init
+func PoolStats(name string) (map[string]interface{}, error) {
+	return defaultClient().PoolStats(name)
+}
+
+// PoolImport calls Client.PoolImport on the device node opened by Init
+func PoolImport(name string, config map[string]interface{}, props map[string]interface{}) (map[string]interface{}, error) {
+	return defaultClient().PoolImport(name, config, props)
+}
+
+// PoolExport calls Client.PoolExport on the device node opened by Init
+func PoolExport(name string, force, hardForce bool) error {
+	return defaultClient().PoolExport(name, force, hardForce)
+}
+
+// Promote calls Client.Promote on the device node opened by Init
+func Promote(name string) (conflictingSnapshot string, err error) {
+	return defaultClient().Promote(name)
+}
+
+// Clone calls Client.Clone on the device node opened by Init
+func Clone(origin string, name string, props *DatasetProps) error {
+	return defaultClient().Clone(origin, name, props)
+}
+
+// Create calls Client.Create on the device node opened by Init
+func Create(name string, t ObjectType, props *DatasetProps) error {
+	return defaultClient().Create(name, t, props)
+}
+
+// Snapshot calls Client.Snapshot on the device node opened by Init
+func Snapshot(names []string, pool string, props *DatasetProps) error {
+	return defaultClient().Snapshot(names, pool, props)
+}
+
+// DestroySnapshots calls Client.DestroySnapshots on the device node opened by Init
+func DestroySnapshots(names []string, pool string, defer_ bool) error {
+	return defaultClient().DestroySnapshots(names, pool, defer_)
+}
+
+// Bookmark calls Client.Bookmark on the device node opened by Init
+func Bookmark(snapshotsToBookmarks map[string]string) error {
+	return defaultClient().Bookmark(snapshotsToBookmarks)
+}
+
+// Rollback calls Client.Rollback on the device node opened by Init
+func Rollback(name string, target string) (actualTarget string, err error) {
+	return defaultClient().Rollback(name, target)
+}
+
+// SetProp calls Client.SetProp on the device node opened by Init
+func SetProp(name string, props map[string]interface{}, source PropSource) error {
+	return defaultClient().SetProp(name, props, source)
+}
+
+// InheritProp calls Client.InheritProp on the device node opened by Init
+func InheritProp(name string, propName string, revertToReceived bool) error {
+	return defaultClient().InheritProp(name, propName, revertToReceived)
+}
+
+// GetSpaceWritten calls Client.GetSpaceWritten on the device node opened by Init
+func GetSpaceWritten(dataset, snapshot string) (uint64, error) {
+	return defaultClient().GetSpaceWritten(dataset, snapshot)
+}
+
+// Rename calls Client.Rename on the device node opened by Init
+func Rename(oldName, newName string, recursive bool) error {
+	return defaultClient().Rename(oldName, newName, recursive)
+}
+
+// Destroy calls Client.Destroy on the device node opened by Init
+func Destroy(name string, t ObjectType, deferred bool) error {
+	return defaultClient().Destroy(name, t, deferred)
+}
+
+// SendSpace calls Client.SendSpace on the device node opened by Init
+func SendSpace(name string, options SendSpaceOptions) (uint64, error) {
+	return defaultClient().SendSpace(name, options)
+}
+
+// Send calls Client.Send on the device node opened by Init
+func Send(name string, options SendOptions) (io.ReadCloser, error) {
+	return defaultClient().Send(name, options)
+}
+
+// Receive calls Client.Receive on the device node opened by Init
+func Receive(name string, opts ReceiveOpts) (*ReceiveStream, error) {
+	return defaultClient().Receive(name, opts)
+}
+
+// PoolGetProps calls Client.PoolGetProps on the device node opened by Init
+func PoolGetProps(name string) (props interface{}, err error) {
+	return defaultClient().PoolGetProps(name)
+}
+
+// ObjsetZPLProps calls Client.ObjsetZPLProps on the device node opened by Init
+func ObjsetZPLProps(name string) (props interface{}, err error) {
+	return defaultClient().ObjsetZPLProps(name)
+}
+
+// ObjsetStats calls Client.ObjsetStats on the device node opened by Init
+func ObjsetStats(name string) (props DatasetPropsWithSource, err error) {
+	return defaultClient().ObjsetStats(name)
+}
+
+// PauseScan calls Client.PauseScan on the device node opened by Init
+func PauseScan(pool string) error {
+	return defaultClient().PauseScan(pool)
+}
+
+// StartStopScan calls Client.StartStopScan on the device node opened by Init
+func StartStopScan(pool string, t ScanType) error {
+	return defaultClient().StartStopScan(pool, t)
+}
+
+// RegenerateGUID calls Client.RegenerateGUID on the device node opened by Init
+func RegenerateGUID(pool string) error {
+	return defaultClient().RegenerateGUID(pool)
+}
@@ -0,0 +1,799 @@
+package fake
+
+import (
+	"sort"
+	"strings"
+
+	"git.dolansoft.org/lorenz/go-zfs/ioctl"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"golang.org/x/sys/unix"
+)
+
+// kind distinguishes the objects stored in a pool, it follows from their names
+type kind int
+
+const (
+	// kindHead are filesystems and volumes
+	kindHead kind = iota
+	kindSnapshot
+	kindBookmark
+)
+
+// dataset is a filesystem, volume, snapshot or bookmark
+type dataset struct {
+	name      string
+	guid      uint64
+	typ       ioctl.ObjectType
+	createTxg uint64
+	creation  uint64
+	// local and received contain the props set on the dataset itself. inherited contains the props
+	// explicitly inherited, which hides their received values.
+	local     map[string]interface{}
+	received  map[string]interface{}
+	inherited map[string]bool
+	// origin is the guid of the snapshot a clone was created from
+	origin uint64
+	// referenced is the amount of data in the dataset. written counts all data ever written into
+	// a filesystem or volume including its origins, snapshots and bookmarks keep the value at the
+	// time they were taken.
+	referenced uint64
+	written    uint64
+	// holds maps the tags of the holds on a snapshot to the time they were created
+	holds        map[string]uint64
+	deferDestroy bool
+}
+
+func (ds *dataset) kind() kind {
+	switch {
+	case strings.Contains(ds.name, "@"):
+		return kindSnapshot
+	case strings.Contains(ds.name, "#"):
+		return kindBookmark
+	}
+	return kindHead
+}
+
+// shortName returns the part of the name of a snapshot or bookmark after the filesystem
+func (ds *dataset) shortName() string {
+	return ds.name[len(parentName(ds.name))+1:]
+}
+
+func (k *Kernel) newDataset(name string, typ ioctl.ObjectType) *dataset {
+	return &dataset{
+		name:      name,
+		guid:      k.newGUID(),
+		typ:       typ,
+		createTxg: k.nextTxg(),
+		creation:  now(),
+		local:     make(map[string]interface{}),
+		received:  make(map[string]interface{}),
+		inherited: make(map[string]bool),
+		holds:     make(map[string]uint64),
+	}
+}
+
+// snapshotOf creates a snapshot or bookmark of ds with the given name
+func (k *Kernel) snapshotOf(ds *dataset, name string, txg uint64) *dataset {
+	snap := k.newDataset(name, ds.typ)
+	snap.createTxg = txg
+	snap.referenced = ds.referenced
+	snap.written = ds.written
+	return snap
+}
+
+// children returns the names of the filesystems and volumes directly below name in order
+func (p *pool) children(name string) []string {
+	var names []string
+	for _, ds := range p.datasets {
+		if ds.kind() == kindHead && parentName(ds.name) == name {
+			names = append(names, ds.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// snapshots returns the snapshots of the filesystem or volume name from the oldest to the newest
+func (p *pool) snapshots(name string) []*dataset {
+	var snaps []*dataset
+	for _, ds := range p.datasets {
+		if ds.kind() == kindSnapshot && parentName(ds.name) == name {
+			snaps = append(snaps, ds)
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].createTxg < snaps[j].createTxg })
+	return snaps
+}
+
+// latest returns the newest snapshot of the filesystem or volume name, nil if it has none
+func (p *pool) latest(name string) *dataset {
+	snaps := p.snapshots(name)
+	if len(snaps) == 0 {
+		return nil
+	}
+	return snaps[len(snaps)-1]
+}
+
+// previous returns the newest snapshot in the history of ds, which is its origin for a clone
+// without snapshots
+func (p *pool) previous(ds *dataset) *dataset {
+	if snap := p.latest(ds.name); snap != nil {
+		return snap
+	}
+	return p.snapshotByGUID(ds.origin)
+}
+
+// clones returns the names of the clones of the snapshot snap in order
+func (p *pool) clones(snap *dataset) []string {
+	var names []string
+	for _, ds := range p.datasets {
+		if ds.kind() == kindHead && ds.origin == snap.guid {
+			names = append(names, ds.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *pool) snapshotByGUID(guid uint64) *dataset {
+	if guid == 0 {
+		return nil
+	}
+	for _, ds := range p.datasets {
+		if ds.kind() == kindSnapshot && ds.guid == guid {
+			return ds
+		}
+	}
+	return nil
+}
+
+// before reports whether the snapshot or bookmark from is part of the history of the filesystem or
+// volume ds up to txg, following its origins
+func (p *pool) before(from, ds *dataset, txg uint64) bool {
+	for ds != nil {
+		if parentName(from.name) == ds.name {
+			return from.createTxg <= txg
+		}
+		origin := p.snapshotByGUID(ds.origin)
+		if origin == nil {
+			return false
+		}
+		txg = origin.createTxg
+		ds = p.datasets[parentName(origin.name)]
+	}
+	return false
+}
+
+// move renames ds and everything inside of it
+func (p *pool) move(ds *dataset, name string) {
+	old := ds.name
+	var moved []*dataset
+	for key, d := range p.datasets {
+		if key == old || strings.HasPrefix(key, old) && strings.ContainsRune("/@#", rune(key[len(old)])) {
+			delete(p.datasets, key)
+			moved = append(moved, d)
+		}
+	}
+	for _, d := range moved {
+		d.name = name + d.name[len(old):]
+		p.datasets[d.name] = d
+	}
+}
+
+// checkNewHead checks that a filesystem or volume can be created with name and returns its pool
+func (k *Kernel) checkNewHead(name string) (*pool, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(name, "@#") {
+		return nil, unix.EINVAL
+	}
+	p, ok := k.pools[poolName(name)]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	if _, ok := p.datasets[name]; ok {
+		return nil, unix.EEXIST
+	}
+	parent, ok := p.datasets[parentName(name)]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	if parent.typ != ioctl.ObjectTypeZFS {
+		return nil, unix.EINVAL
+	}
+	return p, nil
+}
+
+// fillStats stores the statistics ZFS returns along with the props of ds in cmd
+func (p *pool) fillStats(cmd *ioctl.Cmd, ds *dataset) {
+	stats := ioctl.DMUObjectSetStats{
+		Creation_txg: ds.createTxg,
+		Guid:         ds.guid,
+		Type:         uint32(ds.typ),
+	}
+	switch ds.kind() {
+	case kindSnapshot:
+		stats.Is_snapshot = 1
+		stats.Num_clones = uint64(len(p.clones(ds)))
+	case kindHead:
+		if origin := p.snapshotByGUID(ds.origin); origin != nil {
+			putCString(stats.Origin[:], origin.name)
+		}
+	}
+	cmd.Objset_stats = stats
+}
+
+func (k *Kernel) objsetStats(r *request) (interface{}, error) {
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() == kindBookmark {
+		return nil, unix.EINVAL
+	}
+	p.fillStats(r.cmd, ds)
+	return p.datasetProps(ds), nil
+}
+
+func (k *Kernel) objsetZPLProps(r *request) (interface{}, error) {
+	_, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() == kindBookmark {
+		return nil, unix.EINVAL
+	}
+	if ds.typ != ioctl.ObjectTypeZFS {
+		return nil, unix.ENOENT
+	}
+	return map[string]uint64{
+		"version":         5,
+		"normalization":   0,
+		"utf8only":        0,
+		"casesensitivity": 0,
+	}, nil
+}
+
+// listNext returns the dataset at the cursor in names and advances the cursor, which is the index
+// of the next dataset
+func (p *pool) listNext(r *request, names []string) (interface{}, error) {
+	if r.cmd.Cookie >= uint64(len(names)) {
+		return nil, unix.ESRCH
+	}
+	ds := p.datasets[names[r.cmd.Cookie]]
+	putCString(r.cmd.Name[:], ds.name)
+	r.cmd.Cookie++
+	p.fillStats(r.cmd, ds)
+	return p.datasetProps(ds), nil
+}
+
+func (k *Kernel) datasetListNext(r *request) (interface{}, error) {
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() != kindHead {
+		return nil, unix.ESRCH
+	}
+	return p.listNext(r, p.children(ds.name))
+}
+
+func (k *Kernel) snapshotListNext(r *request) (interface{}, error) {
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() != kindHead {
+		return nil, unix.ESRCH
+	}
+	var names []string
+	for _, snap := range p.snapshots(ds.name) {
+		names = append(names, snap.name)
+	}
+	return p.listNext(r, names)
+}
+
+func (k *Kernel) create(r *request) (interface{}, error) {
+	var req struct {
+		Type  ioctl.ObjectType       `nvlist:"type"`
+		Props map[string]interface{} `nvlist:"props"`
+	}
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	p, err := k.checkNewHead(r.name)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Type {
+	case ioctl.ObjectTypeZFS:
+	case ioctl.ObjectTypeZvol:
+		if _, ok := req.Props["volsize"].(uint64); !ok {
+			return nil, unix.EINVAL
+		}
+	default:
+		return nil, unix.EINVAL
+	}
+	if _, err := validateProps(req.Props, kindHead); err != nil {
+		return nil, err
+	}
+	ds := k.newDataset(r.name, req.Type)
+	for name, v := range req.Props {
+		ds.local[name] = v
+	}
+	p.datasets[ds.name] = ds
+	return nil, nil
+}
+
+func (k *Kernel) clone(r *request) (interface{}, error) {
+	var req struct {
+		Origin string                 `nvlist:"origin"`
+		Props  map[string]interface{} `nvlist:"props"`
+	}
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(req.Origin, "@") {
+		return nil, unix.EINVAL
+	}
+	originPool, origin, err := k.lookup(req.Origin)
+	if err != nil {
+		return nil, err
+	}
+	p, err := k.checkNewHead(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if p != originPool {
+		return nil, unix.EXDEV
+	}
+	if _, err := validateProps(req.Props, kindHead); err != nil {
+		return nil, err
+	}
+	ds := k.newDataset(r.name, origin.typ)
+	ds.origin = origin.guid
+	ds.referenced = origin.referenced
+	ds.written = origin.written
+	for name, v := range req.Props {
+		ds.local[name] = v
+	}
+	p.datasets[ds.name] = ds
+	return nil, nil
+}
+
+// checkDestroySnapshot returns why the snapshot ds can't be destroyed right now
+func (p *pool) checkDestroySnapshot(ds *dataset) error {
+	if len(ds.holds) > 0 {
+		return unix.EBUSY
+	}
+	if len(p.clones(ds)) > 0 {
+		return unix.EEXIST
+	}
+	return nil
+}
+
+// destroySnapshot destroys the snapshot ds. If it is held or has clones, it fails unless deferred
+// is set, which marks it to be destroyed once the last hold and clone are gone.
+func (p *pool) destroySnapshot(ds *dataset, deferred bool) error {
+	if err := p.checkDestroySnapshot(ds); err != nil {
+		if !deferred {
+			return err
+		}
+		ds.deferDestroy = true
+		return nil
+	}
+	delete(p.datasets, ds.name)
+	return nil
+}
+
+// reap destroys the snapshot ds if it has been marked for destruction and nothing keeps it anymore
+func (p *pool) reap(ds *dataset) {
+	if ds != nil && ds.deferDestroy && p.checkDestroySnapshot(ds) == nil {
+		delete(p.datasets, ds.name)
+	}
+}
+
+func (k *Kernel) destroy(r *request) (interface{}, error) {
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	switch ds.kind() {
+	case kindSnapshot:
+		return nil, p.destroySnapshot(ds, r.cmd.Defer_destroy != 0)
+	case kindBookmark:
+		return nil, unix.EINVAL
+	}
+	if ds.name == p.name {
+		return nil, unix.EINVAL
+	}
+	// Like dsl_destroy_head_check_impl, snapshots are checked before children
+	if len(p.snapshots(ds.name)) > 0 {
+		return nil, unix.EBUSY
+	}
+	if len(p.children(ds.name)) > 0 {
+		return nil, unix.EEXIST
+	}
+	for name := range p.datasets {
+		if strings.HasPrefix(name, ds.name+"#") {
+			delete(p.datasets, name)
+		}
+	}
+	delete(p.datasets, ds.name)
+	p.reap(p.snapshotByGUID(ds.origin))
+	return nil, nil
+}
+
+func (k *Kernel) destroySnaps(r *request) (interface{}, error) {
+	var req struct {
+		Snaps map[string]interface{} `nvlist:"snaps"`
+		Defer nvlist.Flag            `nvlist:"defer"`
+	}
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	var snaps []*dataset
+	var errs errorList
+	for _, name := range sortedKeys(req.Snaps) {
+		if !strings.Contains(name, "@") {
+			return nil, unix.EINVAL
+		}
+		if poolName(name) != p.name {
+			return nil, unix.EXDEV
+		}
+		// Snapshots which don't exist are ignored
+		ds, ok := p.datasets[name]
+		if !ok {
+			continue
+		}
+		if err := p.checkDestroySnapshot(ds); err != nil && !req.Defer {
+			errs.add(name, err)
+		}
+		snaps = append(snaps, ds)
+	}
+	if errs.first != nil {
+		return errs.result()
+	}
+	for _, ds := range snaps {
+		p.destroySnapshot(ds, bool(req.Defer))
+	}
+	return nil, nil
+}
+
+func (k *Kernel) snapshot(r *request) (interface{}, error) {
+	var req struct {
+		Snaps map[string]interface{} `nvlist:"snaps"`
+		Props map[string]interface{} `nvlist:"props"`
+	}
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	if _, err := validateProps(req.Props, kindSnapshot); err != nil {
+		return nil, err
+	}
+	var errs errorList
+	filesystems := make(map[string]bool)
+	for _, name := range sortedKeys(req.Snaps) {
+		if err := validateName(name); err != nil {
+			return nil, err
+		}
+		if !strings.Contains(name, "@") {
+			return nil, unix.EINVAL
+		}
+		if poolName(name) != p.name {
+			return nil, unix.EXDEV
+		}
+		// Only one snapshot per filesystem can be created at once
+		fs := parentName(name)
+		if filesystems[fs] {
+			return nil, unix.EXDEV
+		}
+		filesystems[fs] = true
+		if _, ok := p.datasets[fs]; !ok {
+			errs.add(name, unix.ENOENT)
+		} else if _, ok := p.datasets[name]; ok {
+			errs.add(name, unix.EEXIST)
+		}
+	}
+	if errs.first != nil {
+		return errs.result()
+	}
+	// All snapshots are taken in the same txg
+	txg := k.nextTxg()
+	for _, name := range sortedKeys(req.Snaps) {
+		snap := k.snapshotOf(p.datasets[parentName(name)], name, txg)
+		for prop, v := range req.Props {
+			snap.local[prop] = v
+		}
+		p.datasets[name] = snap
+	}
+	return nil, nil
+}
+
+func (k *Kernel) bookmark(r *request) (interface{}, error) {
+	var req map[string]interface{}
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	var errs errorList
+	var p *pool
+	for _, name := range sortedKeys(req) {
+		snapName, ok := req[name].(string)
+		if !ok || !strings.Contains(name, "#") || !strings.Contains(snapName, "@") {
+			return nil, unix.EINVAL
+		}
+		if parentName(name) != parentName(snapName) {
+			return nil, unix.EINVAL
+		}
+		if err := validateName(name); err != nil {
+			return nil, err
+		}
+		snapPool, snap, err := k.lookup(snapName)
+		if snapPool != nil && p != nil && snapPool != p {
+			return nil, unix.EXDEV
+		}
+		if snapPool != nil {
+			p = snapPool
+		}
+		if err != nil {
+			errs.add(name, err)
+		} else if _, ok := p.datasets[name]; ok {
+			errs.add(name, unix.EEXIST)
+		} else if snap.kind() != kindSnapshot {
+			errs.add(name, unix.EINVAL)
+		}
+	}
+	if errs.first != nil {
+		return errs.result()
+	}
+	for _, name := range sortedKeys(req) {
+		snap := p.datasets[req[name].(string)]
+		bm := k.snapshotOf(snap, name, snap.createTxg)
+		bm.guid = snap.guid
+		bm.creation = snap.creation
+		p.datasets[name] = bm
+	}
+	return nil, nil
+}
+
+func (k *Kernel) rename(r *request) (interface{}, error) {
+	newName := cString(r.cmd.Value[:])
+	recursive := r.cmd.Cookie != 0
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateName(newName); err != nil {
+		return nil, err
+	}
+	if poolName(newName) != p.name {
+		return nil, unix.EXDEV
+	}
+	switch ds.kind() {
+	case kindSnapshot:
+		fs := parentName(ds.name)
+		if parentName(newName) != fs || !strings.Contains(newName, "@") {
+			return nil, unix.EINVAL
+		}
+		oldSnap := ds.shortName()
+		newSnap := newName[len(fs)+1:]
+		snaps := []*dataset{ds}
+		if recursive {
+			for name, d := range p.datasets {
+				if d.kind() == kindSnapshot && d.shortName() == oldSnap && strings.HasPrefix(name, fs+"/") {
+					snaps = append(snaps, d)
+				}
+			}
+		}
+		for _, snap := range snaps {
+			if _, ok := p.datasets[parentName(snap.name)+"@"+newSnap]; ok {
+				return nil, unix.EEXIST
+			}
+		}
+		for _, snap := range snaps {
+			delete(p.datasets, snap.name)
+			snap.name = parentName(snap.name) + "@" + newSnap
+			p.datasets[snap.name] = snap
+		}
+		return nil, nil
+	case kindBookmark:
+		return nil, unix.EINVAL
+	}
+	if strings.ContainsAny(newName, "@#") || ds.name == p.name {
+		return nil, unix.EINVAL
+	}
+	if _, ok := p.datasets[newName]; ok {
+		return nil, unix.EEXIST
+	}
+	if newName == ds.name || strings.HasPrefix(newName, ds.name+"/") {
+		return nil, unix.EINVAL
+	}
+	if _, ok := p.datasets[parentName(newName)]; !ok {
+		return nil, unix.ENOENT
+	}
+	p.move(ds, newName)
+	return nil, nil
+}
+
+func (k *Kernel) promote(r *request) (interface{}, error) {
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() != kindHead {
+		return nil, unix.EINVAL
+	}
+	origin := p.snapshotByGUID(ds.origin)
+	if origin == nil {
+		return nil, unix.EINVAL
+	}
+	originFS := p.datasets[parentName(origin.name)]
+	// The snapshots of the origin filesystem up to the origin move to the clone
+	var moving []*dataset
+	for _, snap := range p.snapshots(originFS.name) {
+		if snap.createTxg > origin.createTxg {
+			break
+		}
+		if _, ok := p.datasets[ds.name+"@"+snap.shortName()]; ok {
+			putCString(r.cmd.String[:], snap.shortName())
+			return nil, unix.EEXIST
+		}
+		moving = append(moving, snap)
+	}
+	for _, snap := range moving {
+		delete(p.datasets, snap.name)
+		snap.name = ds.name + "@" + snap.shortName()
+		p.datasets[snap.name] = snap
+	}
+	ds.origin, originFS.origin = originFS.origin, origin.guid
+	return nil, nil
+}
+
+func (k *Kernel) rollback(r *request) (interface{}, error) {
+	var req struct {
+		Target string `nvlist:"target"`
+	}
+	if r.src != nil {
+		if err := r.decode(&req); err != nil {
+			return nil, err
+		}
+	}
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() != kindHead {
+		return nil, unix.EINVAL
+	}
+	latest := p.latest(ds.name)
+	if latest == nil {
+		return nil, unix.EINVAL
+	}
+	// Only the latest snapshot can be the target
+	if req.Target != "" && req.Target != latest.name {
+		return nil, unix.EXDEV
+	}
+	ds.referenced = latest.referenced
+	ds.written = latest.written
+	return map[string]string{"target": latest.name}, nil
+}
+
+func (k *Kernel) hold(r *request) (interface{}, error) {
+	var req struct {
+		Holds map[string]interface{} `nvlist:"holds"`
+	}
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	var errs errorList
+	for _, name := range sortedKeys(req.Holds) {
+		tag, ok := req.Holds[name].(string)
+		if !ok || tag == "" || !strings.Contains(name, "@") {
+			return nil, unix.EINVAL
+		}
+		if len(tag) >= maxNameLen {
+			return nil, unix.ENAMETOOLONG
+		}
+		if poolName(name) != p.name {
+			return nil, unix.EXDEV
+		}
+		if ds, ok := p.datasets[name]; !ok {
+			errs.add(name, unix.ENOENT)
+		} else if _, ok := ds.holds[tag]; ok {
+			errs.add(name, unix.EEXIST)
+		}
+	}
+	if errs.first != nil {
+		return errs.result()
+	}
+	for name, tag := range req.Holds {
+		p.datasets[name].holds[tag.(string)] = now()
+	}
+	return nil, nil
+}
+
+func (k *Kernel) release(r *request) (interface{}, error) {
+	var req map[string]map[string]interface{}
+	if err := r.decode(&req); err != nil {
+		return nil, err
+	}
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	var errs errorList
+	for _, name := range sortedKeys(req) {
+		if poolName(name) != p.name {
+			return nil, unix.EXDEV
+		}
+		ds, ok := p.datasets[name]
+		if !ok || ds.kind() != kindSnapshot {
+			errs.add(name, unix.ENOENT)
+			continue
+		}
+		for tag := range req[name] {
+			if _, ok := ds.holds[tag]; !ok {
+				errs.add(name, unix.ESRCH)
+				break
+			}
+		}
+	}
+	if errs.first != nil {
+		return errs.result()
+	}
+	for name, tags := range req {
+		ds := p.datasets[name]
+		for tag := range tags {
+			delete(ds.holds, tag)
+		}
+		p.reap(ds)
+	}
+	return nil, nil
+}
+
+func (k *Kernel) getHolds(r *request) (interface{}, error) {
+	_, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() != kindSnapshot {
+		return nil, unix.EINVAL
+	}
+	holds := make(map[string]uint64, len(ds.holds))
+	for tag, created := range ds.holds {
+		holds[tag] = created
+	}
+	return holds, nil
+}
+
+func (k *Kernel) spaceWritten(r *request) (interface{}, error) {
+	p, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() != kindHead {
+		return nil, unix.EINVAL
+	}
+	snapPool, snap, err := k.lookup(cString(r.cmd.Value[:]))
+	if err != nil {
+		return nil, err
+	}
+	if snapPool != p || snap.kind() != kindSnapshot || !p.before(snap, ds, ^uint64(0)) {
+		return nil, unix.EINVAL
+	}
+	r.cmd.Cookie = ds.written - snap.written
+	return nil, nil
+}
@@ -0,0 +1,325 @@
+// Package fake emulates the kernel side of the ZFS ioctls in memory, so code using the ioctl package
+// can be tested without the ZFS kernel module. A Kernel is an ioctl.Transport:
+//
+//	c := ioctl.NewClient(fake.New())
+//
+// It keeps pools, datasets, volumes, snapshots, bookmarks and clones with their props, holds and
+// the cursors used for listing, and fails with the same errnos as ZFS. All ioctls wrapped by the
+// ioctl package are emulated, as well as ZFS_IOC_HOLD, ZFS_IOC_RELEASE and ZFS_IOC_GET_HOLDS. Other
+// ioctls fail with ENOTSUP.
+//
+// No data is stored. Writes to filesystems and volumes can be simulated with Write, which changes
+// their space accounting. Send streams consist of a begin record like the one of ZFS followed by the
+// metadata needed to receive them into another Kernel, they can't be received by ZFS.
+package fake
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.dolansoft.org/lorenz/go-zfs/ioctl"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"golang.org/x/sys/unix"
+)
+
+// maxNameLen is the maximum length of a dataset name including the terminating null byte
+const maxNameLen = 256
+
+// Kernel is an emulated ZFS kernel module. It is safe for concurrent use.
+type Kernel struct {
+	mu sync.Mutex
+	// pools contains the imported pools by name, exported by their guid
+	pools    map[string]*pool
+	exported map[uint64]*pool
+	// generation is increased on every change of the pool configs
+	generation uint64
+	txg        uint64
+	rand       *rand.Rand
+}
+
+// New returns a Kernel without any pools. The guids it assigns are the same on every run.
+func New() *Kernel {
+	return &Kernel{
+		pools:      make(map[string]*pool),
+		exported:   make(map[uint64]*pool),
+		generation: 1,
+		txg:        4,
+		rand:       rand.New(rand.NewSource(1)),
+	}
+}
+
+// request contains the arguments of a single ioctl
+type request struct {
+	name string
+	cmd  *ioctl.Cmd
+	src  []byte
+	conf []byte
+}
+
+// decode decodes the request nvlist into v, ZFS rejects missing or malformed ones with EINVAL
+func (r *request) decode(v interface{}) error {
+	if r.src == nil {
+		return unix.EINVAL
+	}
+	if err := nvlist.Unmarshal(r.src, v); err != nil {
+		return unix.EINVAL
+	}
+	return nil
+}
+
+// handler emulates an ioctl. It returns the response nvlist, which is also passed back if the ioctl
+// fails, for example to report which snapshots couldn't be created.
+type handler func(k *Kernel, r *request) (interface{}, error)
+
+var handlers = map[ioctl.Ioctl]handler{
+	ioctl.ZFS_IOC_POOL_CREATE:        (*Kernel).poolCreate,
+	ioctl.ZFS_IOC_POOL_DESTROY:       (*Kernel).poolDestroy,
+	ioctl.ZFS_IOC_POOL_IMPORT:        (*Kernel).poolImport,
+	ioctl.ZFS_IOC_POOL_EXPORT:        (*Kernel).poolExport,
+	ioctl.ZFS_IOC_POOL_CONFIGS:       (*Kernel).poolConfigs,
+	ioctl.ZFS_IOC_POOL_STATS:         (*Kernel).poolStats,
+	ioctl.ZFS_IOC_POOL_SCAN:          (*Kernel).poolScan,
+	ioctl.ZFS_IOC_POOL_REGUID:        (*Kernel).poolReguid,
+	ioctl.ZFS_IOC_POOL_GET_PROPS:     (*Kernel).poolGetProps,
+	ioctl.ZFS_IOC_OBJSET_STATS:       (*Kernel).objsetStats,
+	ioctl.ZFS_IOC_OBJSET_ZPLPROPS:    (*Kernel).objsetZPLProps,
+	ioctl.ZFS_IOC_DATASET_LIST_NEXT:  (*Kernel).datasetListNext,
+	ioctl.ZFS_IOC_SNAPSHOT_LIST_NEXT: (*Kernel).snapshotListNext,
+	ioctl.ZFS_IOC_SET_PROP:           (*Kernel).setProp,
+	ioctl.ZFS_IOC_INHERIT_PROP:       (*Kernel).inheritProp,
+	ioctl.ZFS_IOC_CREATE:             (*Kernel).create,
+	ioctl.ZFS_IOC_CLONE:              (*Kernel).clone,
+	ioctl.ZFS_IOC_DESTROY:            (*Kernel).destroy,
+	ioctl.ZFS_IOC_DESTROY_SNAPS:      (*Kernel).destroySnaps,
+	ioctl.ZFS_IOC_SNAPSHOT:           (*Kernel).snapshot,
+	ioctl.ZFS_IOC_BOOKMARK:           (*Kernel).bookmark,
+	ioctl.ZFS_IOC_RENAME:             (*Kernel).rename,
+	ioctl.ZFS_IOC_PROMOTE:            (*Kernel).promote,
+	ioctl.ZFS_IOC_ROLLBACK:           (*Kernel).rollback,
+	ioctl.ZFS_IOC_HOLD:               (*Kernel).hold,
+	ioctl.ZFS_IOC_RELEASE:            (*Kernel).release,
+	ioctl.ZFS_IOC_GET_HOLDS:          (*Kernel).getHolds,
+	ioctl.ZFS_IOC_SPACE_WRITTEN:      (*Kernel).spaceWritten,
+	ioctl.ZFS_IOC_SEND_SPACE:         (*Kernel).sendSpace,
+	ioctl.ZFS_IOC_SEND_NEW:           (*Kernel).send,
+	ioctl.ZFS_IOC_RECV_NEW:           (*Kernel).recv,
+}
+
+// unlocked contains the handlers which lock the Kernel themselves because they block on file
+// descriptors
+var unlocked = map[ioctl.Ioctl]bool{
+	ioctl.ZFS_IOC_SEND_NEW: true,
+	ioctl.ZFS_IOC_RECV_NEW: true,
+}
+
+// Ioctl emulates a single ioctl, it implements ioctl.Transport
+func (k *Kernel) Ioctl(ioc ioctl.Ioctl, cmd *ioctl.Cmd, src, dst, conf []byte) error {
+	h, ok := handlers[ioc]
+	if !ok {
+		return unix.ENOTSUP
+	}
+	r := &request{name: cString(cmd.Name[:]), cmd: cmd, src: src, conf: conf}
+	if !unlocked[ioc] {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+	}
+	out, err := h(k, r)
+	if out == nil && (err != nil || dst == nil) {
+		return err
+	}
+	if replyErr := reply(cmd, dst, out); err == nil {
+		err = replyErr
+	}
+	return err
+}
+
+// reply writes the response nvlist out into dst like the kernel does. It needs to fit, otherwise
+// ENOMEM is returned and the size needed is stored in cmd.
+func reply(cmd *ioctl.Cmd, dst []byte, out interface{}) error {
+	if dst == nil {
+		return nil
+	}
+	if out == nil {
+		out = struct{}{}
+	}
+	data, err := nvlist.Marshal(out)
+	if err != nil {
+		return unix.EINVAL
+	}
+	cmd.Nvlist_dst_size = uint64(len(data))
+	if len(data) > len(dst) {
+		return unix.ENOMEM
+	}
+	copy(dst, data)
+	cmd.Nvlist_dst_filled = true
+	return nil
+}
+
+// Write simulates writing n bytes of new data into the filesystem or volume name. They are added to
+// its referenced and written space until it is rolled back.
+func (k *Kernel) Write(name string, n uint64) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	p, ds, err := k.lookup(name)
+	if err != nil {
+		return err
+	}
+	if ds.kind() != kindHead {
+		return unix.EINVAL
+	}
+	if n > p.free() {
+		return unix.ENOSPC
+	}
+	ds.referenced += n
+	ds.written += n
+	return nil
+}
+
+// newGUID returns a new random guid, which is never 0
+func (k *Kernel) newGUID() uint64 {
+	for {
+		if guid := k.rand.Uint64(); guid != 0 {
+			return guid
+		}
+	}
+}
+
+// nextTxg returns the txg in which the next change is made
+func (k *Kernel) nextTxg() uint64 {
+	k.txg++
+	return k.txg
+}
+
+// now returns the current time in seconds, which is used for the creation time of datasets
+func now() uint64 {
+	return uint64(time.Now().Unix())
+}
+
+// lookup returns the imported pool containing name and the dataset, snapshot or bookmark with that
+// name
+func (k *Kernel) lookup(name string) (*pool, *dataset, error) {
+	if err := validateName(name); err != nil {
+		return nil, nil, err
+	}
+	p, ok := k.pools[poolName(name)]
+	if !ok {
+		return nil, nil, unix.ENOENT
+	}
+	ds, ok := p.datasets[name]
+	if !ok {
+		return p, nil, unix.ENOENT
+	}
+	return p, ds, nil
+}
+
+// poolName returns the name of the pool containing the dataset name
+func poolName(name string) string {
+	if i := strings.IndexAny(name, "/@#"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// parentName returns the name of the filesystem containing name, which is the filesystem of a
+// snapshot or bookmark or the parent of a dataset. The parent of a pool is the empty string.
+func parentName(name string) string {
+	if i := strings.IndexAny(name, "@#"); i >= 0 {
+		return name[:i]
+	}
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// validateName checks that name is a valid dataset, snapshot or bookmark name
+func validateName(name string) error {
+	if len(name) >= maxNameLen {
+		return unix.ENAMETOOLONG
+	}
+	fs := name
+	if i := strings.IndexAny(name, "@#"); i >= 0 {
+		fs = name[:i]
+		if !validComponent(name[i+1:]) {
+			return unix.EINVAL
+		}
+	}
+	for _, c := range strings.Split(fs, "/") {
+		if !validComponent(c) {
+			return unix.EINVAL
+		}
+	}
+	return nil
+}
+
+func validComponent(c string) bool {
+	if c == "" {
+		return false
+	}
+	for _, r := range c {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '_' || r == '-' || r == '.' || r == ':' || r == ' ':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// cString returns the contents of a null-terminated buffer
+func cString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
+
+// putCString stores str in buf, truncating it if it doesn't fit
+func putCString(buf []byte, str string) {
+	n := copy(buf[:len(buf)-1], str)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+}
+
+// errorList collects the errors of ioctls operating on several datasets, which are returned as a
+// map from the dataset name to the errno. It also remembers the first error as the one returned by
+// the ioctl.
+type errorList struct {
+	errs  map[string]int32
+	first error
+}
+
+func (l *errorList) add(name string, err error) {
+	if l.errs == nil {
+		l.errs = make(map[string]int32)
+	}
+	l.errs[name] = int32(err.(unix.Errno))
+	if l.first == nil {
+		l.first = err
+	}
+}
+
+// result returns the response nvlist and error of the ioctl
+func (l *errorList) result() (interface{}, error) {
+	if l.first == nil {
+		return nil, nil
+	}
+	return l.errs, l.first
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
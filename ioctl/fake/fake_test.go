@@ -0,0 +1,376 @@
+package fake_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.dolansoft.org/lorenz/go-zfs/ioctl"
+	"git.dolansoft.org/lorenz/go-zfs/ioctl/fake"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"golang.org/x/sys/unix"
+)
+
+// newPool returns a client on a new Kernel with the pool tp1 backed by a sparse file
+func newPool(t *testing.T) (*fake.Kernel, *ioctl.Client) {
+	path := filepath.Join(t.TempDir(), "vdev.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(1 << 30); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	k := fake.New()
+	c := ioctl.NewClient(k)
+	err = c.PoolCreate("tp1", nil, ioctl.VDev{
+		Type:     "root",
+		Children: []ioctl.VDev{{Type: "file", Path: path}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, c
+}
+
+// rawIoctl issues an ioctl which has no wrapper in the ioctl package
+func rawIoctl(k *fake.Kernel, ioc ioctl.Ioctl, name string, req interface{}) (map[string]interface{}, error) {
+	cmd := &ioctl.Cmd{}
+	copy(cmd.Name[:], name)
+	src, err := nvlist.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, 64*1024)
+	if err := k.Ioctl(ioc, cmd, src, dst, nil); err != nil {
+		return nil, err
+	}
+	res := make(map[string]interface{})
+	err = nvlist.Unmarshal(dst, &res)
+	return res, err
+}
+
+func TestPool(t *testing.T) {
+	_, c := newPool(t)
+	if err := c.PoolCreate("tp1", nil, ioctl.VDev{Type: "root", Children: []ioctl.VDev{{Type: "file", Path: "/nonexistent"}}}); err != unix.EEXIST {
+		t.Errorf("expected EEXIST for an existing pool, got %v", err)
+	}
+	if err := c.PoolCreate("tp2", nil, ioctl.VDev{Type: "root", Children: []ioctl.VDev{{Type: "file", Path: "/nonexistent"}}}); err != unix.ENOENT {
+		t.Errorf("expected ENOENT for a missing vdev, got %v", err)
+	}
+	if err := c.PauseScan("tp1"); err != unix.ENOENT {
+		t.Errorf("expected ENOENT when pausing without a scrub, got %v", err)
+	}
+	if err := c.StartStopScan("tp1", ioctl.ScanTypeScrub); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartStopScan("tp1", ioctl.ScanTypeScrub); err != unix.EBUSY {
+		t.Errorf("expected EBUSY for a second scrub, got %v", err)
+	}
+	if err := c.StartStopScan("tp1", ioctl.ScanTypeNone); err != nil {
+		t.Error(err)
+	}
+
+	configs, err := c.PoolConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := nvlist.Get[map[string]interface{}](configs, "tp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PoolExport("tp1", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PoolStats("tp1"); err != unix.ENOENT {
+		t.Errorf("expected ENOENT for an exported pool, got %v", err)
+	}
+	if _, err := c.PoolImport("tp2", config, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PoolImport("tp2", config, nil); err != unix.ENOENT {
+		t.Errorf("expected ENOENT for importing twice, got %v", err)
+	}
+	if _, err := c.ObjsetStats("tp2"); err != nil {
+		t.Errorf("root dataset hasn't been renamed with the pool: %v", err)
+	}
+	props, err := c.PoolGetProps("tp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := nvlist.Get[uint64](props, "size.value"); err != nil || size != 1<<30 {
+		t.Errorf("unexpected pool size %v, %v", size, err)
+	}
+}
+
+func TestDatasets(t *testing.T) {
+	k, c := newPool(t)
+	if err := c.Create("tp1/a/b", ioctl.ObjectTypeZFS, nil); err != unix.ENOENT {
+		t.Errorf("expected ENOENT for a missing parent, got %v", err)
+	}
+	if err := c.Create("tp1/a", ioctl.ObjectTypeZFS, &ioctl.DatasetProps{"mountpoint": "/a", "org.example:tag": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("tp1/a", ioctl.ObjectTypeZFS, nil); err != unix.EEXIST {
+		t.Errorf("expected EEXIST for an existing dataset, got %v", err)
+	}
+	if err := c.Create("tp1/v", ioctl.ObjectTypeZvol, nil); err != unix.EINVAL {
+		t.Errorf("expected EINVAL for a volume without volsize, got %v", err)
+	}
+	if err := c.Create("tp1/a/b", ioctl.ObjectTypeZFS, &ioctl.DatasetProps{"atime": "off"}); err != unix.EINVAL {
+		t.Errorf("expected EINVAL for a string index prop, got %v", err)
+	}
+	if err := c.Create("tp1/a/b", ioctl.ObjectTypeZFS, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	props, err := c.ObjsetStats("tp1/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := props["mountpoint"]; p.Value != "/a" || p.Source != "tp1/a" {
+		t.Errorf("mountpoint not inherited from tp1/a: %+v", p)
+	}
+	if err := c.SetProp("tp1/a/b", map[string]interface{}{"org.example:tag": "recvd"}, ioctl.PropSourceReceived); err != nil {
+		t.Fatal(err)
+	}
+	if props, _ = c.ObjsetStats("tp1/a/b"); props["org.example:tag"] != (ioctl.PropWithSource{Value: "recvd", Source: "$recvd"}) {
+		t.Errorf("unexpected received prop %+v", props["org.example:tag"])
+	}
+	if err := c.InheritProp("tp1/a/b", "org.example:tag", false); err != nil {
+		t.Fatal(err)
+	}
+	if props, _ = c.ObjsetStats("tp1/a/b"); props["org.example:tag"] != (ioctl.PropWithSource{Value: "x", Source: "tp1/a"}) {
+		t.Errorf("received prop not hidden by inheriting: %+v", props["org.example:tag"])
+	}
+	if err := c.InheritProp("tp1/a/b", "quota", false); err != unix.EINVAL {
+		t.Errorf("expected EINVAL for inheriting quota, got %v", err)
+	}
+	if err := c.Destroy("tp1/a", ioctl.ObjectTypeAny, false); err != unix.EEXIST {
+		t.Errorf("expected EEXIST for destroying a dataset with children, got %v", err)
+	}
+
+	if err := c.Snapshot([]string{"tp1/a@s1", "tp1/a/b@s1"}, "tp1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Snapshot([]string{"tp1/a@s1", "tp1/a/b@s2"}, "tp1", nil); err != unix.EEXIST {
+		t.Errorf("expected EEXIST for an existing snapshot, got %v", err)
+	}
+	if _, err := c.ObjsetStats("tp1/a/b@s2"); err != unix.ENOENT {
+		t.Errorf("failed snapshot call isn't atomic: %v", err)
+	}
+	if err := c.Snapshot([]string{"tp1/a@s2"}, "tp1", nil); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for cookie := uint64(0); ; {
+		var name string
+		var err error
+		name, cookie, _, err = c.SnapshotListNext("tp1/a", cookie, nil)
+		if err == unix.ESRCH {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if len(names) != 2 || names[0] != "tp1/a@s1" || names[1] != "tp1/a@s2" {
+		t.Errorf("unexpected snapshots %v", names)
+	}
+
+	if err := c.Rename("tp1/a@s1", "tp1/a@old", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ObjsetStats("tp1/a/b@old"); err != nil {
+		t.Errorf("snapshot of child not renamed recursively: %v", err)
+	}
+	if err := c.Destroy("tp1/a/b", ioctl.ObjectTypeAny, false); err != unix.EBUSY {
+		t.Errorf("expected EBUSY for destroying a dataset with snapshots, got %v", err)
+	}
+
+	if err := k.Write("tp1/a", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := c.GetSpaceWritten("tp1/a", "tp1/a@old"); err != nil || written != 1000 {
+		t.Errorf("unexpected written %v, %v", written, err)
+	}
+	if _, err := c.Rollback("tp1/a", "tp1/a@old"); err != unix.EXDEV {
+		t.Errorf("expected EXDEV for rolling back to an older snapshot, got %v", err)
+	}
+	if target, err := c.Rollback("tp1/a", ""); err != nil || target != "tp1/a@s2" {
+		t.Errorf("unexpected rollback to %q, %v", target, err)
+	}
+	if written, err := c.GetSpaceWritten("tp1/a", "tp1/a@s2"); err != nil || written != 0 {
+		t.Errorf("unexpected written after rollback %v, %v", written, err)
+	}
+}
+
+func TestHoldsAndClones(t *testing.T) {
+	k, c := newPool(t)
+	if err := c.Create("tp1/fs", ioctl.ObjectTypeZFS, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Snapshot([]string{"tp1/fs@s1"}, "tp1", nil); err != nil {
+		t.Fatal(err)
+	}
+	holds := map[string]interface{}{"holds": map[string]string{"tp1/fs@s1": "backup"}}
+	if _, err := rawIoctl(k, ioctl.ZFS_IOC_HOLD, "tp1", holds); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := rawIoctl(k, ioctl.ZFS_IOC_HOLD, "tp1", holds); err != unix.EEXIST || res != nil {
+		t.Errorf("expected EEXIST for an existing hold, got %v, %v", res, err)
+	}
+	if res, err := rawIoctl(k, ioctl.ZFS_IOC_GET_HOLDS, "tp1/fs@s1", struct{}{}); err != nil || res["backup"] == nil {
+		t.Errorf("hold not found: %v, %v", res, err)
+	}
+	if err := c.Destroy("tp1/fs@s1", ioctl.ObjectTypeAny, false); err != unix.EBUSY {
+		t.Errorf("expected EBUSY for destroying a held snapshot, got %v", err)
+	}
+	if err := c.DestroySnapshots([]string{"tp1/fs@s1"}, "tp1", true); err != nil {
+		t.Fatal(err)
+	}
+	props, err := c.ObjsetStats("tp1/fs@s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props["defer_destroy"].Value != uint64(1) || props["userrefs"].Value != uint64(1) {
+		t.Errorf("unexpected props of deferred snapshot %v", props)
+	}
+	release := map[string]interface{}{"tp1/fs@s1": map[string]nvlist.Flag{"backup": true}}
+	if _, err := rawIoctl(k, ioctl.ZFS_IOC_RELEASE, "tp1", release); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ObjsetStats("tp1/fs@s1"); err != unix.ENOENT {
+		t.Errorf("deferred snapshot not destroyed by its last release: %v", err)
+	}
+	if _, err := rawIoctl(k, ioctl.ZFS_IOC_RELEASE, "tp1", release); err != unix.ENOENT {
+		t.Errorf("expected ENOENT for releasing a destroyed snapshot, got %v", err)
+	}
+
+	if err := c.Snapshot([]string{"tp1/fs@s2"}, "tp1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clone("tp1/fs@s2", "tp1/clone", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Destroy("tp1/fs@s2", ioctl.ObjectTypeAny, false); err != unix.EEXIST {
+		t.Errorf("expected EEXIST for destroying a snapshot with clones, got %v", err)
+	}
+	if err := c.Snapshot([]string{"tp1/clone@s2"}, "tp1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if conflict, err := c.Promote("tp1/clone"); err != unix.EEXIST || conflict != "s2" {
+		t.Errorf("expected conflicting snapshot s2, got %q, %v", conflict, err)
+	}
+	if err := c.Destroy("tp1/clone@s2", ioctl.ObjectTypeAny, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Promote("tp1/clone"); err != nil {
+		t.Fatal(err)
+	}
+	props, err = c.ObjsetStats("tp1/fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props["origin"].Value != "tp1/clone@s2" {
+		t.Errorf("unexpected origin after promote %v", props["origin"])
+	}
+	if err := c.Destroy("tp1/fs", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+	if err := c.Destroy("tp1/clone@s2", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendReceive(t *testing.T) {
+	k, c := newPool(t)
+	if err := c.Create("tp1/src", ioctl.ObjectTypeZFS, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Write("tp1/src", 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Snapshot([]string{"tp1/src@s1"}, "tp1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Snapshot([]string{"tp1/src@s2"}, "tp1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(name, from string) []byte {
+		r, err := c.Send(name, ioctl.SendOptions{From: from})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		stream, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		space, err := c.SendSpace(name, ioctl.SendSpaceOptions{From: from})
+		if err != nil || space != uint64(len(stream)) {
+			t.Errorf("send space %v doesn't match stream size %v: %v", space, len(stream), err)
+		}
+		return stream
+	}
+	receive := func(name string, stream []byte) error {
+		w, err := c.Receive("tp1", ioctl.ReceiveOpts{SnapshotName: name})
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, bytes.NewReader(stream)); err != nil {
+			return err
+		}
+		return w.WaitAndClose()
+	}
+
+	full := send("tp1/src@s1", "")
+	incremental := send("tp1/src@s2", "tp1/src@s1")
+	if _, err := c.Send("tp1/src@s1", ioctl.SendOptions{From: "tp1/src@s2"}); err != unix.EXDEV {
+		t.Errorf("expected EXDEV for a later incremental source, got %v", err)
+	}
+
+	if err := receive("tp1/dst@s2", incremental); err != unix.ENOENT {
+		t.Errorf("expected ENOENT for an incremental stream without destination, got %v", err)
+	}
+	if err := receive("tp1/dst@s1", full); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive("tp1/dst@s1", full); err != unix.EEXIST {
+		t.Errorf("expected EEXIST for receiving twice, got %v", err)
+	}
+	if err := k.Write("tp1/dst", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive("tp1/dst@s2", incremental); err != unix.ETXTBSY {
+		t.Errorf("expected ETXTBSY for a modified destination, got %v", err)
+	}
+	if _, err := c.Rollback("tp1/dst", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive("tp1/dst@s2", incremental); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive("tp1/dst@s3", incremental); err != unix.ENODEV {
+		t.Errorf("expected ENODEV for a stream from another snapshot, got %v", err)
+	}
+
+	src, err := c.ObjsetStats("tp1/src@s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := c.ObjsetStats("tp1/dst@s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prop := range []string{"guid", "referenced"} {
+		if src[prop] != dst[prop] {
+			t.Errorf("%v differs after receive: %v != %v", prop, src[prop], dst[prop])
+		}
+	}
+}
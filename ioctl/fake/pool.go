@@ -0,0 +1,369 @@
+package fake
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.dolansoft.org/lorenz/go-zfs/ioctl"
+	"golang.org/x/sys/unix"
+)
+
+// Pool states as reported in the pool configs
+const (
+	poolStateActive   = 0
+	poolStateExported = 1
+)
+
+// vdevStateHealthy is the value of the health prop of a healthy pool
+const vdevStateHealthy = 7
+
+// minDeviceSize is the size ZFS needs at least on every device
+const minDeviceSize = 64 << 20
+
+type scanState int
+
+const (
+	scanNone scanState = iota
+	scanScrubbing
+	scanPaused
+)
+
+type pool struct {
+	name     string
+	guid     uint64
+	state    uint64
+	txg      uint64
+	vdevTree map[string]interface{}
+	// size is the usable space of all vdevs together
+	size     uint64
+	props    map[string]interface{}
+	scan     scanState
+	datasets map[string]*dataset
+}
+
+func (k *Kernel) poolCreate(r *request) (interface{}, error) {
+	if strings.ContainsAny(r.name, "/@#") || !validComponent(r.name) {
+		return nil, unix.EINVAL
+	}
+	for _, reserved := range []string{"mirror", "raidz", "draid", "spare", "log"} {
+		if strings.HasPrefix(r.name, reserved) {
+			return nil, unix.EINVAL
+		}
+	}
+	if _, ok := k.pools[r.name]; ok {
+		return nil, unix.EEXIST
+	}
+	props := make(map[string]interface{})
+	if r.src != nil {
+		if err := r.decode(&props); err != nil {
+			return nil, err
+		}
+	}
+	rootProps, _ := props["root-props-nvl"].(map[string]interface{})
+	delete(props, "root-props-nvl")
+	var tree map[string]interface{}
+	r.src = r.conf
+	if err := r.decode(&tree); err != nil {
+		return nil, err
+	}
+	if tree["type"] != "root" {
+		return nil, unix.EINVAL
+	}
+	size, err := k.initVdev(tree, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := validateProps(rootProps, kindHead); err != nil {
+		return nil, err
+	}
+	p := &pool{
+		name:     r.name,
+		guid:     k.newGUID(),
+		txg:      k.nextTxg(),
+		vdevTree: tree,
+		size:     size,
+		props:    props,
+		datasets: make(map[string]*dataset),
+	}
+	tree["guid"] = p.guid
+	root := k.newDataset(r.name, ioctl.ObjectTypeZFS)
+	for name, v := range rootProps {
+		root.local[name] = v
+	}
+	p.datasets[r.name] = root
+	k.pools[r.name] = p
+	k.generation++
+	return nil, nil
+}
+
+// initVdev checks the vdev v and its children, assigns their ids and guids and returns the usable
+// space of v
+func (k *Kernel) initVdev(v map[string]interface{}, id uint64) (uint64, error) {
+	v["id"] = id
+	v["guid"] = k.newGUID()
+	typ, _ := v["type"].(string)
+	switch typ {
+	case "file", "disk":
+		path, _ := v["path"].(string)
+		if !filepath.IsAbs(path) {
+			return 0, unix.EINVAL
+		}
+		size, err := deviceSize(path)
+		if err != nil {
+			return 0, err
+		}
+		if size < minDeviceSize {
+			return 0, unix.EOVERFLOW
+		}
+		v["ashift"] = uint64(12)
+		v["asize"] = size
+		return size, nil
+	case "root", "mirror", "raidz":
+		children, ok := v["children"].([]map[string]interface{})
+		if !ok || len(children) == 0 {
+			return 0, unix.EINVAL
+		}
+		var total, smallest uint64
+		for i, c := range children {
+			size, err := k.initVdev(c, uint64(i))
+			if err != nil {
+				return 0, err
+			}
+			total += size
+			if i == 0 || size < smallest {
+				smallest = size
+			}
+		}
+		switch typ {
+		case "mirror":
+			return smallest, nil
+		case "raidz":
+			parity, _ := v["nparity"].(uint64)
+			if parity == 0 {
+				parity = 1
+			}
+			if uint64(len(children)) <= parity {
+				return 0, unix.EINVAL
+			}
+			return smallest * (uint64(len(children)) - parity), nil
+		}
+		v["vdev_children"] = uint64(len(children))
+		return total, nil
+	}
+	return 0, unix.EINVAL
+}
+
+// deviceSize returns the size of a file or block device
+func deviceSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errno, ok := err.(*os.PathError).Err.(unix.Errno); ok {
+			return 0, errno
+		}
+		return 0, unix.EIO
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, unix.EIO
+	}
+	return uint64(size), nil
+}
+
+// config returns the pool config as returned by ZFS_IOC_POOL_CONFIGS
+func (p *pool) config() map[string]interface{} {
+	hostname, _ := os.Hostname()
+	return map[string]interface{}{
+		"version":           uint64(5000),
+		"name":              p.name,
+		"state":             p.state,
+		"txg":               p.txg,
+		"pool_guid":         p.guid,
+		"errata":            uint64(0),
+		"hostname":          hostname,
+		"vdev_children":     p.vdevTree["vdev_children"],
+		"vdev_tree":         p.vdevTree,
+		"features_for_read": map[string]interface{}{},
+	}
+}
+
+// allocated returns the space referenced by all filesystems and volumes
+func (p *pool) allocated() uint64 {
+	var n uint64
+	for _, ds := range p.datasets {
+		if ds.kind() == kindHead {
+			n += ds.referenced
+		}
+	}
+	return n
+}
+
+func (p *pool) free() uint64 {
+	return p.size - p.allocated()
+}
+
+// rename changes the name of the pool and all its datasets
+func (p *pool) rename(name string) {
+	datasets := make(map[string]*dataset, len(p.datasets))
+	for _, ds := range p.datasets {
+		ds.name = name + ds.name[len(p.name):]
+		datasets[ds.name] = ds
+	}
+	p.name = name
+	p.datasets = datasets
+}
+
+func (k *Kernel) poolDestroy(r *request) (interface{}, error) {
+	if _, ok := k.pools[r.name]; !ok {
+		return nil, unix.ENOENT
+	}
+	delete(k.pools, r.name)
+	k.generation++
+	return nil, nil
+}
+
+func (k *Kernel) poolConfigs(r *request) (interface{}, error) {
+	// The cookie is the generation of the configs the caller already has
+	if r.cmd.Cookie == k.generation {
+		return nil, unix.EEXIST
+	}
+	r.cmd.Cookie = k.generation
+	configs := make(map[string]interface{}, len(k.pools))
+	for name, p := range k.pools {
+		configs[name] = p.config()
+	}
+	return configs, nil
+}
+
+func (k *Kernel) poolStats(r *request) (interface{}, error) {
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	return p.config(), nil
+}
+
+func (k *Kernel) poolExport(r *request) (interface{}, error) {
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	delete(k.pools, r.name)
+	p.state = poolStateExported
+	p.scan = scanNone
+	k.exported[p.guid] = p
+	k.generation++
+	return nil, nil
+}
+
+func (k *Kernel) poolImport(r *request) (interface{}, error) {
+	var config struct {
+		GUID uint64 `nvlist:"pool_guid"`
+	}
+	props := make(map[string]interface{})
+	if r.src != nil {
+		if err := r.decode(&props); err != nil {
+			return nil, err
+		}
+	}
+	r.src = r.conf
+	if err := r.decode(&config); err != nil {
+		return nil, err
+	}
+	if config.GUID != r.cmd.Guid {
+		return nil, unix.EINVAL
+	}
+	if strings.ContainsAny(r.name, "/@#") || !validComponent(r.name) {
+		return nil, unix.EINVAL
+	}
+	p, ok := k.exported[r.cmd.Guid]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	if _, ok := k.pools[r.name]; ok {
+		return nil, unix.EEXIST
+	}
+	delete(k.exported, p.guid)
+	p.rename(r.name)
+	for name, v := range props {
+		p.props[name] = v
+	}
+	p.state = poolStateActive
+	p.txg = k.nextTxg()
+	k.pools[p.name] = p
+	k.generation++
+	return p.config(), nil
+}
+
+func (k *Kernel) poolScan(r *request) (interface{}, error) {
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	switch r.cmd.Flags {
+	case 0:
+	case 1:
+		if p.scan != scanScrubbing {
+			return nil, unix.ENOENT
+		}
+		p.scan = scanPaused
+		return nil, nil
+	default:
+		return nil, unix.EINVAL
+	}
+	switch ioctl.ScanType(r.cmd.Cookie) {
+	case ioctl.ScanTypeNone:
+		if p.scan == scanNone {
+			return nil, unix.ENOENT
+		}
+		p.scan = scanNone
+	case ioctl.ScanTypeScrub:
+		if p.scan == scanScrubbing {
+			return nil, unix.EBUSY
+		}
+		p.scan = scanScrubbing
+	case ioctl.ScanTypeResilver:
+		// Without faulted devices there is nothing to resilver
+	default:
+		return nil, unix.EINVAL
+	}
+	return nil, nil
+}
+
+func (k *Kernel) poolReguid(r *request) (interface{}, error) {
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	p.guid = k.newGUID()
+	p.vdevTree["guid"] = p.guid
+	p.txg = k.nextTxg()
+	k.generation++
+	return nil, nil
+}
+
+func (k *Kernel) poolGetProps(r *request) (interface{}, error) {
+	p, ok := k.pools[r.name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	props := make(map[string]interface{})
+	set := func(name string, v interface{}, source ioctl.PropSource) {
+		props[name] = map[string]interface{}{"value": v, "source": uint64(source)}
+	}
+	for name, v := range p.props {
+		set(name, v, ioctl.PropSourceLocal)
+	}
+	allocated := p.allocated()
+	set("name", p.name, ioctl.PropSourceNone)
+	set("guid", p.guid, ioctl.PropSourceNone)
+	set("size", p.size, ioctl.PropSourceNone)
+	set("allocated", allocated, ioctl.PropSourceNone)
+	set("free", p.size-allocated, ioctl.PropSourceNone)
+	set("capacity", allocated*100/p.size, ioctl.PropSourceNone)
+	set("health", uint64(vdevStateHealthy), ioctl.PropSourceNone)
+	set("readonly", uint64(0), ioctl.PropSourceNone)
+	return props, nil
+}
@@ -0,0 +1,288 @@
+package fake
+
+import (
+	"strings"
+
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"golang.org/x/sys/unix"
+)
+
+// propInfo describes a native prop which can be set
+type propInfo struct {
+	// str is set for props with string values, all others are numbers or indices stored as uint64
+	str bool
+	// inherit is set for props which are inherited by the datasets below
+	inherit bool
+}
+
+var nativeProps = map[string]propInfo{
+	"aclinherit":           {inherit: true},
+	"acltype":              {inherit: true},
+	"atime":                {inherit: true},
+	"canmount":             {},
+	"casesensitivity":      {},
+	"checksum":             {inherit: true},
+	"compression":          {inherit: true},
+	"context":              {str: true},
+	"copies":               {inherit: true},
+	"dedup":                {inherit: true},
+	"defcontext":           {str: true},
+	"devices":              {inherit: true},
+	"dnodesize":            {inherit: true},
+	"exec":                 {inherit: true},
+	"filesystem_limit":     {},
+	"fscontext":            {str: true},
+	"keylocation":          {str: true},
+	"logbias":              {inherit: true},
+	"mlslabel":             {str: true, inherit: true},
+	"mountpoint":           {str: true, inherit: true},
+	"nbmand":               {inherit: true},
+	"normalization":        {},
+	"overlay":              {inherit: true},
+	"primarycache":         {inherit: true},
+	"quota":                {},
+	"readonly":             {inherit: true},
+	"recordsize":           {inherit: true},
+	"redundant_metadata":   {inherit: true},
+	"refquota":             {},
+	"refreservation":       {},
+	"relatime":             {inherit: true},
+	"reservation":          {},
+	"rootcontext":          {str: true},
+	"secondarycache":       {inherit: true},
+	"setuid":               {inherit: true},
+	"sharenfs":             {str: true, inherit: true},
+	"sharesmb":             {str: true, inherit: true},
+	"snapdev":              {inherit: true},
+	"snapdir":              {inherit: true},
+	"snapshot_limit":       {},
+	"special_small_blocks": {inherit: true},
+	"sync":                 {inherit: true},
+	"utf8only":             {},
+	"version":              {},
+	"volblocksize":         {},
+	"volmode":              {inherit: true},
+	"volsize":              {},
+	"vscan":                {inherit: true},
+	"xattr":                {inherit: true},
+	"zoned":                {inherit: true},
+}
+
+// maxPropValueLen is the maximum length of the value of a user prop
+const maxPropValueLen = 8192
+
+// isUserProp reports whether name is a user prop, which always contain a colon
+func isUserProp(name string) bool {
+	return strings.Contains(name, ":")
+}
+
+func inheritable(name string) bool {
+	return isUserProp(name) || nativeProps[name].inherit
+}
+
+// validateProps checks that props can be set on a dataset of kind k and returns the first prop
+// which can't
+func validateProps(props map[string]interface{}, k kind) (string, error) {
+	for _, name := range sortedKeys(props) {
+		if err := validateProp(name, props[name], k); err != nil {
+			return name, err
+		}
+	}
+	return "", nil
+}
+
+func validateProp(name string, v interface{}, k kind) error {
+	if isUserProp(name) {
+		s, ok := v.(string)
+		if !ok {
+			return unix.EINVAL
+		}
+		if len(name) >= maxNameLen {
+			return unix.ENAMETOOLONG
+		}
+		if len(s) >= maxPropValueLen {
+			return unix.E2BIG
+		}
+		return nil
+	}
+	info, ok := nativeProps[name]
+	// Snapshots and bookmarks only have user props
+	if !ok || k != kindHead {
+		return unix.EINVAL
+	}
+	switch v.(type) {
+	case string:
+		if !info.str {
+			return unix.EINVAL
+		}
+	case uint64:
+		if info.str {
+			return unix.EINVAL
+		}
+	default:
+		return unix.EINVAL
+	}
+	return nil
+}
+
+func (k *Kernel) setProp(r *request) (interface{}, error) {
+	var props map[string]interface{}
+	if err := r.decode(&props); err != nil {
+		return nil, err
+	}
+	_, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if ds.kind() == kindBookmark {
+		return nil, unix.EINVAL
+	}
+	if name, err := validateProps(props, ds.kind()); err != nil {
+		return map[string]int32{name: int32(err.(unix.Errno))}, err
+	}
+	// ZFS treats every nonzero cookie as setting received props
+	received := r.cmd.Cookie != 0
+	for name, v := range props {
+		if received {
+			ds.received[name] = v
+		} else {
+			ds.local[name] = v
+			delete(ds.inherited, name)
+		}
+	}
+	return nil, nil
+}
+
+func (k *Kernel) inheritProp(r *request) (interface{}, error) {
+	name := cString(r.cmd.Value[:])
+	revert := r.cmd.Cookie != 0
+	_, ds, err := k.lookup(r.name)
+	if err != nil {
+		return nil, err
+	}
+	if !isUserProp(name) {
+		info, ok := nativeProps[name]
+		if !ok || ds.kind() != kindHead || !info.inherit && !revert {
+			return nil, unix.EINVAL
+		}
+	}
+	delete(ds.local, name)
+	if revert {
+		delete(ds.inherited, name)
+	} else if _, ok := ds.received[name]; ok {
+		ds.inherited[name] = true
+	}
+	return nil, nil
+}
+
+// ownProps returns the values of the props set on ds itself and whether they are received
+func (ds *dataset) ownProps() (map[string]interface{}, map[string]bool) {
+	values := make(map[string]interface{})
+	received := make(map[string]bool)
+	for name, v := range ds.received {
+		if !ds.inherited[name] {
+			values[name] = v
+			received[name] = true
+		}
+	}
+	for name, v := range ds.local {
+		values[name] = v
+		delete(received, name)
+	}
+	return values, received
+}
+
+// datasetProps returns the props of ds as returned by ZFS_IOC_OBJSET_STATS. Props which can be set have
+// the name of the dataset they are set on as their source or $recvd for received values, the
+// statistics have no source.
+func (p *pool) datasetProps(ds *dataset) map[string]interface{} {
+	props := make(map[string]interface{})
+	for d, own := ds, true; d != nil; d, own = p.datasets[parentName(d.name)], false {
+		values, received := d.ownProps()
+		for name, v := range values {
+			if _, ok := props[name]; ok || !own && !inheritable(name) {
+				continue
+			}
+			source := d.name
+			if own && received[name] {
+				source = "$recvd"
+			}
+			props[name] = map[string]interface{}{"value": v, "source": source}
+		}
+	}
+
+	stat := func(name string, v interface{}) {
+		props[name] = map[string]interface{}{"value": v}
+	}
+	stat("type", uint64(ds.typ))
+	stat("creation", ds.creation)
+	stat("createtxg", ds.createTxg)
+	stat("guid", ds.guid)
+	stat("referenced", ds.referenced)
+	stat("logicalreferenced", ds.referenced)
+	stat("compressratio", uint64(100))
+	stat("refcompressratio", uint64(100))
+	switch ds.kind() {
+	case kindHead:
+		used := p.used(ds)
+		stat("used", used)
+		stat("logicalused", used)
+		stat("available", p.free())
+		written := ds.written
+		if prev := p.previous(ds); prev != nil {
+			written -= prev.written
+		}
+		stat("written", written)
+		if origin := p.snapshotByGUID(ds.origin); origin != nil {
+			stat("origin", origin.name)
+		}
+	case kindSnapshot:
+		// Without overwritten data snapshots don't use any space of their own
+		stat("used", uint64(0))
+		written := ds.written
+		if prev := p.snapshotBefore(ds); prev != nil {
+			written -= prev.written
+		}
+		stat("written", written)
+		stat("userrefs", uint64(len(ds.holds)))
+		var deferDestroy uint64
+		if ds.deferDestroy {
+			deferDestroy = 1
+		}
+		stat("defer_destroy", deferDestroy)
+		if clones := p.clones(ds); len(clones) > 0 {
+			names := make(map[string]nvlist.Flag, len(clones))
+			for _, name := range clones {
+				names[name] = true
+			}
+			stat("clones", names)
+		}
+	}
+	return props
+}
+
+// used returns the space used by the filesystem or volume ds and all datasets below it
+func (p *pool) used(ds *dataset) uint64 {
+	used := ds.referenced
+	for _, child := range p.children(ds.name) {
+		used += p.used(p.datasets[child])
+	}
+	return used
+}
+
+// snapshotBefore returns the snapshot taken before snap, which is the origin for the first
+// snapshot of a clone
+func (p *pool) snapshotBefore(snap *dataset) *dataset {
+	fs := p.datasets[parentName(snap.name)]
+	var prev *dataset
+	for _, s := range p.snapshots(fs.name) {
+		if s == snap {
+			break
+		}
+		prev = s
+	}
+	if prev == nil {
+		return p.snapshotByGUID(fs.origin)
+	}
+	return prev
+}
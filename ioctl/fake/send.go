@@ -0,0 +1,276 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"git.dolansoft.org/lorenz/go-zfs/ioctl"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// beginRecordSize is the size of the dmu_replay_record at the start of every stream
+	beginRecordSize = 312
+	drrBegin        = 0
+	drrMagic        = 0x2F5bacbac
+	// drrSubstream is the version of streams which aren't compound streams
+	drrSubstream = 1
+)
+
+// beginRecord contains the fields of the begin record used by a Kernel
+type beginRecord struct {
+	creation uint64
+	typ      ioctl.ObjectType
+	toGUID   uint64
+	fromGUID uint64
+	toName   string
+}
+
+func (b *beginRecord) marshal() []byte {
+	buf := make([]byte, beginRecordSize)
+	binary.LittleEndian.PutUint32(buf[0:], drrBegin)
+	binary.LittleEndian.PutUint64(buf[8:], drrMagic)
+	binary.LittleEndian.PutUint64(buf[16:], drrSubstream)
+	binary.LittleEndian.PutUint64(buf[24:], b.creation)
+	binary.LittleEndian.PutUint32(buf[32:], uint32(b.typ))
+	binary.LittleEndian.PutUint64(buf[40:], b.toGUID)
+	binary.LittleEndian.PutUint64(buf[48:], b.fromGUID)
+	putCString(buf[56:], b.toName)
+	return buf
+}
+
+func (b *beginRecord) unmarshal(buf []byte) error {
+	if len(buf) != beginRecordSize || binary.LittleEndian.Uint32(buf[0:]) != drrBegin || binary.LittleEndian.Uint64(buf[8:]) != drrMagic {
+		return unix.EINVAL
+	}
+	b.creation = binary.LittleEndian.Uint64(buf[24:])
+	b.typ = ioctl.ObjectType(binary.LittleEndian.Uint32(buf[32:]))
+	b.toGUID = binary.LittleEndian.Uint64(buf[40:])
+	b.fromGUID = binary.LittleEndian.Uint64(buf[48:])
+	b.toName = cString(buf[56:])
+	return nil
+}
+
+// streamPayload follows the begin record in the streams of a Kernel
+type streamPayload struct {
+	Referenced uint64 `nvlist:"referenced"`
+	// Written is the amount of data written since the incremental source or in total for full
+	// streams
+	Written uint64 `nvlist:"written"`
+}
+
+// stream returns the send stream of the snapshot name, incremental from the snapshot or bookmark
+// from unless it is empty
+func (k *Kernel) stream(name, from string) ([]byte, error) {
+	p, to, err := k.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if to.kind() != kindSnapshot {
+		return nil, unix.EINVAL
+	}
+	b := beginRecord{creation: to.creation, typ: to.typ, toGUID: to.guid, toName: to.name}
+	payload := streamPayload{Referenced: to.referenced, Written: to.written}
+	if from != "" {
+		fromPool, f, err := k.lookup(from)
+		if err != nil {
+			return nil, err
+		}
+		if f.kind() == kindHead {
+			return nil, unix.EINVAL
+		}
+		// The incremental source needs to be an earlier snapshot in the history of the filesystem
+		if fromPool != p || !p.before(f, p.datasets[parentName(to.name)], to.createTxg-1) {
+			return nil, unix.EXDEV
+		}
+		b.fromGUID = f.guid
+		payload.Written -= f.written
+	}
+	var buf bytes.Buffer
+	buf.Write(b.marshal())
+	if err := nvlist.NewEncoder(&buf).Encode(payload); err != nil {
+		return nil, unix.EINVAL
+	}
+	return buf.Bytes(), nil
+}
+
+func (k *Kernel) sendSpace(r *request) (interface{}, error) {
+	var opts ioctl.SendSpaceOptions
+	if r.src != nil {
+		if err := r.decode(&opts); err != nil {
+			return nil, err
+		}
+	}
+	stream, err := k.stream(r.name, opts.From)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]uint64{"space": uint64(len(stream))}, nil
+}
+
+// send writes the stream into the file descriptor in the request. It is called without holding the
+// lock, since writing blocks until the stream is read.
+func (k *Kernel) send(r *request) (interface{}, error) {
+	var opts ioctl.SendOptions
+	if err := r.decode(&opts); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	stream, err := k.stream(r.name, opts.From)
+	k.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return nil, writeFd(int(opts.Fd), stream)
+}
+
+// recv receives a stream from the file descriptor in the request into a new snapshot. It is called
+// without holding the lock, since reading blocks until the stream is written.
+func (k *Kernel) recv(r *request) (interface{}, error) {
+	var opts ioctl.ReceiveOpts
+	if err := r.decode(&opts); err != nil {
+		return nil, err
+	}
+	var b beginRecord
+	if err := b.unmarshal(opts.BeginRecord); err != nil {
+		return nil, err
+	}
+	if err := validateName(opts.SnapshotName); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(opts.SnapshotName, "@") {
+		return nil, unix.EINVAL
+	}
+	// The file descriptor belongs to the caller, so it can't be wrapped in an os.File which would
+	// close it
+	in := &fdReader{fd: int(opts.Fd)}
+	var payload streamPayload
+	if err := nvlist.NewDecoder(in).Decode(&payload); err != nil {
+		if errno, ok := err.(unix.Errno); ok {
+			return nil, errno
+		}
+		return nil, unix.EINVAL
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	p, ok := k.pools[poolName(opts.SnapshotName)]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	if _, ok := p.datasets[opts.SnapshotName]; ok {
+		return nil, unix.EEXIST
+	}
+	fsName := parentName(opts.SnapshotName)
+	fs := p.datasets[fsName]
+	if b.fromGUID == 0 {
+		if fs != nil && (!opts.Force || p.latest(fsName) != nil) {
+			return nil, unix.EEXIST
+		}
+		if fs == nil {
+			var origin *dataset
+			if opts.Origin != "" {
+				originPool, o, err := k.lookup(opts.Origin)
+				if err != nil {
+					return nil, err
+				}
+				if originPool != p || o.kind() != kindSnapshot {
+					return nil, unix.EINVAL
+				}
+				origin = o
+			}
+			if _, err := k.checkNewHead(fsName); err != nil {
+				return nil, err
+			}
+			fs = k.newDataset(fsName, b.typ)
+			if origin != nil {
+				fs.origin = origin.guid
+			}
+			p.datasets[fsName] = fs
+		}
+		fs.written = payload.Written
+	} else {
+		if fs == nil {
+			return nil, unix.ENOENT
+		}
+		// The stream needs to continue from the newest snapshot
+		prev := p.previous(fs)
+		if prev == nil || prev.guid != b.fromGUID {
+			return nil, unix.ENODEV
+		}
+		if fs.written != prev.written && !opts.Force {
+			return nil, unix.ETXTBSY
+		}
+		fs.written = prev.written + payload.Written
+	}
+	fs.referenced = payload.Referenced
+	snap := k.snapshotOf(fs, opts.SnapshotName, k.nextTxg())
+	snap.guid = b.toGUID
+	snap.creation = b.creation
+	p.datasets[snap.name] = snap
+
+	// Props which can't be set don't fail the receive, they are reported in the response
+	res := ioctl.ReceiveError{ReadBytes: in.n, ErrorList: make(map[string]int32)}
+	setReceivedProps(opts.ReceivedProps, fs.received, res.ErrorList)
+	setReceivedProps(opts.LocalProps, fs.local, res.ErrorList)
+	return res, nil
+}
+
+// setReceivedProps stores the valid props into dst and the errors of the others in errs
+func setReceivedProps(props *ioctl.DatasetProps, dst map[string]interface{}, errs map[string]int32) {
+	if props == nil {
+		return
+	}
+	for name, v := range *props {
+		if err := validateProp(name, v, kindHead); err != nil {
+			errs[name] = int32(err.(unix.Errno))
+		} else {
+			dst[name] = v
+		}
+	}
+}
+
+// fdReader reads from a file descriptor and counts the bytes read
+type fdReader struct {
+	fd int
+	n  uint64
+}
+
+func (r *fdReader) Read(buf []byte) (int, error) {
+	for {
+		n, err := unix.Read(r.fd, buf)
+		switch err {
+		case nil:
+			if n == 0 && len(buf) > 0 {
+				return 0, io.EOF
+			}
+			r.n += uint64(n)
+			return n, nil
+		case unix.EINTR:
+		case unix.EAGAIN:
+			unix.Poll([]unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN}}, -1)
+		default:
+			return 0, err
+		}
+	}
+}
+
+// writeFd writes all of data into the file descriptor fd
+func writeFd(fd int, data []byte) error {
+	for len(data) > 0 {
+		n, err := unix.Write(fd, data)
+		switch err {
+		case nil:
+			data = data[n:]
+		case unix.EINTR:
+		case unix.EAGAIN:
+			unix.Poll([]unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}, -1)
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -11,45 +11,90 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// Transport issues raw ioctls for a Client. The name and all other arguments besides the nvlists are
+// set in cmd, src and conf contain the encoded request and config nvlists and dst is the buffer for
+// the response nvlist, each of them is nil if the ioctl doesn't use it. The Nvlist_* fields of cmd
+// are left for the Transport to fill in. Changes the kernel makes to cmd need to be applied to it.
+//
+// Errors of the kernel need to be returned as unix.Errno, a Client retries with a bigger dst on
+// ENOMEM. Transports can be fakes for testing, recorders, proxies to another process or middleware
+// wrapping another Transport. They need to be safe for concurrent use.
+type Transport interface {
+	Ioctl(ioctl Ioctl, cmd *Cmd, src, dst, conf []byte) error
+}
+
+// TransportFunc allows using an ordinary function as a Transport
+type TransportFunc func(ioctl Ioctl, cmd *Cmd, src, dst, conf []byte) error
+
+// Ioctl calls f
+func (f TransportFunc) Ioctl(ioctl Ioctl, cmd *Cmd, src, dst, conf []byte) error {
+	return f(ioctl, cmd, src, dst, conf)
+}
+
+// fdTransport issues ioctls with the ioctl syscall on a file descriptor
+type fdTransport uintptr
+
+func (fd fdTransport) Ioctl(ioctl Ioctl, cmd *Cmd, src, dst, conf []byte) error {
+	// WARNING: Here be dragons! This is completely outside of Go's safety net and uses various
+	// criticial runtime workarounds to make sure that memory is safely handled
+	if dst != nil {
+		cmd.Nvlist_dst = uint64(uintptr(unsafe.Pointer(&dst[0])))
+		cmd.Nvlist_dst_size = uint64(len(dst))
+	}
+	if src != nil {
+		cmd.Nvlist_src = uint64(uintptr(unsafe.Pointer(&src[0])))
+		cmd.Nvlist_src_size = uint64(len(src))
+	}
+	if conf != nil {
+		cmd.Nvlist_conf = uint64(uintptr(unsafe.Pointer(&conf[0])))
+		cmd.Nvlist_conf_size = uint64(len(conf))
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(ioctl), uintptr(unsafe.Pointer(cmd)))
+	runtime.KeepAlive(src)
+	runtime.KeepAlive(dst)
+	runtime.KeepAlive(cmd)
+	runtime.KeepAlive(conf)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 // NvlistIoctl issues a low-level ioctl syscall with only some common wrappers. All unsafety is contained in here.
 func NvlistIoctl(fd uintptr, ioctl Ioctl, name string, cmd *Cmd, request interface{}, response interface{}, config interface{}) error {
+	return transportIoctl(fdTransport(fd), ioctl, name, cmd, request, response, config)
+}
+
+// transportIoctl encodes the request and config nvlists, issues the ioctl on t and decodes the
+// response nvlist. Only ioctls with a response get a dst buffer and are retried with a bigger one on
+// ENOMEM, for all others ENOMEM can't be caused by the buffer and is returned as is.
+func transportIoctl(t Transport, ioctl Ioctl, name string, cmd *Cmd, request interface{}, response interface{}, config interface{}) error {
 	var src []byte
 	var configRaw []byte
 	var err error
+	// Identical calls always produce identical buffers, which makes them comparable with traces
+	opts := nvlist.EncoderOptions{Canonical: true}
 	if request != nil {
-		if src, err = nvlist.Marshal(request); err != nil {
+		if src, err = nvlist.MarshalWithOptions(request, opts); err != nil {
+			return err
+		}
+	}
+	if config != nil {
+		if configRaw, err = nvlist.MarshalWithOptions(config, opts); err != nil {
 			return err
 		}
 	}
-	dst := make([]byte, 8*1024)
+	var dst []byte
+	if response != nil {
+		dst = make([]byte, 8*1024)
+	}
 	for {
 		// This is necessary as some ioctl handlers modify the command buffer even though they
 		// later return ENOMEM and we retry the call.
 		privateCmd := *cmd
-		// WARNING: Here be dragons! This is completely outside of Go's safety net and uses various
-		// criticial runtime workarounds to make sure that memory is safely handled
-		if response != nil {
-			privateCmd.Nvlist_dst = uint64(uintptr(unsafe.Pointer(&dst[0])))
-			privateCmd.Nvlist_dst_size = uint64(len(dst))
-		}
-		if request != nil {
-			privateCmd.Nvlist_src = uint64(uintptr(unsafe.Pointer(&src[0])))
-			privateCmd.Nvlist_src_size = uint64(len(src))
-		}
-		if config != nil {
-			if configRaw, err = nvlist.Marshal(config); err != nil {
-				return err
-			}
-			privateCmd.Nvlist_conf = uint64(uintptr(unsafe.Pointer(&configRaw[0])))
-			privateCmd.Nvlist_conf_size = uint64(len(configRaw))
-		}
 		stringToDelimitedBuf(name, privateCmd.Name[:])
-		_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(ioctl), uintptr(unsafe.Pointer(&privateCmd)))
-		runtime.KeepAlive(src)
-		runtime.KeepAlive(dst)
-		runtime.KeepAlive(privateCmd)
-		runtime.KeepAlive(configRaw)
-		if errno == unix.ENOMEM {
+		err := t.Ioctl(ioctl, &privateCmd, src, dst, configRaw)
+		if err == unix.ENOMEM && dst != nil {
 			if len(dst) >= 16*1024*1024 {
 				return errors.New("return buffer is bigger than 16MiB, something probably went wrong")
 			}
@@ -57,8 +102,8 @@ func NvlistIoctl(fd uintptr, ioctl Ioctl, name string, cmd *Cmd, request interfa
 			continue
 		}
 		*cmd = privateCmd
-		if errno != 0 {
-			return errno
+		if err != nil {
+			return err
 		}
 		break
 	}
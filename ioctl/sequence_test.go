@@ -0,0 +1,237 @@
+package ioctl_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.dolansoft.org/lorenz/go-zfs/ioctl"
+	"git.dolansoft.org/lorenz/go-zfs/ioctl/fake"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// TestSequence runs against the ZFS kernel module if it is loaded and against the emulation in the
+// fake package otherwise
+func TestSequence(t *testing.T) {
+	baseLocation := "/dev/shm"
+
+	if _, err := os.Stat("/sys/module/zfs"); err == nil {
+		ioctl.Init("")
+	} else {
+		ioctl.InitTransport(fake.New())
+	}
+
+	fileLocation := filepath.Join(baseLocation, "test.img")
+	f, err := os.Create(fileLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(1e9); err != nil { // 1GiB
+		t.Fatal(err)
+	}
+	f.Close()
+
+	defer ioctl.PoolDestroy("tp1")
+	defer os.Remove(fileLocation)
+
+	err = ioctl.PoolCreate("tp1", map[string]uint64{}, ioctl.VDev{
+		Type: "root",
+		Children: []ioctl.VDev{
+			ioctl.VDev{
+				Type: "file",
+				Path: fileLocation,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolConfigs, err := ioctl.PoolConfigs()
+	assert.NoError(t, err)
+	assert.Contains(t, poolConfigs, "tp1")
+
+	_, _, _, _, err = ioctl.DatasetListNext("tp1", 0)
+	if err != unix.ESRCH {
+		t.Errorf("Dataset list of empty pool doesn't return ESRCH (instead %v)", err)
+	}
+
+	if err := ioctl.Create("tp1/test5", ioctl.ObjectTypeZFS, &ioctl.DatasetProps{"mountpoint": "legacy"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioctl.Create("tp1/test7", ioctl.ObjectTypeZFS, &ioctl.DatasetProps{"mountpoint": "legacy"}); err != nil {
+		t.Error(err)
+	}
+	err = ioctl.Create("tp1/test7/ml0", ioctl.ObjectTypeZFS, &ioctl.DatasetProps{"mountpoint": "legacy"})
+	assert.NoError(t, err)
+
+	props, err := ioctl.ObjsetStats("tp1/test5")
+	assert.NoError(t, err, "Failed to call ObjsetStats")
+
+	name, cookie, _, props, err := ioctl.DatasetListNext("tp1", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, props["mountpoint"].Value.(string), "legacy")
+	assert.Equal(t, props["type"].Value.(uint64), uint64(2))
+
+	name2, cookie, _, props, err := ioctl.DatasetListNext("tp1", cookie)
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, name2) // Test if cookies work
+
+	var findDatasetsRecursive func(prefix string, root bool) bool
+	findDatasetsRecursive = func(prefix string, root bool) bool {
+		cookie := uint64(0)
+		for {
+			var name string
+			name, cookie, _, _, err = ioctl.DatasetListNext(prefix, cookie)
+			if err == unix.ESRCH {
+				if root {
+					t.Error("Didn't find ml0 in listing")
+				}
+				return false
+			}
+			if err != nil {
+				t.Error(err)
+				t.FailNow()
+			}
+			if strings.Contains(name, "ml0") {
+				return true
+			}
+			if findDatasetsRecursive(name, false) {
+				return true
+			}
+		}
+	}
+
+	findDatasetsRecursive("tp1", true)
+
+	if err := ioctl.Rename("tp1/test7", "tp1/test6", false); err != nil {
+		t.Error(err)
+	}
+	if err := ioctl.Snapshot([]string{"tp1/test5@snap1", "tp1/test6@snap1"}, "tp1", nil); err != nil {
+		t.Error(err)
+	}
+	n, err := ioctl.SendSpace("tp1/test5@snap1", ioctl.SendSpaceOptions{Compress: true})
+	if err != nil {
+		t.Error(err)
+	}
+	if n == 0 {
+		t.Error(errors.New("size of snaphsot is 0"))
+	}
+	if err := ioctl.Clone("tp1/test5@snap1", "tp1/test9", nil); err != nil {
+		t.Error(err)
+	}
+	if err := ioctl.Snapshot([]string{"tp1/test5@snap2"}, "tp1", nil); err != nil {
+		t.Error(err)
+	}
+
+	written, err := ioctl.GetSpaceWritten("tp1/test5", "tp1/test5@snap2")
+	assert.NoError(t, err, "GetSpaceWritten failed")
+	assert.Zero(t, written, "written is not zero for a fresh snapshot")
+
+	n, err = ioctl.SendSpace("tp1/test5@snap2", ioctl.SendSpaceOptions{From: "tp1/test5@snap1"})
+	if err != nil {
+		t.Error(err)
+	}
+	if n == 0 {
+		t.Error(errors.New("size of snaphsot is 0"))
+	}
+
+	r, err := ioctl.Send("tp1/test5@snap2", ioctl.SendOptions{From: "tp1/test5@snap1"})
+	assert.NoError(t, err, "Failed to send snap2")
+	defer r.Close()
+
+	sendLocation := filepath.Join(baseLocation, "send.bin")
+	f, err = os.Create(sendLocation)
+	if err != nil {
+		t.Error(err)
+	}
+	defer f.Close()
+	defer os.Remove(sendLocation)
+	if _, err := io.Copy(f, r); err != nil {
+		t.Error(err)
+	}
+
+	r.Close()
+	f.Seek(0, io.SeekStart)
+
+	ioctl.Destroy("tp1/test5@snap2", ioctl.ObjectTypeAny, false)
+
+	w, err := ioctl.Receive("tp1", ioctl.ReceiveOpts{SnapshotName: "tp1/test5@snap2"})
+	assert.NoError(t, err, "Failed to start receive")
+	_, err = io.Copy(w, f)
+	assert.NoError(t, err, "Failed to receive data")
+	err = w.WaitAndClose()
+	assert.NoError(t, err, "Failed to complete receive")
+
+	props, err = ioctl.ObjsetStats("tp1/test5@snap2")
+	assert.NoError(t, err, "Failed to stat received snapshot")
+	assert.Equal(t, ioctl.ObjectType(props["type"].Value.(uint64)), ioctl.ObjectTypeZFS, "Invalid received object type")
+
+	r, err = ioctl.Send("tp1/test5@nonexistent", ioctl.SendOptions{})
+	if err == nil {
+		t.Error("Nonexistent send should immediately return an error")
+	}
+
+	if err := ioctl.StartStopScan("tp1", ioctl.ScanTypeScrub); err != nil {
+		t.Error(err)
+	}
+
+	// TODO: Look if scrub is running
+
+	if err := ioctl.RegenerateGUID("tp1"); err != nil {
+		t.Error(err)
+	}
+
+	configs, err := ioctl.PoolConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioctl.PoolExport("tp1", false, false); err != nil {
+		t.Fatal(err)
+	}
+	importConfig, err := nvlist.Get[map[string]interface{}](configs, "tp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioctl.PoolImport("tp1", importConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// TODO: Validate that GUID has changed
+
+	_, err = ioctl.PoolStats("tp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioctl.Destroy("tp1/test9", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+	if err := ioctl.Destroy("tp1/test5@snap1", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+	if err := ioctl.Destroy("tp1/test5@snap2", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+	if err := ioctl.Destroy("tp1/test6@snap1", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+	if err := ioctl.Destroy("tp1/test6/ml0", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+
+	if err := ioctl.Destroy("tp1/test6", ioctl.ObjectTypeAny, false); err != nil {
+		t.Error(err)
+	}
+	if err := ioctl.PoolDestroy("tp1"); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,13 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"syscall"
 
 	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist/nvjson"
 
 	"git.dolansoft.org/lorenz/go-zfs/ioctl"
 	"github.com/lunixbochs/struc"
@@ -85,11 +85,11 @@ func main() {
 					if _, err := syscall.PtracePeekData(pid, uintptr(cmd.Nvlist_src), rawSrc); err != nil {
 						panic(err)
 					}
-					src := new(interface{})
+					src := new(nvlist.List)
 					if err := nvlist.Unmarshal(rawSrc, src); err != nil {
 						panic(err)
 					}
-					srcJSON, err := json.MarshalIndent(src, "", "\t")
+					srcJSON, err := nvjson.MarshalIndent(src, "", "\t")
 					if err != nil {
 						panic(err)
 					}
@@ -101,11 +101,11 @@ func main() {
 					if _, err := syscall.PtracePeekData(pid, uintptr(cmd.Nvlist_dst), rawDst); err != nil {
 						panic(err)
 					}
-					dst := new(interface{})
+					dst := new(nvlist.List)
 					if err := nvlist.Unmarshal(rawDst, dst); err != nil {
 						panic(err)
 					}
-					dstJSON, err := json.MarshalIndent(dst, "", "\t")
+					dstJSON, err := nvjson.MarshalIndent(dst, "", "\t")
 					if err != nil {
 						panic(err)
 					}
@@ -116,11 +116,11 @@ func main() {
 					if _, err := syscall.PtracePeekData(pid, uintptr(cmd.Nvlist_conf), rawConf); err != nil {
 						panic(err)
 					}
-					conf := new(interface{})
+					conf := new(nvlist.List)
 					if err := nvlist.Unmarshal(rawConf, conf); err != nil {
 						panic(err)
 					}
-					confJSON, err := json.MarshalIndent(conf, "", "\t")
+					confJSON, err := nvjson.MarshalIndent(conf, "", "\t")
 					if err != nil {
 						panic(err)
 					}
@@ -195,6 +195,21 @@ const (
 
 type State uint64
 
+// MarshalNvlist encodes the state as the uint64 used by ZFS
+func (s State) MarshalNvlist() (interface{}, error) {
+	return uint64(s), nil
+}
+
+// UnmarshalNvlist decodes the state from the uint64 used by ZFS
+func (s *State) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	var raw uint64
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*s = State(raw)
+	return nil
+}
+
 const (
 	FailWait = iota
 	FailContinue
@@ -203,6 +218,21 @@ const (
 
 type FailMode uint64
 
+// MarshalNvlist encodes the fail mode as the uint64 used by ZFS
+func (f FailMode) MarshalNvlist() (interface{}, error) {
+	return uint64(f), nil
+}
+
+// UnmarshalNvlist decodes the fail mode from the uint64 used by ZFS
+func (f *FailMode) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	var raw uint64
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*f = FailMode(raw)
+	return nil
+}
+
 type ObjectType int32
 
 const (
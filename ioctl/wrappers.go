@@ -7,9 +7,12 @@ import (
 	"os"
 	"syscall"
 
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
 	"golang.org/x/sys/unix"
 )
 
+//go:generate go run ../cmd/nvlistgen -type VDev,PoolConfig,PoolProps,FilesystemProps,SendOptions,SendSpaceOptions,ReceiveOpts,ReceiveError,PropWithSource -output wrappers_nvlist.go
+
 // PropWithSource repesents a prop with source
 type PropWithSource struct {
 	Value  interface{} `nvlist:"value"`
@@ -28,15 +31,15 @@ type FilesystemProps struct {
 	SnapshotDirectoryEnabled bool                 `nvlist:"snapdir,asuint64"`
 	ACLInheritancePolicy     ACLInheritancePolicy `nvlist:"aclinherit,omitempty,default=4"`
 	DNodeSize                DNodeSize            `nvlist:"dnodesize,omitempty"`
-	Atime                    bool                 `nvlist:"atime,default=true"`
-	RelativeAtime            bool                 `nvlist:"relatime"`
+	Atime                    bool                 `nvlist:"atime,asuint64,default=true"`
+	RelativeAtime            bool                 `nvlist:"relatime,asuint64"`
 
 	// All props below do nothing here
-	Zoned     bool     `nvlist:"zoned"`
-	VirusScan bool     `nvlist:"vscan"`
-	Overlay   bool     `nvlist:"overlay"`
+	Zoned     bool     `nvlist:"zoned,asuint64"`
+	VirusScan bool     `nvlist:"vscan,asuint64"`
+	Overlay   bool     `nvlist:"overlay,asuint64"`
 	CanMount  CanMount `nvlist:"canmount,default=true"`
-	Mounted   bool     `nvlist:"mounted"`
+	Mounted   bool     `nvlist:"mounted,asuint64"`
 
 	Mountpoint string `nvlist:"mountpoint"`
 }
@@ -55,15 +58,15 @@ type PoolProps struct {
 	TemporaryName   string   `nvlist:"tname,omitempty"`
 	BootFS          string   `nvlist:"bootfs,omitempty"`
 	CacheFile       string   `nvlist:"cachefile,omitempty"`
-	ReadOnly        bool     `nvlist:"readonly,omitempty"`
-	Multihost       bool     `nvlist:"multihost,omitempty"`
+	ReadOnly        bool     `nvlist:"readonly,asuint64,omitempty"`
+	Multihost       bool     `nvlist:"multihost,asuint64,omitempty"`
 	Failmode        FailMode `nvlist:"failmode,omitempty"`
 	DedupDitto      uint64   `nvlist:"dedupditto,omitempty"`
 	AlignmentShift  uint64   `nvlist:"ashift,omitempty"`
-	Delegation      bool     `nvlist:"delegation,omitempty"`
-	Autoreplace     bool     `nvlist:"autoreplace,omitempty"`
-	ListSnapshots   bool     `nvlist:"listsnapshots,omitempty"`
-	Autoexpand      bool     `nvlist:"autoexpand,omitempty"`
+	Delegation      bool     `nvlist:"delegation,asuint64,omitempty"`
+	Autoreplace     bool     `nvlist:"autoreplace,asuint64,omitempty"`
+	ListSnapshots   bool     `nvlist:"listsnapshots,asuint64,omitempty"`
+	Autoexpand      bool     `nvlist:"autoexpand,asuint64,omitempty"`
 	MaxBlockSize    uint64   `nvlist:"maxblocksize,omitempty"`
 	MaxDnodeSize    uint64   `nvlist:"maxdnodesize,omitempty"`
 
@@ -87,25 +90,6 @@ type PoolProps struct {
 	DedupRatio    uint64 `nvlist:"dedupratio,ro"`
 }
 
-var zfsHandle *os.File
-
-// Init optionally creates and opens a ZFS handle, by default at "/dev/zfs", overridable by nodePath
-func Init(nodePath string) error {
-	if nodePath == "" {
-		nodePath = "/dev/zfs"
-	}
-	var err error
-	zfsHandle, err = os.Open(nodePath)
-	if os.IsNotExist(err) {
-		unix.Mknod(nodePath, 666, int(unix.Mkdev(10, 54)))
-	}
-	zfsHandle, err = os.Open(nodePath)
-	if err != nil {
-		return fmt.Errorf("Failed to open or create ZFS device node: %v", err)
-	}
-	return nil
-}
-
 type VDev struct {
 	IsLog               uint64 `nvlist:"is_log"`
 	DTL                 uint64 `nvlist:"DTL,omitempty"`
@@ -160,53 +144,53 @@ func stringToDelimitedBuf(str string, buf []byte) error {
 
 // DatasetListNext lists ZFS datsets under the dataset or zpool given by name. It only returns one dataset and
 // a cursor which can be used to get the next dataset in the list. The cursor value for the first element is 0.
-func DatasetListNext(name string, cursor uint64) (string, uint64, DMUObjectSetStats, DatasetPropsWithSource, error) {
+func (c *Client) DatasetListNext(name string, cursor uint64) (string, uint64, DMUObjectSetStats, DatasetPropsWithSource, error) {
 	cmd := &Cmd{
 		Cookie: cursor,
 	}
 	props := make(DatasetPropsWithSource)
-	if err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_DATASET_LIST_NEXT, name, cmd, nil, props, nil); err != nil {
+	if err := c.ioctl(ZFS_IOC_DATASET_LIST_NEXT, name, cmd, nil, props, nil); err != nil {
 		return "", 0, DMUObjectSetStats{}, props, err
 	}
 	return delimitedBufToString(cmd.Name[:]), cmd.Cookie, cmd.Objset_stats, props, nil
 }
 
 // SnapshotListNext lists ZFS snapshots under the dataset or zpool given by name. It works similar to DatsetListNext
-func SnapshotListNext(name string, cursor uint64, props interface{}) (string, uint64, DMUObjectSetStats, error) {
+func (c *Client) SnapshotListNext(name string, cursor uint64, props interface{}) (string, uint64, DMUObjectSetStats, error) {
 	cmd := &Cmd{
 		Cookie: cursor,
 	}
-	if err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_SNAPSHOT_LIST_NEXT, name, cmd, nil, props, nil); err != nil {
+	if err := c.ioctl(ZFS_IOC_SNAPSHOT_LIST_NEXT, name, cmd, nil, props, nil); err != nil {
 		return "", 0, DMUObjectSetStats{}, err
 	}
 	return delimitedBufToString(cmd.Name[:]), cmd.Cookie, cmd.Objset_stats, nil
 }
 
 // PoolCreate creates a new zpool with the given name, featues and devices
-func PoolCreate(name string, features map[string]uint64, config VDev) error {
+func (c *Client) PoolCreate(name string, features map[string]uint64, config VDev) error {
 	cmd := &Cmd{}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_CREATE, name, cmd, features, nil, config)
+	return c.ioctl(ZFS_IOC_POOL_CREATE, name, cmd, features, nil, config)
 }
 
 // PoolDestroy removes a zpool completely
-func PoolDestroy(name string) error {
+func (c *Client) PoolDestroy(name string) error {
 	cmd := &Cmd{}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_DESTROY, name, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_POOL_DESTROY, name, cmd, nil, nil, nil)
 }
 
 // PoolConfigs gets all pool configs
-func PoolConfigs() (map[string]interface{}, error) {
+func (c *Client) PoolConfigs() (map[string]interface{}, error) {
 	cmd := &Cmd{}
 	res := make(map[string]interface{})
-	err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_CONFIGS, "", cmd, nil, res, nil)
+	err := c.ioctl(ZFS_IOC_POOL_CONFIGS, "", cmd, nil, res, nil)
 	return res, err
 }
 
 // PoolStats gets statistics from a pool
-func PoolStats(name string) (map[string]interface{}, error) {
+func (c *Client) PoolStats(name string) (map[string]interface{}, error) {
 	cmd := &Cmd{}
 	res := make(map[string]interface{})
-	err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_STATS, name, cmd, nil, res, nil)
+	err := c.ioctl(ZFS_IOC_POOL_STATS, name, cmd, nil, res, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -217,11 +201,11 @@ func PoolStats(name string) (map[string]interface{}, error) {
 }
 
 // PoolImport imports a pool
-func PoolImport(name string, config map[string]interface{}, props map[string]interface{}) (map[string]interface{}, error) {
+func (c *Client) PoolImport(name string, config map[string]interface{}, props map[string]interface{}) (map[string]interface{}, error) {
 	cmd := &Cmd{}
 	cmd.Guid = config["pool_guid"].(uint64)
 	outConfig := make(map[string]interface{})
-	err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_IMPORT, name, cmd, props, outConfig, config)
+	err := c.ioctl(ZFS_IOC_POOL_IMPORT, name, cmd, props, outConfig, config)
 	if cmd.Cookie != 0 {
 		return nil, unix.Errno(cmd.Cookie)
 	}
@@ -229,7 +213,7 @@ func PoolImport(name string, config map[string]interface{}, props map[string]int
 }
 
 // PoolExport exports a pool
-func PoolExport(name string, force, hardForce bool) error {
+func (c *Client) PoolExport(name string, force, hardForce bool) error {
 	cmd := &Cmd{}
 	if force {
 		cmd.Cookie = 1
@@ -237,52 +221,57 @@ func PoolExport(name string, force, hardForce bool) error {
 	if hardForce {
 		cmd.Guid = 1
 	}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_EXPORT, name, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_POOL_EXPORT, name, cmd, nil, nil, nil)
 }
 
 // Promote replaces a ZFS filesystem with a clone of itself.
-func Promote(name string) (conflictingSnapshot string, err error) {
+func (c *Client) Promote(name string) (conflictingSnapshot string, err error) {
 	cmd := &Cmd{}
-	err = NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_PROMOTE, name, cmd, nil, nil, nil)
+	err = c.ioctl(ZFS_IOC_PROMOTE, name, cmd, nil, nil, nil)
 	conflictingSnapshot = delimitedBufToString(cmd.String[:])
 	return
 }
 
+// propsReq is embedded into the requests which create datasets
+type propsReq struct {
+	Props *DatasetProps `nvlist:"props"`
+}
+
 // Clone creates a new writable ZFS dataset from the given origin snapshot
-func Clone(origin string, name string, props *DatasetProps) error {
+func (c *Client) Clone(origin string, name string, props *DatasetProps) error {
 	var cloneReq struct {
-		Origin string        `nvlist:"origin"`
-		Props  *DatasetProps `nvlist:"props"`
+		Origin string `nvlist:"origin"`
+		propsReq
 	}
 	cloneReq.Origin = origin
 	cloneReq.Props = props
 	errList := make(map[string]int32)
 	cmd := &Cmd{}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_CLONE, name, cmd, cloneReq, errList, nil)
+	return c.ioctl(ZFS_IOC_CLONE, name, cmd, cloneReq, errList, nil)
 	// TODO: Partial failures using errList
 }
 
 // Create creates a new ZFS dataset
-func Create(name string, t ObjectType, props *DatasetProps) error {
+func (c *Client) Create(name string, t ObjectType, props *DatasetProps) error {
 	var createReq struct {
-		Type  ObjectType    `nvlist:"type"`
-		Props *DatasetProps `nvlist:"props"`
+		Type ObjectType `nvlist:"type"`
+		propsReq
 	}
 	createReq.Type = t
 	createReq.Props = props
 	cmd := &Cmd{}
 	createRes := make(map[string]int32)
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_CREATE, name, cmd, createReq, createRes, nil)
+	return c.ioctl(ZFS_IOC_CREATE, name, cmd, createReq, createRes, nil)
 }
 
 // Snapshot creates one or more snapshots of datasets on the same zpool. The names are in standard
 // ZFS syntax (dataset/subdataset@snapname).
-func Snapshot(names []string, pool string, props *DatasetProps) error {
+func (c *Client) Snapshot(names []string, pool string, props *DatasetProps) error {
 	var snapReq struct {
-		Snaps map[string]bool `nvlist:"snaps"`
-		Props *DatasetProps   `nvlist:"props"`
+		Snaps map[string]nvlist.Flag `nvlist:"snaps"`
+		propsReq
 	}
-	snapReq.Snaps = make(map[string]bool)
+	snapReq.Snaps = make(map[string]nvlist.Flag)
 	for _, name := range names {
 		if _, ok := snapReq.Snaps[name]; ok {
 			return errors.New("duplicate snapshot name")
@@ -292,42 +281,42 @@ func Snapshot(names []string, pool string, props *DatasetProps) error {
 	snapReq.Props = props
 	cmd := &Cmd{}
 	snapRes := make(map[string]int32)
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_SNAPSHOT, pool, cmd, snapReq, snapRes, nil)
+	return c.ioctl(ZFS_IOC_SNAPSHOT, pool, cmd, snapReq, snapRes, nil)
 	// TODO: Maybe there is an error in snapRes
 }
 
 // DestroySnapshots removes multiple snapshots in the same pool. By setting the defer option the
 // operation will be executed in the background after the function has returned.
-func DestroySnapshots(names []string, pool string, defer_ bool) error {
+func (c *Client) DestroySnapshots(names []string, pool string, defer_ bool) error {
 	var destroySnapReq struct {
-		Snaps map[string]bool `nvlist:"snaps"`
-		Defer bool            `nvlist:"defer"`
+		Snaps map[string]nvlist.Flag `nvlist:"snaps"`
+		Defer nvlist.Flag            `nvlist:"defer"`
 	}
-	destroySnapReq.Snaps = make(map[string]bool)
+	destroySnapReq.Snaps = make(map[string]nvlist.Flag)
 	for _, name := range names {
 		if _, ok := destroySnapReq.Snaps[name]; ok {
 			return errors.New("duplicate snapshot name")
 		}
 		destroySnapReq.Snaps[name] = true
 	}
-	destroySnapReq.Defer = defer_
+	destroySnapReq.Defer = nvlist.Flag(defer_)
 	errList := make(map[string]int32)
 	cmd := &Cmd{}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_CLONE, pool, cmd, destroySnapReq, errList, nil)
+	return c.ioctl(ZFS_IOC_DESTROY_SNAPS, pool, cmd, destroySnapReq, errList, nil)
 }
 
 // Bookmark creates ZFS bookmarks from snapshots. These are only available on ZoL 0.7+ and currently
 // only used for resumable send/receive, but will eventually be usable as a reference for incremental
 // sends.
-func Bookmark(snapshotsToBookmarks map[string]string) error {
+func (c *Client) Bookmark(snapshotsToBookmarks map[string]string) error {
 	errList := make(map[string]int32)
 	cmd := &Cmd{}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_BOOKMARK, "", cmd, snapshotsToBookmarks, errList, nil)
+	return c.ioctl(ZFS_IOC_BOOKMARK, "", cmd, snapshotsToBookmarks, errList, nil)
 	// TODO: Handle errList
 }
 
 // Rollback rolls back a ZFS dataset to a snapshot taken earlier
-func Rollback(name string, target string) (actualTarget string, err error) {
+func (c *Client) Rollback(name string, target string) (actualTarget string, err error) {
 	var req struct {
 		Target string `nvlist:"target,omitempty"`
 	}
@@ -336,7 +325,7 @@ func Rollback(name string, target string) (actualTarget string, err error) {
 		Target string `nvlist:"target"`
 	}
 	cmd := &Cmd{}
-	err = NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_ROLLBACK, name, cmd, req, res, nil)
+	err = c.ioctl(ZFS_IOC_ROLLBACK, name, cmd, req, &res, nil)
 	actualTarget = res.Target
 	return
 }
@@ -355,18 +344,18 @@ const (
 )
 
 // SetProp sets one or more props on a ZFS dataset.
-func SetProp(name string, props map[string]interface{}, source PropSource) error {
+func (c *Client) SetProp(name string, props map[string]interface{}, source PropSource) error {
 	cmd := &Cmd{
 		Cookie: uint64(source),
 	}
 	errList := make(map[string]int64)
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_SET_PROP, name, cmd, props, errList, nil)
+	return c.ioctl(ZFS_IOC_SET_PROP, name, cmd, props, errList, nil)
 	// TODO: Distinguish between partial and complete failures using errList
 }
 
 // InheritProp makes a prop inherit from its parent or reverts it to the received prop which is
 // being shadowed by a local prop (see PropSource).
-func InheritProp(name string, propName string, revertToReceived bool) error {
+func (c *Client) InheritProp(name string, propName string, revertToReceived bool) error {
 	var cookie uint64
 	if revertToReceived {
 		cookie = 1
@@ -377,22 +366,22 @@ func InheritProp(name string, propName string, revertToReceived bool) error {
 	if err := stringToDelimitedBuf(propName, cmd.Value[:]); err != nil {
 		return err
 	}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_INHERIT_PROP, name, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_INHERIT_PROP, name, cmd, nil, nil, nil)
 }
 
 // GetSpaceWritten returns the amount of bytes written into a dataset since the given snapshot was
 // taken. Also useful for determining if anything has changed in dataset since the snaphsot was taken.
-func GetSpaceWritten(dataset, snapshot string) (uint64, error) {
+func (c *Client) GetSpaceWritten(dataset, snapshot string) (uint64, error) {
 	cmd := &Cmd{}
 	stringToDelimitedBuf(snapshot, cmd.Value[:])
-	if err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_SPACE_WRITTEN, dataset, cmd, nil, nil, nil); err != nil {
+	if err := c.ioctl(ZFS_IOC_SPACE_WRITTEN, dataset, cmd, nil, nil, nil); err != nil {
 		return 0, err
 	}
 	return cmd.Cookie, nil
 }
 
 // Rename renames a dataset
-func Rename(oldName, newName string, recursive bool) error {
+func (c *Client) Rename(oldName, newName string, recursive bool) error {
 	var cookieVal uint64
 	if recursive {
 		cookieVal = 1
@@ -401,16 +390,16 @@ func Rename(oldName, newName string, recursive bool) error {
 		Cookie: cookieVal,
 	}
 	stringToDelimitedBuf(newName, cmd.Value[:])
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_RENAME, oldName, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_RENAME, oldName, cmd, nil, nil, nil)
 }
 
 // Destroy removes dataset irrevocably. If the deferred flag is given, the function will terminate
 // and the actuall removal will be processed asynchronously.
-func Destroy(name string, t ObjectType, deferred bool) error {
+func (c *Client) Destroy(name string, t ObjectType, deferred bool) error {
 	cmd := &Cmd{
 		Objset_type: uint64(t),
 	}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_DESTROY, name, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_DESTROY, name, cmd, nil, nil, nil)
 }
 
 // SendSpaceOptions contains all options for the SendSpace function
@@ -418,18 +407,18 @@ type SendSpaceOptions struct {
 	// From can contain an older snapshot for an incremental transfer
 	From string `nvlist:"from,omitempty"`
 	// These enable individual features for transfer space estimation
-	LargeBlocks bool `nvlist:"largeblockok"`
-	Embed       bool `nvlist:"embedok"`
-	Compress    bool `nvlist:"compressok"`
+	LargeBlocks nvlist.Flag `nvlist:"largeblockok"`
+	Embed       nvlist.Flag `nvlist:"embedok"`
+	Compress    nvlist.Flag `nvlist:"compressok"`
 }
 
 // SendSpace determines approximately how big a ZFS send stream will be
-func SendSpace(name string, options SendSpaceOptions) (uint64, error) {
+func (c *Client) SendSpace(name string, options SendSpaceOptions) (uint64, error) {
 	cmd := &Cmd{}
 	var spaceRes struct {
 		Space uint64 `nvlist:"space"`
 	}
-	if err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_SEND_SPACE, name, cmd, options, &spaceRes, nil); err != nil {
+	if err := c.ioctl(ZFS_IOC_SEND_SPACE, name, cmd, options, &spaceRes, nil); err != nil {
 		return 0, err
 	}
 	return spaceRes.Space, nil
@@ -498,15 +487,15 @@ type SendOptions struct {
 	FromBookmark string `nvlist:"redactbook,omitempty"`
 
 	// These enable individual features for the send stream
-	LargeBlocks bool `nvlist:"largeblockok"`
+	LargeBlocks nvlist.Flag `nvlist:"largeblockok"`
 	// Allows DRR_WRITE_EMBEDDED
-	Embed bool `nvlist:"embedok"`
+	Embed nvlist.Flag `nvlist:"embedok"`
 	// Allows compressed DRR_WRITE
-	Compress bool `nvlist:"compress"`
+	Compress nvlist.Flag `nvlist:"compressok"`
 	// Allows raw encrypted records
-	Raw bool `nvlist:"rawok"`
+	Raw nvlist.Flag `nvlist:"rawok"`
 	// Send a partially received snapshot
-	Saved bool `nvlist:"savedok"`
+	Saved nvlist.Flag `nvlist:"savedok"`
 
 	// These can optionally be set to resume a transfer (ZoL 0.7+)
 	ResumeObject uint64 `nvlist:"resume_object,omitempty"`
@@ -516,7 +505,7 @@ type SendOptions struct {
 // Send generates a stream containing either a full or an incremental snapshot. This function provides
 // some basic convenience wrappers including a fail-fast mode which returns an error directly if it
 // happens before a single byte is sent out and a Read-compatible output stream.
-func Send(name string, options SendOptions) (io.ReadCloser, error) {
+func (c *Client) Send(name string, options SendOptions) (io.ReadCloser, error) {
 	cmd := &Cmd{}
 
 	r, w, err := os.Pipe()
@@ -531,7 +520,7 @@ func Send(name string, options SendOptions) (io.ReadCloser, error) {
 	}
 
 	go func() {
-		err := NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_SEND_NEW, name, cmd, options, &struct{}{}, nil)
+		err := c.ioctl(ZFS_IOC_SEND_NEW, name, cmd, options, &struct{}{}, nil)
 		stream.errorChan <- err
 		w.Close()
 	}()
@@ -564,8 +553,8 @@ type ReceiveOpts struct {
 	// ActionHandle uint64 `nvlist:"action_handle"` -> Purpose is unknown, zero value is valid, currently not exposed
 
 	// The following are options
-	Force     bool `nvlist:"force"`
-	Resumable bool `nvlist:"resumable"`
+	Force     nvlist.Flag `nvlist:"force"`
+	Resumable nvlist.Flag `nvlist:"resumable"`
 }
 
 type ReceiveError struct {
@@ -635,7 +624,7 @@ func (r *ReceiveStream) WaitAndClose() error {
 }
 
 // Receive creates a snapshot from a stream generated by Send()
-func Receive(name string, opts ReceiveOpts) (*ReceiveStream, error) {
+func (c *Client) Receive(name string, opts ReceiveOpts) (*ReceiveStream, error) {
 	var beginRecordToReadBytes uint
 	if len(opts.BeginRecord) == 312 {
 		beginRecordToReadBytes = 0
@@ -663,7 +652,7 @@ func Receive(name string, opts ReceiveOpts) (*ReceiveStream, error) {
 			return
 		}
 		res := new(ReceiveError)
-		err = NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_RECV_NEW, name, cmd, opts, res, nil)
+		err = c.ioctl(ZFS_IOC_RECV_NEW, name, cmd, opts, res, nil)
 		if err != nil {
 			stream.errorChan <- err
 		} else if res.ErrorFlags != 0 {
@@ -677,28 +666,28 @@ func Receive(name string, opts ReceiveOpts) (*ReceiveStream, error) {
 }
 
 // PoolGetProps gets all props for a zpool
-func PoolGetProps(name string) (props interface{}, err error) {
+func (c *Client) PoolGetProps(name string) (props interface{}, err error) {
 	props = new(interface{})
 	cmd := &Cmd{}
-	err = NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_GET_PROPS, name, cmd, nil, props, nil)
+	err = c.ioctl(ZFS_IOC_POOL_GET_PROPS, name, cmd, nil, props, nil)
 	return
 }
 
 // ObjsetZPLProps gets all object set props
-func ObjsetZPLProps(name string) (props interface{}, err error) {
+func (c *Client) ObjsetZPLProps(name string) (props interface{}, err error) {
 	props = new(interface{})
 	cmd := &Cmd{}
-	if err = NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_OBJSET_ZPLPROPS, name, cmd, nil, props, nil); err != nil {
+	if err = c.ioctl(ZFS_IOC_OBJSET_ZPLPROPS, name, cmd, nil, props, nil); err != nil {
 		return
 	}
 	return
 }
 
 // ObjsetStats gets statistics on object sets
-func ObjsetStats(name string) (props DatasetPropsWithSource, err error) {
+func (c *Client) ObjsetStats(name string) (props DatasetPropsWithSource, err error) {
 	props = make(DatasetPropsWithSource)
 	cmd := &Cmd{}
-	if err = NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_OBJSET_STATS, name, cmd, nil, props, nil); err != nil {
+	if err = c.ioctl(ZFS_IOC_OBJSET_STATS, name, cmd, nil, props, nil); err != nil {
 		return
 	}
 	return
@@ -717,26 +706,26 @@ const (
 )
 
 // PauseScan pauses an active resilver or scrub operation.
-func PauseScan(pool string) error {
+func (c *Client) PauseScan(pool string) error {
 	cmd := &Cmd{
 		Flags: 1,
 	}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_SCAN, pool, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_POOL_SCAN, pool, cmd, nil, nil, nil)
 }
 
 // StartStopScan starts or stops a scrub or resilver operation. If the ScanType is set to ScanType none,
 // it will stop an active resilver or scrub operation, ScanTypeScrub and ScanTypeResilver will resume
 // or start a new operation (start is not supported for resilver)
-func StartStopScan(pool string, t ScanType) error {
+func (c *Client) StartStopScan(pool string, t ScanType) error {
 	cmd := &Cmd{
 		Cookie: uint64(t),
 	}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_SCAN, pool, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_POOL_SCAN, pool, cmd, nil, nil, nil)
 }
 
 // RegenerateGUID assigns a new GUID to the pool. Since this operation needs to write to all devices
 // the pool cannot be degraded or have missing devices.
-func RegenerateGUID(pool string) error {
+func (c *Client) RegenerateGUID(pool string) error {
 	cmd := &Cmd{}
-	return NvlistIoctl(zfsHandle.Fd(), ZFS_IOC_POOL_REGUID, pool, cmd, nil, nil, nil)
+	return c.ioctl(ZFS_IOC_POOL_REGUID, pool, cmd, nil, nil, nil)
 }
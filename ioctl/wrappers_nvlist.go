@@ -0,0 +1,1069 @@
+// Code generated by nvlistgen. DO NOT EDIT.
+
+package ioctl
+
+import "git.dolansoft.org/lorenz/go-zfs/nvlist"
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v VDev) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerVDev{&v}, nil
+}
+
+type nvlistMarshalerVDev struct{ v *VDev }
+
+func (m nvlistMarshalerVDev) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerVDev) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if err := w.Uint("is_log", nvlist.TypeUint64, m.v.IsLog); err != nil {
+		return err
+	}
+	if m.v.DTL != 0 {
+		if err := w.Uint("DTL", nvlist.TypeUint64, m.v.DTL); err != nil {
+			return err
+		}
+	}
+	if m.v.AlignmentShift != 0 {
+		if err := w.Uint("ashift", nvlist.TypeUint64, m.v.AlignmentShift); err != nil {
+			return err
+		}
+	}
+	if m.v.AllocatableCapacity != 0 {
+		if err := w.Uint("asize", nvlist.TypeUint64, m.v.AllocatableCapacity); err != nil {
+			return err
+		}
+	}
+	if m.v.GUID != 0 {
+		if err := w.Uint("guid", nvlist.TypeUint64, m.v.GUID); err != nil {
+			return err
+		}
+	}
+	if m.v.ID != 0 {
+		if err := w.Uint("id", nvlist.TypeUint64, m.v.ID); err != nil {
+			return err
+		}
+	}
+	if err := w.String("path", m.v.Path); err != nil {
+		return err
+	}
+	if err := w.String("type", m.v.Type); err != nil {
+		return err
+	}
+	if err := w.Value("children", m.v.Children, true, false); err != nil {
+		return err
+	}
+	if err := w.Value("l2cache", m.v.L2CacheChildren, true, false); err != nil {
+		return err
+	}
+	if err := w.Value("spares", m.v.SparesChildren, true, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *VDev) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerVDev{v: v})
+}
+
+type nvlistUnmarshalerVDev struct {
+	v *VDev
+}
+
+func (u *nvlistUnmarshalerVDev) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "is_log":
+		if x, ok := p.Uint(64); ok {
+			u.v.IsLog = x
+		}
+	case "DTL":
+		if x, ok := p.Uint(64); ok {
+			u.v.DTL = x
+		}
+	case "ashift":
+		if x, ok := p.Uint(64); ok {
+			u.v.AlignmentShift = x
+		}
+	case "asize":
+		if x, ok := p.Uint(64); ok {
+			u.v.AllocatableCapacity = x
+		}
+	case "guid":
+		if x, ok := p.Uint(64); ok {
+			u.v.GUID = x
+		}
+	case "id":
+		if x, ok := p.Uint(64); ok {
+			u.v.ID = x
+		}
+	case "path":
+		if x, ok := p.String(); ok {
+			u.v.Path = x
+		}
+	case "type":
+		if x, ok := p.String(); ok {
+			u.v.Type = x
+		}
+	case "children":
+		return p.Decode(&u.v.Children, false)
+	case "l2cache":
+		return p.Decode(&u.v.L2CacheChildren, false)
+	case "spares":
+		return p.Decode(&u.v.SparesChildren, false)
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerVDev) EndNvlist(flags uint32) error {
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v PoolConfig) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerPoolConfig{&v}, nil
+}
+
+type nvlistMarshalerPoolConfig struct{ v *PoolConfig }
+
+func (m nvlistMarshalerPoolConfig) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerPoolConfig) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if m.v.Version != 0 {
+		if err := w.Uint("version", nvlist.TypeUint64, m.v.Version); err != nil {
+			return err
+		}
+	}
+	if m.v.Name != "" {
+		if err := w.String("name", m.v.Name); err != nil {
+			return err
+		}
+	}
+	if m.v.State != 0 {
+		if err := w.Uint("state", nvlist.TypeUint64, m.v.State); err != nil {
+			return err
+		}
+	}
+	if m.v.TXG != 0 {
+		if err := w.Uint("txg", nvlist.TypeUint64, m.v.TXG); err != nil {
+			return err
+		}
+	}
+	if m.v.GUID != 0 {
+		if err := w.Uint("pool_guid", nvlist.TypeUint64, m.v.GUID); err != nil {
+			return err
+		}
+	}
+	if m.v.Errata != 0 {
+		if err := w.Uint("errata", nvlist.TypeUint64, m.v.Errata); err != nil {
+			return err
+		}
+	}
+	if m.v.Hostname != "" {
+		if err := w.String("hostname", m.v.Hostname); err != nil {
+			return err
+		}
+	}
+	if err := w.Uint("vdev_children", nvlist.TypeUint64, m.v.NumberOfChildren); err != nil {
+		return err
+	}
+	if err := w.Value("vdev_tree", m.v.VDevTree, false, false); err != nil {
+		return err
+	}
+	if m.v.HostID != 0 {
+		if err := w.Uint("hostid", nvlist.TypeUint64, m.v.HostID); err != nil {
+			return err
+		}
+	}
+	if err := w.Value("features_for_read", m.v.FeaturesForRead, false, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *PoolConfig) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerPoolConfig{v: v})
+}
+
+type nvlistUnmarshalerPoolConfig struct {
+	v *PoolConfig
+}
+
+func (u *nvlistUnmarshalerPoolConfig) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "version":
+		if x, ok := p.Uint(64); ok {
+			u.v.Version = x
+		}
+	case "name":
+		if x, ok := p.String(); ok {
+			u.v.Name = x
+		}
+	case "state":
+		if x, ok := p.Uint(64); ok {
+			u.v.State = x
+		}
+	case "txg":
+		if x, ok := p.Uint(64); ok {
+			u.v.TXG = x
+		}
+	case "pool_guid":
+		if x, ok := p.Uint(64); ok {
+			u.v.GUID = x
+		}
+	case "errata":
+		if x, ok := p.Uint(64); ok {
+			u.v.Errata = x
+		}
+	case "hostname":
+		if x, ok := p.String(); ok {
+			u.v.Hostname = x
+		}
+	case "vdev_children":
+		if x, ok := p.Uint(64); ok {
+			u.v.NumberOfChildren = x
+		}
+	case "vdev_tree":
+		return p.Decode(&u.v.VDevTree, false)
+	case "hostid":
+		if x, ok := p.Uint(64); ok {
+			u.v.HostID = x
+		}
+	case "features_for_read":
+		return p.Decode(&u.v.FeaturesForRead, false)
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerPoolConfig) EndNvlist(flags uint32) error {
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v PoolProps) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerPoolProps{&v}, nil
+}
+
+type nvlistMarshalerPoolProps struct{ v *PoolProps }
+
+func (m nvlistMarshalerPoolProps) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerPoolProps) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if m.v.Name != "" {
+		if err := w.String("name", m.v.Name); err != nil {
+			return err
+		}
+	}
+	if m.v.Version != 0 {
+		if err := w.Uint("version", nvlist.TypeUint64, m.v.Version); err != nil {
+			return err
+		}
+	}
+	if m.v.Comment != "" {
+		if err := w.String("comment", m.v.Comment); err != nil {
+			return err
+		}
+	}
+	if m.v.AlternativeRoot != "" {
+		if err := w.String("altroot", m.v.AlternativeRoot); err != nil {
+			return err
+		}
+	}
+	if m.v.TemporaryName != "" {
+		if err := w.String("tname", m.v.TemporaryName); err != nil {
+			return err
+		}
+	}
+	if m.v.BootFS != "" {
+		if err := w.String("bootfs", m.v.BootFS); err != nil {
+			return err
+		}
+	}
+	if m.v.CacheFile != "" {
+		if err := w.String("cachefile", m.v.CacheFile); err != nil {
+			return err
+		}
+	}
+	if m.v.ReadOnly {
+		if err := w.BoolUint64("readonly", m.v.ReadOnly); err != nil {
+			return err
+		}
+	}
+	if m.v.Multihost {
+		if err := w.BoolUint64("multihost", m.v.Multihost); err != nil {
+			return err
+		}
+	}
+	if err := w.Value("failmode", m.v.Failmode, true, false); err != nil {
+		return err
+	}
+	if m.v.DedupDitto != 0 {
+		if err := w.Uint("dedupditto", nvlist.TypeUint64, m.v.DedupDitto); err != nil {
+			return err
+		}
+	}
+	if m.v.AlignmentShift != 0 {
+		if err := w.Uint("ashift", nvlist.TypeUint64, m.v.AlignmentShift); err != nil {
+			return err
+		}
+	}
+	if m.v.Delegation {
+		if err := w.BoolUint64("delegation", m.v.Delegation); err != nil {
+			return err
+		}
+	}
+	if m.v.Autoreplace {
+		if err := w.BoolUint64("autoreplace", m.v.Autoreplace); err != nil {
+			return err
+		}
+	}
+	if m.v.ListSnapshots {
+		if err := w.BoolUint64("listsnapshots", m.v.ListSnapshots); err != nil {
+			return err
+		}
+	}
+	if m.v.Autoexpand {
+		if err := w.BoolUint64("autoexpand", m.v.Autoexpand); err != nil {
+			return err
+		}
+	}
+	if m.v.MaxBlockSize != 0 {
+		if err := w.Uint("maxblocksize", nvlist.TypeUint64, m.v.MaxBlockSize); err != nil {
+			return err
+		}
+	}
+	if m.v.MaxDnodeSize != 0 {
+		if err := w.Uint("maxdnodesize", nvlist.TypeUint64, m.v.MaxDnodeSize); err != nil {
+			return err
+		}
+	}
+	if err := w.Value("root-props-nvl", m.v.RootProps, true, false); err != nil {
+		return err
+	}
+	if err := w.Extra(m.v.User, m.isField); err != nil {
+		return err
+	}
+	return nil
+}
+
+// isField checks if there is a field for the given nvpair name
+func (m nvlistMarshalerPoolProps) isField(name string) bool {
+	switch name {
+	case "name", "version", "comment", "altroot", "tname", "bootfs", "cachefile", "readonly", "multihost", "failmode", "dedupditto", "ashift", "delegation", "autoreplace", "listsnapshots", "autoexpand", "maxblocksize", "maxdnodesize", "root-props-nvl", "size", "free", "freeing", "leaked", "allocated", "expandsize", "fragmentation", "capacity", "guid", "health", "dedupratio":
+		return true
+	}
+	return false
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *PoolProps) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerPoolProps{v: v})
+}
+
+type nvlistUnmarshalerPoolProps struct {
+	v *PoolProps
+}
+
+func (u *nvlistUnmarshalerPoolProps) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "name":
+		if x, ok := p.String(); ok {
+			u.v.Name = x
+		}
+	case "version":
+		if x, ok := p.Uint(64); ok {
+			u.v.Version = x
+		}
+	case "comment":
+		if x, ok := p.String(); ok {
+			u.v.Comment = x
+		}
+	case "altroot":
+		if x, ok := p.String(); ok {
+			u.v.AlternativeRoot = x
+		}
+	case "tname":
+		if x, ok := p.String(); ok {
+			u.v.TemporaryName = x
+		}
+	case "bootfs":
+		if x, ok := p.String(); ok {
+			u.v.BootFS = x
+		}
+	case "cachefile":
+		if x, ok := p.String(); ok {
+			u.v.CacheFile = x
+		}
+	case "readonly":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.ReadOnly = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.ReadOnly = x
+		}
+	case "multihost":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Multihost = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Multihost = x
+		}
+	case "failmode":
+		return p.Decode(&u.v.Failmode, false)
+	case "dedupditto":
+		if x, ok := p.Uint(64); ok {
+			u.v.DedupDitto = x
+		}
+	case "ashift":
+		if x, ok := p.Uint(64); ok {
+			u.v.AlignmentShift = x
+		}
+	case "delegation":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Delegation = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Delegation = x
+		}
+	case "autoreplace":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Autoreplace = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Autoreplace = x
+		}
+	case "listsnapshots":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.ListSnapshots = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.ListSnapshots = x
+		}
+	case "autoexpand":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Autoexpand = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Autoexpand = x
+		}
+	case "maxblocksize":
+		if x, ok := p.Uint(64); ok {
+			u.v.MaxBlockSize = x
+		}
+	case "maxdnodesize":
+		if x, ok := p.Uint(64); ok {
+			u.v.MaxDnodeSize = x
+		}
+	case "root-props-nvl":
+		return p.Decode(&u.v.RootProps, false)
+	case "size":
+		if x, ok := p.Uint(64); ok {
+			u.v.Size = x
+		}
+	case "free":
+		if x, ok := p.Uint(64); ok {
+			u.v.Free = x
+		}
+	case "freeing":
+		if x, ok := p.Uint(64); ok {
+			u.v.Freeing = x
+		}
+	case "leaked":
+		if x, ok := p.Uint(64); ok {
+			u.v.Leaked = x
+		}
+	case "allocated":
+		if x, ok := p.Uint(64); ok {
+			u.v.Allocated = x
+		}
+	case "expandsize":
+		if x, ok := p.Uint(64); ok {
+			u.v.ExpandSize = x
+		}
+	case "fragmentation":
+		if x, ok := p.Uint(64); ok {
+			u.v.Fragmentation = x
+		}
+	case "capacity":
+		if x, ok := p.Uint(64); ok {
+			u.v.Capacity = x
+		}
+	case "guid":
+		if x, ok := p.Uint(64); ok {
+			u.v.GUID = x
+		}
+	case "health":
+		return p.Decode(&u.v.Health, false)
+	case "dedupratio":
+		if x, ok := p.Uint(64); ok {
+			u.v.DedupRatio = x
+		}
+	default:
+		return p.DecodeExtra(&u.v.User)
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerPoolProps) EndNvlist(flags uint32) error {
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v FilesystemProps) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerFilesystemProps{&v}, nil
+}
+
+type nvlistMarshalerFilesystemProps struct{ v *FilesystemProps }
+
+func (m nvlistMarshalerFilesystemProps) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerFilesystemProps) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if err := w.BoolUint64("snapdir", m.v.SnapshotDirectoryEnabled); err != nil {
+		return err
+	}
+	if m.v.ACLInheritancePolicy != 0 {
+		if err := w.Uint("aclinherit", nvlist.TypeUint64, uint64(m.v.ACLInheritancePolicy)); err != nil {
+			return err
+		}
+	}
+	if m.v.DNodeSize != 0 {
+		if err := w.Uint("dnodesize", nvlist.TypeUint64, uint64(m.v.DNodeSize)); err != nil {
+			return err
+		}
+	}
+	if err := w.BoolUint64("atime", m.v.Atime); err != nil {
+		return err
+	}
+	if err := w.BoolUint64("relatime", m.v.RelativeAtime); err != nil {
+		return err
+	}
+	if err := w.BoolUint64("zoned", m.v.Zoned); err != nil {
+		return err
+	}
+	if err := w.BoolUint64("vscan", m.v.VirusScan); err != nil {
+		return err
+	}
+	if err := w.BoolUint64("overlay", m.v.Overlay); err != nil {
+		return err
+	}
+	if err := w.Uint("canmount", nvlist.TypeUint64, uint64(m.v.CanMount)); err != nil {
+		return err
+	}
+	if err := w.BoolUint64("mounted", m.v.Mounted); err != nil {
+		return err
+	}
+	if err := w.String("mountpoint", m.v.Mountpoint); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *FilesystemProps) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerFilesystemProps{v: v})
+}
+
+type nvlistUnmarshalerFilesystemProps struct {
+	v                        *FilesystemProps
+	seenACLInheritancePolicy bool
+	seenAtime                bool
+	seenCanMount             bool
+}
+
+func (u *nvlistUnmarshalerFilesystemProps) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "snapdir":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.SnapshotDirectoryEnabled = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.SnapshotDirectoryEnabled = x
+		}
+	case "aclinherit":
+		u.seenACLInheritancePolicy = true
+		if x, ok := p.Uint(64); ok {
+			u.v.ACLInheritancePolicy = ACLInheritancePolicy(x)
+		}
+	case "dnodesize":
+		if x, ok := p.Uint(64); ok {
+			u.v.DNodeSize = DNodeSize(x)
+		}
+	case "atime":
+		u.seenAtime = true
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Atime = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Atime = x
+		}
+	case "relatime":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.RelativeAtime = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.RelativeAtime = x
+		}
+	case "zoned":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Zoned = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Zoned = x
+		}
+	case "vscan":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.VirusScan = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.VirusScan = x
+		}
+	case "overlay":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Overlay = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Overlay = x
+		}
+	case "canmount":
+		u.seenCanMount = true
+		if x, ok := p.Uint(64); ok {
+			u.v.CanMount = CanMount(x)
+		}
+	case "mounted":
+		if p.Type() == nvlist.TypeUint64 {
+			if x, ok := p.Uint(64); ok {
+				u.v.Mounted = x != 0
+			}
+		} else if x, ok := p.Bool(); ok {
+			u.v.Mounted = x
+		}
+	case "mountpoint":
+		if x, ok := p.String(); ok {
+			u.v.Mountpoint = x
+		}
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerFilesystemProps) EndNvlist(flags uint32) error {
+	if !u.seenACLInheritancePolicy {
+		u.v.ACLInheritancePolicy = 4
+	}
+	if !u.seenAtime {
+		u.v.Atime = true
+	}
+	if !u.seenCanMount {
+		u.v.CanMount = 1
+	}
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v SendOptions) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerSendOptions{&v}, nil
+}
+
+type nvlistMarshalerSendOptions struct{ v *SendOptions }
+
+func (m nvlistMarshalerSendOptions) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerSendOptions) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if err := w.Int("fd", nvlist.TypeInt32, int64(m.v.Fd)); err != nil {
+		return err
+	}
+	if m.v.From != "" {
+		if err := w.String("fromsnap", m.v.From); err != nil {
+			return err
+		}
+	}
+	if m.v.FromBookmark != "" {
+		if err := w.String("redactbook", m.v.FromBookmark); err != nil {
+			return err
+		}
+	}
+	if err := w.Bool("largeblockok", bool(m.v.LargeBlocks)); err != nil {
+		return err
+	}
+	if err := w.Bool("embedok", bool(m.v.Embed)); err != nil {
+		return err
+	}
+	if err := w.Bool("compressok", bool(m.v.Compress)); err != nil {
+		return err
+	}
+	if err := w.Bool("rawok", bool(m.v.Raw)); err != nil {
+		return err
+	}
+	if err := w.Bool("savedok", bool(m.v.Saved)); err != nil {
+		return err
+	}
+	if m.v.ResumeObject != 0 {
+		if err := w.Uint("resume_object", nvlist.TypeUint64, m.v.ResumeObject); err != nil {
+			return err
+		}
+	}
+	if m.v.ResumeOffset != 0 {
+		if err := w.Uint("resume_offset", nvlist.TypeUint64, m.v.ResumeOffset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *SendOptions) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerSendOptions{v: v})
+}
+
+type nvlistUnmarshalerSendOptions struct {
+	v *SendOptions
+}
+
+func (u *nvlistUnmarshalerSendOptions) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "fd":
+		if x, ok := p.Int(32); ok {
+			u.v.Fd = int32(x)
+		}
+	case "fromsnap":
+		if x, ok := p.String(); ok {
+			u.v.From = x
+		}
+	case "redactbook":
+		if x, ok := p.String(); ok {
+			u.v.FromBookmark = x
+		}
+	case "largeblockok":
+		if x, ok := p.Bool(); ok {
+			u.v.LargeBlocks = nvlist.Flag(x)
+		}
+	case "embedok":
+		if x, ok := p.Bool(); ok {
+			u.v.Embed = nvlist.Flag(x)
+		}
+	case "compressok":
+		if x, ok := p.Bool(); ok {
+			u.v.Compress = nvlist.Flag(x)
+		}
+	case "rawok":
+		if x, ok := p.Bool(); ok {
+			u.v.Raw = nvlist.Flag(x)
+		}
+	case "savedok":
+		if x, ok := p.Bool(); ok {
+			u.v.Saved = nvlist.Flag(x)
+		}
+	case "resume_object":
+		if x, ok := p.Uint(64); ok {
+			u.v.ResumeObject = x
+		}
+	case "resume_offset":
+		if x, ok := p.Uint(64); ok {
+			u.v.ResumeOffset = x
+		}
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerSendOptions) EndNvlist(flags uint32) error {
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v SendSpaceOptions) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerSendSpaceOptions{&v}, nil
+}
+
+type nvlistMarshalerSendSpaceOptions struct{ v *SendSpaceOptions }
+
+func (m nvlistMarshalerSendSpaceOptions) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerSendSpaceOptions) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if m.v.From != "" {
+		if err := w.String("from", m.v.From); err != nil {
+			return err
+		}
+	}
+	if err := w.Bool("largeblockok", bool(m.v.LargeBlocks)); err != nil {
+		return err
+	}
+	if err := w.Bool("embedok", bool(m.v.Embed)); err != nil {
+		return err
+	}
+	if err := w.Bool("compressok", bool(m.v.Compress)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *SendSpaceOptions) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerSendSpaceOptions{v: v})
+}
+
+type nvlistUnmarshalerSendSpaceOptions struct {
+	v *SendSpaceOptions
+}
+
+func (u *nvlistUnmarshalerSendSpaceOptions) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "from":
+		if x, ok := p.String(); ok {
+			u.v.From = x
+		}
+	case "largeblockok":
+		if x, ok := p.Bool(); ok {
+			u.v.LargeBlocks = nvlist.Flag(x)
+		}
+	case "embedok":
+		if x, ok := p.Bool(); ok {
+			u.v.Embed = nvlist.Flag(x)
+		}
+	case "compressok":
+		if x, ok := p.Bool(); ok {
+			u.v.Compress = nvlist.Flag(x)
+		}
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerSendSpaceOptions) EndNvlist(flags uint32) error {
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v ReceiveOpts) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerReceiveOpts{&v}, nil
+}
+
+type nvlistMarshalerReceiveOpts struct{ v *ReceiveOpts }
+
+func (m nvlistMarshalerReceiveOpts) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerReceiveOpts) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if m.v.Origin != "" {
+		if err := w.String("origin", m.v.Origin); err != nil {
+			return err
+		}
+	}
+	if err := w.String("snapname", m.v.SnapshotName); err != nil {
+		return err
+	}
+	if err := w.Value("props", m.v.ReceivedProps, false, false); err != nil {
+		return err
+	}
+	if err := w.Value("localprops", m.v.LocalProps, false, false); err != nil {
+		return err
+	}
+	if err := w.Value("hidden_args", m.v.HiddenArgs, false, false); err != nil {
+		return err
+	}
+	if err := w.Int("input_fd", nvlist.TypeInt32, int64(m.v.Fd)); err != nil {
+		return err
+	}
+	if err := w.Value("begin_record", m.v.BeginRecord, false, false); err != nil {
+		return err
+	}
+	if m.v.CleanupFd != 0 {
+		if err := w.Int("cleanup_fd", nvlist.TypeInt32, int64(m.v.CleanupFd)); err != nil {
+			return err
+		}
+	}
+	if err := w.Bool("force", bool(m.v.Force)); err != nil {
+		return err
+	}
+	if err := w.Bool("resumable", bool(m.v.Resumable)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *ReceiveOpts) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerReceiveOpts{v: v})
+}
+
+type nvlistUnmarshalerReceiveOpts struct {
+	v *ReceiveOpts
+}
+
+func (u *nvlistUnmarshalerReceiveOpts) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "origin":
+		if x, ok := p.String(); ok {
+			u.v.Origin = x
+		}
+	case "snapname":
+		if x, ok := p.String(); ok {
+			u.v.SnapshotName = x
+		}
+	case "props":
+		return p.Decode(&u.v.ReceivedProps, false)
+	case "localprops":
+		return p.Decode(&u.v.LocalProps, false)
+	case "hidden_args":
+		return p.Decode(&u.v.HiddenArgs, false)
+	case "input_fd":
+		if x, ok := p.Int(32); ok {
+			u.v.Fd = int32(x)
+		}
+	case "begin_record":
+		return p.Decode(&u.v.BeginRecord, false)
+	case "cleanup_fd":
+		if x, ok := p.Int(32); ok {
+			u.v.CleanupFd = int32(x)
+		}
+	case "force":
+		if x, ok := p.Bool(); ok {
+			u.v.Force = nvlist.Flag(x)
+		}
+	case "resumable":
+		if x, ok := p.Bool(); ok {
+			u.v.Resumable = nvlist.Flag(x)
+		}
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerReceiveOpts) EndNvlist(flags uint32) error {
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v ReceiveError) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerReceiveError{&v}, nil
+}
+
+type nvlistMarshalerReceiveError struct{ v *ReceiveError }
+
+func (m nvlistMarshalerReceiveError) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerReceiveError) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if err := w.Uint("read_bytes", nvlist.TypeUint64, m.v.ReadBytes); err != nil {
+		return err
+	}
+	if err := w.Uint("error_flags", nvlist.TypeUint64, m.v.ErrorFlags); err != nil {
+		return err
+	}
+	if err := w.Value("errors", m.v.ErrorList, false, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *ReceiveError) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerReceiveError{v: v})
+}
+
+type nvlistUnmarshalerReceiveError struct {
+	v *ReceiveError
+}
+
+func (u *nvlistUnmarshalerReceiveError) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "read_bytes":
+		if x, ok := p.Uint(64); ok {
+			u.v.ReadBytes = x
+		}
+	case "error_flags":
+		if x, ok := p.Uint(64); ok {
+			u.v.ErrorFlags = x
+		}
+	case "errors":
+		return p.Decode(&u.v.ErrorList, false)
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerReceiveError) EndNvlist(flags uint32) error {
+	return nil
+}
+
+// MarshalNvlist encodes v using code generated from its nvlist tags
+func (v PropWithSource) MarshalNvlist() (interface{}, error) {
+	return nvlistMarshalerPropWithSource{&v}, nil
+}
+
+type nvlistMarshalerPropWithSource struct{ v *PropWithSource }
+
+func (m nvlistMarshalerPropWithSource) NvlistFlags() (uint32, bool) {
+	return 0, false
+}
+
+func (m nvlistMarshalerPropWithSource) MarshalNvpairs(w *nvlist.PairWriter) error {
+	if err := w.Value("value", m.v.Value, false, false); err != nil {
+		return err
+	}
+	if err := w.String("source", m.v.Source); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalNvlist decodes v using code generated from its nvlist tags
+func (v *PropWithSource) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return unmarshal(&nvlistUnmarshalerPropWithSource{v: v})
+}
+
+type nvlistUnmarshalerPropWithSource struct {
+	v *PropWithSource
+}
+
+func (u *nvlistUnmarshalerPropWithSource) UnmarshalNvpair(p *nvlist.PairReader) error {
+	switch p.Name() {
+	case "value":
+		return p.Decode(&u.v.Value, false)
+	case "source":
+		if x, ok := p.String(); ok {
+			u.v.Source = x
+		}
+	default:
+		return p.Unknown()
+	}
+	return nil
+}
+
+func (u *nvlistUnmarshalerPropWithSource) EndNvlist(flags uint32) error {
+	return nil
+}
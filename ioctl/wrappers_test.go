@@ -1,225 +1,243 @@
 package ioctl
 
 import (
-	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/stretchr/testify/assert"
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
 	"golang.org/x/sys/unix"
 )
 
-func TestSequence(t *testing.T) {
-	baseLocation := "/dev/shm"
-
-	Init("")
-
-	fileLocation := filepath.Join(baseLocation, "test.img")
-	f, err := os.Create(fileLocation)
-	if err != nil {
-		t.Fatal(err)
+func TestClientClose(t *testing.T) {
+	// Missing nodes are created as character devices, which needs CAP_MKNOD
+	nodePath := filepath.Join(t.TempDir(), "zfs")
+	if c, err := Open(nodePath); err == nil {
+		c.Close()
+		if info, err := os.Stat(nodePath); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			t.Errorf("created node is not a character device: %v, %v", info, err)
+		}
 	}
 
-	if err := f.Truncate(1e9); err != nil { // 1GiB
+	f, err := os.CreateTemp(t.TempDir(), "zfs")
+	if err != nil {
 		t.Fatal(err)
 	}
 	f.Close()
-
-	defer PoolDestroy("tp1")
-	defer os.Remove(fileLocation)
-
-	err = PoolCreate("tp1", map[string]uint64{}, VDev{
-		Type: "root",
-		Children: []VDev{
-			VDev{
-				Type: "file",
-				Path: fileLocation,
-			},
-		},
-	})
+	c, err := Open(f.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	poolConfigs, err := PoolConfigs()
-	assert.NoError(t, err)
-	assert.Contains(t, poolConfigs, "tp1")
-
-	_, _, _, _, err = DatasetListNext("tp1", 0)
-	if err != unix.ESRCH {
-		t.Errorf("Dataset list of empty pool doesn't return ESRCH (instead %v)", err)
+	if err := c.PoolDestroy("tp1"); err != unix.ENOTTY {
+		t.Errorf("expected ENOTTY from a regular file, got %v", err)
 	}
-
-	if err := Create("tp1/test5", ObjectTypeZFS, &DatasetProps{"mountpoint": "legacy"}); err != nil {
+	if err := c.Close(); err != nil {
 		t.Fatal(err)
 	}
-	if err := Create("tp1/test7", ObjectTypeZFS, &DatasetProps{"mountpoint": "legacy"}); err != nil {
-		t.Error(err)
+	if err := c.PoolDestroy("tp1"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	if err := c.Close(); err != ErrClosed {
+		t.Errorf("expected ErrClosed when closing twice, got %v", err)
 	}
-	err = Create("tp1/test7/ml0", ObjectTypeZFS, &DatasetProps{"mountpoint": "legacy"})
-	assert.NoError(t, err)
-
-	props, err := ObjsetStats("tp1/test5")
-	assert.NoError(t, err, "Failed to call ObjsetStats")
-
-	name, cookie, _, props, err := DatasetListNext("tp1", 0)
-	assert.NoError(t, err)
-	assert.Equal(t, props["mountpoint"].Value.(string), "legacy")
-	assert.Equal(t, props["type"].Value.(uint64), uint64(2))
 
-	name2, cookie, _, props, err := DatasetListNext("tp1", cookie)
-	assert.NoError(t, err)
-	assert.NotEqual(t, name, name2) // Test if cookies work
+	defaultMu.Lock()
+	previous := defaultHandle
+	defaultHandle = &Client{err: ErrNotInitialized}
+	defaultMu.Unlock()
+	defer func() {
+		defaultMu.Lock()
+		defaultHandle = previous
+		defaultMu.Unlock()
+	}()
+	if _, err := PoolConfigs(); err != ErrNotInitialized {
+		t.Errorf("expected ErrNotInitialized before Init, got %v", err)
+	}
+}
 
-	var findDatasetsRecursive func(prefix string, root bool) bool
-	findDatasetsRecursive = func(prefix string, root bool) bool {
-		cookie := uint64(0)
-		for {
-			var name string
-			name, cookie, _, _, err = DatasetListNext(prefix, cookie)
-			if err == unix.ESRCH {
-				if root {
-					t.Error("Didn't find ml0 in listing")
-				}
-				return false
-			}
+func TestTransport(t *testing.T) {
+	configs := map[string]interface{}{
+		"tp1": map[string]interface{}{"name": "tp1", "comment": strings.Repeat("x", 10000)},
+	}
+	configCalls, exportCalls := 0, 0
+	c := NewClient(TransportFunc(func(ioctl Ioctl, cmd *Cmd, src, dst, conf []byte) error {
+		switch ioctl {
+		case ZFS_IOC_POOL_CONFIGS:
+			configCalls++
+			out, err := nvlist.Marshal(configs)
 			if err != nil {
-				t.Error(err)
-				t.FailNow()
+				return err
+			}
+			if len(out) > len(dst) {
+				return unix.ENOMEM
+			}
+			copy(dst, out)
+			return nil
+		case ZFS_IOC_CREATE:
+			var req struct {
+				Type  ObjectType   `nvlist:"type"`
+				Props DatasetProps `nvlist:"props"`
 			}
-			if strings.Contains(name, "ml0") {
-				return true
+			if err := nvlist.Unmarshal(src, &req); err != nil {
+				return err
 			}
-			if findDatasetsRecursive(name, false) {
-				return true
+			if name := delimitedBufToString(cmd.Name[:]); name != "tp1/test5" || req.Type != ObjectTypeZFS || req.Props["mountpoint"] != "legacy" || conf != nil {
+				t.Errorf("unexpected create request for %q: %+v", name, req)
 			}
+			return unix.EEXIST
+		case ZFS_IOC_POOL_EXPORT:
+			exportCalls++
+			if dst != nil {
+				t.Errorf("unexpected response buffer for export")
+			}
+			return unix.ENOMEM
 		}
-	}
+		return unix.ENOTSUP
+	}))
 
-	findDatasetsRecursive("tp1", true)
-
-	if err := Rename("tp1/test7", "tp1/test6", false); err != nil {
-		t.Error(err)
-	}
-	if err := Snapshot([]string{"tp1/test5@snap1", "tp1/test6@snap1"}, "tp1", nil); err != nil {
-		t.Error(err)
-	}
-	n, err := SendSpace("tp1/test5@snap1", SendSpaceOptions{Compress: true})
+	res, err := c.PoolConfigs()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if n == 0 {
-		t.Error(errors.New("size of snaphsot is 0"))
+	if comment, err := nvlist.Get[string](res, "tp1.comment"); err != nil || len(comment) != 10000 {
+		t.Errorf("unexpected pool configs %v, %v", res, err)
 	}
-	if err := Clone("tp1/test5@snap1", "tp1/test9", nil); err != nil {
-		t.Error(err)
+	if configCalls != 2 {
+		t.Errorf("expected a retry with a bigger buffer, got %d calls", configCalls)
 	}
-	if err := Snapshot([]string{"tp1/test5@snap2"}, "tp1", nil); err != nil {
-		t.Error(err)
+	if err := c.Create("tp1/test5", ObjectTypeZFS, &DatasetProps{"mountpoint": "legacy"}); err != unix.EEXIST {
+		t.Errorf("expected EEXIST, got %v", err)
 	}
-
-	written, err := GetSpaceWritten("tp1/test5", "tp1/test5@snap2")
-	assert.NoError(t, err, "GetSpaceWritten failed")
-	assert.Zero(t, written, "written is not zero for a fresh snapshot")
-
-	n, err = SendSpace("tp1/test5@snap2", SendSpaceOptions{From: "tp1/test5@snap1"})
-	if err != nil {
-		t.Error(err)
+	// Without a response there is no buffer to grow, so ENOMEM isn't retried
+	if err := c.PoolExport("tp1", false, false); err != unix.ENOMEM || exportCalls != 1 {
+		t.Errorf("expected ENOMEM after a single call, got %v after %d calls", err, exportCalls)
 	}
-	if n == 0 {
-		t.Error(errors.New("size of snaphsot is 0"))
+	if err := c.PoolDestroy("tp1"); err != unix.ENOTSUP {
+		t.Errorf("expected ENOTSUP, got %v", err)
 	}
+}
 
-	r, err := Send("tp1/test5@snap2", SendOptions{From: "tp1/test5@snap1"})
-	assert.NoError(t, err, "Failed to send snap2")
-	defer r.Close()
+// closerTransport is a TransportFunc which records when it is closed
+type closerTransport struct {
+	TransportFunc
+	closed chan struct{}
+}
 
-	sendLocation := filepath.Join(baseLocation, "send.bin")
-	f, err = os.Create(sendLocation)
-	if err != nil {
-		t.Error(err)
+func (t *closerTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func TestClientCloseWhileSending(t *testing.T) {
+	release := make(chan struct{})
+	transport := &closerTransport{closed: make(chan struct{})}
+	transport.TransportFunc = func(ioctl Ioctl, cmd *Cmd, src, dst, conf []byte) error {
+		if ioctl != ZFS_IOC_SEND_NEW {
+			return unix.ENOTSUP
+		}
+		var opts SendOptions
+		if err := nvlist.Unmarshal(src, &opts); err != nil {
+			return err
+		}
+		// Send returns after the first byte, the rest of the stream is written after Close
+		if _, err := unix.Write(int(opts.Fd), []byte{1}); err != nil {
+			return err
+		}
+		<-release
+		_, err := unix.Write(int(opts.Fd), []byte{2, 3})
+		return err
 	}
-	defer f.Close()
-	defer os.Remove(sendLocation)
-	if _, err := io.Copy(f, r); err != nil {
-		t.Error(err)
+	c := NewClient(transport)
+	stream, err := c.Send("tp1/fs@s1", SendOptions{})
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer stream.Close()
 
-	r.Close()
-	f.Seek(0, io.SeekStart)
-
-	Destroy("tp1/test5@snap2", ObjectTypeAny, false)
-
-	w, err := Receive("tp1", ReceiveOpts{SnapshotName: "tp1/test5@snap2"})
-	assert.NoError(t, err, "Failed to start receive")
-	_, err = io.Copy(w, f)
-	assert.NoError(t, err, "Failed to receive data")
-	err = w.WaitAndClose()
-	assert.NoError(t, err, "Failed to complete receive")
-
-	props, err = ObjsetStats("tp1/test5@snap2")
-	assert.NoError(t, err, "Failed to stat received snapshot")
-	assert.Equal(t, ObjectType(props["type"].Value.(uint64)), ObjectTypeZFS, "Invalid received object type")
-
-	r, err = Send("tp1/test5@nonexistent", SendOptions{})
-	if err == nil {
-		t.Error("Nonexistent send should immediately return an error")
+	closeErr := make(chan error, 1)
+	go func() { closeErr <- c.Close() }()
+	select {
+	case err := <-closeErr:
+		if err != nil {
+			t.Errorf("failed to close with a running send: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close waits for the running send")
 	}
-
-	if err := StartStopScan("tp1", ScanTypeScrub); err != nil {
-		t.Error(err)
+	if err := c.PoolDestroy("tp1"); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
 	}
-
-	// TODO: Look if scrub is running
-
-	if err := RegenerateGUID("tp1"); err != nil {
-		t.Error(err)
+	select {
+	case <-transport.closed:
+		t.Error("transport closed while the send is still running")
+	default:
 	}
 
-	configs, err := PoolConfigs()
-	if err != nil {
-		t.Fatal(err)
+	close(release)
+	data, err := io.ReadAll(stream)
+	if err != nil || string(data) != "\x01\x02\x03" {
+		t.Errorf("unexpected stream %v, %v", data, err)
 	}
-
-	if err := PoolExport("tp1", false, false); err != nil {
-		t.Fatal(err)
+	select {
+	case <-transport.closed:
+	default:
+		t.Error("transport not closed after the send finished")
 	}
-	importConfig := configs["tp1"].(map[string]interface{})
+}
 
-	if _, err := PoolImport("tp1", importConfig, nil); err != nil {
-		t.Fatal(err)
+func TestBoolPropsAsUint64(t *testing.T) {
+	// ZFS only accepts string and uint64 values for native props, boolean props like atime are
+	// index props and fail with EINVAL if they are passed as boolean_value.
+	tests := []struct {
+		props interface{}
+		names []string
+	}{
+		{
+			props: FilesystemProps{Atime: true, RelativeAtime: true, Zoned: true, VirusScan: true, Overlay: true, Mounted: true},
+			names: []string{"atime", "relatime", "zoned", "vscan", "overlay", "mounted"},
+		},
+		{
+			props: PoolProps{ReadOnly: true, Multihost: true, Delegation: true, Autoreplace: true, ListSnapshots: true, Autoexpand: true},
+			names: []string{"readonly", "multihost", "delegation", "autoreplace", "listsnapshots", "autoexpand"},
+		},
 	}
+	for _, test := range tests {
+		data, err := nvlist.Marshal(test.props)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pairs map[string]interface{}
+		if err := nvlist.Unmarshal(data, &pairs); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range test.names {
+			if v, ok := pairs[name].(uint64); !ok || v != 1 {
+				t.Errorf("%v: got %#v, want uint64(1)", name, pairs[name])
+			}
+		}
+	}
+}
 
-	// TODO: Validate that GUID has changed
-
-	_, err = PoolStats("tp1")
+func TestSendOptionsFlags(t *testing.T) {
+	// zfs_ioc_send_new only reads compressok, the compress key used before was ignored
+	data, err := nvlist.Marshal(SendOptions{Fd: 3, Compress: true, Embed: true})
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if err := Destroy("tp1/test9", ObjectTypeAny, false); err != nil {
-		t.Error(err)
-	}
-	if err := Destroy("tp1/test5@snap1", ObjectTypeAny, false); err != nil {
-		t.Error(err)
-	}
-	if err := Destroy("tp1/test5@snap2", ObjectTypeAny, false); err != nil {
-		t.Error(err)
-	}
-	if err := Destroy("tp1/test6@snap1", ObjectTypeAny, false); err != nil {
-		t.Error(err)
-	}
-	if err := Destroy("tp1/test6/ml0", ObjectTypeAny, false); err != nil {
-		t.Error(err)
+	var pairs map[string]interface{}
+	if err := nvlist.Unmarshal(data, &pairs); err != nil {
+		t.Fatal(err)
 	}
-
-	if err := Destroy("tp1/test6", ObjectTypeAny, false); err != nil {
-		t.Error(err)
+	expected := map[string]interface{}{"fd": int32(3), "compressok": true, "embedok": true}
+	if len(pairs) != len(expected) {
+		t.Errorf("got %v, expected %v", pairs, expected)
 	}
-	if err := PoolDestroy("tp1"); err != nil {
-		t.Error(err)
+	for name, v := range expected {
+		if pairs[name] != v {
+			t.Errorf("%v: got %#v, expected %#v", name, pairs[name], v)
+		}
 	}
 }
@@ -1,88 +1,157 @@
 package nvlist
 
-import "reflect"
+import (
+	"fmt"
+	"reflect"
+)
 
-type nvtype uint32
+// Type is the type of an nvpair on the wire (data_type_t)
+type Type uint32
 
+// All nvpair types supported by ZFS
 const (
-	typeUnknown nvtype = iota
-	typeBoolean
-	typeByte
-	typeInt16
-	typeUint16
-	typeInt32
-	typeUint32
-	typeInt64
-	typeUint64
-	typeString
-	typeByteArray
-	typeInt16Array
-	typeUint16Array
-	typeInt32Array
-	typeUint32Array
-	typeInt64Array
-	typeUint64Array
-	typeStringArray
-	typeHrtime
-	typeNvlist
-	typeNvlistArray
-	typeBooleanValue
-	typeInt8
-	typeUint8
-	typeBooleanArray
-	typeInt8Array
-	typeUint8Array
-	typeDouble
+	TypeUnknown Type = iota
+	TypeBoolean
+	TypeByte
+	TypeInt16
+	TypeUint16
+	TypeInt32
+	TypeUint32
+	TypeInt64
+	TypeUint64
+	TypeString
+	TypeByteArray
+	TypeInt16Array
+	TypeUint16Array
+	TypeInt32Array
+	TypeUint32Array
+	TypeInt64Array
+	TypeUint64Array
+	TypeStringArray
+	TypeHrtime
+	TypeNvlist
+	TypeNvlistArray
+	TypeBooleanValue
+	TypeInt8
+	TypeUint8
+	TypeBooleanArray
+	TypeInt8Array
+	TypeUint8Array
+	TypeDouble
 )
 
+var typeNames = [...]string{
+	TypeUnknown:      "unknown",
+	TypeBoolean:      "boolean",
+	TypeByte:         "byte",
+	TypeInt16:        "int16",
+	TypeUint16:       "uint16",
+	TypeInt32:        "int32",
+	TypeUint32:       "uint32",
+	TypeInt64:        "int64",
+	TypeUint64:       "uint64",
+	TypeString:       "string",
+	TypeByteArray:    "byte_array",
+	TypeInt16Array:   "int16_array",
+	TypeUint16Array:  "uint16_array",
+	TypeInt32Array:   "int32_array",
+	TypeUint32Array:  "uint32_array",
+	TypeInt64Array:   "int64_array",
+	TypeUint64Array:  "uint64_array",
+	TypeStringArray:  "string_array",
+	TypeHrtime:       "hrtime",
+	TypeNvlist:       "nvlist",
+	TypeNvlistArray:  "nvlist_array",
+	TypeBooleanValue: "boolean_value",
+	TypeInt8:         "int8",
+	TypeUint8:        "uint8",
+	TypeBooleanArray: "boolean_array",
+	TypeInt8Array:    "int8_array",
+	TypeUint8Array:   "uint8_array",
+	TypeDouble:       "double",
+}
+
+// String returns the name of the type as used by libnvpair (for example "uint64" or "nvlist_array")
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("Type(%d)", uint32(t))
+}
+
 const nvlistHeaderSize = 16
-const uniqueNameFlag = 0x01
+const nvlistSize = 24
 
-var nvtypeFromKindMap = map[reflect.Kind]nvtype{
-	reflect.Bool:    typeBooleanValue,
-	reflect.Int8:    typeInt8,
-	reflect.Int16:   typeInt16,
-	reflect.Int32:   typeInt32,
-	reflect.Int64:   typeInt64,
-	reflect.Uint8:   typeByte, // Special case, probably needs override
-	reflect.Uint16:  typeUint16,
-	reflect.Uint32:  typeUint32,
-	reflect.Uint64:  typeUint64,
-	reflect.Float64: typeDouble,
-	reflect.Map:     typeNvlist,
-	reflect.String:  typeString,
-	reflect.Struct:  typeNvlist,
+// Flags of an nvlist (nvflag). They tell libnvpair which existing pairs to replace when a pair is
+// added, lists with none of them set can contain any number of pairs with the same name.
+const (
+	// UniqueName lists contain at most one pair with any given name (NV_UNIQUE_NAME)
+	UniqueName uint32 = 0x01
+	// UniqueNameType lists contain at most one pair with any given name and type
+	// (NV_UNIQUE_NAME_TYPE)
+	UniqueNameType uint32 = 0x02
+)
+
+var nvtypeFromKindMap = map[reflect.Kind]Type{
+	reflect.Bool:    TypeBooleanValue,
+	reflect.Int8:    TypeInt8,
+	reflect.Int16:   TypeInt16,
+	reflect.Int32:   TypeInt32,
+	reflect.Int64:   TypeInt64,
+	reflect.Uint8:   TypeByte, // Special case, probably needs override
+	reflect.Uint16:  TypeUint16,
+	reflect.Uint32:  TypeUint32,
+	reflect.Uint64:  TypeUint64,
+	reflect.Float64: TypeDouble,
+	reflect.Map:     TypeNvlist,
+	reflect.String:  TypeString,
+	reflect.Struct:  TypeNvlist,
 }
 
-var nvtypeFromArrayKindMap = map[reflect.Kind]nvtype{
-	reflect.Bool:   typeBooleanArray,
-	reflect.Int8:   typeInt8Array,
-	reflect.Int16:  typeInt16Array,
-	reflect.Int32:  typeInt32Array,
-	reflect.Int64:  typeInt64Array,
-	reflect.Uint8:  typeByteArray, // Special case, probably needs override
-	reflect.Uint16: typeUint16Array,
-	reflect.Uint32: typeUint32Array,
-	reflect.Uint64: typeUint64Array,
-	reflect.Map:    typeNvlistArray,
-	reflect.String: typeStringArray,
-	reflect.Struct: typeNvlistArray,
+var nvtypeFromArrayKindMap = map[reflect.Kind]Type{
+	reflect.Bool:   TypeBooleanArray,
+	reflect.Int8:   TypeInt8Array,
+	reflect.Int16:  TypeInt16Array,
+	reflect.Int32:  TypeInt32Array,
+	reflect.Int64:  TypeInt64Array,
+	reflect.Uint8:  TypeByteArray, // Special case, probably needs override
+	reflect.Uint16: TypeUint16Array,
+	reflect.Uint32: TypeUint32Array,
+	reflect.Uint64: TypeUint64Array,
+	reflect.Map:    TypeNvlistArray,
+	reflect.String: TypeStringArray,
+	reflect.Struct: TypeNvlistArray,
 }
 
-// nvtypeFromKind gets the nvtype from the given reflect kind for non-compound types
-func nvtypeFromKind(kind reflect.Kind) nvtype {
+// nvtypeFromKind gets the Type from the given reflect kind for non-compound types
+func nvtypeFromKind(kind reflect.Kind) Type {
 	t, ok := nvtypeFromKindMap[kind]
 	if !ok {
-		return typeUnknown
+		return TypeUnknown
 	}
 	return t
 }
 
-// nvtypeFromArrayKind gets the nvtype for an array of the given reflect kind
-func nvtypeFromArrayKind(kind reflect.Kind) nvtype {
+// nvtypeFromArrayKind gets the Type for an array of the given reflect kind
+func nvtypeFromArrayKind(kind reflect.Kind) Type {
 	t, ok := nvtypeFromArrayKindMap[kind]
 	if !ok {
-		return typeUnknown
+		return TypeUnknown
 	}
 	return t
 }
+
+// nvtypeSize returns the size in bytes of a single element of the given type in native encoding
+func nvtypeSize(t Type) int {
+	switch t {
+	case TypeByte, TypeInt8, TypeUint8, TypeByteArray, TypeInt8Array, TypeUint8Array:
+		return 1
+	case TypeInt16, TypeUint16, TypeInt16Array, TypeUint16Array:
+		return 2
+	case TypeInt32, TypeUint32, TypeBooleanValue, TypeInt32Array, TypeUint32Array, TypeBooleanArray:
+		return 4
+	case TypeInt64, TypeUint64, TypeHrtime, TypeDouble, TypeInt64Array, TypeUint64Array:
+		return 8
+	}
+	return 0
+}
@@ -1,21 +1,25 @@
 // Package nvlist implements encoding and decoding of ZFS-style nvlists with an interface similar to
-// that of encoding/json. It supports "native" encoding and parts of XDR in both big and little endian.
+// that of encoding/json. It supports both "native" and XDR encoding in big and little endian.
 package nvlist
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 	"reflect"
-	"strings"
 )
 
 var (
-	ErrInvalidEncoding  = errors.New("this nvlist is not in native encoding")
+	ErrInvalidEncoding  = errors.New("this nvlist is neither in native nor in XDR encoding")
 	ErrInvalidEndianess = errors.New("this nvlist is neither in big nor in little endian")
 	ErrInvalidData      = errors.New("this nvlist contains invalid data")
 	ErrInvalidValue     = errors.New("the value provided to unmarshal contains invalid types")
-	ErrUnsupportedType  = errors.New("this nvlist contains an unsupported type (hrtime)")
+	ErrUnsupportedType  = errors.New("this nvlist contains an unsupported type")
+	ErrUnknownField     = errors.New("the nvpair has no corresponding struct field")
+	ErrLimitExceeded    = errors.New("this nvlist exceeds the configured limits")
+	ErrDuplicateName    = errors.New("this nvlist contains duplicate names its flags don't allow")
 	errEndOfData        = errors.New("end of data")
 )
 
@@ -25,21 +29,114 @@ type Encoding uint8
 const (
 	// EncodingNative is used in syscalls and cache files
 	EncodingNative Encoding = 0x00
-	// EncodingXDR is used on-disk (and is not actually XDR)
+	// EncodingXDR is used on-disk, for example in vdev labels
 	EncodingXDR  Encoding = 0x01
 	bigEndian             = 0x00
 	littleEndian          = 0x01
 )
 
-// Unmarshal parses a ZFS-style nvlist in native encoding and with any endianness
+// Unmarshaler is implemented by types which control how they are decoded from an nvlist.
+// UnmarshalNvlist gets called with a function which decodes the nvpair value (or the whole nvlist
+// at the top level) into the value it is given, which needs to be a non-nil pointer. It can be called
+// multiple times, for example to try different types. If it isn't called, the value is skipped.
+type Unmarshaler interface {
+	UnmarshalNvlist(unmarshal func(interface{}) error) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// DecoderOptions contains all options for decoding nvlists
+type DecoderOptions struct {
+	// Strict rejects nvpairs which have no corresponding struct field, duplicate names in nvlists
+	// flagged UniqueName or UniqueNameType and trailing data after the nvlist. By default these are
+	// ignored. It also rejects numeric conversions which lose precision (ErrLossyConversion),
+	// which are otherwise rounded or truncated.
+	Strict bool
+
+	// The following limits protect against crafted nvlists, for example in untrusted cache files or
+	// vdev labels. Exceeding them results in ErrLimitExceeded. Zero values select the defaults
+	// below, negative values disable a limit.
+
+	// MaxTotalSize is the maximum size of a single nvlist in bytes
+	MaxTotalSize int
+	// MaxDepth is the maximum number of nvlists nested into each other below the top-level one
+	MaxDepth int
+	// MaxArrayLen is the maximum number of elements of an array nvpair
+	MaxArrayLen int
+	// MaxStringLen is the maximum length of a string in bytes, names included
+	MaxStringLen int
+}
+
+// Defaults for the limits in DecoderOptions
+const (
+	// DefaultMaxTotalSize is also the maximum size of nvlists passed to the ZFS kernel module
+	DefaultMaxTotalSize = 128 << 20
+	DefaultMaxDepth     = 64
+	DefaultMaxArrayLen  = 65535
+	DefaultMaxStringLen = 1 << 20
+)
+
+const maxInt = int(^uint(0) >> 1)
+
+// limit returns the effective value of a limit in DecoderOptions
+func limit(value, def int) int {
+	switch {
+	case value == 0:
+		return def
+	case value < 0:
+		return maxInt
+	}
+	return value
+}
+
+// Unmarshal parses a ZFS-style nvlist in native or XDR encoding and with any endianness. val needs
+// to be a non-nil pointer or map. If an nvlist contains several pairs with the same name, the last
+// one wins in structs and maps, a List keeps all of them. All errors are of type *DecodeError.
 func Unmarshal(data []byte, val interface{}) error {
+	return UnmarshalWithOptions(data, val, DecoderOptions{})
+}
+
+// UnmarshalWithOptions parses a ZFS-style nvlist like Unmarshal with the given options
+func UnmarshalWithOptions(data []byte, val interface{}, opts DecoderOptions) error {
+	if len(data) > limit(opts.MaxTotalSize, DefaultMaxTotalSize) {
+		return &DecodeError{Err: ErrLimitExceeded}
+	}
 	s := nvlistReader{
-		nvlist: data,
+		nvlist:       data,
+		strict:       opts.Strict,
+		maxDepth:     limit(opts.MaxDepth, DefaultMaxDepth),
+		maxArrayLen:  limit(opts.MaxArrayLen, DefaultMaxArrayLen),
+		maxStringLen: limit(opts.MaxStringLen, DefaultMaxStringLen),
 	}
 	if err := s.readNvHeader(); err != nil {
+		return &DecodeError{Err: err}
+	}
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Map || v.IsNil() {
+		return &DecodeError{GoType: reflect.TypeOf(val), Err: ErrInvalidValue}
+	}
+	var u Unmarshaler
+	if v.Kind() == reflect.Ptr {
+		u = unmarshalerOf(v)
+	}
+	if u != nil {
+		err := s.callUnmarshaler(u, nil, nil, TypeNvlist, func(dst reflect.Value) error {
+			if !canHoldNvlist(dst.Type()) {
+				s.saveTypeError(nil, TypeNvlist, dst.Type().Elem())
+				dst = reflect.New(emptyInterfaceType)
+			}
+			return s.readPairs(dst, nil, s.flags)
+		})
+		if err != nil {
+			return err
+		}
+	} else if err := s.readPairs(v, nil, s.flags); err != nil {
 		return err
 	}
-	return s.readPairs(reflect.ValueOf(val))
+	if s.strict && s.currentByte != len(s.nvlist) {
+		return &DecodeError{Err: ErrInvalidData}
+	}
+	return s.typeError
 }
 
 type nvlistReader struct {
@@ -49,6 +146,15 @@ type nvlistReader struct {
 	encoding    Encoding
 	flags       uint32
 	version     int32
+	strict      bool
+	// typeError is the first type mismatch or error returned by an Unmarshaler encountered
+	typeError error
+
+	maxDepth     int
+	maxArrayLen  int
+	maxStringLen int
+	// depth is the number of nvlists the one currently being read is nested in
+	depth int
 }
 
 type nvPairReader struct {
@@ -68,21 +174,25 @@ func (r *nvlistReader) ReadByte() (byte, error) {
 }
 
 func (r *nvlistReader) Read(p []byte) (n int, err error) {
-	if r.currentByte+len(p) < len(r.nvlist) {
+	if r.currentByte+len(p) <= len(r.nvlist) {
 		n = len(p)
-	} else {
+	} else if r.currentByte < len(r.nvlist) {
 		n = len(r.nvlist) - r.currentByte
 		err = io.EOF
+	} else {
+		return 0, io.EOF
 	}
-	for i := 0; i < n; i++ {
-		p[i] = r.nvlist[r.currentByte+i]
-	}
+	copy(p, r.nvlist[r.currentByte:r.currentByte+n])
 	r.currentByte += n
 	return
 }
 
+func (r *nvPairReader) endByte() int {
+	return r.startByte + r.sizeBytes
+}
+
 func (r *nvPairReader) ReadByte() (byte, error) {
-	if r.currentByte <= r.startByte+r.sizeBytes {
+	if r.currentByte < r.endByte() {
 		val := r.nvlist.nvlist[r.currentByte]
 		r.currentByte++
 		return val, nil
@@ -92,7 +202,7 @@ func (r *nvPairReader) ReadByte() (byte, error) {
 
 func (r *nvPairReader) ReadBytes(delim byte) ([]byte, error) {
 	startByte := r.currentByte
-	for ; r.currentByte <= r.startByte+r.sizeBytes; r.currentByte++ {
+	for ; r.currentByte < r.endByte(); r.currentByte++ {
 		if r.nvlist.nvlist[r.currentByte] == delim {
 			val := r.nvlist.nvlist[startByte : r.currentByte+1]
 			r.currentByte++ // consume delimiter
@@ -103,7 +213,7 @@ func (r *nvPairReader) ReadBytes(delim byte) ([]byte, error) {
 }
 
 func (r *nvPairReader) readN(n int) (val []byte, err error) {
-	if r.currentByte+n <= r.startByte+r.sizeBytes {
+	if n >= 0 && r.currentByte+n <= r.endByte() {
 		val = r.nvlist.nvlist[r.currentByte : r.currentByte+n]
 		r.currentByte += n
 		return
@@ -113,24 +223,117 @@ func (r *nvPairReader) readN(n int) (val []byte, err error) {
 }
 
 func (r *nvPairReader) Read(p []byte) (n int, err error) {
-	if r.currentByte+len(p) <= r.startByte+r.sizeBytes {
+	if r.currentByte+len(p) <= r.endByte() {
 		n = len(p)
-	} else {
-		n = r.startByte + r.sizeBytes - r.currentByte
+	} else if r.currentByte < r.endByte() {
+		n = r.endByte() - r.currentByte
 		err = io.EOF
+	} else {
+		return 0, io.EOF
 	}
-	for i := 0; i < n; i++ {
-		p[i] = r.nvlist.nvlist[r.currentByte+i]
-	}
+	copy(p, r.nvlist.nvlist[r.currentByte:r.currentByte+n])
 	r.currentByte += n
 	return
 }
 
 func (r *nvPairReader) readInt(val interface{}) error {
-	return binary.Read(r, r.nvlist.endianness, val)
+	if err := binary.Read(r, r.nvlist.endianness, val); err != nil {
+		return ErrInvalidData
+	}
+	return nil
+}
+
+// readNumber reads a number which is size bytes wide in native encoding. XDR encodes everything
+// smaller than 4 bytes as a 4 byte integer. The raw bits are returned and need to be truncated by
+// the caller.
+func (r *nvPairReader) readNumber(size int) (uint64, error) {
+	if r.nvlist.encoding == EncodingXDR && size < 4 {
+		size = 4
+	}
+	buf, err := r.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(buf[0]), nil
+	case 2:
+		return uint64(r.nvlist.endianness.Uint16(buf)), nil
+	case 4:
+		return uint64(r.nvlist.endianness.Uint32(buf)), nil
+	case 8:
+		return r.nvlist.endianness.Uint64(buf), nil
+	}
+	panic("Invalid number size inside parser")
 }
 
-// Skips to next 8-byte aligned address inside nvPair
+// readString reads a single string. Native strings are null-terminated, XDR strings are
+// length-prefixed and padded to 4 bytes.
+func (r *nvPairReader) readString() (string, error) {
+	if r.nvlist.encoding == EncodingXDR {
+		length, err := r.readNumber(4)
+		if err != nil {
+			return "", err
+		}
+		if length > uint64(r.endByte()-r.currentByte) {
+			return "", ErrInvalidData
+		}
+		if length > uint64(r.nvlist.maxStringLen) {
+			return "", ErrLimitExceeded
+		}
+		data, err := r.readN(int(length))
+		if err != nil {
+			return "", err
+		}
+		if bytes.IndexByte(data, 0x00) != -1 {
+			// Not representable in native encoding
+			return "", ErrInvalidData
+		}
+		r.skipToAlign()
+		return string(data), nil
+	}
+	data, err := r.ReadBytes(0x00)
+	if err != nil {
+		return "", err
+	}
+	if len(data)-1 > r.nvlist.maxStringLen {
+		return "", ErrLimitExceeded
+	}
+	return string(data[:len(data)-1]), nil
+}
+
+// readBool reads a boolean_t, which is always 4 bytes wide
+func (r *nvPairReader) readBool() (bool, error) {
+	tmp, err := r.readNumber(4)
+	if err != nil {
+		return false, err
+	}
+	switch tmp {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, ErrInvalidData
+	}
+}
+
+// readArrayLength reads and checks the element count XDR prefixes arrays with
+func (r *nvPairReader) readArrayLength(nelem int32) error {
+	if r.nvlist.encoding != EncodingXDR {
+		return nil
+	}
+	length, err := r.readNumber(4)
+	if err != nil {
+		return err
+	}
+	if length != uint64(nelem) {
+		return ErrInvalidData
+	}
+	return nil
+}
+
+// Skips to next aligned address inside nvPair (8 bytes for native, 4 bytes for XDR)
 func (r *nvPairReader) skipToAlign() {
 	var alignment int
 	switch r.nvlist.encoding {
@@ -155,7 +358,20 @@ func (r *nvlistReader) skipN(n int) {
 }
 
 func (r *nvlistReader) readInt(data interface{}) error {
-	return binary.Read(r, r.endianness, data)
+	if err := binary.Read(r, r.endianness, data); err != nil {
+		return ErrInvalidData
+	}
+	return nil
+}
+
+// readUint32 reads a 4 byte integer without going through binary.Read
+func (r *nvlistReader) readUint32() (uint32, error) {
+	if r.currentByte+4 > len(r.nvlist) {
+		return 0, ErrInvalidData
+	}
+	val := r.endianness.Uint32(r.nvlist[r.currentByte:])
+	r.currentByte += 4
+	return val, nil
 }
 
 func (r *nvlistReader) readNvHeader() error {
@@ -185,293 +401,953 @@ func (r *nvlistReader) readNvHeader() error {
 	default:
 		return ErrInvalidEndianess
 	}
+	if r.encoding == EncodingXDR {
+		// The endianness only documents the host which has written the nvlist, XDR is always
+		// big endian.
+		r.endianness = binary.BigEndian
+	}
 
 	r.skipN(2) // reserved
 
+	return r.readNvlistHeader()
+}
+
+// readNvlistHeader reads the version and flags of the top-level nvlist
+func (r *nvlistReader) readNvlistHeader() error {
 	if err := r.readInt(&r.version); err != nil {
-		return err
+		return ErrInvalidData
 	}
 	if err := r.readInt(&r.flags); err != nil {
-		return err
+		return ErrInvalidData
 	}
-
 	return nil
 }
 
-func (r *nvlistReader) readPairs(v reflect.Value) error {
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
+// readNvPairHeader reads the header and name of a single nvpair. It returns a zero-sized nvpair
+// if the end of the nvlist has been reached.
+func (r *nvlistReader) readNvPairHeader() (nvp nvpair, name string, nvpr nvPairReader, err error) {
+	nvpr = nvPairReader{
+		nvlist:      r,
+		currentByte: r.currentByte + 4, // Size (4 bytes)
+		startByte:   r.currentByte,
 	}
-	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
-		val := make(map[string]interface{})
-		v.Set(reflect.ValueOf(val))
-		v = v.Elem()
+	var rawSize uint32
+	if rawSize, err = r.readUint32(); err != nil {
+		return
 	}
-	structFieldByName := make(map[string]reflect.Value)
-	if v.Kind() == reflect.Struct {
-		t := v.Type()
-		for i := 0; i < t.NumField(); i++ {
-			field := t.Field(i)
-			tags := strings.Split(field.Tag.Get("nvlist"), ",")
-			name := field.Name
-			if tags[0] != "" {
-				name = tags[0]
-			}
-			structFieldByName[name] = v.Field(i)
+	nvp.Size = int32(rawSize)
+	if nvp.Size < 0 {
+		err = ErrInvalidData
+		return
+	}
+	if r.encoding == EncodingXDR {
+		var decodedSize uint32
+		if decodedSize, err = r.readUint32(); err != nil { // Irrelevant for us
+			return
+		}
+		nvpr.skipN(4)
+		if nvp.Size == 0 && decodedSize == 0 { // End indicated by zero sizes
+			return
+		}
+	} else if nvp.Size == 0 { // End indicated by zero size
+		return
+	}
+	if int(nvp.Size)+nvpr.startByte > len(r.nvlist) {
+		err = ErrInvalidData
+		return
+	}
+	nvpr.sizeBytes = int(nvp.Size)
+
+	if r.encoding == EncodingXDR {
+		if name, err = nvpr.readString(); err != nil {
+			return
+		}
+		if len(name) == 0 {
+			err = ErrInvalidData
+			return
 		}
-	} else if v.Kind() == reflect.Map {
-		// Noop, but valid
+		var rawType, rawElem uint64
+		if rawType, err = nvpr.readNumber(4); err != nil {
+			return
+		}
+		if rawElem, err = nvpr.readNumber(4); err != nil {
+			return
+		}
+		nvp.Name_sz = int16(len(name) + 1)
+		nvp.Type = Type(rawType)
+		nvp.Value_elem = int32(rawElem)
 	} else {
-		return ErrInvalidData
+		var rawNameSz, rawReserve, rawElem, rawType uint64
+		if rawNameSz, err = nvpr.readNumber(2); err != nil {
+			return
+		}
+		nvp.Name_sz = int16(rawNameSz)
+		if nvp.Name_sz <= 0 { // Null terminated, so at least size 1 is required
+			err = ErrInvalidData
+			return
+		}
+		if rawReserve, err = nvpr.readNumber(2); err != nil {
+			return
+		}
+		if rawElem, err = nvpr.readNumber(4); err != nil {
+			return
+		}
+		if rawType, err = nvpr.readNumber(4); err != nil {
+			return
+		}
+		nvp.Reserve = int16(rawReserve)
+		nvp.Value_elem = int32(rawElem)
+		nvp.Type = Type(rawType)
+
+		var nameRaw []byte
+		nameRaw, err = nvpr.readN(int(nvp.Name_sz)) // Upcast: always OK
+		if err != nil {
+			return
+		}
+		if bytes.IndexByte(nameRaw, 0x00) != len(nameRaw)-1 {
+			// Names are exactly null-terminated
+			err = ErrInvalidData
+			return
+		}
+		if len(nameRaw)-1 > r.maxStringLen {
+			err = ErrLimitExceeded
+			return
+		}
+		name = string(nameRaw[:len(nameRaw)-1]) // Remove null termination
+
+		nvpr.skipToAlign()
 	}
-	for {
-		var nvp nvpair
-		nvpr := nvPairReader{
-			nvlist:      r,
-			currentByte: r.currentByte + 4, // Size (4 bytes)
-			startByte:   r.currentByte,
+
+	if nvp.Value_elem < 0 {
+		err = ErrInvalidData
+		return
+	}
+	if int(nvp.Value_elem) > r.maxArrayLen {
+		err = ErrLimitExceeded
+		return
+	}
+	if int(nvp.Value_elem) > nvpr.endByte()-nvpr.currentByte {
+		// Every element takes up at least one byte, this prevents huge allocations for short data
+		err = ErrInvalidData
+		return
+	}
+	return
+}
+
+// readValue reads the value of all nvpairs which don't contain nvlists into their natural Go type
+func (nvpr *nvPairReader) readValue(nvp nvpair) (interface{}, error) {
+	switch nvp.Type {
+	case TypeBoolean:
+		return true, nil
+	case TypeInt16, TypeUint16, TypeInt32, TypeUint32, TypeInt64, TypeUint64, TypeInt8, TypeUint8, TypeByte: // Integer-style types
+		raw, err := nvpr.readNumber(nvtypeSize(nvp.Type))
+		if err != nil {
+			return nil, err
 		}
-		if err := r.readInt(&nvp.Size); err != nil {
-			return err
+		switch nvp.Type {
+		case TypeInt16:
+			return int16(raw), nil
+		case TypeUint16:
+			return uint16(raw), nil
+		case TypeInt32:
+			return int32(raw), nil
+		case TypeUint32:
+			return uint32(raw), nil
+		case TypeInt64:
+			return int64(raw), nil
+		case TypeUint64:
+			return raw, nil
+		case TypeInt8:
+			return int8(raw), nil
+		case TypeUint8, TypeByte:
+			return uint8(raw), nil
+		default:
+			panic("Primitive type with no handler (illegal state), check all primitive types are handled")
+		}
+	case TypeHrtime:
+		raw, err := nvpr.readNumber(8)
+		if err != nil {
+			return nil, err
+		}
+		return Hrtime(raw), nil
+	case TypeDouble:
+		raw, err := nvpr.readNumber(8)
+		if err != nil {
+			return nil, err
 		}
-		if nvp.Size < 0 {
-			return ErrInvalidData
+		return math.Float64frombits(raw), nil
+	case TypeString:
+		return nvpr.readString()
+	case TypeBooleanValue:
+		return nvpr.readBool()
+	// Array handling
+	case TypeInt16Array, TypeUint16Array, TypeInt32Array, TypeUint32Array, TypeInt64Array, TypeUint64Array, TypeInt8Array, TypeUint8Array:
+		if err := nvpr.readArrayLength(nvp.Value_elem); err != nil {
+			return nil, err
 		}
-		if nvp.Size == 0 { // End indicated by zero size
-			return nil
+		var val reflect.Value
+		switch nvp.Type {
+		case TypeInt16Array:
+			val = reflect.ValueOf(make([]int16, nvp.Value_elem))
+		case TypeUint16Array:
+			val = reflect.ValueOf(make([]uint16, nvp.Value_elem))
+		case TypeInt32Array:
+			val = reflect.ValueOf(make([]int32, nvp.Value_elem))
+		case TypeUint32Array:
+			val = reflect.ValueOf(make([]uint32, nvp.Value_elem))
+		case TypeInt64Array:
+			val = reflect.ValueOf(make([]int64, nvp.Value_elem))
+		case TypeUint64Array:
+			val = reflect.ValueOf(make([]uint64, nvp.Value_elem))
+		case TypeInt8Array:
+			val = reflect.ValueOf(make([]int8, nvp.Value_elem))
+		case TypeUint8Array:
+			val = reflect.ValueOf(make([]uint8, nvp.Value_elem))
+		default:
+			panic("Array type with no handler (illegal state), check all primitive types are handled")
 		}
-		if int(nvp.Size)+r.currentByte > len(r.nvlist) {
-			return ErrInvalidData
+		elemSize := int(val.Type().Elem().Size())
+		for i := 0; i < val.Len(); i++ {
+			raw, err := nvpr.readNumber(elemSize)
+			if err != nil {
+				return nil, err
+			}
+			elem := val.Index(i)
+			if elem.Kind() >= reflect.Int && elem.Kind() <= reflect.Int64 {
+				elem.SetInt(signExtend(raw, elemSize))
+			} else {
+				elem.SetUint(raw)
+			}
 		}
-		nvpr.sizeBytes = int(nvp.Size)
-		r.skipN(int(nvp.Size) - 4) // Skip to next nvPair, subtract 4 already read size bytes
+		return val.Interface(), nil
+	case TypeByteArray:
+		// XDR encodes byte arrays as opaque data without a length prefix
+		val, err := nvpr.readN(int(nvp.Value_elem))
+		if err != nil {
+			return nil, err
+		}
+		if nvpr.nvlist.encoding == EncodingXDR {
+			nvpr.skipToAlign()
+		}
+		return val, nil
+	case TypeStringArray:
+		val := make([]string, nvp.Value_elem)
+		if nvpr.nvlist.encoding == EncodingNative {
+			nvpr.skipN(int(8 * nvp.Value_elem)) // Skip pointers
+		}
+		// Pointers are always aligned
+		for i := uint32(0); i < uint32(nvp.Value_elem); i++ {
+			str, err := nvpr.readString()
+			if err != nil {
+				return nil, err
+			}
+			val[i] = str
+		}
+		return val, nil
+	case TypeBooleanArray:
+		if err := nvpr.readArrayLength(nvp.Value_elem); err != nil {
+			return nil, err
+		}
+		val := make([]bool, nvp.Value_elem)
+		for i := uint32(0); i < uint32(nvp.Value_elem); i++ {
+			b, err := nvpr.readBool()
+			if err != nil {
+				return nil, err
+			}
+			val[i] = b
+		}
+		return val, nil
+	}
+	return nil, ErrUnsupportedType
+}
 
-		if r.encoding == EncodingXDR {
-			r.skipN(4) // Skip decoded size, it's irrelevant for us
+// signExtend interprets the lowest size bytes of raw as a two's complement number
+func signExtend(raw uint64, size int) int64 {
+	shift := uint(64 - 8*size)
+	return int64(raw<<shift) >> shift
+}
+
+var emptyInterfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+var uint64Type = reflect.TypeOf(uint64(0))
+
+// decodeError attaches the path and types to err, unless it already is a DecodeError
+func decodeError(err error, path *nvPath, t Type, goType reflect.Type) error {
+	if _, ok := err.(*DecodeError); ok {
+		return err
+	}
+	return &DecodeError{Path: path.String(), Type: t, GoType: goType, Err: err}
+}
+
+// saveTypeError records a type mismatch, only the first one is returned after decoding has finished
+func (r *nvlistReader) saveTypeError(path *nvPath, t Type, goType reflect.Type) {
+	r.saveValueError(ErrTypeMismatch, path, t, goType)
+}
+
+// saveValueError records a value which couldn't be stored like a type mismatch
+func (r *nvlistReader) saveValueError(err error, path *nvPath, t Type, goType reflect.Type) {
+	if r.typeError == nil {
+		r.typeError = &DecodeError{Path: path.String(), Type: t, GoType: goType, Err: err}
+	}
+}
+
+// canHoldNvlist checks if an nvlist can be decoded into a value of the given type
+func canHoldNvlist(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == rawMessageType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return true
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String
+	case reflect.Interface:
+		return t.NumMethod() == 0
+	}
+	return false
+}
+
+// canHoldNvlistArray checks if an nvlist array can be decoded into a value of the given type
+func canHoldNvlistArray(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		return canHoldNvlist(t.Elem()) || hasUnmarshaler(t.Elem())
+	case reflect.Interface:
+		return t.NumMethod() == 0
+	}
+	return false
+}
+
+// indirect follows pointers, allocating nil ones on the way
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
 		}
+		v = v.Elem()
+	}
+	return v
+}
 
-		if err := nvpr.readInt(&nvp.Name_sz); err != nil {
-			return err
+// setValue stores the decoded value val into dst. Numbers are converted into any numeric type
+// they fit in, other values into named types with the same kind and slices element by element. If
+// the value can't be stored, the error is recorded and false is returned.
+func (r *nvlistReader) setValue(dst reflect.Value, val reflect.Value, path *nvPath, t Type) bool {
+	if dst.Type() == rawMessageType {
+		// Only receives nvlists, which never get here
+		r.saveTypeError(path, t, dst.Type())
+		return false
+	}
+	if val.Type().AssignableTo(dst.Type()) {
+		dst.Set(val)
+		return true
+	}
+	if val.Kind() == reflect.Bool && dst.Kind() == reflect.Bool {
+		// Flags and boolean values can be decoded into bool, Flag and BoolValue
+		dst.SetBool(val.Bool())
+		return true
+	}
+	if dst.Kind() == reflect.Slice && val.Kind() == reflect.Slice && hasUnmarshaler(dst.Type().Elem()) {
+		return r.setUnmarshalerSlice(dst, val, path, t)
+	}
+	if dst.Kind() == reflect.Ptr {
+		elem := reflect.New(dst.Type().Elem())
+		if r.setValue(elem.Elem(), val, path, t) {
+			dst.Set(elem)
+			return true
 		}
-		if nvp.Name_sz <= 0 { // Null terminated, so at least size 1 is required
-			return ErrInvalidData
+		return false
+	}
+	if isNumber(val.Kind()) && isNumber(dst.Kind()) {
+		if err := r.setNumber(dst, val); err != nil {
+			r.saveValueError(err, path, t, dst.Type())
+			return false
+		}
+		return true
+	}
+	if val.Kind() == dst.Kind() && val.Type().ConvertibleTo(dst.Type()) {
+		dst.Set(val.Convert(dst.Type()))
+		return true
+	}
+	if val.Kind() == reflect.Slice && dst.Kind() == reflect.Slice {
+		out := reflect.MakeSlice(dst.Type(), val.Len(), val.Len())
+		for i := 0; i < val.Len(); i++ {
+			if !r.setValue(out.Index(i), val.Index(i), path.element(i), t) {
+				return false
+			}
+		}
+		dst.Set(out)
+		return true
+	}
+	r.saveTypeError(path, t, dst.Type())
+	return false
+}
+
+func isNumber(k reflect.Kind) bool {
+	return isInt(k) || isUint(k) || k == reflect.Float32 || k == reflect.Float64
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+// setNumber stores the number val into the numeric value dst. Values outside of the range of dst
+// result in ErrOverflow, conversions losing precision in ErrLossyConversion in strict mode.
+func (r *nvlistReader) setNumber(dst reflect.Value, val reflect.Value) error {
+	var n number
+	switch {
+	case isInt(val.Kind()):
+		n = number{kind: reflect.Int64, i: val.Int()}
+	case isUint(val.Kind()):
+		n = number{kind: reflect.Uint64, u: val.Uint()}
+	default:
+		n = number{kind: reflect.Float64, f: val.Float()}
+	}
+	bits := dst.Type().Bits()
+	switch {
+	case isInt(dst.Kind()):
+		i, err := n.toInt(bits, r.strict)
+		if err != nil {
+			return err
 		}
-		if err := nvpr.readInt(&nvp.Reserve); err != nil {
+		dst.SetInt(i)
+	case isUint(dst.Kind()):
+		u, err := n.toUint(bits, r.strict)
+		if err != nil {
 			return err
 		}
-		if err := nvpr.readInt(&nvp.Value_elem); err != nil {
+		dst.SetUint(u)
+	default:
+		f, err := n.toFloat(bits, r.strict)
+		if err != nil {
 			return err
 		}
+		dst.SetFloat(f)
+	}
+	return nil
+}
+
+// number is a decoded integer or floating point number, kind is either Int64, Uint64 or Float64
+type number struct {
+	kind reflect.Kind
+	i    int64
+	u    uint64
+	f    float64
+}
 
-		if nvp.Value_elem < 0 {
-			return ErrInvalidData
+// toInt converts n into a signed integer with the given size in bits
+func (n number) toInt(bits int, strict bool) (int64, error) {
+	var i int64
+	switch n.kind {
+	case reflect.Int64:
+		i = n.i
+	case reflect.Uint64:
+		if n.u > math.MaxInt64 {
+			return 0, ErrOverflow
 		}
-		if nvp.Value_elem > 65535 { // 64K entries are enough
-			return ErrInvalidData
+		i = int64(n.u)
+	default:
+		if math.IsNaN(n.f) || n.f < -(1<<63) || n.f >= 1<<63 {
+			return 0, ErrOverflow
 		}
-		if err := nvpr.readInt(&nvp.Type); err != nil {
-			return err
+		i = int64(n.f)
+		if float64(i) != n.f && strict {
+			return 0, ErrLossyConversion
 		}
+	}
+	if bits < 64 && (i < -1<<uint(bits-1) || i >= 1<<uint(bits-1)) {
+		return 0, ErrOverflow
+	}
+	return i, nil
+}
 
-		nameRaw, err := nvpr.readN(int(nvp.Name_sz)) // Upcast: always OK
-		if err != nil {
-			return err
+// toUint converts n into an unsigned integer with the given size in bits
+func (n number) toUint(bits int, strict bool) (uint64, error) {
+	var u uint64
+	switch n.kind {
+	case reflect.Int64:
+		if n.i < 0 {
+			return 0, ErrOverflow
+		}
+		u = uint64(n.i)
+	case reflect.Uint64:
+		u = n.u
+	default:
+		if math.IsNaN(n.f) || n.f < 0 || n.f >= 1<<64 {
+			return 0, ErrOverflow
+		}
+		u = uint64(n.f)
+		if float64(u) != n.f && strict {
+			return 0, ErrLossyConversion
 		}
-		name := string(nameRaw[:len(nameRaw)-1]) // Remove null termination
+	}
+	if bits < 64 && u >= 1<<uint(bits) {
+		return 0, ErrOverflow
+	}
+	return u, nil
+}
 
-		nvpr.skipToAlign()
+// toFloat converts n into a floating point number with the given size in bits
+func (n number) toFloat(bits int, strict bool) (float64, error) {
+	var f float64
+	exact := true
+	switch n.kind {
+	case reflect.Int64:
+		f = float64(n.i)
+		exact = f < 1<<63 && int64(f) == n.i
+	case reflect.Uint64:
+		f = float64(n.u)
+		exact = f < 1<<64 && uint64(f) == n.u
+	default:
+		f = n.f
+	}
+	if bits == 32 && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		if math.Abs(f) > math.MaxFloat32 {
+			return 0, ErrOverflow
+		}
+		exact = exact && float64(float32(f)) == f
+	}
+	if !exact && strict {
+		return 0, ErrLossyConversion
+	}
+	return f, nil
+}
 
-		setPrimitive := func(value interface{}) {
-			rValue := reflect.ValueOf(value)
-			if rValue.Kind() == reflect.Ptr {
-				rValue = rValue.Elem()
-			}
-			if v.Kind() == reflect.Struct {
-				field := structFieldByName[name]
-				if field.CanSet() {
-					field.Set(rValue)
-				}
-			} else if v.Kind() == reflect.Map {
-				v.SetMapIndex(reflect.ValueOf(name), rValue)
-			}
+// hasUnmarshaler checks if pointers to values of type t or the values they point to implement
+// Unmarshaler
+func hasUnmarshaler(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.PtrTo(t).Implements(unmarshalerType)
+}
+
+// unmarshalerOf returns the Unmarshaler for v, which needs to be settable or a pointer. Nil pointers
+// are allocated on the way. If there is none, nil is returned.
+func unmarshalerOf(v reflect.Value) Unmarshaler {
+	if !hasUnmarshaler(v.Type()) {
+		return nil
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Elem().Kind() != reflect.Ptr {
+			return v.Interface().(Unmarshaler)
 		}
+		v = v.Elem()
+	}
+	return v.Addr().Interface().(Unmarshaler)
+}
 
-		switch nvp.Type {
-		case typeUnknown:
-			return ErrInvalidData
-		case typeBoolean:
-			setPrimitive(true)
-		case typeInt16, typeUint16, typeInt32, typeUint32, typeInt64, typeUint64, typeInt8, typeUint8: // Integer-style types
-			var val interface{}
-			switch nvp.Type {
-			case typeInt16:
-				val = new(int16)
-			case typeUint16:
-				val = new(uint16)
-			case typeInt32:
-				val = new(int32)
-			case typeUint32:
-				val = new(uint32)
-			case typeInt64:
-				val = new(int64)
-			case typeUint64:
-				val = new(uint64)
-			case typeInt8:
-				val = new(int8)
-			case typeUint8:
-				val = new(uint8)
-			default:
-				panic("Primitive type with no handler (illegal state), check all primitive types are handled")
+// callUnmarshaler lets u decode a value with the given decode function. Every call of the function
+// handed to u decodes the value again from the start, if u never calls it, it is decoded into an
+// empty interface to skip it. nvpr is nil for the top-level nvlist.
+func (r *nvlistReader) callUnmarshaler(u Unmarshaler, nvpr *nvPairReader, path *nvPath, t Type, decode func(dst reflect.Value) error) error {
+	listStart, listEnd := r.currentByte, r.currentByte
+	var pairStart, pairEnd int
+	if nvpr != nil {
+		pairStart = nvpr.currentByte
+	}
+	decoded := false
+	var dataErr error
+	unmarshal := func(dst interface{}) error {
+		v := reflect.ValueOf(dst)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return decodeError(ErrInvalidValue, path, t, reflect.TypeOf(dst))
+		}
+		r.currentByte = listStart
+		if nvpr != nil {
+			nvpr.currentByte = pairStart
+		}
+		typeError := r.typeError
+		r.typeError = nil
+		err := decode(v)
+		if err != nil {
+			dataErr = err
+		} else {
+			err = r.typeError
+			decoded = true
+			listEnd = r.currentByte
+			if nvpr != nil {
+				pairEnd = nvpr.currentByte
 			}
+		}
+		r.typeError = typeError
+		return err
+	}
+	if err := u.UnmarshalNvlist(unmarshal); err != nil {
+		if dataErr != nil {
+			return dataErr
+		}
+		return decodeError(err, path, t, reflect.TypeOf(u))
+	}
+	if dataErr != nil {
+		// The data itself is broken, so it can't be skipped either
+		return dataErr
+	}
+	if !decoded {
+		return decode(reflect.New(emptyInterfaceType))
+	}
+	r.currentByte = listEnd
+	if nvpr != nil {
+		nvpr.currentByte = pairEnd
+	}
+	return nil
+}
 
-			err := nvpr.readInt(val)
-			if err != nil {
-				return err
-			}
-			setPrimitive(val)
-		case typeByte:
-			b, err := nvpr.ReadByte()
-			if err != nil {
-				return err
-			}
-			setPrimitive(b)
-		case typeString:
-			data, err := nvpr.ReadBytes(0x00)
-			if err != nil {
-				return err
+// setUnmarshalerSlice stores the array val into dst, whose elements implement Unmarshaler. Errors
+// returned by them are recorded like type mismatches.
+func (r *nvlistReader) setUnmarshalerSlice(dst reflect.Value, val reflect.Value, path *nvPath, t Type) bool {
+	out := reflect.MakeSlice(dst.Type(), val.Len(), val.Len())
+	for i := 0; i < val.Len(); i++ {
+		elem, elemPath := val.Index(i), path.element(i)
+		err := unmarshalerOf(out.Index(i)).UnmarshalNvlist(func(d interface{}) error {
+			v := reflect.ValueOf(d)
+			if v.Kind() != reflect.Ptr || v.IsNil() {
+				return decodeError(ErrInvalidValue, elemPath, t, reflect.TypeOf(d))
 			}
-			setPrimitive(string(data[:len(data)-1]))
-		case typeBooleanValue:
-			var tmp int32
-			err := nvpr.readInt(&tmp)
-			if err != nil {
-				return err
-			}
-			var val bool
-			switch tmp {
-			case 0:
-				val = false
-			case 1:
-				val = true
-			default:
-				return ErrInvalidData
-			}
-			setPrimitive(val)
-		// Array handling
-		case typeInt16Array, typeUint16Array, typeInt32Array, typeUint32Array, typeInt64Array, typeUint64Array, typeInt8Array, typeUint8Array:
-			var val interface{}
-			switch nvp.Type {
-			case typeInt16Array:
-				val = make([]int16, nvp.Value_elem)
-			case typeUint16Array:
-				val = make([]uint16, nvp.Value_elem)
-			case typeInt32Array:
-				val = make([]int32, nvp.Value_elem)
-			case typeUint32Array:
-				val = make([]uint32, nvp.Value_elem)
-			case typeInt64Array:
-				val = make([]int64, nvp.Value_elem)
-			case typeUint64Array:
-				val = make([]uint64, nvp.Value_elem)
-			case typeInt8Array:
-				val = make([]int8, nvp.Value_elem)
-			case typeUint8Array:
-				val = make([]uint8, nvp.Value_elem)
-			default:
-				panic("Array type with no handler (illegal state), check all primitive types are handled")
+			typeError := r.typeError
+			r.typeError = nil
+			r.setValue(v.Elem(), elem, elemPath, t)
+			err := r.typeError
+			r.typeError = typeError
+			return err
+		})
+		if err != nil {
+			if r.typeError == nil {
+				r.typeError = decodeError(err, elemPath, t, dst.Type().Elem())
 			}
-			if err := binary.Read(&nvpr, nvpr.nvlist.endianness, val); err != nil {
-				return err
+			return false
+		}
+	}
+	dst.Set(out)
+	return true
+}
+
+// readNvlistStruct reads the nvlist_t of an embedded nvlist in native encoding and returns its
+// nvflag
+func (r *nvPairReader) readNvlistStruct() (uint32, error) {
+	nvl, err := r.readN(nvlistSize)
+	if err != nil {
+		return 0, err
+	}
+	return r.nvlist.endianness.Uint32(nvl[4:8]), nil
+}
+
+// readEmbeddedNvlist reads the pairs of an nvlist embedded into the given nvpair. In native
+// encoding these directly follow the nvpair and flags has been read from the nvpair value, in XDR
+// encoding they are part of the nvpair, preceded by the version and flags.
+func (r *nvlistReader) readEmbeddedNvlist(nvpr *nvPairReader, v reflect.Value, path *nvPath, flags uint32) error {
+	if r.encoding != EncodingXDR {
+		return r.readPairs(v, path, flags)
+	}
+	r.currentByte = nvpr.currentByte
+	var version int32
+	if err := r.readInt(&version); err != nil {
+		return decodeError(ErrInvalidData, path, TypeNvlist, nil)
+	}
+	if err := r.readInt(&flags); err != nil {
+		return decodeError(ErrInvalidData, path, TypeNvlist, nil)
+	}
+	if err := r.readPairs(v, path, flags); err != nil {
+		return err
+	}
+	if r.currentByte > nvpr.endByte() {
+		return decodeError(ErrInvalidData, path, TypeNvlist, nil)
+	}
+	nvpr.currentByte = r.currentByte
+	return nil
+}
+
+// readNvlistInto reads an embedded nvlist into v, which can be a struct, a map, an empty interface or
+// a pointer to one of these. Nil pointers and maps are allocated. If v cannot hold an nvlist, a type
+// mismatch is recorded and the nvlist is skipped.
+func (r *nvlistReader) readNvlistInto(nvpr *nvPairReader, v reflect.Value, path *nvPath, flags uint32) error {
+	if r.depth >= r.maxDepth {
+		return decodeError(ErrLimitExceeded, path, TypeNvlist, nil)
+	}
+	if !canHoldNvlist(v.Type()) {
+		r.saveTypeError(path, TypeNvlist, v.Type())
+		v = reflect.New(emptyInterfaceType).Elem()
+	}
+	r.depth++
+	err := r.readEmbeddedNvlist(nvpr, indirect(v), path, flags)
+	r.depth--
+	return err
+}
+
+// readNvlistArrayInto reads an array of embedded nvlists into v, which needs to be a slice of
+// something readNvlistInto accepts or an empty interface, which receives []map[string]interface{}.
+// Otherwise a type mismatch is recorded and the nvlists are skipped.
+func (r *nvlistReader) readNvlistArrayInto(nvpr *nvPairReader, nvp nvpair, v reflect.Value, path *nvPath) error {
+	flags := make([]uint32, nvp.Value_elem)
+	if r.encoding == EncodingNative {
+		nvpr.skipN(int(8 * nvp.Value_elem)) // Skip pointers
+		for i := range flags {
+			var err error
+			if flags[i], err = nvpr.readNvlistStruct(); err != nil {
+				return decodeError(err, path, TypeNvlistArray, nil)
 			}
-			setPrimitive(val)
+		}
+	}
+	t := v.Type()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	sliceType := reflect.TypeOf([]map[string]interface{}{})
+	discard := false
+	if t.Kind() == reflect.Slice && canHoldNvlistArray(t) {
+		sliceType = t
+	} else if !canHoldNvlistArray(t) {
+		r.saveTypeError(path, TypeNvlistArray, v.Type())
+		discard = true
+	}
+	val := reflect.MakeSlice(sliceType, int(nvp.Value_elem), int(nvp.Value_elem))
+	for i := 0; i < int(nvp.Value_elem); i++ {
+		elemPath := path.element(i)
+		var err error
+		if u := unmarshalerOf(val.Index(i)); u != nil {
+			err = r.callUnmarshaler(u, nvpr, elemPath, TypeNvlist, func(dst reflect.Value) error {
+				return r.readNvlistInto(nvpr, dst.Elem(), elemPath, flags[i])
+			})
+		} else {
+			err = r.readNvlistInto(nvpr, val.Index(i), elemPath, flags[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !discard {
+		indirect(v).Set(val)
+	}
+	return nil
+}
 
-		case typeByteArray:
-			val, err := nvpr.readN(int(nvp.Value_elem))
-			if err != nil {
+// readValueInto reads the value of the given nvpair into target, which needs to be settable or
+// invalid to skip the value. It returns if the value has been stored in target.
+func (r *nvlistReader) readValueInto(nvpr *nvPairReader, nvp nvpair, target reflect.Value, path *nvPath) (bool, error) {
+	if target.IsValid() {
+		if u := unmarshalerOf(target); u != nil {
+			return true, r.callUnmarshaler(u, nvpr, path, nvp.Type, func(dst reflect.Value) error {
+				_, err := r.readValueInto(nvpr, nvp, dst.Elem(), path)
 				return err
-			}
-			setPrimitive(val)
-		case typeStringArray:
-			val := make([]string, nvp.Value_elem)
-			nvpr.skipN(int(8 * nvp.Value_elem)) // Skip pointers
-			// Pointers are always aligned
-			for i := uint32(0); i < uint32(nvp.Value_elem); i++ {
-				data, err := nvpr.ReadBytes(0x00)
-				if err != nil {
-					return err
+			})
+		}
+	}
+	switch nvp.Type {
+	case TypeUnknown:
+		return false, decodeError(ErrInvalidData, path, nvp.Type, nil)
+	// Nvlist handling
+	case TypeNvlist, TypeNvlistArray:
+		stored := target.IsValid()
+		if !stored {
+			// Still needs to be decoded to find the end of the embedded nvlists
+			target = reflect.New(emptyInterfaceType).Elem()
+		}
+		if nvp.Type == TypeNvlist {
+			stored = stored && canHoldNvlist(target.Type())
+			var flags uint32
+			if r.encoding == EncodingNative {
+				var err error
+				if flags, err = nvpr.readNvlistStruct(); err != nil {
+					return false, decodeError(err, path, nvp.Type, nil)
 				}
-				val[i] = string(data[:len(data)-1])
 			}
-			setPrimitive(val)
-		case typeBooleanArray:
-			var tmp int32
-			val := make([]bool, nvp.Value_elem)
-			for i := uint32(0); i < uint32(nvp.Value_elem); i++ {
-				if err := nvpr.readInt(&tmp); err != nil {
-					return err
-				}
-				switch tmp {
-				case 0:
-					val[i] = false
-				case 1:
-					val[i] = true
-				default:
-					return ErrInvalidData
+			return stored, r.readNvlistInto(nvpr, target, path, flags)
+		}
+		stored = stored && canHoldNvlistArray(target.Type())
+		return stored, r.readNvlistArrayInto(nvpr, nvp, target, path)
+	default:
+		val, err := nvpr.readValue(nvp)
+		if err != nil {
+			return false, decodeError(err, path, nvp.Type, nil)
+		}
+		return target.IsValid() && r.setValue(target, reflect.ValueOf(val), path, nvp.Type), nil
+	}
+}
+
+// readPairs reads the pairs of an nvlist with the given nvflag into v
+func (r *nvlistReader) readPairs(v reflect.Value, path *nvPath, flags uint32) error {
+	v = indirect(v)
+	if v.Type() == listType {
+		return r.readList(v.Addr().Interface().(*List), path, flags)
+	}
+	if v.Type() == rawMessageType {
+		m, err := r.readRawPairs(path, flags)
+		if err != nil {
+			return err
+		}
+		v.SetBytes(m)
+		return nil
+	}
+	if v.Kind() == reflect.Struct && reflect.PtrTo(v.Type()).Implements(pairUnmarshalerType) {
+		return r.readPairsWith(v.Addr().Interface().(PairUnmarshaler), path, flags)
+	}
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		val := reflect.ValueOf(make(map[string]interface{}))
+		v.Set(val)
+		v = val
+	}
+	var plan *structPlan
+	var seen []bool
+	// extra is the field receiving unknown nvpairs, it is only resolved when there is one since it
+	// might be promoted through a nil pointer
+	var extra *field
+	if v.Kind() == reflect.Struct {
+		plan = cachedStructPlan(v.Type())
+		seen = make([]bool, len(plan.fields))
+		for i, f := range plan.fields {
+			if f.extra {
+				if !isExtraMap(f.typ) {
+					return decodeError(ErrInvalidTag, path.child(f.name), TypeUnknown, f.typ)
 				}
+				extra = &plan.fields[i]
+				continue
 			}
-			setPrimitive(val)
-		// Nvlist handling
-		case typeNvlist:
-			if v.Kind() == reflect.Struct {
-				field := structFieldByName[name]
-				if field.CanSet() {
-					if err := nvpr.nvlist.readPairs(field); err != nil {
-						return err
-					}
+			if f.nvflag {
+				if !isFlagsField(f.typ) {
+					return decodeError(ErrInvalidTag, path.child(f.name), TypeUnknown, f.typ)
 				}
-			} else if v.Kind() == reflect.Map {
-				valueType := v.Type().Elem()
-				var val reflect.Value
-				if valueType.Kind() == reflect.Interface {
-					val = reflect.ValueOf(make(map[string]interface{}))
-				} else if valueType.Kind() == reflect.Struct {
-					val = reflect.New(valueType)
-				} else if valueType.Kind() == reflect.Map {
-					val = reflect.MakeMap(reflect.MapOf(reflect.TypeOf(""), valueType.Elem()))
-				} else {
-					panic("Cannot currently handle complex hybrid types")
-				}
-				if err := nvpr.nvlist.readPairs(val); err != nil {
-					return err
-				}
-				if val.Kind() == reflect.Ptr {
-					v.SetMapIndex(reflect.ValueOf(name), val.Elem())
-				} else {
-					v.SetMapIndex(reflect.ValueOf(name), val)
+				fieldByIndexAlloc(v, f.index).SetUint(uint64(flags))
+			}
+		}
+	} else if v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String {
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	} else {
+		return decodeError(ErrInvalidValue, path, TypeNvlist, v.Type())
+	}
+	names := r.newNameSet(flags)
+	for {
+		nvp, name, nvpr, err := r.readNvPairHeader()
+		if err != nil {
+			return decodeError(err, path, TypeUnknown, nil)
+		}
+		if nvp.Size == 0 {
+			return r.setDefaults(v, plan, seen, path)
+		}
+		if r.encoding == EncodingNative {
+			// Embedded nvlists follow the nvpair
+			r.currentByte = nvpr.endByte()
+		}
+		pairPath := path.child(name)
+		if !names.add(name, nvp.Type) {
+			return decodeError(ErrDuplicateName, pairPath, nvp.Type, nil)
+		}
+
+		// target is where the value gets decoded into, it's invalid for unknown struct fields
+		var target, extraMap reflect.Value
+		var f field
+		isField := false
+		asUint64 := false
+		if v.Kind() == reflect.Struct {
+			var i int
+			if i, isField = plan.byName[name]; isField {
+				f = plan.fields[i]
+			}
+			switch {
+			case isField:
+				seen[i] = true
+				target = fieldByIndexAlloc(v, f.index)
+				if f.asUint64 && nvp.Type == TypeUint64 && unpackType(f.typ).Kind() == reflect.Bool {
+					asUint64 = true
+					target = reflect.New(uint64Type).Elem()
 				}
-			} else {
-				panic("Invalid pair type (not map or struct)")
+			case extra != nil:
+				extraMap = fieldByIndexAlloc(v, extra.index)
+				target = reflect.New(extra.typ.Elem()).Elem()
+			case r.strict:
+				return decodeError(ErrUnknownField, pairPath, nvp.Type, v.Type())
 			}
-		case typeNvlistArray:
-			var val reflect.Value
-			if v.Kind() == reflect.Struct {
-				panic("Deserializing NVListArrays into structs currently unsupported")
-			} else if v.Kind() == reflect.Map {
-				val = reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(map[string]interface{}{})), int(nvp.Value_elem), int(nvp.Value_elem))
-				// Drop unused data (nvlist header @ 8 bytes + 64 bit pointer @ 8 bytes)
-				nvpr.skipN(int((8 + 8) * nvp.Value_elem))
-				for i := 0; i < int(nvp.Value_elem); i++ { // arraySize is <2^16
-					val.Index(i).Set(reflect.MakeMap(val.Type().Elem()))
-					err := nvpr.nvlist.readPairs(val.Index(i))
-					if err != nil {
-						return err
-					}
+		} else {
+			target = reflect.New(v.Type().Elem()).Elem()
+		}
+
+		stored, err := r.readValueInto(&nvpr, nvp, target, pairPath)
+		if err != nil {
+			return err
+		}
+		if stored {
+			switch {
+			case v.Kind() == reflect.Map:
+				v.SetMapIndex(reflect.ValueOf(name).Convert(v.Type().Key()), target)
+			case asUint64:
+				indirect(fieldByIndexAlloc(v, f.index)).SetBool(target.Uint() != 0)
+			case !isField:
+				if extraMap.IsNil() {
+					extraMap.Set(reflect.MakeMap(extra.typ))
 				}
-				v.SetMapIndex(reflect.ValueOf(name), val)
-			} else {
-				panic("Invalid pair type (not map or struct)")
+				extraMap.SetMapIndex(reflect.ValueOf(name).Convert(extra.typ.Key()), target)
 			}
+		}
+
+		if r.encoding == EncodingXDR {
+			r.currentByte = nvpr.endByte()
+		}
+	}
+}
 
+// setDefaults applies the default values of all struct fields whose nvpairs were missing
+func (r *nvlistReader) setDefaults(v reflect.Value, plan *structPlan, seen []bool, path *nvPath) error {
+	if plan == nil {
+		return nil
+	}
+	for _, f := range plan.fields {
+		if !f.hasDefault || f.extra || f.nvflag {
+			continue
+		}
+		if i := plan.byName[f.name]; !seen[i] {
+			if err := setDefault(fieldByIndexAlloc(v, f.index), f.defaultValue); err != nil {
+				return decodeError(err, path.child(f.name), TypeUnknown, f.typ)
+			}
 		}
 	}
+	return nil
+}
+
+// nameSet detects pairs whose names violate the UniqueName and UniqueNameType flags of an nvlist
+type nameSet struct {
+	flags uint32
+	seen  map[nameSetKey]bool
+}
+
+type nameSetKey struct {
+	name string
+	typ  Type
+}
+
+// newNameSet returns a nameSet for an nvlist with the given nvflag, outside of strict mode it accepts
+// all names
+func (r *nvlistReader) newNameSet(flags uint32) *nameSet {
+	if !r.strict || flags&(UniqueName|UniqueNameType) == 0 {
+		return nil
+	}
+	return &nameSet{flags: flags, seen: make(map[nameSetKey]bool)}
+}
+
+// add records a pair and returns false if the flags don't allow it next to the previous ones
+func (s *nameSet) add(name string, t Type) bool {
+	if s == nil {
+		return true
+	}
+	key := nameSetKey{name: name}
+	if s.flags&UniqueName == 0 {
+		key.typ = t
+	}
+	if s.seen[key] {
+		return false
+	}
+	s.seen[key] = true
+	return true
 }
@@ -0,0 +1,223 @@
+package nvlist
+
+import "reflect"
+
+// ChangeKind tells how a value differs between the nvlists compared by Diff
+type ChangeKind int
+
+const (
+	// ChangeAdded values only exist in the second nvlist
+	ChangeAdded ChangeKind = iota + 1
+	// ChangeRemoved values only exist in the first nvlist
+	ChangeRemoved
+	// ChangeModified values exist in both nvlists with different types or values
+	ChangeModified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// Change is a single difference found by Diff. Old and New have the Go types documented on Pair,
+// they aren't copied and must not be modified.
+type Change struct {
+	Kind ChangeKind
+	// Path of the value, for example vdev_tree.children[2].path
+	Path string
+	// OldType and Old are the type and value in the first nvlist, TypeUnknown and nil for added
+	// values
+	OldType Type
+	Old     interface{}
+	// NewType and New are the type and value in the second nvlist, TypeUnknown and nil for removed
+	// values
+	NewType Type
+	New     interface{}
+}
+
+// ToList converts v, which can be anything Marshal accepts, into a List by encoding and decoding it.
+// Maps are converted in the order of their keys. The result never shares memory with v.
+func ToList(v interface{}) (*List, error) {
+	data, err := MarshalWithOptions(v, EncoderOptions{Canonical: true})
+	if err != nil {
+		return nil, err
+	}
+	l := new(List)
+	if err := Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// asList returns v if it is a List and converts it with ToList otherwise
+func asList(v interface{}) (*List, error) {
+	switch v := v.(type) {
+	case *List:
+		return v, nil
+	case List:
+		return &v, nil
+	}
+	return ToList(v)
+}
+
+// Diff compares the nvlists a and b, which are converted with ToList unless they already are Lists,
+// and returns the differences between them. Nested nvlists and the elements of nvlist arrays are
+// compared recursively, all other values are reported as modified if their types or values differ.
+// In lists with duplicate names, the n-th pairs with a name in both lists are compared with each
+// other. Removed and modified values are reported in the order of a, followed by the added ones in
+// the order of b, on each level of nesting.
+func Diff(a, b interface{}) ([]Change, error) {
+	la, err := asList(a)
+	if err != nil {
+		return nil, err
+	}
+	lb, err := asList(b)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	diffLists(la, lb, nil, &changes)
+	return changes, nil
+}
+
+func diffLists(a, b *List, path *nvPath, changes *[]Change) {
+	byName := make(map[string][]*Pair)
+	for i := range b.Pairs {
+		byName[b.Pairs[i].Name] = append(byName[b.Pairs[i].Name], &b.Pairs[i])
+	}
+	seen := make(map[string]int)
+	for i := range a.Pairs {
+		p := &a.Pairs[i]
+		n := seen[p.Name]
+		seen[p.Name]++
+		if n >= len(byName[p.Name]) {
+			*changes = append(*changes, Change{Kind: ChangeRemoved, Path: path.child(p.Name).String(), OldType: p.Type, Old: p.Value})
+			continue
+		}
+		diffValues(p.Type, p.Value, byName[p.Name][n].Type, byName[p.Name][n].Value, path.child(p.Name), changes)
+	}
+	counts := make(map[string]int)
+	for i := range b.Pairs {
+		p := &b.Pairs[i]
+		n := counts[p.Name]
+		counts[p.Name]++
+		if n >= seen[p.Name] {
+			*changes = append(*changes, Change{Kind: ChangeAdded, Path: path.child(p.Name).String(), NewType: p.Type, New: p.Value})
+		}
+	}
+}
+
+func diffValues(oldType Type, oldVal interface{}, newType Type, newVal interface{}, path *nvPath, changes *[]Change) {
+	if oldType == newType {
+		switch oldType {
+		case TypeNvlist:
+			oldList, ok1 := oldVal.(*List)
+			newList, ok2 := newVal.(*List)
+			if ok1 && ok2 && oldList != nil && newList != nil {
+				diffLists(oldList, newList, path, changes)
+				return
+			}
+		case TypeNvlistArray:
+			oldLists, ok1 := oldVal.([]*List)
+			newLists, ok2 := newVal.([]*List)
+			if ok1 && ok2 {
+				for i, l := range oldLists {
+					if i >= len(newLists) {
+						*changes = append(*changes, Change{Kind: ChangeRemoved, Path: path.element(i).String(), OldType: TypeNvlist, Old: l})
+						continue
+					}
+					diffValues(TypeNvlist, l, TypeNvlist, newLists[i], path.element(i), changes)
+				}
+				for i := len(oldLists); i < len(newLists); i++ {
+					*changes = append(*changes, Change{Kind: ChangeAdded, Path: path.element(i).String(), NewType: TypeNvlist, New: newLists[i]})
+				}
+				return
+			}
+		}
+		if reflect.DeepEqual(oldVal, newVal) {
+			return
+		}
+	}
+	*changes = append(*changes, Change{Kind: ChangeModified, Path: path.String(), OldType: oldType, Old: oldVal, NewType: newType, New: newVal})
+}
+
+// MergePolicy selects how Merge treats pairs which exist in both nvlists
+type MergePolicy int
+
+const (
+	// MergeReplace works like nvlist_merge: each pair of src is added to dst like with Put, so it
+	// replaces the pairs of dst with the same name, or name and type with UniqueNameType. Nested
+	// nvlists are replaced as a whole.
+	MergeReplace MergePolicy = iota
+	// MergeRecursive works like MergeReplace, but nested nvlists which exist in both lists with the
+	// same name are merged recursively instead of being replaced. Nvlist arrays are replaced.
+	MergeRecursive
+	// MergeKeep only adds the pairs of src whose names don't exist in dst yet, nested nvlists are
+	// merged recursively. It can be used to fill in defaults.
+	MergeKeep
+)
+
+// Merge adds the pairs of src to dst according to policy. src is converted with ToList unless it
+// already is a List. The values of src are copied, so dst never shares memory with it.
+func Merge(dst *List, src interface{}, policy MergePolicy) error {
+	l, err := asList(src)
+	if err != nil {
+		return err
+	}
+	mergeLists(dst, l, policy)
+	return nil
+}
+
+func mergeLists(dst, src *List, policy MergePolicy) {
+	for _, p := range src.Pairs {
+		if policy != MergeReplace && p.Type == TypeNvlist {
+			if existing := dst.Get(p.Name); existing != nil && existing.Type == TypeNvlist {
+				dstList, ok1 := existing.Value.(*List)
+				srcList, ok2 := p.Value.(*List)
+				if ok1 && ok2 && dstList != nil && srcList != nil {
+					mergeLists(dstList, srcList, policy)
+					continue
+				}
+			}
+		}
+		if policy == MergeKeep && dst.Get(p.Name) != nil {
+			continue
+		}
+		dst.Put(p.Name, p.Type, cloneValue(p.Value))
+	}
+}
+
+// cloneValue returns a deep copy of the value of a Pair
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *List:
+		if v == nil {
+			return v
+		}
+		l := &List{Flags: v.Flags, Pairs: make([]Pair, len(v.Pairs))}
+		for i, p := range v.Pairs {
+			l.Pairs[i] = Pair{Name: p.Name, Type: p.Type, Value: cloneValue(p.Value)}
+		}
+		return l
+	case []*List:
+		lists := make([]*List, len(v))
+		for i, l := range v {
+			lists[i] = cloneValue(l).(*List)
+		}
+		return lists
+	}
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Slice || val.IsNil() {
+		return v
+	}
+	out := reflect.MakeSlice(val.Type(), val.Len(), val.Len())
+	reflect.Copy(out, val)
+	return out.Interface()
+}
@@ -4,30 +4,115 @@ import (
 	"encoding/binary"
 	"math"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 )
 
-// Marshal serializes the given data into a ZFS-style nvlist
+// Marshaler is implemented by types which control their own nvlist representation. MarshalNvlist
+// returns the value to encode in place of the original one, for example a primitive, a map or a
+// struct. It must not return a value of its own type.
+type Marshaler interface {
+	MarshalNvlist() (interface{}, error)
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+// EncoderOptions contains all options for encoding nvlists
+type EncoderOptions struct {
+	// Encoding selects the encoding of the nvlist, by default EncodingNative. EncodingXDR produces
+	// nvlists as found in vdev labels and zpool.cache.
+	Encoding Encoding
+	// ByteOrder is either binary.LittleEndian (the default) or binary.BigEndian. XDR is always big
+	// endian, there it only selects the host endianness recorded in the header.
+	ByteOrder binary.ByteOrder
+	// Flags is the nvflag of all nvlists produced from maps and structs without an nvflag field,
+	// zero selects UniqueName. Lists always keep their own flags.
+	Flags uint32
+	// Canonical writes the entries of maps sorted by name instead of in Go's random map order, so
+	// equal values always produce identical bytes. Structs and Lists always keep their order.
+	Canonical bool
+}
+
+// Marshal serializes the given data into a ZFS-style nvlist. All errors are of type *EncodeError.
 func Marshal(val interface{}) ([]byte, error) {
+	return MarshalWithOptions(val, EncoderOptions{})
+}
+
+// AppendMarshal appends the nvlist encoding of val to dst and returns the extended buffer
+func AppendMarshal(dst []byte, val interface{}) ([]byte, error) {
+	return AppendMarshalWithOptions(dst, val, EncoderOptions{})
+}
+
+// maxPooledBuffer is the capacity up to which encoding buffers are reused
+const maxPooledBuffer = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// marshalPooled encodes val into a buffer from the pool and calls fn with the result, which
+// must not be retained after fn returns
+func marshalPooled(val interface{}, opts EncoderOptions, fn func([]byte) error) error {
+	buf := bufferPool.Get().(*[]byte)
+	data, err := AppendMarshalWithOptions((*buf)[:0], val, opts)
+	if err == nil {
+		err = fn(data)
+		*buf = data[:0]
+	}
+	if cap(*buf) <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+	return err
+}
+
+// MarshalWithOptions serializes the given data into a ZFS-style nvlist with the given options
+func MarshalWithOptions(val interface{}, opts EncoderOptions) ([]byte, error) {
+	var out []byte
+	err := marshalPooled(val, opts, func(data []byte) error {
+		out = append(make([]byte, 0, len(data)), data...)
+		return nil
+	})
+	return out, err
+}
+
+// AppendMarshalWithOptions appends the nvlist encoding of val with the given options to dst and
+// returns the extended buffer
+func AppendMarshalWithOptions(dst []byte, val interface{}, opts EncoderOptions) ([]byte, error) {
+	v, err := marshalValue(reflect.ValueOf(val))
+	if err != nil {
+		return nil, encodeError(err, nil, reflect.TypeOf(val))
+	}
 	writer := nvlistWriter{
-		flags: uniqueNameFlag,
+		nvlist:       dst,
+		encoding:     opts.Encoding,
+		endianness:   opts.ByteOrder,
+		defaultFlags: opts.Flags,
+		canonical:    opts.Canonical,
+	}
+	if writer.defaultFlags == 0 {
+		writer.defaultFlags = UniqueName
 	}
+	writer.flags = writer.nvlistFlags(v)
 	if err := writer.writeNvHeader(); err != nil {
-		return nil, err
+		return nil, &EncodeError{Err: err}
 	}
-	if err := writer.writeNvPairs(reflect.ValueOf(val)); err != nil {
+	if err := writer.writeNvPairs(v, nil); err != nil {
 		return nil, err
 	}
 	return writer.nvlist, nil
 }
 
 type nvlistWriter struct {
-	nvlist                 []byte
-	nvpairStartByte        int
-	modeWriteFromStartByte bool
-	endianness             binary.ByteOrder
-	flags                  uint32
-	version                int32
+	nvlist     []byte
+	endianness binary.ByteOrder
+	encoding   Encoding
+	flags      uint32
+	version    int32
+	// defaultFlags is the nvflag of nvlists encoded from maps and structs
+	defaultFlags uint32
+	// canonical sorts map entries by name
+	canonical bool
 }
 
 func (w *nvlistWriter) WriteByte(c byte) error {
@@ -35,65 +120,123 @@ func (w *nvlistWriter) WriteByte(c byte) error {
 	return nil
 }
 
-func (w *nvlistWriter) skipN(len int) {
-	for i := 0; i < len; i++ {
-		w.nvlist = append(w.nvlist, 0x00)
+// grow makes sure the next n bytes can be written without reallocating
+func (w *nvlistWriter) grow(n int) {
+	if cap(w.nvlist)-len(w.nvlist) >= n {
+		return
 	}
+	buf := make([]byte, len(w.nvlist), 2*cap(w.nvlist)+n)
+	copy(buf, w.nvlist)
+	w.nvlist = buf
 }
 
-func (w *nvlistWriter) skipToAlign() {
-	var padSize int
-	if (len(w.nvlist)-w.nvpairStartByte)%8 != 0 {
-		padSize = 8 - ((len(w.nvlist) - w.nvpairStartByte) % 8)
+func (w *nvlistWriter) skipN(n int) {
+	w.nvlist = append(w.nvlist, make([]byte, n)...)
+}
+
+// skipToAlign pads the nvpair starting at startByte to the next 8-byte boundary in native and to
+// the next 4-byte boundary in XDR encoding
+func (w *nvlistWriter) skipToAlign(startByte int) {
+	alignment := 8
+	if w.encoding == EncodingXDR {
+		alignment = 4
 	}
-	for i := 0; i < padSize; i++ {
-		w.WriteByte(0x0)
+	if rest := (len(w.nvlist) - startByte) % alignment; rest != 0 {
+		w.skipN(alignment - rest)
 	}
 }
 
-func (w *nvlistWriter) writeInt(val interface{}) error {
-	return binary.Write(w, w.endianness, val)
+// writeNumber writes the lowest size bytes of val. XDR has a minimum unit of 4 bytes, so smaller
+// numbers are widened, val needs to be sign-extended for signed numbers.
+func (w *nvlistWriter) writeNumber(size int, val uint64) {
+	if w.encoding == EncodingXDR && size < 4 {
+		size = 4
+	}
+	var buf [8]byte
+	switch size {
+	case 1:
+		buf[0] = byte(val)
+	case 2:
+		w.endianness.PutUint16(buf[:], uint16(val))
+	case 4:
+		w.endianness.PutUint32(buf[:], uint32(val))
+	case 8:
+		w.endianness.PutUint64(buf[:], val)
+	default:
+		panic("Invalid number size inside encoder")
+	}
+	w.nvlist = append(w.nvlist, buf[:size]...)
 }
 
+// writeString writes a single string. Native strings are null-terminated, XDR strings are
+// length-prefixed and padded to 4 bytes.
 func (w *nvlistWriter) writeString(str string) error {
-	for i := 0; i < len(str); i++ {
-		if str[i] == 0x00 {
+	if strings.IndexByte(str, 0x00) != -1 {
+		return ErrInvalidValue
+	}
+	if w.encoding == EncodingXDR {
+		if len(str) >= math.MaxInt32 {
 			return ErrInvalidValue
 		}
-		w.nvlist = append(w.nvlist, str[i])
+		w.writeNumber(4, uint64(len(str)))
+		w.nvlist = append(w.nvlist, str...)
+		w.skipToAlign(len(w.nvlist) - len(str))
+		return nil
 	}
+	w.nvlist = append(w.nvlist, str...)
 	w.nvlist = append(w.nvlist, 0x00) // Null byte
 	return nil
 }
 
-func (w *nvlistWriter) Write(buf []byte) (int, error) {
-	if w.modeWriteFromStartByte {
-		for i, b := range buf {
-			w.nvlist[w.nvpairStartByte+i] = b
-		}
-		w.nvpairStartByte += len(buf)
-	} else {
-		for _, b := range buf {
-			w.nvlist = append(w.nvlist, b)
-		}
+// writeBool writes a boolean_t, which is always 4 bytes wide
+func (w *nvlistWriter) writeBool(b bool) {
+	var val uint64
+	if b {
+		val = 1
+	}
+	w.writeNumber(4, val)
+}
+
+// writeArrayLength writes the element count XDR prefixes arrays with
+func (w *nvlistWriter) writeArrayLength(n int) {
+	if w.encoding == EncodingXDR {
+		w.writeNumber(4, uint64(n))
 	}
+}
+
+func (w *nvlistWriter) Write(buf []byte) (int, error) {
+	w.nvlist = append(w.nvlist, buf...)
 	return len(buf), nil
 }
 
 func (w *nvlistWriter) writeNvHeader() error {
-	if err := w.WriteByte(byte(EncodingNative)); err != nil {
-		return err
+	if w.encoding != EncodingNative && w.encoding != EncodingXDR {
+		return ErrInvalidEncoding
 	}
-	// TODO: Actually deal with BE
-	if err := w.WriteByte(littleEndian); err != nil {
+	if err := w.WriteByte(byte(w.encoding)); err != nil {
 		return err
 	}
-	w.endianness = binary.LittleEndian
+	switch w.endianness {
+	case nil, binary.LittleEndian:
+		w.endianness = binary.LittleEndian
+		if err := w.WriteByte(littleEndian); err != nil {
+			return err
+		}
+	case binary.BigEndian:
+		if err := w.WriteByte(bigEndian); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidEndianess
+	}
+	if w.encoding == EncodingXDR {
+		w.endianness = binary.BigEndian
+	}
 
 	w.skipN(2) // reserved
 
-	w.writeInt(w.version)
-	w.writeInt(w.flags)
+	w.writeNumber(4, uint64(w.version))
+	w.writeNumber(4, uint64(w.flags))
 
 	return nil
 }
@@ -118,202 +261,520 @@ func unpackType(t reflect.Type) reflect.Type {
 	if t.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
-	if t.Kind() == reflect.Interface {
-		t = t.Elem()
-	}
 	return t
 }
 
-func (w *nvlistWriter) startNvPair() {
-	w.nvpairStartByte = len(w.nvlist)
-	for i := 0; i < nvlistHeaderSize; i++ {
-		w.nvlist = append(w.nvlist, 0x00)
+// implementsMarshaler checks if values of type t or the values they point to implement Marshaler
+func implementsMarshaler(t reflect.Type) bool {
+	if t.Implements(marshalerType) {
+		return true
 	}
+	if t.Kind() == reflect.Ptr {
+		return implementsMarshaler(t.Elem())
+	}
+	return reflect.PtrTo(t).Implements(marshalerType)
+}
+
+// marshalerOf returns the Marshaler implemented by v or a value it points to
+func marshalerOf(v reflect.Value) (Marshaler, bool) {
+	for v.IsValid() {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() || !v.CanInterface() {
+			return nil, false
+		}
+		if v.Type().Implements(marshalerType) {
+			return v.Interface().(Marshaler), true
+		}
+		if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+			return v.Addr().Interface().(Marshaler), true
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+			break
+		}
+		v = v.Elem()
+	}
+	return nil, false
+}
+
+// marshalValue returns the value to encode in place of v. Values implementing Marshaler are
+// replaced by the result of MarshalNvlist, pointers and interfaces are unpacked.
+func marshalValue(v reflect.Value) (reflect.Value, error) {
+	if m, ok := marshalerOf(v); ok {
+		val, err := m.MarshalNvlist()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return marshalValue(reflect.ValueOf(val))
+	}
+	return unpackVal(v), nil
+}
+
+// marshalSlice runs marshalValue on all elements of v and returns them as a slice of their common
+// type. Empty slices are returned unchanged and encoded according to their Go type.
+func marshalSlice(v reflect.Value, path *nvPath) (reflect.Value, error) {
+	if v.Len() == 0 {
+		return v, nil
+	}
+	elems := make([]reflect.Value, v.Len())
+	for i := range elems {
+		elem, err := marshalValue(v.Index(i))
+		if err != nil {
+			return reflect.Value{}, encodeError(err, path.element(i), v.Type().Elem())
+		}
+		if !elem.IsValid() || i > 0 && elem.Type() != elems[0].Type() {
+			return reflect.Value{}, encodeError(ErrInvalidValue, path.element(i), v.Type().Elem())
+		}
+		elems[i] = elem
+	}
+	return reflect.Append(reflect.MakeSlice(reflect.SliceOf(elems[0].Type()), 0, len(elems)), elems...), nil
+}
+
+// numberBits returns the raw bits of a number, sign-extended to 64 bits for signed numbers
+func numberBits(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	case reflect.Float32, reflect.Float64:
+		return math.Float64bits(v.Float())
+	}
+	return v.Uint()
+}
+
+// startNvPair writes the header with the sizes left empty and the name of an nvpair and returns
+// the position at which the nvpair starts
+func (w *nvlistWriter) startNvPair(name string, nvp nvpair) (int, error) {
+	startByte := len(w.nvlist)
+	if w.encoding == EncodingXDR {
+		w.skipN(8) // Encoded and decoded size
+		if err := w.writeString(name); err != nil {
+			return 0, err
+		}
+		w.writeNumber(4, uint64(nvp.Type))
+		w.writeNumber(4, uint64(nvp.Value_elem))
+		return startByte, nil
+	}
+	w.skipN(nvlistHeaderSize)
+	if err := w.writeString(name); err != nil {
+		return 0, err
+	}
+	w.skipToAlign(startByte)
+	return startByte, nil
 }
 
-func (w *nvlistWriter) endNvPair(nvp nvpair) {
-	if nvp.Type == typeUnknown {
+// endNvPair pads the nvpair and fills in its sizes. XDR additionally records the size the value
+// would have in native encoding, so valueSize needs to contain that.
+func (w *nvlistWriter) endNvPair(startByte int, nvp nvpair, valueSize int) error {
+	if nvp.Type == TypeUnknown {
 		panic("Unknown type hit")
 	}
-	if w.nvpairStartByte == 0 {
-		panic("nvPair was not started")
+	if w.encoding == EncodingNative {
+		w.skipToAlign(startByte)
 	}
-	w.skipToAlign()
-	nvp.Size = int32(len(w.nvlist) - w.nvpairStartByte)
-	w.modeWriteFromStartByte = true
-	w.writeInt(nvp.Size)
-	w.writeInt(nvp.Name_sz)
-	w.writeInt(nvp.Reserve)
-	w.writeInt(nvp.Value_elem)
-	w.writeInt(nvp.Type)
-	w.modeWriteFromStartByte = false
-	w.nvpairStartByte = 0
+	if len(w.nvlist)-startByte >= math.MaxInt32 {
+		return ErrInvalidValue
+	}
+	nvp.Size = int32(len(w.nvlist) - startByte)
+	header := w.nvlist[startByte:]
+	if w.encoding == EncodingXDR {
+		decodedSize := align8(nvlistHeaderSize+int(nvp.Name_sz)) + align8(valueSize)
+		w.endianness.PutUint32(header[0:], uint32(nvp.Size))
+		w.endianness.PutUint32(header[4:], uint32(decodedSize))
+		return nil
+	}
+	w.endianness.PutUint32(header[0:], uint32(nvp.Size))
+	w.endianness.PutUint16(header[4:], uint16(nvp.Name_sz))
+	w.endianness.PutUint16(header[6:], uint16(nvp.Reserve))
+	w.endianness.PutUint32(header[8:], uint32(nvp.Value_elem))
+	w.endianness.PutUint32(header[12:], uint32(nvp.Type))
+	return nil
+}
+
+func align8(n int) int {
+	return (n + 7) &^ 7
 }
 
-func (w *nvlistWriter) writeNvlistHeader() {
+// writeNvlistHeader writes the header of an embedded nvlist. In native encoding this is a
+// nvlist_t with zeroed out pointers, XDR only stores version and flags.
+func (w *nvlistWriter) writeNvlistHeader(flags uint32) {
 	nvl := nvlist{
-		Nvflag: uniqueNameFlag,
+		Nvflag: flags,
+	}
+	w.writeNumber(4, uint64(nvl.Version))
+	w.writeNumber(4, uint64(nvl.Nvflag))
+	if w.encoding == EncodingXDR {
+		return
 	}
-	w.writeInt(nvl.Version)
-	w.writeInt(nvl.Nvflag)
-	w.writeInt(nvl.Priv)
-	w.writeInt(nvl.Flag)
-	w.writeInt(nvl.Pad)
+	w.writeNumber(8, nvl.Priv)
+	w.writeNumber(4, uint64(nvl.Flag))
+	w.writeNumber(4, uint64(nvl.Pad))
 }
 
-func (w *nvlistWriter) writeNvPairs(v reflect.Value) error {
+// nvlistFlags returns the nvflag of the nvlist encoded from v
+func (w *nvlistWriter) nvlistFlags(v reflect.Value) uint32 {
 	v = unpackVal(v)
+	if !v.IsValid() {
+		return w.defaultFlags
+	}
+	if v.Type() == listType {
+		return uint32(v.FieldByName("Flags").Uint())
+	}
+	if v.Type() == rawMessageType {
+		if flags, ok := rawFlags(v.Bytes()); ok {
+			return flags
+		}
+		return w.defaultFlags
+	}
+	if m, ok := pairMarshalerOf(v); ok {
+		if flags, ok := m.NvlistFlags(); ok {
+			return flags
+		}
+		return w.defaultFlags
+	}
+	if v.Kind() == reflect.Struct {
+		for _, f := range cachedStructPlan(v.Type()).fields {
+			if f.nvflag && isFlagsField(f.typ) {
+				if fv, ok := fieldByIndex(v, f.index); ok {
+					return uint32(fv.Uint())
+				}
+			}
+		}
+	}
+	return w.defaultFlags
+}
+
+// mapKeys returns the keys of the map m with string keys, sorted in canonical mode
+func (w *nvlistWriter) mapKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	if w.canonical {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	}
+	return keys
+}
+
+// writeNvlistTrailer terminates an nvlist, with 4 zero bytes in native and 8 in XDR encoding
+func (w *nvlistWriter) writeNvlistTrailer() {
+	if w.encoding == EncodingXDR {
+		w.skipN(8)
+	} else {
+		w.skipN(4)
+	}
+}
+
+// encodeError attaches the path and type to err, unless it already is an EncodeError
+func encodeError(err error, path *nvPath, t reflect.Type) error {
+	if _, ok := err.(*EncodeError); ok {
+		return err
+	}
+	return &EncodeError{Path: path.String(), GoType: t, Err: err}
+}
+
+func (w *nvlistWriter) writeNvPairs(v reflect.Value, path *nvPath) error {
+	v, err := marshalValue(v)
+	if err != nil {
+		return encodeError(err, path, nil)
+	}
 
 	if !v.IsValid() {
-		// Null pointer
+		// Null pointer, encoded as an empty nvlist
+		w.writeNvlistTrailer()
 		return nil
 	}
 
+	if v.Type() == listType {
+		l := v.Interface().(List)
+		return w.writeList(&l, path)
+	}
+	if v.Type() == rawMessageType {
+		return w.writeRawPairs(v.Bytes(), path)
+	}
+	if m, ok := pairMarshalerOf(v); ok {
+		return w.writePairs(m, path)
+	}
+
 	var names []string
 	var vals []reflect.Value
 
 	switch v.Kind() {
 	case reflect.Map:
-		keys := v.MapKeys()
-		for _, key := range keys {
-			if key.Kind() != reflect.String {
-				return ErrInvalidValue
+		if v.Type().Key().Kind() != reflect.String {
+			return encodeError(ErrInvalidValue, path, v.Type())
+		}
+		for _, key := range w.mapKeys(v) {
+			val, err := marshalValue(v.MapIndex(key))
+			if err != nil {
+				return encodeError(err, path.child(key.String()), v.Type().Elem())
 			}
-			val := unpackVal(v.MapIndex(key))
 			if val.IsValid() {
 				names = append(names, key.String())
 				vals = append(vals, val)
 			}
 		}
 	case reflect.Struct:
-		t := v.Type()
-		for i := 0; i < v.NumField(); i++ {
-			tags := strings.Split(t.Field(i).Tag.Get("nvlist"), ",")
-			name := tags[0]
-			val := unpackVal(v.Field(i))
-			if len(tags) > 1 {
-				switch tags[1] {
-				case "omitempty":
-					if isEmptyValue(val) {
-						continue
-					}
-				case "ro": // Never marshal
-					continue
+		plan := cachedStructPlan(v.Type())
+		var extra []field
+		for _, f := range plan.fields {
+			if f.extra {
+				extra = append(extra, f)
+				continue
+			}
+			if f.nvflag {
+				if !isFlagsField(f.typ) {
+					return encodeError(ErrInvalidTag, path.child(f.name), f.typ)
 				}
+				continue
+			}
+			if f.readOnly { // Never marshal
+				continue
+			}
+			fieldVal, ok := fieldByIndex(v, f.index)
+			if !ok { // Promoted through a nil pointer
+				continue
+			}
+			if f.omitEmpty && isEmptyValue(unpackVal(fieldVal)) {
+				continue
+			}
+			val, err := marshalValue(fieldVal)
+			if err != nil {
+				return encodeError(err, path.child(f.name), f.typ)
+			}
+			if f.asUint64 && val.Kind() == reflect.Bool {
+				val = reflect.ValueOf(uint64(boolToInt(val.Bool())))
 			}
 			if val.IsValid() {
-				if name == "" {
-					names = append(names, t.Field(i).Name)
-				} else {
-					names = append(names, name)
-				}
+				names = append(names, f.name)
 				vals = append(vals, val)
 			}
 		}
+		for _, f := range extra {
+			if f.readOnly {
+				continue
+			}
+			fieldVal, ok := fieldByIndex(v, f.index)
+			if !ok {
+				continue
+			}
+			m := unpackVal(fieldVal)
+			if !m.IsValid() {
+				continue
+			}
+			if !isExtraMap(m.Type()) {
+				return encodeError(ErrInvalidTag, path.child(f.name), f.typ)
+			}
+			for _, key := range w.mapKeys(m) {
+				if _, ok := plan.byName[key.String()]; ok { // Proper fields take precedence
+					continue
+				}
+				val, err := marshalValue(m.MapIndex(key))
+				if err != nil {
+					return encodeError(err, path.child(key.String()), m.Type().Elem())
+				}
+				if val.IsValid() {
+					names = append(names, key.String())
+					vals = append(vals, val)
+				}
+			}
+		}
 	default:
-		return ErrInvalidValue
+		return encodeError(ErrInvalidValue, path, v.Type())
 	}
 
 	for i := 0; i < len(names); i++ {
-		nameLen := len(names[i]) + 1
-		if nameLen >= math.MaxInt16 {
-			return ErrInvalidValue
-		}
-		nvp := nvpair{
-			Size:       0,
-			Name_sz:    int16(nameLen),
-			Value_elem: 1,
-			Type:       0,
+		pairPath := path.child(names[i])
+		if err := w.writeNvPair(names[i], vals[i], pairPath); err != nil {
+			return encodeError(err, pairPath, vals[i].Type())
 		}
+	}
+	w.writeNvlistTrailer()
+	return nil
+}
 
-		t := vals[i].Kind()
+// writeNvPair writes a single nvpair and all nvlists embedded into it
+func (w *nvlistWriter) writeNvPair(name string, val reflect.Value, path *nvPath) error {
+	nameLen := len(name) + 1
+	if nameLen >= math.MaxInt16 {
+		return ErrInvalidValue
+	}
+	nvp := nvpair{
+		Size:       0,
+		Name_sz:    int16(nameLen),
+		Value_elem: 1,
+		Type:       0,
+	}
 
-		if t == reflect.Bool && !vals[i].Bool() {
-			continue
-		}
+	t := val.Kind()
 
-		w.startNvPair()
+	// Flags are only present if they are set
+	if t == reflect.Bool && val.Type() != boolValueType && !val.Bool() {
+		return nil
+	}
+
+	switch t {
+	case reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32, reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Float64:
+		nvp.Type = nvtypeFromKind(t)
+		if val.Type() == hrtimeType {
+			nvp.Type = TypeHrtime
+		}
+	case reflect.Bool:
+		nvp.Type = TypeBoolean
+		nvp.Value_elem = 0
+		if val.Type() == boolValueType {
+			nvp.Type = TypeBooleanValue
+			nvp.Value_elem = 1
+		}
+	case reflect.Map, reflect.Struct:
+		nvp.Type = TypeNvlist
+	case reflect.String:
+		nvp.Type = TypeString
+	case reflect.Array, reflect.Slice:
+		if val.Type() == rawMessageType {
+			nvp.Type = TypeNvlist
+			break
+		}
+		if val.Len() >= math.MaxInt32 {
+			return ErrInvalidValue
+		}
+		if unpackType(val.Type().Elem()) == rawMessageType {
+			nvp.Type = TypeNvlistArray
+			nvp.Value_elem = int32(val.Len())
+			break
+		}
+		if elemType := val.Type().Elem(); elemType.Kind() == reflect.Interface || implementsMarshaler(elemType) {
+			var err error
+			if val, err = marshalSlice(val, path); err != nil {
+				return err
+			}
+		}
+		nvp.Value_elem = int32(val.Len())
+		elemKind := unpackType(val.Type().Elem()).Kind()
+		switch elemKind {
+		case reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32, reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Bool, reflect.String, reflect.Struct, reflect.Map:
+			nvp.Type = nvtypeFromArrayKind(elemKind)
+		default:
+			return ErrInvalidValue
+		}
+	default:
+		return ErrInvalidValue
+	}
+	return w.writeNvPairValue(name, nvp, val, path)
+}
 
-		w.writeString(names[i])
-		w.skipToAlign()
+// writeNvPairValue writes an nvpair with the type given in nvp and the value val
+func (w *nvlistWriter) writeNvPairValue(name string, nvp nvpair, val reflect.Value, path *nvPath) error {
+	startByte, err := w.startNvPair(name, nvp)
+	if err != nil {
+		return err
+	}
 
-		switch t {
-		case reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32, reflect.Uint32, reflect.Int64, reflect.Uint64, reflect.Float64:
-			nvp.Type = nvtypeFromKind(t)
-			if err := w.writeInt(vals[i].Interface()); err != nil {
+	switch nvp.Type {
+	case TypeBoolean:
+		return w.endNvPair(startByte, nvp, 0)
+	case TypeBooleanValue:
+		w.writeBool(val.Bool())
+		return w.endNvPair(startByte, nvp, 4)
+	case TypeNvlist:
+		if w.encoding == EncodingXDR {
+			w.writeNvlistHeader(w.nvlistFlags(val))
+			if err := w.writeNvPairs(val, path); err != nil {
 				return err
 			}
-			w.endNvPair(nvp)
-		case reflect.Bool:
-			nvp.Type = typeBoolean
-			nvp.Value_elem = 0
-			w.endNvPair(nvp)
-		case reflect.Map, reflect.Struct:
-			nvp.Type = typeNvlist
-			w.writeNvlistHeader()
-			w.endNvPair(nvp)
-			if err := w.writeNvPairs(vals[i]); err != nil {
-				return nil
+			return w.endNvPair(startByte, nvp, nvlistSize)
+		}
+		w.writeNvlistHeader(w.nvlistFlags(val))
+		if err := w.endNvPair(startByte, nvp, nvlistSize); err != nil {
+			return err
+		}
+		return w.writeNvPairs(val, path)
+	case TypeString:
+		if err := w.writeString(val.String()); err != nil {
+			return err
+		}
+		return w.endNvPair(startByte, nvp, val.Len()+1)
+	case TypeByteArray:
+		// XDR encodes byte arrays as opaque data without a length prefix, which is padded to 4 bytes
+		if val.Kind() == reflect.Slice && val.Type().Elem().Kind() == reflect.Uint8 {
+			w.nvlist = append(w.nvlist, val.Bytes()...)
+		} else {
+			w.grow(val.Len())
+			for j := 0; j < val.Len(); j++ {
+				w.WriteByte(byte(unpackVal(val.Index(j)).Uint()))
+			}
+		}
+		w.skipToAlign(startByte)
+		return w.endNvPair(startByte, nvp, val.Len())
+	case TypeInt8Array, TypeUint8Array, TypeInt16Array, TypeUint16Array, TypeInt32Array, TypeUint32Array, TypeInt64Array, TypeUint64Array:
+		elemSize := nvtypeSize(nvp.Type)
+		w.writeArrayLength(val.Len())
+		if w.encoding == EncodingXDR && elemSize < 4 {
+			w.grow(4 * val.Len())
+		} else {
+			w.grow(elemSize * val.Len())
+		}
+		for j := 0; j < val.Len(); j++ {
+			elem := unpackVal(val.Index(j))
+			if !elem.IsValid() {
+				return encodeError(ErrInvalidValue, path.element(j), val.Type().Elem())
 			}
-		case reflect.String:
-			nvp.Type = typeString
-			w.writeString(vals[i].String())
-			w.endNvPair(nvp)
-		case reflect.Array, reflect.Slice:
-			if vals[i].Len() >= math.MaxInt32 {
-				return ErrInvalidValue
+			w.writeNumber(elemSize, numberBits(elem))
+		}
+		return w.endNvPair(startByte, nvp, elemSize*val.Len())
+	case TypeBooleanArray:
+		w.writeArrayLength(val.Len())
+		for j := 0; j < val.Len(); j++ {
+			elem := unpackVal(val.Index(j))
+			if !elem.IsValid() {
+				return encodeError(ErrInvalidValue, path.element(j), val.Type().Elem())
 			}
-			nvp.Value_elem = int32(vals[i].Len())
-			elemKind := unpackType(vals[i].Type().Elem()).Kind()
-			switch elemKind {
-			case reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32, reflect.Uint32, reflect.Int64, reflect.Uint64:
-				nvp.Type = nvtypeFromArrayKind(elemKind)
-				for j := 0; j < vals[i].Len(); j++ {
-					if err := w.writeInt(vals[i].Index(j).Interface()); err != nil {
-						return err
-					}
-				}
-				w.endNvPair(nvp)
-			case reflect.Bool:
-				nvp.Type = typeBooleanArray
-				for j := 0; j < vals[i].Len(); j++ {
-					var val int32
-					if unpackVal(vals[i].Index(j)).Bool() {
-						val = 1
-					}
-					if err := w.writeInt(val); err != nil {
-						return err
-					}
-				}
-				w.endNvPair(nvp)
-			case reflect.String:
-				nvp.Type = typeStringArray
-				w.skipN(8 * vals[i].Len()) // Skip pointers
-				for j := 0; j < vals[i].Len(); j++ {
-					w.writeString(unpackVal(vals[i].Index(j)).String())
-				}
-				w.endNvPair(nvp)
-			case reflect.Struct, reflect.Map:
-				nvp.Type = typeNvlistArray
-				w.skipN(8 * vals[i].Len()) // Skip pointers
-				for j := 0; j < vals[i].Len(); j++ {
-					w.writeNvlistHeader()
-				}
-				w.endNvPair(nvp)
-				for j := 0; j < vals[i].Len(); j++ {
-					if err := w.writeNvPairs(vals[i].Index(j)); err != nil {
-						return err
-					}
+			w.writeBool(elem.Bool())
+		}
+		return w.endNvPair(startByte, nvp, 4*val.Len())
+	case TypeStringArray:
+		valueSize := 8 * val.Len()
+		if w.encoding == EncodingNative {
+			w.skipN(8 * val.Len()) // Skip pointers
+		}
+		for j := 0; j < val.Len(); j++ {
+			elem := unpackVal(val.Index(j))
+			if !elem.IsValid() {
+				return encodeError(ErrInvalidValue, path.element(j), val.Type().Elem())
+			}
+			if err := w.writeString(elem.String()); err != nil {
+				return encodeError(err, path.element(j), elem.Type())
+			}
+			valueSize += elem.Len() + 1
+		}
+		return w.endNvPair(startByte, nvp, valueSize)
+	case TypeNvlistArray:
+		valueSize := (8 + nvlistSize) * val.Len()
+		for j := 0; j < val.Len(); j++ {
+			if !unpackVal(val.Index(j)).IsValid() {
+				return encodeError(ErrInvalidValue, path.element(j), val.Type().Elem())
+			}
+		}
+		if w.encoding == EncodingXDR {
+			for j := 0; j < val.Len(); j++ {
+				w.writeNvlistHeader(w.nvlistFlags(val.Index(j)))
+				if err := w.writeNvPairs(val.Index(j), path.element(j)); err != nil {
+					return err
 				}
-			default:
-				return ErrInvalidValue
 			}
-		default:
-			return ErrInvalidValue
+			return w.endNvPair(startByte, nvp, valueSize)
+		}
+		w.skipN(8 * val.Len()) // Skip pointers
+		for j := 0; j < val.Len(); j++ {
+			w.writeNvlistHeader(w.nvlistFlags(val.Index(j)))
 		}
+		if err := w.endNvPair(startByte, nvp, valueSize); err != nil {
+			return err
+		}
+		for j := 0; j < val.Len(); j++ {
+			if err := w.writeNvPairs(val.Index(j), path.element(j)); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	w.skipN(4) // 4 byte trailer
-	return nil
+	// Numbers
+	w.writeNumber(nvtypeSize(nvp.Type), numberBits(val))
+	return w.endNvPair(startByte, nvp, nvtypeSize(nvp.Type))
 }
 
 func isEmptyValue(v reflect.Value) bool {
@@ -0,0 +1,122 @@
+package nvlist
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrTypeMismatch is returned inside a DecodeError if the type of an nvpair doesn't fit the Go value
+// it should be decoded into.
+var ErrTypeMismatch = errors.New("the nvpair type cannot be stored in the Go type")
+
+// ErrOverflow is returned inside a DecodeError if a number is out of the range of the Go type it
+// should be decoded into.
+var ErrOverflow = errors.New("the nvpair value overflows the Go type")
+
+// ErrLossyConversion is returned inside a DecodeError in strict mode if a number can only be
+// decoded into the Go type by losing precision, for example a fraction into an integer.
+var ErrLossyConversion = errors.New("the nvpair value cannot be stored in the Go type without loss")
+
+// DecodeError describes a problem encountered while decoding an nvlist. Structural problems with
+// the data (ErrInvalidData and similar) abort decoding, values which don't fit their Go type
+// (ErrTypeMismatch, ErrOverflow and ErrLossyConversion) are left untouched and decoding continues,
+// the first of them is returned.
+type DecodeError struct {
+	// Path of the affected nvpair, for example vdev_tree.children[2].path. Empty if the problem is
+	// not specific to an nvpair.
+	Path string
+	// Type of the nvpair on the wire, TypeUnknown if it is not known
+	Type Type
+	// GoType is the type of the value the nvpair should have been decoded into, nil if not known
+	GoType reflect.Type
+	// Err is the underlying error
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	var b strings.Builder
+	b.WriteString("nvlist: cannot decode")
+	if e.Type != TypeUnknown {
+		b.WriteString(" ")
+		b.WriteString(e.Type.String())
+	}
+	if e.Path != "" {
+		b.WriteString(" ")
+		b.WriteString(e.Path)
+	}
+	if e.GoType != nil {
+		b.WriteString(" into Go value of type ")
+		b.WriteString(e.GoType.String())
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeError describes a problem encountered while encoding a Go value into an nvlist
+type EncodeError struct {
+	// Path of the affected value, for example vdev_tree.children[2].path. Empty if the problem is
+	// not specific to a value inside the nvlist.
+	Path string
+	// GoType is the type of the affected value, nil if not known
+	GoType reflect.Type
+	// Err is the underlying error
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	var b strings.Builder
+	b.WriteString("nvlist: cannot encode")
+	if e.Path != "" {
+		b.WriteString(" ")
+		b.WriteString(e.Path)
+	}
+	if e.GoType != nil {
+		b.WriteString(" of type ")
+		b.WriteString(e.GoType.String())
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// nvPath is the path of an nvpair inside nested nvlists. It is only rendered into a string when
+// an error occurs.
+type nvPath struct {
+	parent *nvPath
+	name   string
+	// index is the index inside an nvlist array or -1
+	index int
+}
+
+func (p *nvPath) child(name string) *nvPath {
+	return &nvPath{parent: p, name: name, index: -1}
+}
+
+func (p *nvPath) element(i int) *nvPath {
+	return &nvPath{parent: p, index: i}
+}
+
+func (p *nvPath) String() string {
+	if p == nil {
+		return ""
+	}
+	parent := p.parent.String()
+	if p.index >= 0 {
+		return parent + "[" + strconv.Itoa(p.index) + "]"
+	}
+	if parent == "" {
+		return p.name
+	}
+	return parent + "." + p.name
+}
@@ -1,12 +1,44 @@
+//go:build gofuzz
 // +build gofuzz
 
 package nvlist
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Fuzz checks that decoding arbitrary data with the default limits never panics or exhausts
+// resources and that every nvlist it accepts survives a round trip: it is decoded into a List,
+// encoded again with the same encoding and byte order, decoded and encoded once more, and both
+// encodings have to be identical.
 func Fuzz(data []byte) int {
 	out := new(interface{})
-	err := Unmarshal(data, &out)
-	if err == nil {
-		return 1
+	Unmarshal(data, out)
+
+	var l List
+	if err := Unmarshal(data, &l); err != nil {
+		return 0
+	}
+	opts := EncoderOptions{Encoding: Encoding(data[0]), ByteOrder: binary.BigEndian}
+	if data[1] == littleEndian {
+		opts.ByteOrder = binary.LittleEndian
+	}
+	first, err := MarshalWithOptions(&l, opts)
+	if err != nil {
+		panic(fmt.Sprintf("encoding a decoded nvlist failed: %v", err))
+	}
+	var again List
+	if err := Unmarshal(first, &again); err != nil {
+		panic(fmt.Sprintf("decoding an encoded nvlist failed: %v", err))
+	}
+	second, err := MarshalWithOptions(&again, opts)
+	if err != nil {
+		panic(fmt.Sprintf("encoding a decoded nvlist failed: %v", err))
+	}
+	if !bytes.Equal(first, second) {
+		panic("the nvlist changed in the round trip")
 	}
-	return 0
+	return 1
 }
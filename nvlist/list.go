@@ -0,0 +1,336 @@
+package nvlist
+
+import (
+	"math"
+	"reflect"
+)
+
+// List is an nvlist which keeps the order, the exact types and duplicate names of its pairs. It can
+// be used everywhere a struct or map can be used, encoding a decoded List reproduces the original
+// nvlist.
+type List struct {
+	// Flags is the nvflag of the list, usually UniqueName. Lists without it can contain several
+	// pairs with the same name.
+	Flags uint32
+	Pairs []Pair
+}
+
+// Pair is a single nvpair inside a List. The Go type of Value depends on Type:
+//
+//	boolean                       nil, the pair only consists of its name
+//	boolean_value                 bool
+//	byte, uint8                   uint8
+//	int8, int16, ..., uint64      int8, int16, ..., uint64
+//	hrtime                        Hrtime
+//	double                        float64
+//	string                        string
+//	nvlist                        *List
+//	byte_array, uint8_array       []uint8
+//	int8_array, ..., uint64_array []int8, ..., []uint64
+//	boolean_array                 []bool
+//	string_array                  []string
+//	nvlist_array                  []*List
+type Pair struct {
+	Name  string
+	Type  Type
+	Value interface{}
+}
+
+var listType = reflect.TypeOf(List{})
+
+var listValueTypes = map[Type]reflect.Type{
+	TypeBooleanValue: reflect.TypeOf(false),
+	TypeByte:         reflect.TypeOf(uint8(0)),
+	TypeInt8:         reflect.TypeOf(int8(0)),
+	TypeUint8:        reflect.TypeOf(uint8(0)),
+	TypeInt16:        reflect.TypeOf(int16(0)),
+	TypeUint16:       reflect.TypeOf(uint16(0)),
+	TypeInt32:        reflect.TypeOf(int32(0)),
+	TypeUint32:       reflect.TypeOf(uint32(0)),
+	TypeInt64:        reflect.TypeOf(int64(0)),
+	TypeUint64:       reflect.TypeOf(uint64(0)),
+	TypeHrtime:       hrtimeType,
+	TypeDouble:       reflect.TypeOf(float64(0)),
+	TypeString:       reflect.TypeOf(""),
+	TypeNvlist:       reflect.TypeOf(&List{}),
+	TypeByteArray:    reflect.TypeOf([]uint8{}),
+	TypeInt8Array:    reflect.TypeOf([]int8{}),
+	TypeUint8Array:   reflect.TypeOf([]uint8{}),
+	TypeInt16Array:   reflect.TypeOf([]int16{}),
+	TypeUint16Array:  reflect.TypeOf([]uint16{}),
+	TypeInt32Array:   reflect.TypeOf([]int32{}),
+	TypeUint32Array:  reflect.TypeOf([]uint32{}),
+	TypeInt64Array:   reflect.TypeOf([]int64{}),
+	TypeUint64Array:  reflect.TypeOf([]uint64{}),
+	TypeBooleanArray: reflect.TypeOf([]bool{}),
+	TypeStringArray:  reflect.TypeOf([]string{}),
+	TypeNvlistArray:  reflect.TypeOf([]*List{}),
+}
+
+// NewList returns an empty List with unique names, like the nvlists produced from structs and maps
+func NewList() *List {
+	return &List{Flags: UniqueName}
+}
+
+// Get returns the first pair with the given name or nil if there is none. The pair can be modified
+// in place.
+func (l *List) Get(name string) *Pair {
+	for i := range l.Pairs {
+		if l.Pairs[i].Name == name {
+			return &l.Pairs[i]
+		}
+	}
+	return nil
+}
+
+// GetAll returns all pairs with the given name in their order. Lists without UniqueName can contain
+// several, for example events. The pairs can be modified in place.
+func (l *List) GetAll(name string) []*Pair {
+	var pairs []*Pair
+	for i := range l.Pairs {
+		if l.Pairs[i].Name == name {
+			pairs = append(pairs, &l.Pairs[i])
+		}
+	}
+	return pairs
+}
+
+// Add appends a pair to the list, even if there already is one with the same name
+func (l *List) Add(name string, t Type, value interface{}) *List {
+	l.Pairs = append(l.Pairs, Pair{Name: name, Type: t, Value: value})
+	return l
+}
+
+// Set replaces the first pair with the given name or appends a new one if there is none
+func (l *List) Set(name string, t Type, value interface{}) *List {
+	if p := l.Get(name); p != nil {
+		p.Type = t
+		p.Value = value
+		return l
+	}
+	return l.Add(name, t, value)
+}
+
+// Put adds a pair like libnvpair does according to the flags of the list: with UniqueName it
+// replaces all pairs with the same name, with UniqueNameType those with the same name and type.
+// Otherwise it just appends the pair.
+func (l *List) Put(name string, t Type, value interface{}) *List {
+	if l.Flags&(UniqueName|UniqueNameType) != 0 {
+		pairs := l.Pairs[:0]
+		for _, p := range l.Pairs {
+			if p.Name != name || l.Flags&UniqueName == 0 && p.Type != t {
+				pairs = append(pairs, p)
+			}
+		}
+		for i := len(pairs); i < len(l.Pairs); i++ {
+			l.Pairs[i] = Pair{}
+		}
+		l.Pairs = pairs
+	}
+	return l.Add(name, t, value)
+}
+
+// Remove removes all pairs with the given name and returns if there were any
+func (l *List) Remove(name string) bool {
+	pairs := l.Pairs[:0]
+	for _, p := range l.Pairs {
+		if p.Name != name {
+			pairs = append(pairs, p)
+		}
+	}
+	removed := len(pairs) != len(l.Pairs)
+	for i := len(pairs); i < len(l.Pairs); i++ {
+		l.Pairs[i] = Pair{}
+	}
+	l.Pairs = pairs
+	return removed
+}
+
+// AddFlag appends a pair of type boolean
+func (l *List) AddFlag(name string) *List {
+	return l.Add(name, TypeBoolean, nil)
+}
+
+// AddBool appends a pair of type boolean_value
+func (l *List) AddBool(name string, value bool) *List {
+	return l.Add(name, TypeBooleanValue, value)
+}
+
+// AddUint64 appends a pair of type uint64
+func (l *List) AddUint64(name string, value uint64) *List {
+	return l.Add(name, TypeUint64, value)
+}
+
+// AddInt64 appends a pair of type int64
+func (l *List) AddInt64(name string, value int64) *List {
+	return l.Add(name, TypeInt64, value)
+}
+
+// AddString appends a pair of type string
+func (l *List) AddString(name string, value string) *List {
+	return l.Add(name, TypeString, value)
+}
+
+// AddList appends a pair of type nvlist
+func (l *List) AddList(name string, value *List) *List {
+	return l.Add(name, TypeNvlist, value)
+}
+
+// AddLists appends a pair of type nvlist_array
+func (l *List) AddLists(name string, value []*List) *List {
+	return l.Add(name, TypeNvlistArray, value)
+}
+
+// GetBool returns true if the first pair with the given name is a boolean or a true boolean_value.
+// The second return value is false if there is no such pair or it has a different type.
+func (l *List) GetBool(name string) (bool, bool) {
+	p := l.Get(name)
+	if p == nil {
+		return false, false
+	}
+	switch p.Type {
+	case TypeBoolean:
+		return true, true
+	case TypeBooleanValue:
+		b, ok := p.Value.(bool)
+		return b, ok
+	}
+	return false, false
+}
+
+// GetUint64 returns the value of the first pair with the given name if it has type uint64
+func (l *List) GetUint64(name string) (uint64, bool) {
+	if p := l.Get(name); p != nil && p.Type == TypeUint64 {
+		val, ok := p.Value.(uint64)
+		return val, ok
+	}
+	return 0, false
+}
+
+// GetInt64 returns the value of the first pair with the given name if it has type int64
+func (l *List) GetInt64(name string) (int64, bool) {
+	if p := l.Get(name); p != nil && p.Type == TypeInt64 {
+		val, ok := p.Value.(int64)
+		return val, ok
+	}
+	return 0, false
+}
+
+// GetString returns the value of the first pair with the given name if it has type string
+func (l *List) GetString(name string) (string, bool) {
+	if p := l.Get(name); p != nil && p.Type == TypeString {
+		val, ok := p.Value.(string)
+		return val, ok
+	}
+	return "", false
+}
+
+// GetList returns the value of the first pair with the given name if it has type nvlist
+func (l *List) GetList(name string) (*List, bool) {
+	if p := l.Get(name); p != nil && p.Type == TypeNvlist {
+		val, ok := p.Value.(*List)
+		return val, ok && val != nil
+	}
+	return nil, false
+}
+
+// GetLists returns the value of the first pair with the given name if it has type nvlist_array
+func (l *List) GetLists(name string) ([]*List, bool) {
+	if p := l.Get(name); p != nil && p.Type == TypeNvlistArray {
+		val, ok := p.Value.([]*List)
+		return val, ok
+	}
+	return nil, false
+}
+
+// readList reads the pairs of an nvlist with the given nvflag into l
+func (r *nvlistReader) readList(l *List, path *nvPath, flags uint32) error {
+	l.Flags = flags
+	l.Pairs = nil
+	names := r.newNameSet(flags)
+	for {
+		nvp, name, nvpr, err := r.readNvPairHeader()
+		if err != nil {
+			return decodeError(err, path, TypeUnknown, nil)
+		}
+		if nvp.Size == 0 {
+			return nil
+		}
+		if r.encoding == EncodingNative {
+			// Embedded nvlists follow the nvpair
+			r.currentByte = nvpr.endByte()
+		}
+		pairPath := path.child(name)
+		if !names.add(name, nvp.Type) {
+			return decodeError(ErrDuplicateName, pairPath, nvp.Type, nil)
+		}
+
+		var target reflect.Value
+		switch nvp.Type {
+		case TypeNvlist, TypeNvlistArray:
+			target = reflect.New(listValueTypes[nvp.Type]).Elem()
+		default:
+			target = reflect.New(emptyInterfaceType).Elem()
+		}
+		if _, err := r.readValueInto(&nvpr, nvp, target, pairPath); err != nil {
+			return err
+		}
+		pair := Pair{Name: name, Type: nvp.Type, Value: target.Interface()}
+		if nvp.Type == TypeBoolean {
+			pair.Value = nil
+		}
+		l.Pairs = append(l.Pairs, pair)
+
+		if r.encoding == EncodingXDR {
+			r.currentByte = nvpr.endByte()
+		}
+	}
+}
+
+// writeList writes the pairs of l followed by the end of the nvlist
+func (w *nvlistWriter) writeList(l *List, path *nvPath) error {
+	for i := range l.Pairs {
+		p := &l.Pairs[i]
+		pairPath := path.child(p.Name)
+		if err := w.writeListPair(p, pairPath); err != nil {
+			return encodeError(err, pairPath, reflect.TypeOf(p.Value))
+		}
+	}
+	w.writeNvlistTrailer()
+	return nil
+}
+
+// writeListPair writes a single pair of a List with exactly its type
+func (w *nvlistWriter) writeListPair(p *Pair, path *nvPath) error {
+	nameLen := len(p.Name) + 1
+	if nameLen >= math.MaxInt16 {
+		return ErrInvalidValue
+	}
+	nvp := nvpair{
+		Name_sz:    int16(nameLen),
+		Value_elem: 1,
+		Type:       p.Type,
+	}
+	if p.Type == TypeBoolean {
+		nvp.Value_elem = 0
+		return w.writeNvPairValue(p.Name, nvp, reflect.Value{}, path)
+	}
+	expected, ok := listValueTypes[p.Type]
+	if !ok {
+		return ErrUnsupportedType
+	}
+	val := reflect.ValueOf(p.Value)
+	if !val.IsValid() || val.Type() != expected {
+		return ErrTypeMismatch
+	}
+	if val.Kind() == reflect.Ptr && val.IsNil() {
+		return ErrInvalidValue
+	}
+	if val.Kind() == reflect.Slice {
+		if val.Len() >= math.MaxInt32 {
+			return ErrInvalidValue
+		}
+		nvp.Value_elem = int32(val.Len())
+	}
+	return w.writeNvPairValue(p.Name, nvp, val, path)
+}
@@ -0,0 +1,373 @@
+// Package nvjson converts nvlists to and from JSON annotated with the nvpair types. Every nvlist is
+// represented as an array of its pairs, which keeps their order and duplicate names:
+//
+//	[
+//		{"name": "ashift", "type": "uint64", "value": 12},
+//		{"name": "vdev_tree", "type": "nvlist", "value": [...]},
+//		{"name": "children", "type": "nvlist_array", "value": [[...], [...]]}
+//	]
+//
+// Type names are the ones used by libnvpair. Pairs of type boolean have no value, byte and uint8
+// arrays are arrays of numbers. Nvlists with an nvflag other than nvlist.UniqueName are represented
+// as an object {"nvflag": 0, "pairs": [...]} instead of a plain array.
+package nvjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+)
+
+type jsonPair struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type jsonList struct {
+	Nvflag uint32     `json:"nvflag"`
+	Pairs  []jsonPair `json:"pairs"`
+}
+
+// Marshal returns the annotated JSON representation of l
+func Marshal(l *nvlist.List) ([]byte, error) {
+	v, err := fromList(l)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// MarshalIndent is like Marshal, but indents the output like json.MarshalIndent
+func MarshalIndent(l *nvlist.List, prefix, indent string) ([]byte, error) {
+	v, err := fromList(l)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(v, prefix, indent)
+}
+
+// Unmarshal parses annotated JSON as produced by Marshal into a List
+func Unmarshal(data []byte) (*nvlist.List, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("nvjson: trailing data after nvlist")
+	}
+	return toList(raw, "")
+}
+
+// fromList converts l into values encoding/json marshals into the annotated representation
+func fromList(l *nvlist.List) (interface{}, error) {
+	if l == nil {
+		return nil, errors.New("nvjson: nil nvlist")
+	}
+	pairs := make([]jsonPair, 0, len(l.Pairs))
+	for _, p := range l.Pairs {
+		value, err := fromValue(p)
+		if err != nil {
+			return nil, fmt.Errorf("nvjson: pair %v: %v", p.Name, err)
+		}
+		pairs = append(pairs, jsonPair{Name: p.Name, Type: p.Type.String(), Value: value})
+	}
+	if l.Flags != nvlist.UniqueName {
+		return jsonList{Nvflag: l.Flags, Pairs: pairs}, nil
+	}
+	return pairs, nil
+}
+
+func fromValue(p nvlist.Pair) (interface{}, error) {
+	switch p.Type {
+	case nvlist.TypeBoolean:
+		return nil, nil
+	case nvlist.TypeByteArray, nvlist.TypeUint8Array:
+		// encoding/json would use base64
+		raw, ok := p.Value.([]uint8)
+		if !ok {
+			return nil, nvlist.ErrTypeMismatch
+		}
+		val := make([]uint16, len(raw))
+		for i, b := range raw {
+			val[i] = uint16(b)
+		}
+		return val, nil
+	case nvlist.TypeNvlist:
+		l, ok := p.Value.(*nvlist.List)
+		if !ok {
+			return nil, nvlist.ErrTypeMismatch
+		}
+		return fromList(l)
+	case nvlist.TypeNvlistArray:
+		lists, ok := p.Value.([]*nvlist.List)
+		if !ok {
+			return nil, nvlist.ErrTypeMismatch
+		}
+		val := make([]interface{}, len(lists))
+		for i, l := range lists {
+			var err error
+			if val[i], err = fromList(l); err != nil {
+				return nil, err
+			}
+		}
+		return val, nil
+	}
+	return p.Value, nil
+}
+
+// parseType returns the Type with the given libnvpair name
+func parseType(name string) (nvlist.Type, error) {
+	for t := nvlist.TypeBoolean; t <= nvlist.TypeDouble; t++ {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return nvlist.TypeUnknown, fmt.Errorf("unknown type %q", name)
+}
+
+// toList converts a decoded JSON value into a List, path is only used for errors
+func toList(raw interface{}, path string) (*nvlist.List, error) {
+	l := &nvlist.List{Flags: nvlist.UniqueName}
+	if obj, ok := raw.(map[string]interface{}); ok {
+		flags, err := parseUint(obj["nvflag"], 32)
+		if err != nil {
+			return nil, fmt.Errorf("nvjson: invalid nvflag of nvlist %q: %v", path, err)
+		}
+		l.Flags = uint32(flags)
+		raw = obj["pairs"]
+	}
+	rawPairs, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("nvjson: nvlist %q is neither an array nor an object", path)
+	}
+	for _, rawPair := range rawPairs {
+		obj, ok := rawPair.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("nvjson: nvlist %q contains a non-object pair", path)
+		}
+		name, ok := obj["name"].(string)
+		if !ok {
+			return nil, fmt.Errorf("nvjson: nvlist %q contains a pair without name", path)
+		}
+		pairPath := name
+		if path != "" {
+			pairPath = path + "." + name
+		}
+		typeName, _ := obj["type"].(string)
+		t, err := parseType(typeName)
+		if err != nil {
+			return nil, fmt.Errorf("nvjson: pair %q: %v", pairPath, err)
+		}
+		value, err := toValue(t, obj["value"], pairPath)
+		if err != nil {
+			return nil, fmt.Errorf("nvjson: pair %q: %v", pairPath, err)
+		}
+		l.Add(name, t, value)
+	}
+	return l, nil
+}
+
+func toValue(t nvlist.Type, raw interface{}, path string) (interface{}, error) {
+	switch t {
+	case nvlist.TypeBoolean:
+		if raw != nil {
+			return nil, errors.New("boolean pairs have no value")
+		}
+		return nil, nil
+	case nvlist.TypeBooleanValue:
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, errors.New("not a bool")
+		}
+		return b, nil
+	case nvlist.TypeString:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		return s, nil
+	case nvlist.TypeDouble:
+		n, ok := raw.(json.Number)
+		if !ok {
+			return nil, errors.New("not a number")
+		}
+		return n.Float64()
+	case nvlist.TypeNvlist:
+		return toList(raw, path)
+	case nvlist.TypeNvlistArray:
+		elems, ok := raw.([]interface{})
+		if !ok {
+			return nil, errors.New("not an array")
+		}
+		lists := make([]*nvlist.List, len(elems))
+		for i, elem := range elems {
+			var err error
+			if lists[i], err = toList(elem, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return nil, err
+			}
+		}
+		return lists, nil
+	case nvlist.TypeStringArray:
+		elems, ok := raw.([]interface{})
+		if !ok {
+			return nil, errors.New("not an array")
+		}
+		val := make([]string, len(elems))
+		for i, elem := range elems {
+			if val[i], ok = elem.(string); !ok {
+				return nil, fmt.Errorf("element %d is not a string", i)
+			}
+		}
+		return val, nil
+	case nvlist.TypeBooleanArray:
+		elems, ok := raw.([]interface{})
+		if !ok {
+			return nil, errors.New("not an array")
+		}
+		val := make([]bool, len(elems))
+		for i, elem := range elems {
+			if val[i], ok = elem.(bool); !ok {
+				return nil, fmt.Errorf("element %d is not a bool", i)
+			}
+		}
+		return val, nil
+	}
+	if elemType, ok := arrayElemType[t]; ok {
+		elems, ok := raw.([]interface{})
+		if !ok {
+			return nil, errors.New("not an array")
+		}
+		var val []interface{}
+		for i, elem := range elems {
+			n, err := toNumber(elemType, elem)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", i, err)
+			}
+			val = append(val, n)
+		}
+		return numberSlice(t, val), nil
+	}
+	return toNumber(t, raw)
+}
+
+// arrayElemType maps all numeric array types to their element types
+var arrayElemType = map[nvlist.Type]nvlist.Type{
+	nvlist.TypeByteArray:   nvlist.TypeByte,
+	nvlist.TypeInt8Array:   nvlist.TypeInt8,
+	nvlist.TypeUint8Array:  nvlist.TypeUint8,
+	nvlist.TypeInt16Array:  nvlist.TypeInt16,
+	nvlist.TypeUint16Array: nvlist.TypeUint16,
+	nvlist.TypeInt32Array:  nvlist.TypeInt32,
+	nvlist.TypeUint32Array: nvlist.TypeUint32,
+	nvlist.TypeInt64Array:  nvlist.TypeInt64,
+	nvlist.TypeUint64Array: nvlist.TypeUint64,
+}
+
+// numberSlice converts the results of toNumber into a slice of the Go type used for t in a List
+func numberSlice(t nvlist.Type, elems []interface{}) interface{} {
+	switch t {
+	case nvlist.TypeByteArray, nvlist.TypeUint8Array:
+		val := make([]uint8, len(elems))
+		for i, e := range elems {
+			val[i] = e.(uint8)
+		}
+		return val
+	case nvlist.TypeInt8Array:
+		val := make([]int8, len(elems))
+		for i, e := range elems {
+			val[i] = e.(int8)
+		}
+		return val
+	case nvlist.TypeInt16Array:
+		val := make([]int16, len(elems))
+		for i, e := range elems {
+			val[i] = e.(int16)
+		}
+		return val
+	case nvlist.TypeUint16Array:
+		val := make([]uint16, len(elems))
+		for i, e := range elems {
+			val[i] = e.(uint16)
+		}
+		return val
+	case nvlist.TypeInt32Array:
+		val := make([]int32, len(elems))
+		for i, e := range elems {
+			val[i] = e.(int32)
+		}
+		return val
+	case nvlist.TypeUint32Array:
+		val := make([]uint32, len(elems))
+		for i, e := range elems {
+			val[i] = e.(uint32)
+		}
+		return val
+	case nvlist.TypeInt64Array:
+		val := make([]int64, len(elems))
+		for i, e := range elems {
+			val[i] = e.(int64)
+		}
+		return val
+	default:
+		val := make([]uint64, len(elems))
+		for i, e := range elems {
+			val[i] = e.(uint64)
+		}
+		return val
+	}
+}
+
+// toNumber converts a JSON number into the Go type used for the integer type t in a List
+func toNumber(t nvlist.Type, raw interface{}) (interface{}, error) {
+	switch t {
+	case nvlist.TypeByte, nvlist.TypeUint8:
+		n, err := parseUint(raw, 8)
+		return uint8(n), err
+	case nvlist.TypeUint16:
+		n, err := parseUint(raw, 16)
+		return uint16(n), err
+	case nvlist.TypeUint32:
+		n, err := parseUint(raw, 32)
+		return uint32(n), err
+	case nvlist.TypeUint64:
+		return parseUint(raw, 64)
+	case nvlist.TypeInt8:
+		n, err := parseInt(raw, 8)
+		return int8(n), err
+	case nvlist.TypeInt16:
+		n, err := parseInt(raw, 16)
+		return int16(n), err
+	case nvlist.TypeInt32:
+		n, err := parseInt(raw, 32)
+		return int32(n), err
+	case nvlist.TypeInt64:
+		return parseInt(raw, 64)
+	case nvlist.TypeHrtime:
+		n, err := parseInt(raw, 64)
+		return nvlist.Hrtime(n), err
+	}
+	return nil, fmt.Errorf("unsupported type %v", t)
+}
+
+func parseUint(raw interface{}, bitSize int) (uint64, error) {
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, errors.New("not a number")
+	}
+	return strconv.ParseUint(n.String(), 10, bitSize)
+}
+
+func parseInt(raw interface{}, bitSize int) (int64, error) {
+	n, ok := raw.(json.Number)
+	if !ok {
+		return 0, errors.New("not a number")
+	}
+	return strconv.ParseInt(n.String(), 10, bitSize)
+}
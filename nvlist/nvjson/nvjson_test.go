@@ -0,0 +1,118 @@
+package nvjson
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"git.dolansoft.org/lorenz/go-zfs/nvlist"
+)
+
+func testList() *nvlist.List {
+	child := nvlist.NewList().AddString("type", "disk").AddUint64("whole_disk", 1)
+	return nvlist.NewList().
+		AddString("name", "tank").
+		Add("state", nvlist.TypeByte, uint8(1)).
+		Add("errata", nvlist.TypeUint8, uint8(2)).
+		Add("small", nvlist.TypeInt8, int8(-1)).
+		Add("tiny", nvlist.TypeInt16, int16(-2)).
+		Add("port", nvlist.TypeUint16, uint16(2)).
+		Add("ashift", nvlist.TypeInt32, int32(-12)).
+		Add("asize", nvlist.TypeUint32, uint32(12)).
+		AddInt64("offset", -1).
+		AddUint64("guid", 18446744073709551615).
+		AddUint64("guid", 2). // Duplicate names are kept
+		AddFlag("force").
+		AddBool("readonly", false).
+		Add("time", nvlist.TypeHrtime, nvlist.Hrtime(42)).
+		Add("ratio", nvlist.TypeDouble, 0.5).
+		Add("raw", nvlist.TypeByteArray, []byte{1, 2, 255}).
+		Add("raw8", nvlist.TypeUint8Array, []uint8{}).
+		Add("signed8", nvlist.TypeInt8Array, []int8{-1, 2}).
+		Add("signed16", nvlist.TypeInt16Array, []int16{-1, 2}).
+		Add("u16", nvlist.TypeUint16Array, []uint16{1}).
+		Add("signed32", nvlist.TypeInt32Array, []int32{-1}).
+		Add("u32", nvlist.TypeUint32Array, []uint32{1}).
+		Add("signed64", nvlist.TypeInt64Array, []int64{-1}).
+		Add("dtl", nvlist.TypeUint64Array, []uint64{5, 6}).
+		Add("bools", nvlist.TypeBooleanArray, []bool{true, false}).
+		Add("features", nvlist.TypeStringArray, []string{"a", "bc"}).
+		AddList("vdev_tree", nvlist.NewList().AddString("type", "root").AddLists("children", []*nvlist.List{child, {Flags: 0}}))
+}
+
+func TestRoundtrip(t *testing.T) {
+	in := testList()
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v, expected %+v", out, in)
+	}
+
+	// The nvlist itself also has to survive the roundtrip byte-identical
+	raw, err := nvlist.MarshalWithOptions(in, nvlist.EncoderOptions{Encoding: nvlist.EncodingXDR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded nvlist.List
+	if err := nvlist.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	indented, err := MarshalIndent(&decoded, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited, err := Unmarshal(indented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := nvlist.MarshalWithOptions(edited, nvlist.EncoderOptions{Encoding: nvlist.EncodingXDR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, raw) {
+		t.Errorf("nvlist changed after JSON roundtrip")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	l := nvlist.NewList().
+		AddUint64("ashift", 12).
+		AddFlag("force").
+		Add("raw", nvlist.TypeByteArray, []byte{1, 2}).
+		AddList("empty", &nvlist.List{})
+	data, err := Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"name":"ashift","type":"uint64","value":12},{"name":"force","type":"boolean"},` +
+		`{"name":"raw","type":"byte_array","value":[1,2]},{"name":"empty","type":"nvlist","value":{"nvflag":0,"pairs":[]}}]`
+	if string(data) != expected {
+		t.Errorf("got %v, expected %v", string(data), expected)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := map[string]string{
+		"overflow":      `[{"name":"a","type":"uint8","value":256}]`,
+		"negative":      `[{"name":"a","type":"uint64","value":-1}]`,
+		"fraction":      `[{"name":"a","type":"int64","value":1.5}]`,
+		"unknown type":  `[{"name":"a","type":"complex","value":1}]`,
+		"wrong value":   `[{"name":"a","type":"string","value":1}]`,
+		"boolean value": `[{"name":"a","type":"boolean","value":true}]`,
+		"no name":       `[{"type":"boolean"}]`,
+		"nested":        `[{"name":"a","type":"nvlist","value":[{"name":"b","type":"int8","value":128}]}]`,
+		"not a list":    `{"name":"a"}`,
+		"trailing data": `[] []`,
+	}
+	for name, in := range tests {
+		if _, err := Unmarshal([]byte(in)); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
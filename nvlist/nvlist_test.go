@@ -1,10 +1,17 @@
 package nvlist
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUnmarshal(t *testing.T) {
@@ -34,11 +41,1765 @@ func TestMarshal(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	ioutil.WriteFile("test-data-out.bin", out, 0644)
 	test2 := new(interface{})
 	if err := Unmarshal(out, test2); err != nil {
 		t.Error(err)
 	}
-	res, _ := json.MarshalIndent(test, "", "\t")
-	fmt.Println(string(res))
+}
+
+func TestMarshalXDR(t *testing.T) {
+	// Beginning of a vdev label
+	expected := []byte{
+		0x01, 0x01, 0x00, 0x00, // XDR, little endian host
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // Version, NV_UNIQUE_NAME
+		0x00, 0x00, 0x00, 0x24, 0x00, 0x00, 0x00, 0x20, // Encoded and decoded size
+		0x00, 0x00, 0x00, 0x07, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x00,
+		0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, // uint64, 1 element
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x13, 0x88,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // End of nvlist
+	}
+	out, err := MarshalWithOptions(map[string]uint64{"version": 5000}, EncoderOptions{Encoding: EncodingXDR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Unexpected XDR encoding: %x", out)
+	}
+}
+
+func TestMarshalXDRByteArray(t *testing.T) {
+	// Byte arrays are opaque data, which is padded to 4 bytes
+	expected := []byte{
+		0x01, 0x01, 0x00, 0x00, // XDR, little endian host
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // Version, NV_UNIQUE_NAME
+		0x00, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x20, // Encoded and decoded size
+		0x00, 0x00, 0x00, 0x01, 'a', 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0x03, // byte_array, 3 elements
+		0x01, 0x02, 0x03, 0x00,
+		0x00, 0x00, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x20, // Encoded and decoded size
+		0x00, 0x00, 0x00, 0x01, 'b', 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x01, // uint32, 1 element
+		0x00, 0x00, 0x00, 0x07,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // End of nvlist
+	}
+	for _, in := range []interface{}{
+		struct {
+			A []byte `nvlist:"a"`
+			B uint32 `nvlist:"b"`
+		}{A: []byte{1, 2, 3}, B: 7},
+		struct {
+			A [3]byte `nvlist:"a"`
+			B uint32  `nvlist:"b"`
+		}{A: [3]byte{1, 2, 3}, B: 7},
+	} {
+		out, err := MarshalWithOptions(in, EncoderOptions{Encoding: EncodingXDR})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("Unexpected XDR encoding of %T: %x", in, out)
+		}
+	}
+}
+
+type testVDev struct {
+	Type     string     `nvlist:"type"`
+	Path     string     `nvlist:"path,omitempty"`
+	GUID     uint64     `nvlist:"guid"`
+	IsLog    bool       `nvlist:"is_log"`
+	Children []testVDev `nvlist:"children,omitempty"`
+}
+
+func TestRoundtrip(t *testing.T) {
+	in := map[string]interface{}{
+		"name":     "tank",
+		"version":  uint64(5000),
+		"errata":   int32(-3),
+		"short":    int16(-2),
+		"byte":     byte(0xab),
+		"flag":     true,
+		"strings":  []string{"a", "bc", "def", ""},
+		"bytes":    []byte{1, 2, 3, 4, 5},
+		"int8s":    []int8{-1, 2, -3},
+		"uint16s":  []uint16{1, 65535},
+		"uint64s":  []uint64{1 << 40, 2},
+		"bools":    []bool{true, false, true},
+		"features": map[string]interface{}{"com.delphix:hole_birth": true},
+		"vdev_tree": testVDev{
+			Type: "root",
+			GUID: 1234,
+			Children: []testVDev{
+				{Type: "disk", Path: "/dev/sda", GUID: 1},
+				{Type: "disk", Path: "/dev/sdb", GUID: 2, IsLog: true},
+			},
+		},
+	}
+	expected := map[string]interface{}{
+		"name":     "tank",
+		"version":  uint64(5000),
+		"errata":   int32(-3),
+		"short":    int16(-2),
+		"byte":     byte(0xab),
+		"flag":     true,
+		"strings":  []string{"a", "bc", "def", ""},
+		"bytes":    []byte{1, 2, 3, 4, 5},
+		"int8s":    []int8{-1, 2, -3},
+		"uint16s":  []uint16{1, 65535},
+		"uint64s":  []uint64{1 << 40, 2},
+		"bools":    []bool{true, false, true},
+		"features": map[string]interface{}{"com.delphix:hole_birth": true},
+		"vdev_tree": map[string]interface{}{
+			"type": "root",
+			"guid": uint64(1234),
+			"children": []map[string]interface{}{
+				{"type": "disk", "path": "/dev/sda", "guid": uint64(1)},
+				{"type": "disk", "path": "/dev/sdb", "guid": uint64(2), "is_log": true},
+			},
+		},
+	}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(in, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatalf("encoding %v: %v", encoding, err)
+		}
+		var out interface{}
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatalf("encoding %v: %v", encoding, err)
+		}
+		if !reflect.DeepEqual(out, expected) {
+			t.Errorf("encoding %v: roundtrip mismatch, got %#v", encoding, out)
+		}
+	}
+}
+
+func TestMarshalBigEndian(t *testing.T) {
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x00, // Native, big endian
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // Version, NV_UNIQUE_NAME
+		0x00, 0x00, 0x00, 0x20, 0x00, 0x04, 0x00, 0x00, // Size, name size, reserved
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08, // 1 element, uint64
+		't', 'x', 'g', 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02,
+		0x00, 0x00, 0x00, 0x00, // End of nvlist
+	}
+	out, err := MarshalWithOptions(map[string]uint64{"txg": 0x102}, EncoderOptions{ByteOrder: binary.BigEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Unexpected big endian encoding: %x", out)
+	}
+
+	in := testVDev{
+		Type:     "root",
+		GUID:     0x0102030405060708,
+		Children: []testVDev{{Type: "disk", Path: "/dev/sda", GUID: 1}},
+	}
+	data, err := MarshalWithOptions(in, EncoderOptions{ByteOrder: binary.BigEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out2 := make(map[string]interface{})
+	if err := Unmarshal(data, &out2); err != nil {
+		t.Fatal(err)
+	}
+	if out2["guid"] != in.GUID {
+		t.Errorf("Unexpected GUID %v", out2["guid"])
+	}
+	children := out2["children"].([]map[string]interface{})
+	if len(children) != 1 || children[0]["path"] != "/dev/sda" {
+		t.Errorf("Unexpected children %v", children)
+	}
+}
+
+func TestUnmarshalNvlistArray(t *testing.T) {
+	in := testVDev{
+		Type: "root",
+		GUID: 1234,
+		Children: []testVDev{
+			{Type: "mirror", GUID: 1, Children: []testVDev{{Type: "disk", Path: "/dev/sda"}, {Type: "disk", Path: "/dev/sdb"}}},
+			{Type: "disk", Path: "/dev/sdc", GUID: 2, IsLog: true},
+		},
+	}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(map[string]interface{}{"vdev_tree": in, "name": "tank"}, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var config struct {
+			Name     string    `nvlist:"name"`
+			VDevTree *testVDev `nvlist:"vdev_tree"`
+		}
+		if err := Unmarshal(data, &config); err != nil {
+			t.Fatalf("encoding %v: %v", encoding, err)
+		}
+		if config.Name != "tank" || !reflect.DeepEqual(*config.VDevTree, in) {
+			t.Errorf("encoding %v: struct mismatch, got %+v", encoding, config.VDevTree)
+		}
+
+		var ptrConfig struct {
+			VDevTree struct {
+				Children []*testVDev `nvlist:"children"`
+			} `nvlist:"vdev_tree"`
+		}
+		if err := Unmarshal(data, &ptrConfig); err != nil {
+			t.Fatalf("encoding %v: %v", encoding, err)
+		}
+		if children := ptrConfig.VDevTree.Children; len(children) != 2 || children[1].Path != "/dev/sdc" || len(children[0].Children) != 2 {
+			t.Errorf("encoding %v: unexpected children %+v", encoding, children)
+		}
+
+		var mapConfig struct {
+			VDevTree struct {
+				Children []map[string]interface{} `nvlist:"children"`
+			} `nvlist:"vdev_tree"`
+		}
+		if err := Unmarshal(data, &mapConfig); err != nil {
+			t.Fatalf("encoding %v: %v", encoding, err)
+		}
+		if children := mapConfig.VDevTree.Children; len(children) != 2 || children[1]["path"] != "/dev/sdc" {
+			t.Errorf("encoding %v: unexpected children %+v", encoding, children)
+		}
+
+		// Unknown fields containing nvlists still need to be skipped correctly
+		var nameOnly struct {
+			Name string `nvlist:"name"`
+		}
+		if err := Unmarshal(data, &nameOnly); err != nil {
+			t.Fatalf("encoding %v: %v", encoding, err)
+		}
+		if nameOnly.Name != "tank" {
+			t.Errorf("encoding %v: unexpected name %q", encoding, nameOnly.Name)
+		}
+	}
+}
+
+func TestUnmarshalMapOfStructs(t *testing.T) {
+	in := map[string][]testVDev{
+		"spares":  {{Type: "disk", Path: "/dev/sdd"}},
+		"l2cache": {{Type: "disk", Path: "/dev/sde"}, {Type: "disk", Path: "/dev/sdf"}},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string][]testVDev)
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("Unexpected result %+v", out)
+	}
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	in := map[string]interface{}{
+		"name": "tank",
+		"vdev_tree": map[string]interface{}{
+			"children": []map[string]interface{}{
+				{"path": "/dev/sda"},
+				{"path": uint64(1)},
+			},
+		},
+	}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(in, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config struct {
+			Name     string   `nvlist:"name"`
+			VDevTree testVDev `nvlist:"vdev_tree"`
+		}
+		err = Unmarshal(data, &config)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Fatalf("encoding %v: expected DecodeError, got %v", encoding, err)
+		}
+		if decodeErr.Path != "vdev_tree.children[1].path" || decodeErr.Type != TypeUint64 || !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("encoding %v: unexpected error %v", encoding, err)
+		}
+		// Decoding continues after type mismatches
+		if config.Name != "tank" || len(config.VDevTree.Children) != 2 || config.VDevTree.Children[0].Path != "/dev/sda" {
+			t.Errorf("encoding %v: unexpected result %+v", encoding, config)
+		}
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	in := map[string]interface{}{
+		"name":    "tank",
+		"guids":   []uint64{1, 2, 3},
+		"vdev":    testVDev{Type: "root", Children: []testVDev{{Type: "disk", Path: "/dev/sda"}}},
+		"comment": []string{"a", "b"},
+	}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(in, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(data)-1; i++ {
+			var out interface{}
+			err := Unmarshal(data[:i], &out)
+			if err == nil {
+				continue // Truncation at the end of an nvlist can be valid
+			}
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Errorf("encoding %v, length %v: expected DecodeError, got %v", encoding, i, err)
+			}
+		}
+	}
+}
+
+func TestMarshalError(t *testing.T) {
+	in := map[string]interface{}{
+		"vdev_tree": map[string]interface{}{
+			"children": []map[string]interface{}{
+				{"path": "/dev/sda"},
+				{"path": func() {}},
+			},
+		},
+	}
+	_, err := Marshal(in)
+	var encodeErr *EncodeError
+	if !errors.As(err, &encodeErr) {
+		t.Fatalf("expected EncodeError, got %v", err)
+	}
+	if encodeErr.Path != "vdev_tree.children[1].path" || !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := Marshal(42); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("expected ErrInvalidValue for non-nvlist value, got %v", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	in := []interface{}{
+		map[string]interface{}{"vdev_tree": testVDev{Type: "root", Children: []testVDev{{Type: "disk", Path: "/dev/sda"}}}, "name": "tank"},
+		map[string]uint64{"version": 5000},
+		map[string]interface{}{"spares": []testVDev{{Type: "disk", Path: "/dev/sdd"}, {Type: "disk", Path: "/dev/sde", Children: []testVDev{{Type: "disk"}}}}},
+	}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetOptions(EncoderOptions{Encoding: encoding})
+		for _, val := range in {
+			if err := enc.Encode(val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf.WriteString("trailer")
+
+		dec := NewDecoder(&buf)
+		for i, val := range in {
+			expected := reflect.New(reflect.TypeOf(val))
+			data, _ := MarshalWithOptions(val, EncoderOptions{Encoding: encoding})
+			if err := Unmarshal(data, expected.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			out := reflect.New(reflect.TypeOf(val))
+			if err := dec.Decode(out.Interface()); err != nil {
+				t.Fatalf("encoding %v, nvlist %v: %v", encoding, i, err)
+			}
+			if !reflect.DeepEqual(out.Interface(), expected.Interface()) {
+				t.Errorf("encoding %v, nvlist %v: got %+v, expected %+v", encoding, i, out.Elem(), expected.Elem())
+			}
+		}
+		if rest := buf.String(); rest != "trailer" {
+			t.Errorf("encoding %v: decoder consumed data after the nvlists, %q left", encoding, rest)
+		}
+		var out interface{}
+		if err := dec.Decode(&out); err == nil {
+			t.Errorf("encoding %v: expected error for trailing garbage", encoding)
+		}
+		buf.Reset()
+		if err := dec.Decode(&out); err != io.EOF {
+			t.Errorf("encoding %v: expected io.EOF, got %v", encoding, err)
+		}
+	}
+}
+
+func TestDecoderOptions(t *testing.T) {
+	data, err := Marshal(map[string]interface{}{"name": "tank", "guid": uint64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Name string `nvlist:"name"`
+	}
+	if err := UnmarshalWithOptions(data, &out, DecoderOptions{}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := UnmarshalWithOptions(data, &out, DecoderOptions{Strict: true}); !errors.Is(err, ErrUnknownField) {
+		t.Errorf("expected ErrUnknownField in strict mode, got %v", err)
+	}
+	if err := UnmarshalWithOptions(append(data, 0, 0, 0, 0), &map[string]interface{}{}, DecoderOptions{Strict: true}); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("expected ErrInvalidData for trailing data in strict mode, got %v", err)
+	}
+	if err := UnmarshalWithOptions(data, &out, DecoderOptions{MaxTotalSize: len(data) - 1}); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded, got %v", err)
+	}
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.SetOptions(DecoderOptions{MaxTotalSize: len(data) - 1})
+	if err := dec.Decode(&out); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded from decoder, got %v", err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	deep := NewList().AddUint64("leaf", 1)
+	for i := 0; i < DefaultMaxDepth+1; i++ {
+		deep = NewList().AddList("nested", deep)
+	}
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		name string
+		in   *List
+		opts DecoderOptions
+		err  error
+	}{
+		{"default depth", deep, DecoderOptions{}, ErrLimitExceeded},
+		{"unlimited depth", deep, DecoderOptions{MaxDepth: -1}, nil},
+		{"depth", NewList().AddList("a", NewList().AddList("b", NewList())), DecoderOptions{MaxDepth: 1}, ErrLimitExceeded},
+		{"array", NewList().Add("a", TypeUint64Array, []uint64{1, 2, 3}), DecoderOptions{MaxArrayLen: 2}, ErrLimitExceeded},
+		{"array within limit", NewList().Add("a", TypeUint64Array, []uint64{1, 2, 3}), DecoderOptions{MaxArrayLen: 3}, nil},
+		{"string", NewList().AddString("a", long), DecoderOptions{MaxStringLen: 99}, ErrLimitExceeded},
+		{"string within limit", NewList().AddString("a", long), DecoderOptions{MaxStringLen: 100}, nil},
+		{"name", NewList().AddUint64(long, 1), DecoderOptions{MaxStringLen: 99}, ErrLimitExceeded},
+		{"unlimited string", NewList().AddString("a", long), DecoderOptions{MaxStringLen: -1}, nil},
+	}
+	for _, test := range tests {
+		for _, encOpts := range []EncoderOptions{{}, {Encoding: EncodingXDR}} {
+			data, err := MarshalWithOptions(test.in, encOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out List
+			err = UnmarshalWithOptions(data, &out, test.opts)
+			if test.err == nil && err != nil || test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("%v (encoding %v): expected %v, got %v", test.name, encOpts.Encoding, test.err, err)
+			}
+		}
+	}
+
+	// An element count exceeding the remaining data is rejected before allocating
+	data, err := MarshalWithOptions(NewList().Add("a", TypeUint64Array, []uint64{1, 2}), EncoderOptions{ByteOrder: binary.LittleEndian})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(data[20:], 60000) // nelem of the first nvpair
+	if err := Unmarshal(data, &map[string]interface{}{}); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("expected ErrInvalidData for an oversized element count, got %v", err)
+	}
+
+	// Strings with null bytes can't be represented in native encoding
+	data, err = MarshalWithOptions(NewList().AddString("a", "a\x01b"), EncoderOptions{Encoding: EncodingXDR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[bytes.Index(data, []byte("a\x01b"))+1] = 0x00
+	if err := Unmarshal(data, &map[string]interface{}{}); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("expected ErrInvalidData for a string containing a null byte, got %v", err)
+	}
+}
+
+// testGUID is encoded as a uint64, but represented as a hex string in Go
+type testGUID string
+
+func (g testGUID) MarshalNvlist() (interface{}, error) {
+	var raw uint64
+	_, err := fmt.Sscanf(string(g), "%x", &raw)
+	return raw, err
+}
+
+func (g *testGUID) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	var raw uint64
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*g = testGUID(fmt.Sprintf("%x", raw))
+	return nil
+}
+
+// testVersion accepts both a uint64 and an nvlist with a major and minor version
+type testVersion struct {
+	Major, Minor uint64
+}
+
+func (v *testVersion) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&v.Major); err == nil {
+		return nil
+	}
+	var full struct {
+		Major uint64 `nvlist:"major"`
+		Minor uint64 `nvlist:"minor"`
+	}
+	if err := unmarshal(&full); err != nil {
+		return err
+	}
+	*v = testVersion(full)
+	return nil
+}
+
+// testIgnored never decodes its value
+type testIgnored struct{}
+
+func (*testIgnored) UnmarshalNvlist(unmarshal func(interface{}) error) error {
+	return nil
+}
+
+func TestMarshalerHooks(t *testing.T) {
+	type hooked struct {
+		GUID     testGUID    `nvlist:"guid"`
+		Spares   []testGUID  `nvlist:"spares"`
+		Version  testVersion `nvlist:"version"`
+		Ignored  testIgnored `nvlist:"ignored"`
+		Name     string      `nvlist:"name"`
+		Versions []*testVersion
+	}
+	in := map[string]interface{}{
+		"guid":     testGUID("deadbeef"),
+		"spares":   []testGUID{"1", "2"},
+		"version":  map[string]uint64{"major": 2, "minor": 1},
+		"ignored":  map[string]interface{}{"nested": map[string]string{"a": "b"}},
+		"name":     "tank",
+		"Versions": []map[string]uint64{{"major": 3}},
+	}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(in, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw map[string]interface{}
+		if err := Unmarshal(data, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if raw["guid"] != uint64(0xdeadbeef) || !reflect.DeepEqual(raw["spares"], []uint64{1, 2}) {
+			t.Errorf("encoding %v: Marshaler not used: %v", encoding, raw)
+		}
+		var out hooked
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatalf("encoding %v: %v", encoding, err)
+		}
+		expected := hooked{
+			GUID:     "deadbeef",
+			Spares:   []testGUID{"1", "2"},
+			Version:  testVersion{2, 1},
+			Name:     "tank",
+			Versions: []*testVersion{{Major: 3}},
+		}
+		if !reflect.DeepEqual(out, expected) {
+			t.Errorf("encoding %v: got %+v, expected %+v", encoding, out, expected)
+		}
+	}
+
+	data, err := Marshal(map[string]uint64{"version": 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version testVersion
+	if err := Unmarshal(data, &version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Major != 0 {
+		t.Errorf("unexpected top-level result %+v", version)
+	}
+	var guid testGUID
+	if err := Unmarshal(data, &guid); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch for top-level nvlist into uint64, got %v", err)
+	}
+}
+
+func TestTagOptions(t *testing.T) {
+	type props struct {
+		SnapDir   bool              `nvlist:"snapdir,asuint64"`
+		ACL       uint64            `nvlist:"aclinherit,omitempty,default=4"`
+		Atime     bool              `nvlist:"atime,default=true,asuint64"`
+		CanMount  uint64            `nvlist:"canmount,default=true"`
+		Comment   string            `nvlist:"comment,default=none"`
+		Size      uint64            `nvlist:"size,ro"`
+		Ignored   string            `nvlist:"-"`
+		User      map[string]string `nvlist:"-,extra,omitempty"`
+		Untagged  uint64
+		unexposed uint64
+	}
+	in := props{
+		SnapDir:   true,
+		Atime:     false,
+		Comment:   "test",
+		Size:      1024,
+		Ignored:   "ignored",
+		User:      map[string]string{"org:owner": "ops", "comment": "shadowed"},
+		Untagged:  3,
+		unexposed: 4,
+	}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(in, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw map[string]interface{}
+		if err := Unmarshal(data, &raw); err != nil {
+			t.Fatal(err)
+		}
+		expectedRaw := map[string]interface{}{
+			"snapdir":   uint64(1),
+			"atime":     uint64(0),
+			"canmount":  uint64(0),
+			"comment":   "test",
+			"org:owner": "ops",
+			"Untagged":  uint64(3),
+		}
+		if !reflect.DeepEqual(raw, expectedRaw) {
+			t.Errorf("encoding %v: got %v, expected %v", encoding, raw, expectedRaw)
+		}
+
+		raw["size"] = uint64(2048)
+		delete(raw, "comment")
+		delete(raw, "atime")
+		delete(raw, "canmount")
+		data, err = MarshalWithOptions(raw, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out props
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		expected := props{
+			SnapDir:  true,
+			ACL:      4,
+			Atime:    true,
+			CanMount: 1,
+			Comment:  "none",
+			Size:     2048,
+			User:     map[string]string{"org:owner": "ops"},
+			Untagged: 3,
+		}
+		if !reflect.DeepEqual(out, expected) {
+			t.Errorf("encoding %v: got %+v, expected %+v", encoding, out, expected)
+		}
+	}
+
+	var invalidDefault struct {
+		Value []string `nvlist:"value,default=a"`
+	}
+	data, err := Marshal(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(data, &invalidDefault); !errors.Is(err, ErrInvalidTag) {
+		t.Errorf("expected ErrInvalidTag, got %v", err)
+	}
+}
+
+// EmbeddedCommon is exported so that pointers to it can be embedded
+type EmbeddedCommon struct {
+	Name string `nvlist:"name"`
+	GUID uint64 `nvlist:"guid,omitempty"`
+}
+
+type embeddedVolume struct {
+	Name string `nvlist:"name"`
+	Size uint64 `nvlist:"volsize"`
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+	type filesystem struct {
+		EmbeddedCommon
+		Mountpoint string            `nvlist:"mountpoint"`
+		User       map[string]string `nvlist:"-,extra"`
+	}
+	type volume struct {
+		*EmbeddedCommon
+		Name string `nvlist:"name"`
+		Size uint64 `nvlist:"volsize,omitempty"`
+	}
+	type named struct {
+		EmbeddedCommon `nvlist:"common"`
+	}
+	type ambiguous struct {
+		EmbeddedCommon
+		embeddedVolume
+	}
+
+	tests := []struct {
+		in  interface{}
+		raw map[string]interface{}
+	}{
+		{
+			filesystem{EmbeddedCommon{"tank/fs", 1}, "/tank", map[string]string{"org:a": "b"}},
+			map[string]interface{}{"name": "tank/fs", "guid": uint64(1), "mountpoint": "/tank", "org:a": "b"},
+		},
+		// The outer field hides the promoted one, promoted fields through nil pointers are skipped
+		{
+			volume{Name: "tank/vol", Size: 2},
+			map[string]interface{}{"name": "tank/vol", "volsize": uint64(2)},
+		},
+		{
+			named{EmbeddedCommon{Name: "tank"}},
+			map[string]interface{}{"common": map[string]interface{}{"name": "tank"}},
+		},
+		// Promoted fields with the same name at the same depth are dropped
+		{
+			ambiguous{EmbeddedCommon{GUID: 1}, embeddedVolume{Size: 2}},
+			map[string]interface{}{"guid": uint64(1), "volsize": uint64(2)},
+		},
+	}
+	for _, test := range tests {
+		for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+			data, err := MarshalWithOptions(test.in, EncoderOptions{Encoding: encoding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var raw map[string]interface{}
+			if err := Unmarshal(data, &raw); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(raw, test.raw) {
+				t.Errorf("encoding %v of %T: got %v, expected %v", encoding, test.in, raw, test.raw)
+			}
+			out := reflect.New(reflect.TypeOf(test.in))
+			if err := Unmarshal(data, out.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Elem().Interface(), test.in) {
+				t.Errorf("encoding %v: got %+v, expected %+v", encoding, out.Elem().Interface(), test.in)
+			}
+		}
+	}
+
+	// Embedded struct pointers are allocated when decoding
+	data, err := Marshal(map[string]interface{}{"name": "tank/vol", "guid": uint64(3), "volsize": uint64(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vol volume
+	if err := Unmarshal(data, &vol); err != nil {
+		t.Fatal(err)
+	}
+	expected := volume{&EmbeddedCommon{GUID: 3}, "tank/vol", 4}
+	if !reflect.DeepEqual(vol, expected) {
+		t.Errorf("got %+v, expected %+v", vol, expected)
+	}
+	if err := UnmarshalWithOptions(data, &ambiguous{}, DecoderOptions{Strict: true}); !errors.Is(err, ErrUnknownField) {
+		t.Errorf("expected ErrUnknownField for an ambiguous field, got %v", err)
+	}
+}
+
+func TestHrtimeAndDouble(t *testing.T) {
+	type event struct {
+		Time  Hrtime  `nvlist:"time"`
+		Ratio float64 `nvlist:"ratio"`
+		Delay int64   `nvlist:"delay"`
+	}
+	in := event{Time: Hrtime(1500 * time.Millisecond), Ratio: 1.25, Delay: -3}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(in, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw map[string]interface{}
+		if err := Unmarshal(data, &raw); err != nil {
+			t.Fatal(err)
+		}
+		expectedRaw := map[string]interface{}{"time": in.Time, "ratio": 1.25, "delay": int64(-3)}
+		if !reflect.DeepEqual(raw, expectedRaw) {
+			t.Errorf("encoding %v: got %v, expected %v", encoding, raw, expectedRaw)
+		}
+		var out event
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out != in || out.Time.Duration() != 1500*time.Millisecond {
+			t.Errorf("encoding %v: got %+v, expected %+v", encoding, out, in)
+		}
+	}
+
+	data, err := Marshal(map[string]uint64{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(data[24:], 99) // Type of the first nvpair
+	var out interface{}
+	if err := Unmarshal(data, &out); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected ErrUnsupportedType, got %v", err)
+	}
+}
+
+func TestFlagAndBoolValue(t *testing.T) {
+	type options struct {
+		Force     Flag      `nvlist:"force"`
+		Resumable Flag      `nvlist:"resumable"`
+		Enabled   BoolValue `nvlist:"enabled"`
+		Disabled  BoolValue `nvlist:"disabled"`
+		Legacy    bool      `nvlist:"legacy"`
+	}
+	in := options{Force: true, Enabled: true, Legacy: true}
+	for _, encoding := range []Encoding{EncodingNative, EncodingXDR} {
+		data, err := MarshalWithOptions(in, EncoderOptions{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw interface{}
+		if err := Unmarshal(data, &raw); err != nil {
+			t.Fatal(err)
+		}
+		// Both types are decoded as bool into empty interfaces
+		expectedRaw := map[string]interface{}{"force": true, "enabled": true, "disabled": false, "legacy": true}
+		if !reflect.DeepEqual(raw, expectedRaw) {
+			t.Errorf("encoding %v: got %#v, expected %#v", encoding, raw, expectedRaw)
+		}
+		var out options
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out != in {
+			t.Errorf("encoding %v: got %+v, expected %+v", encoding, out, in)
+		}
+		var plain map[string]bool
+		if err := Unmarshal(data, &plain); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(plain, map[string]bool{"force": true, "enabled": true, "disabled": false, "legacy": true}) {
+			t.Errorf("encoding %v: unexpected plain bools %v", encoding, plain)
+		}
+	}
+}
+
+func testList() *List {
+	child := NewList().AddString("type", "disk").AddString("path", "/dev/sda")
+	child.Add("whole_disk", TypeUint64, uint64(1))
+	return NewList().
+		AddString("name", "tank").
+		Add("state", TypeByte, uint8(1)).
+		Add("errata", TypeUint8, uint8(2)).
+		Add("ashift", TypeInt32, int32(-12)).
+		Add("asize", TypeUint32, uint32(12)).
+		AddFlag("force").
+		AddBool("readonly", false).
+		Add("time", TypeHrtime, Hrtime(42)).
+		Add("ratio", TypeDouble, 0.5).
+		Add("small", TypeInt8, int8(-1)).
+		Add("tiny", TypeInt16, int16(-2)).
+		Add("guid", TypeUint64, uint64(1)).
+		Add("guid", TypeUint64, uint64(2)). // Duplicate names are kept
+		Add("raw", TypeByteArray, []byte{1, 2, 3}).
+		Add("raw8", TypeUint8Array, []uint8{1, 2, 3}).
+		Add("signed8", TypeInt8Array, []int8{-1, 2}).
+		Add("bools", TypeBooleanArray, []bool{true, false}).
+		Add("features", TypeStringArray, []string{"a", "bc"}).
+		Add("dtl", TypeUint64Array, []uint64{5, 6}).
+		AddList("vdev_tree", NewList().AddString("type", "root").AddLists("children", []*List{child, {Flags: 0}}))
+}
+
+func TestFprint(t *testing.T) {
+	config := NewList().
+		AddUint64("version", 5000).
+		AddString("name", "tank").
+		Add("errata", TypeInt32, int32(-1)).
+		Add("time", TypeHrtime, Hrtime(255)).
+		Add("empty", TypeUint64Array, []uint64{}).
+		AddList("vdev_tree", NewList().
+			AddString("type", "root").
+			AddLists("children", []*List{NewList().AddString("type", "disk").Add("dtl", TypeUint64Array, []uint64{1, 2})})).
+		AddList("features_for_read", NewList().AddFlag("com.delphix:hole_birth"))
+	data, err := Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		opts     PrintOptions
+		expected string
+	}{
+		{PrintOptions{}, `nvlist version: 0
+	version = 0x1388
+	name = tank
+	errata = -1
+	time = 0xff
+
+	vdev_tree = (embedded nvlist)
+	nvlist version: 0
+		type = root
+		children = (array of embedded nvlists)
+		(start children[0])
+		nvlist version: 0
+			type = disk
+			dtl = 0x1 0x2
+		(end children[0])
+
+	(end vdev_tree)
+
+	features_for_read = (embedded nvlist)
+	nvlist version: 0
+		com.delphix:hole_birth = 1
+	(end features_for_read)
+
+`},
+		{PrintOptions{Format: FormatDumpNvlist, Indent: 8}, `        version: 5000
+        name: 'tank'
+        errata: -1
+bad config type 18 for time
+        vdev_tree:
+            type: 'root'
+            children[0]:
+                type: 'disk'
+                dtl[0]: 1
+                dtl[1]: 2
+        features_for_read:
+            com.delphix:hole_birth
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := Fprint(&buf, data, test.opts); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("format %v: got\n%v\nexpected\n%v", test.opts.Format, buf.String(), test.expected)
+		}
+	}
+
+	invalid := NewList().Add("x", TypeUint64, "not a number")
+	if err := invalid.Fprint(ioutil.Discard, PrintOptions{}); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch, got %v", err)
+	}
+}
+
+func TestParseText(t *testing.T) {
+	// Shortened output of zdb -C
+	zdb := `
+        version: 5000
+        name: 'tank'
+        state: 0
+        hostid: 2831157250
+        errata: -1
+        vdev_children: 1
+        vdev_tree:
+            type: 'root'
+            id: 0
+            children[0]:
+                type: 'disk'
+                path: '/dev/sda1'
+                whole_disk: 1
+                dtl[0]: 5
+                dtl[1]: 6
+            children[1]:
+        features_for_read:
+            com.delphix:hole_birth
+            com.delphix:embedded_data
+        comment: 'a: b'
+        bools: [true, false]
+`
+	l, err := ParseText([]byte(zdb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := NewList().
+		AddUint64("version", 5000).
+		AddString("name", "tank").
+		AddUint64("state", 0).
+		AddUint64("hostid", 2831157250).
+		AddInt64("errata", -1).
+		AddUint64("vdev_children", 1).
+		AddList("vdev_tree", NewList().
+			AddString("type", "root").
+			AddUint64("id", 0).
+			AddLists("children", []*List{
+				NewList().AddString("type", "disk").AddString("path", "/dev/sda1").AddUint64("whole_disk", 1).Add("dtl", TypeUint64Array, []uint64{5, 6}),
+				NewList(),
+			})).
+		AddList("features_for_read", NewList().AddFlag("com.delphix:hole_birth").AddFlag("com.delphix:embedded_data")).
+		AddString("comment", "a: b").
+		Add("bools", TypeBooleanArray, []bool{true, false})
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("got %+v, expected %+v", l, expected)
+	}
+
+	// Parsed lists decode into structs
+	var config struct {
+		Version  uint64   `nvlist:"version"`
+		Errata   int32    `nvlist:"errata"`
+		VDevTree testVDev `nvlist:"vdev_tree"`
+	}
+	data, err := Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != 5000 || config.Errata != -1 || len(config.VDevTree.Children) != 2 || config.VDevTree.Children[0].Path != "/dev/sda1" {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	// Printing and parsing both formats keeps the structure with inferred types
+	var buf bytes.Buffer
+	if err := testList().Fprint(&buf, PrintOptions{Indent: 1}); err != nil {
+		t.Fatal(err)
+	}
+	l, err = ParseText(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := l.GetUint64("state"); v != 1 {
+		t.Errorf("unexpected state %v", l.Get("state"))
+	}
+	if p := l.Get("ratio"); p == nil || p.Value != 0.5 {
+		t.Errorf("unexpected ratio %v", p)
+	}
+	if p := l.Get("raw"); p == nil || !reflect.DeepEqual(p.Value, []uint64{1, 2, 3}) {
+		t.Errorf("unexpected raw %v", p)
+	}
+	if p := l.Get("signed8"); p == nil || !reflect.DeepEqual(p.Value, []int64{-1, 2}) {
+		t.Errorf("unexpected signed8 %v", p)
+	}
+	if v, _ := l.GetString("features"); v != "a bc" {
+		t.Errorf("unexpected features %v", l.Get("features"))
+	}
+	vdevTree, _ := l.GetList("vdev_tree")
+	children, _ := vdevTree.GetLists("children")
+	if len(children) != 2 || len(children[1].Pairs) != 0 {
+		t.Errorf("unexpected children %+v", children)
+	} else if path, _ := children[0].GetString("path"); path != "/dev/sda" {
+		t.Errorf("unexpected path %v", path)
+	}
+
+	for _, invalid := range []string{"", "nvlist version: 0\n\tx = (embedded nvlist)\n\tnvlist version: 0\n", "a: 1\n  b: 2\n", "a[1]: 1\n", "a: 1\na[1]: 2\n", "a: x\n"} {
+		if _, err := ParseText([]byte(invalid)); err == nil {
+			t.Errorf("%q was accepted", invalid)
+		}
+	}
+}
+
+func TestListRoundtrip(t *testing.T) {
+	in := testList()
+	for _, opts := range []EncoderOptions{{}, {ByteOrder: binary.BigEndian}, {Encoding: EncodingXDR}} {
+		data, err := MarshalWithOptions(in, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out List
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatalf("options %+v: %v", opts, err)
+		}
+		if !reflect.DeepEqual(&out, in) {
+			t.Errorf("options %+v: got %+v, expected %+v", opts, out, *in)
+		}
+		again, err := MarshalWithOptions(out, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Errorf("options %+v: encoding is not byte-identical", opts)
+		}
+
+		// Lists can also be used as part of other values
+		var config struct {
+			Name     string `nvlist:"name"`
+			VDevTree *List  `nvlist:"vdev_tree"`
+		}
+		if err := Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		children, ok := config.VDevTree.GetLists("children")
+		if !ok || len(children) != 2 || children[1].Flags != 0 {
+			t.Fatalf("options %+v: unexpected vdev tree %+v", opts, config.VDevTree)
+		}
+		children[0].Get("path").Value = "/dev/sdb"
+		data, err = MarshalWithOptions(config, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var edited struct {
+			VDevTree testVDev `nvlist:"vdev_tree"`
+		}
+		if err := Unmarshal(data, &edited); err != nil {
+			t.Fatal(err)
+		}
+		if len(edited.VDevTree.Children) != 2 || edited.VDevTree.Children[0].Path != "/dev/sdb" {
+			t.Errorf("options %+v: edit got lost: %+v", opts, edited)
+		}
+	}
+}
+
+func TestListAccessors(t *testing.T) {
+	l := testList()
+	if name, ok := l.GetString("name"); !ok || name != "tank" {
+		t.Errorf("GetString: %v %v", name, ok)
+	}
+	if guid, ok := l.GetUint64("guid"); !ok || guid != 1 {
+		t.Errorf("GetUint64: %v %v", guid, ok)
+	}
+	if _, ok := l.GetUint64("name"); ok {
+		t.Error("GetUint64 returned a string pair")
+	}
+	if force, ok := l.GetBool("force"); !ok || !force {
+		t.Errorf("GetBool on flag: %v %v", force, ok)
+	}
+	if readonly, ok := l.GetBool("readonly"); !ok || readonly {
+		t.Errorf("GetBool on boolean_value: %v %v", readonly, ok)
+	}
+	if !l.Remove("guid") || l.Get("guid") != nil {
+		t.Error("Remove didn't remove all pairs")
+	}
+	l.Set("name", TypeString, "pool")
+	l.Set("comment", TypeString, "new")
+	if name, _ := l.GetString("name"); name != "pool" || l.Pairs[0].Name != "name" || l.Pairs[len(l.Pairs)-1].Name != "comment" {
+		t.Errorf("Set didn't keep the order: %+v", l.Pairs)
+	}
+	if _, err := Marshal(NewList().Add("bad", TypeUint32, uint64(1))); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch, got %v", err)
+	}
+}
+
+type testFlags struct {
+	Flags uint32 `nvlist:"-,nvflag"`
+	Name  string `nvlist:"name"`
+	Child *struct {
+		Flags uint32 `nvlist:"-,nvflag"`
+		Value uint64 `nvlist:"value"`
+	} `nvlist:"child"`
+}
+
+func TestNvflag(t *testing.T) {
+	data, err := MarshalWithOptions(map[string]interface{}{"a": "b"}, EncoderOptions{Flags: UniqueNameType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := binary.LittleEndian.Uint32(data[8:12]); flags != UniqueNameType {
+		t.Errorf("expected nvflag %v, got %v", UniqueNameType, flags)
+	}
+
+	// nvflag fields preserve the flags of every nested nvlist
+	in := (&List{Flags: 0}).AddString("name", "a").AddList("child", (&List{Flags: UniqueNameType}).AddUint64("value", 1))
+	for _, opts := range []EncoderOptions{{}, {Encoding: EncodingXDR}} {
+		data, err := MarshalWithOptions(in, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out testFlags
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Flags != 0 || out.Child == nil || out.Child.Flags != UniqueNameType || out.Child.Value != 1 {
+			t.Errorf("options %+v: unexpected result %+v", opts, out)
+		}
+		again, err := MarshalWithOptions(out, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Errorf("options %+v: nvflags were not preserved", opts)
+		}
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		list      *List
+		strictErr bool
+	}{
+		{"unique name", (&List{Flags: UniqueName}).AddUint64("a", 1).AddUint64("a", 2), true},
+		{"unique name with different types", (&List{Flags: UniqueName}).AddUint64("a", 1).AddString("a", "b"), true},
+		{"unique name type", (&List{Flags: UniqueNameType}).AddUint64("a", 1).AddUint64("a", 2), true},
+		{"unique name type with different types", (&List{Flags: UniqueNameType}).AddUint64("a", 1).AddString("a", "b"), false},
+		{"not unique", (&List{Flags: 0}).AddUint64("a", 1).AddUint64("a", 2), false},
+	}
+	for _, test := range tests {
+		data, err := Marshal(test.list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out map[string]interface{}
+		if err := Unmarshal(data, &out); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !reflect.DeepEqual(out["a"], test.list.Pairs[1].Value) {
+			t.Errorf("%v: expected the last pair to win, got %v", test.name, out["a"])
+		}
+		for _, target := range []interface{}{&map[string]interface{}{}, &List{}} {
+			err := UnmarshalWithOptions(data, target, DecoderOptions{Strict: true})
+			if test.strictErr && !errors.Is(err, ErrDuplicateName) {
+				t.Errorf("%v: expected ErrDuplicateName decoding into %T, got %v", test.name, target, err)
+			}
+			if !test.strictErr && err != nil {
+				t.Errorf("%v: decoding into %T: %v", test.name, target, err)
+			}
+		}
+	}
+}
+
+func TestListMultiValue(t *testing.T) {
+	l := (&List{Flags: 0}).AddUint64("a", 1).AddString("b", "x").AddUint64("a", 2)
+	if pairs := l.GetAll("a"); len(pairs) != 2 || pairs[0].Value != uint64(1) || pairs[1].Value != uint64(2) {
+		t.Errorf("unexpected pairs %+v", pairs)
+	}
+	l.Put("a", TypeUint64, uint64(3))
+	if len(l.GetAll("a")) != 3 {
+		t.Errorf("expected Put to append without unique names, got %+v", l.Pairs)
+	}
+
+	l.Flags = UniqueNameType
+	l.Put("a", TypeString, "y")
+	l.Put("a", TypeUint64, uint64(4))
+	expected := (&List{Flags: UniqueNameType}).AddString("b", "x").AddString("a", "y").AddUint64("a", 4)
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("got %+v, expected %+v", l, expected)
+	}
+
+	l.Flags = UniqueName
+	l.Put("a", TypeBooleanValue, true)
+	expected = (&List{Flags: UniqueName}).AddString("b", "x").AddBool("a", true)
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("got %+v, expected %+v", l, expected)
+	}
+}
+
+type testSource uint64
+
+type testNames []string
+
+func TestUnmarshalConversion(t *testing.T) {
+	in := NewList().
+		AddUint64("source", 8).
+		Add("errno", TypeInt32, int32(-5)).
+		AddUint64("size", 1<<40).
+		Add("time", TypeHrtime, Hrtime(time.Second)).
+		Add("ratio", TypeDouble, 1.5).
+		Add("guids", TypeUint32Array, []uint32{1, 2}).
+		Add("names", TypeStringArray, []string{"a", "b"})
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Source testSource      `nvlist:"source"`
+		Errno  int             `nvlist:"errno"`
+		Size   *float64        `nvlist:"size"`
+		Time   time.Duration   `nvlist:"time"`
+		Ratio  float32         `nvlist:"ratio"`
+		GUIDs  []testSource    `nvlist:"guids"`
+		Names  testNames       `nvlist:"names"`
+		Rest   map[string]int8 `nvlist:"-,extra"`
+	}
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Source != 8 || out.Errno != -5 || out.Size == nil || *out.Size != 1<<40 || out.Time != time.Second ||
+		out.Ratio != 1.5 || !reflect.DeepEqual(out.GUIDs, []testSource{1, 2}) || !reflect.DeepEqual(out.Names, testNames{"a", "b"}) {
+		t.Errorf("unexpected result %+v", out)
+	}
+
+	var sizes map[string]uint64
+	if err := Unmarshal(data, &sizes); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected ErrOverflow for the negative errno, got %v", err)
+	}
+	if sizes["source"] != 8 || sizes["size"] != 1<<40 || sizes["time"] != uint64(time.Second) {
+		t.Errorf("unexpected result %v", sizes)
+	}
+	if _, ok := sizes["errno"]; ok {
+		t.Errorf("negative value decoded into uint64")
+	}
+
+	tests := []struct {
+		value  interface{}
+		target interface{}
+		err    error
+		strict error
+	}{
+		{int32(-5), new(uint64), ErrOverflow, ErrOverflow},
+		{uint64(256), new(uint8), ErrOverflow, ErrOverflow},
+		{uint64(1 << 63), new(int64), ErrOverflow, ErrOverflow},
+		{int64(-129), new(int8), ErrOverflow, ErrOverflow},
+		{1e40, new(float32), ErrOverflow, ErrOverflow},
+		{-1.0, new(uint), ErrOverflow, ErrOverflow},
+		{1.5, new(int), nil, ErrLossyConversion},
+		{0.1, new(float32), nil, ErrLossyConversion},
+		{uint64(1<<53 + 1), new(float64), nil, ErrLossyConversion},
+		{2.0, new(int), nil, nil},
+		{uint64(1 << 53), new(float64), nil, nil},
+		{"a", new(int), ErrTypeMismatch, ErrTypeMismatch},
+	}
+	for _, test := range tests {
+		data, err := Marshal(map[string]interface{}{"value": test.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, strict := range []bool{false, true} {
+			expected := test.err
+			if strict {
+				expected = test.strict
+			}
+			goType := reflect.TypeOf(test.target).Elem()
+			holder := reflect.New(reflect.StructOf([]reflect.StructField{{
+				Name: "Value",
+				Type: goType,
+				Tag:  `nvlist:"value"`,
+			}}))
+			err := UnmarshalWithOptions(data, holder.Interface(), DecoderOptions{Strict: strict})
+			if expected == nil && err != nil || expected != nil && !errors.Is(err, expected) {
+				t.Errorf("%T %v into %v (strict %v): expected %v, got %v", test.value, test.value, goType, strict, expected, err)
+			}
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	type props struct {
+		Name string            `nvlist:"name"`
+		User map[string]string `nvlist:"-,extra"`
+	}
+	snaps := make(map[string]bool)
+	user := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		snaps[fmt.Sprintf("tank@%02d", i)] = true
+		user[fmt.Sprintf("org:%02d", i)] = "x"
+	}
+	in := map[string]interface{}{"snaps": snaps, "props": props{Name: "tank", User: user}}
+
+	snapList := NewList()
+	userList := NewList().AddString("name", "tank")
+	for i := 0; i < 50; i++ {
+		snapList.AddFlag(fmt.Sprintf("tank@%02d", i))
+		userList.AddString(fmt.Sprintf("org:%02d", i), "x")
+	}
+	expected, err := Marshal(NewList().AddList("props", userList).AddList("snaps", snapList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		out, err := MarshalWithOptions(in, EncoderOptions{Canonical: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("canonical encoding differs from the sorted list")
+		}
+	}
+}
+
+func TestAppendMarshal(t *testing.T) {
+	in := testList()
+	expected, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := []byte{1, 2, 3}
+	out, err := AppendMarshal(prefix, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[:3], prefix) || !bytes.Equal(out[3:], expected) {
+		t.Errorf("AppendMarshal didn't append the encoding")
+	}
+	// Results of Marshal must not share the pooled buffers
+	again, err := Marshal(NewList().AddString("other", "value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, expected) || cap(expected) != len(expected) {
+		t.Errorf("Marshal returned a pooled buffer")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	tree := NewList().AddString("type", "root").Add("id", TypeUint32, uint32(0)).
+		AddList("stats", NewList().AddUint64("ops", 1).AddUint64("ops", 2))
+	tree.Pairs[2].Value.(*List).Flags = 0 // Keeps the duplicate name
+	children := []*List{NewList().AddString("path", "/dev/sda"), NewList().AddInt64("weight", -1)}
+	in := NewList().AddString("name", "tank").AddList("vdev_tree", tree).AddLists("children", children)
+
+	type config struct {
+		Name     string       `nvlist:"name"`
+		VDevTree *RawMessage  `nvlist:"vdev_tree"`
+		Children []RawMessage `nvlist:"children"`
+	}
+	allOpts := []EncoderOptions{
+		{Encoding: EncodingNative, ByteOrder: binary.LittleEndian},
+		{Encoding: EncodingNative, ByteOrder: binary.BigEndian},
+		{Encoding: EncodingXDR},
+	}
+	for _, opts := range allOpts {
+		data, err := MarshalWithOptions(in, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c config
+		if err := UnmarshalWithOptions(data, &c, DecoderOptions{Strict: true}); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if c.VDevTree == nil || len(c.Children) != 2 {
+			t.Fatalf("%+v: unexpected result %+v", opts, c)
+		}
+		var decoded List
+		if err := UnmarshalWithOptions(*c.VDevTree, &decoded, DecoderOptions{Strict: true}); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if !reflect.DeepEqual(&decoded, tree) {
+			t.Errorf("%+v: raw message decoded to %v, expected %v", opts, decoded, tree)
+		}
+		for i, child := range c.Children {
+			var decoded List
+			if err := Unmarshal(child, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&decoded, children[i]) {
+				t.Errorf("%+v: children[%d] decoded to %v, expected %v", opts, i, decoded, children[i])
+			}
+		}
+
+		// Raw messages are copied if the encoding matches and transcoded otherwise
+		for _, outOpts := range allOpts {
+			expected, err := MarshalWithOptions(in, outOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := MarshalWithOptions(c, outOpts)
+			if err != nil {
+				t.Fatalf("%+v to %+v: %v", opts, outOpts, err)
+			}
+			if !bytes.Equal(out, expected) {
+				t.Errorf("%+v to %+v: raw messages were not reproduced", opts, outOpts)
+			}
+		}
+
+		var raw RawMessage
+		if err := Unmarshal(data, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, data) {
+			t.Errorf("%+v: top-level raw message differs from the input", opts)
+		}
+	}
+
+	// Raw messages only receive nvlists
+	data, err := Marshal(map[string]interface{}{"vdev_tree": []byte{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c config
+	if err := Unmarshal(data, &c); !errors.Is(err, ErrTypeMismatch) || c.VDevTree != nil {
+		t.Errorf("expected type mismatch, got %v", err)
+	}
+
+	// Empty raw messages are empty nvlists, malformed ones are rejected
+	out, err := Marshal(map[string]RawMessage{"empty": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := Marshal(NewList().AddList("empty", NewList()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("empty raw message was not encoded as an empty nvlist")
+	}
+	malformed := RawMessage(expected[:len(expected)-1])
+	if _, err := Marshal(map[string]RawMessage{"bad": malformed}); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("expected ErrInvalidData for a malformed raw message, got %v", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	in := map[string]interface{}{
+		"name": "tank",
+		"vdev_tree": map[string]interface{}{
+			"guid": uint64(1),
+			"children": []map[string]interface{}{
+				{"path": "/dev/sda", "guid": uint64(2)},
+				{"guid": uint64(3)},
+				{"path": "/dev/sdc", "guid": uint64(4)},
+			},
+		},
+		"features": map[string]interface{}{
+			"org.zfsonlinux:large_dnode": uint64(5),
+		},
+		"stats": []uint64{7, 8},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree interface{}
+	if err := Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+	list := new(List)
+	if err := Unmarshal(data, list); err != nil {
+		t.Fatal(err)
+	}
+	var raw struct {
+		Name     string     `nvlist:"name"`
+		VDevTree RawMessage `nvlist:"vdev_tree"`
+	}
+	if err := Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tree := range []interface{}{in, &tree, list, raw} {
+		path, err := Get[string](tree, "vdev_tree.children[0].path")
+		if err != nil || path != "/dev/sda" {
+			t.Errorf("%T: unexpected result %q, %v", tree, path, err)
+		}
+		guids, err := GetAll[uint64](tree, "vdev_tree.children[*].guid")
+		if err != nil || !reflect.DeepEqual(guids, []uint64{2, 3, 4}) {
+			t.Errorf("%T: unexpected result %v, %v", tree, guids, err)
+		}
+		// Children without the pair are skipped
+		paths, err := GetAll[string](tree, "vdev_tree.children[*].path")
+		if err != nil || !reflect.DeepEqual(paths, []string{"/dev/sda", "/dev/sdc"}) {
+			t.Errorf("%T: unexpected result %v, %v", tree, paths, err)
+		}
+	}
+
+	for _, tree := range []interface{}{in, &tree, list} {
+		if val, err := Get[uint64](tree, `features["org.zfsonlinux:large_dnode"]`); err != nil || val != 5 {
+			t.Errorf("%T: unexpected result %v, %v", tree, val, err)
+		}
+		if val, err := Get[uint64](tree, "stats[1]"); err != nil || val != 8 {
+			t.Errorf("%T: unexpected result %v, %v", tree, val, err)
+		}
+		if val, err := Get[uint64](tree, "features.*"); err != nil || val != 5 {
+			t.Errorf("%T: unexpected result %v, %v", tree, val, err)
+		}
+	}
+
+	errorCases := []struct {
+		path string
+		err  error
+		at   string
+	}{
+		{"vdev_tree.children[1].path", ErrNotFound, "vdev_tree.children[1].path"},
+		{"vdev_tree.children[3]", ErrNotFound, "vdev_tree.children[3]"},
+		{"vdev_tree.guid", ErrTypeMismatch, "vdev_tree.guid"},
+		{"name.first", ErrTypeMismatch, "name"},
+		{"name[0]", ErrTypeMismatch, "name"},
+		{"vdev_tree.children[*].path", ErrAmbiguousPath, ""},
+		{"vdev_tree..guid", ErrInvalidPath, ""},
+		{"vdev_tree.children[-1]", ErrInvalidPath, ""},
+		{`features["org`, ErrInvalidPath, ""},
+	}
+	for _, c := range errorCases {
+		_, err := Get[string](&tree, c.path)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) || !errors.Is(err, c.err) || queryErr.Path != c.at || queryErr.Query != c.path {
+			t.Errorf("%v: unexpected error %v", c.path, err)
+		}
+	}
+	_, err = Get[string](&tree, "vdev_tree.guid")
+	if expected := "nvlist: cannot get vdev_tree.guid from Go value of type uint64 as string: " + ErrTypeMismatch.Error(); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error message %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	vdev := func(path, state string) map[string]interface{} {
+		return map[string]interface{}{"path": path, "state": state}
+	}
+	before := map[string]interface{}{
+		"name":      "tank",
+		"pool_guid": uint64(1),
+		"vdev_tree": map[string]interface{}{
+			"children": []map[string]interface{}{vdev("/dev/sda", "ONLINE"), vdev("/dev/sdb", "ONLINE")},
+		},
+		"comment": "old",
+	}
+	after := map[string]interface{}{
+		"name":      "tank",
+		"pool_guid": uint32(1),
+		"vdev_tree": map[string]interface{}{
+			"children": []map[string]interface{}{vdev("/dev/sdc", "ONLINE"), vdev("/dev/sdb", "FAULTED"), vdev("/dev/sdd", "ONLINE")},
+		},
+		"errata": uint64(2),
+	}
+	changes, err := Diff(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := ToList(vdev("/dev/sdd", "ONLINE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Kind: ChangeRemoved, Path: "comment", OldType: TypeString, Old: "old"},
+		{Kind: ChangeModified, Path: "pool_guid", OldType: TypeUint64, Old: uint64(1), NewType: TypeUint32, New: uint32(1)},
+		{Kind: ChangeModified, Path: "vdev_tree.children[0].path", OldType: TypeString, Old: "/dev/sda", NewType: TypeString, New: "/dev/sdc"},
+		{Kind: ChangeModified, Path: "vdev_tree.children[1].state", OldType: TypeString, Old: "ONLINE", NewType: TypeString, New: "FAULTED"},
+		{Kind: ChangeAdded, Path: "vdev_tree.children[2]", NewType: TypeNvlist, New: added},
+		{Kind: ChangeAdded, Path: "errata", NewType: TypeUint64, New: uint64(2)},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+	if changes, err := Diff(before, before); err != nil || len(changes) != 0 {
+		t.Errorf("identical nvlists differ: %+v, %v", changes, err)
+	}
+
+	// Pairs with duplicate names are compared in order
+	a := &List{Pairs: []Pair{{"event", TypeString, "a"}, {"event", TypeString, "b"}}}
+	b := &List{Pairs: []Pair{{"event", TypeString, "a"}, {"event", TypeString, "c"}, {"event", TypeString, "d"}}}
+	changes, err = Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Change{
+		{Kind: ChangeModified, Path: "event", OldType: TypeString, Old: "b", NewType: TypeString, New: "c"},
+		{Kind: ChangeAdded, Path: "event", NewType: TypeString, New: "d"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	newDst := func() *List {
+		return NewList().AddString("name", "tank").AddUint64("version", 5000).
+			AddList("props", NewList().AddString("comment", "kernel").AddUint64("autotrim", 0))
+	}
+	src := map[string]interface{}{
+		"name":  "newtank",
+		"props": map[string]interface{}{"comment": "ours", "multihost": uint64(1)},
+		"tags":  []string{"a"},
+	}
+
+	cases := []struct {
+		policy   MergePolicy
+		expected *List
+	}{
+		{MergeReplace, NewList().AddUint64("version", 5000).AddString("name", "newtank").
+			AddList("props", NewList().AddString("comment", "ours").AddUint64("multihost", 1)).
+			Add("tags", TypeStringArray, []string{"a"})},
+		// Merged nvlists keep their position
+		{MergeRecursive, NewList().AddUint64("version", 5000).
+			AddList("props", NewList().AddUint64("autotrim", 0).AddString("comment", "ours").AddUint64("multihost", 1)).
+			AddString("name", "newtank").Add("tags", TypeStringArray, []string{"a"})},
+		{MergeKeep, NewList().AddString("name", "tank").AddUint64("version", 5000).
+			AddList("props", NewList().AddString("comment", "kernel").AddUint64("autotrim", 0).AddUint64("multihost", 1)).
+			Add("tags", TypeStringArray, []string{"a"})},
+	}
+	for _, c := range cases {
+		dst := newDst()
+		if err := Merge(dst, src, c.policy); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dst, c.expected) {
+			t.Errorf("policy %v: got %v, expected %v", c.policy, dst, c.expected)
+		}
+	}
+
+	// Merged values are copies
+	srcList := NewList().AddList("props", NewList().AddString("comment", "ours")).Add("tags", TypeStringArray, []string{"a"})
+	dst := NewList()
+	if err := Merge(dst, srcList, MergeReplace); err != nil {
+		t.Fatal(err)
+	}
+	srcList.Pairs[0].Value.(*List).Pairs[0].Value = "changed"
+	srcList.Pairs[1].Value.([]string)[0] = "changed"
+	if comment, _ := dst.Pairs[0].Value.(*List).GetString("comment"); comment != "ours" || dst.Pairs[1].Value.([]string)[0] != "a" {
+		t.Errorf("merged values share memory with the source")
+	}
+
+	// Lists with UniqueNameType only replace pairs with the same type
+	dst = &List{Flags: UniqueNameType, Pairs: []Pair{{"x", TypeString, "a"}, {"x", TypeUint64, uint64(1)}}}
+	if err := Merge(dst, &List{Pairs: []Pair{{"x", TypeUint64, uint64(2)}}}, MergeReplace); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []Pair{{"x", TypeString, "a"}, {"x", TypeUint64, uint64(2)}}; !reflect.DeepEqual(dst.Pairs, expected) {
+		t.Errorf("unexpected pairs %v", dst.Pairs)
+	}
+}
+
+// benchSnapshot resembles the nvlists returned for each snapshot when listing snapshots
+type benchSnapshot struct {
+	Name          string            `nvlist:"name"`
+	GUID          uint64            `nvlist:"guid"`
+	CreateTXG     uint64            `nvlist:"createtxg"`
+	Creation      uint64            `nvlist:"creation"`
+	Used          uint64            `nvlist:"used"`
+	Referenced    uint64            `nvlist:"referenced"`
+	Compressratio uint64            `nvlist:"compressratio"`
+	Defer         bool              `nvlist:"defer_destroy,asuint64"`
+	UserRefs      uint64            `nvlist:"userrefs"`
+	Clones        []string          `nvlist:"clones,omitempty"`
+	Props         map[string]uint64 `nvlist:"-,extra"`
+}
+
+func benchSnapshotValue() benchSnapshot {
+	return benchSnapshot{
+		Name:          "tank/data@autosnap_2020-01-01_00:00:00_hourly",
+		GUID:          1234567890123456789,
+		CreateTXG:     123456,
+		Creation:      1577836800,
+		Used:          1 << 20,
+		Referenced:    1 << 30,
+		Compressratio: 150,
+		UserRefs:      1,
+		Clones:        []string{"tank/clone"},
+		Props:         map[string]uint64{"written": 4096},
+	}
+}
+
+func BenchmarkMarshalStruct(b *testing.B) {
+	val := benchSnapshotValue()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(val); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendMarshalStruct(b *testing.B) {
+	val := benchSnapshotValue()
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = AppendMarshal(buf[:0], val); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalList(b *testing.B) {
+	val := testList()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(val); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalStruct(b *testing.B) {
+	data, err := Marshal(benchSnapshotValue())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out benchSnapshot
+		if err := Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalMap(b *testing.B) {
+	data, err := Marshal(benchSnapshotValue())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out map[string]interface{}
+		if err := Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
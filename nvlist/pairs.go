@@ -0,0 +1,453 @@
+package nvlist
+
+import (
+	"math"
+	"math/bits"
+	"reflect"
+)
+
+// PairMarshaler is implemented by the values MarshalNvlist methods generated by cmd/nvlistgen
+// return. It writes the pairs of an nvlist directly instead of going through reflection.
+type PairMarshaler interface {
+	// MarshalNvpairs writes all pairs of the nvlist
+	MarshalNvpairs(w *PairWriter) error
+	// NvlistFlags returns the nvflag of the nvlist, ok is false to use the default
+	NvlistFlags() (flags uint32, ok bool)
+}
+
+// PairUnmarshaler is implemented by the values UnmarshalNvlist methods generated by cmd/nvlistgen
+// pass to unmarshal. It receives the pairs of an nvlist one by one instead of going through
+// reflection.
+type PairUnmarshaler interface {
+	// UnmarshalNvpair is called for every pair of the nvlist. Pairs it doesn't read are skipped.
+	UnmarshalNvpair(p *PairReader) error
+	// EndNvlist is called with the nvflag of the nvlist after its last pair
+	EndNvlist(flags uint32) error
+}
+
+var pairMarshalerType = reflect.TypeOf((*PairMarshaler)(nil)).Elem()
+var pairUnmarshalerType = reflect.TypeOf((*PairUnmarshaler)(nil)).Elem()
+
+// pairMarshalerOf returns the PairMarshaler implemented by v
+func pairMarshalerOf(v reflect.Value) (PairMarshaler, bool) {
+	if v.Kind() != reflect.Struct || !v.CanInterface() || !v.Type().Implements(pairMarshalerType) {
+		return nil, false
+	}
+	return v.Interface().(PairMarshaler), true
+}
+
+// PairWriter writes the pairs of a single nvlist for a PairMarshaler. Its methods apply the same
+// rules as encoding struct fields with reflection.
+type PairWriter struct {
+	w    *nvlistWriter
+	path *nvPath
+}
+
+// writePairs lets m write the pairs of an nvlist followed by its end
+func (w *nvlistWriter) writePairs(m PairMarshaler, path *nvPath) error {
+	pw := PairWriter{w: w, path: path}
+	if err := m.MarshalNvpairs(&pw); err != nil {
+		return encodeError(err, path, nil)
+	}
+	w.writeNvlistTrailer()
+	return nil
+}
+
+// start begins an nvpair with the given type and number of elements
+func (pw *PairWriter) start(name string, t Type, nelem int) (nvpair, int, error) {
+	nameLen := len(name) + 1
+	if nameLen >= math.MaxInt16 || nelem >= math.MaxInt32 {
+		return nvpair{}, 0, ErrInvalidValue
+	}
+	nvp := nvpair{Name_sz: int16(nameLen), Value_elem: int32(nelem), Type: t}
+	startByte, err := pw.w.startNvPair(name, nvp)
+	return nvp, startByte, err
+}
+
+// number writes an nvpair of the numeric type t with the given raw bits
+func (pw *PairWriter) number(name string, t Type, raw uint64) error {
+	nvp, startByte, err := pw.start(name, t, 1)
+	if err == nil {
+		pw.w.writeNumber(nvtypeSize(t), raw)
+		err = pw.w.endNvPair(startByte, nvp, nvtypeSize(t))
+	}
+	if err != nil {
+		return encodeError(err, pw.path.child(name), listValueTypes[t])
+	}
+	return nil
+}
+
+// Int writes a signed integer with the type t, which is one of the intN types or hrtime
+func (pw *PairWriter) Int(name string, t Type, v int64) error {
+	switch t {
+	case TypeInt8, TypeInt16, TypeInt32, TypeInt64, TypeHrtime:
+		return pw.number(name, t, uint64(v))
+	}
+	return encodeError(ErrInvalidValue, pw.path.child(name), nil)
+}
+
+// Uint writes an unsigned integer with the type t, which is byte or one of the uintN types
+func (pw *PairWriter) Uint(name string, t Type, v uint64) error {
+	switch t {
+	case TypeByte, TypeUint8, TypeUint16, TypeUint32, TypeUint64:
+		return pw.number(name, t, v)
+	}
+	return encodeError(ErrInvalidValue, pw.path.child(name), nil)
+}
+
+// Float writes a double
+func (pw *PairWriter) Float(name string, v float64) error {
+	return pw.number(name, TypeDouble, math.Float64bits(v))
+}
+
+// Bool writes a boolean if v is true, like bool fields are encoded
+func (pw *PairWriter) Bool(name string, v bool) error {
+	if !v {
+		return nil
+	}
+	nvp, startByte, err := pw.start(name, TypeBoolean, 0)
+	if err == nil {
+		err = pw.w.endNvPair(startByte, nvp, 0)
+	}
+	if err != nil {
+		return encodeError(err, pw.path.child(name), nil)
+	}
+	return nil
+}
+
+// BoolUint64 writes v as a uint64 with value 0 or 1, like bool fields with the asuint64 option
+func (pw *PairWriter) BoolUint64(name string, v bool) error {
+	return pw.number(name, TypeUint64, uint64(boolToInt(v)))
+}
+
+// BoolValue writes a boolean_value
+func (pw *PairWriter) BoolValue(name string, v bool) error {
+	nvp, startByte, err := pw.start(name, TypeBooleanValue, 1)
+	if err == nil {
+		pw.w.writeBool(v)
+		err = pw.w.endNvPair(startByte, nvp, 4)
+	}
+	if err != nil {
+		return encodeError(err, pw.path.child(name), boolValueType)
+	}
+	return nil
+}
+
+// String writes a string
+func (pw *PairWriter) String(name string, v string) error {
+	nvp, startByte, err := pw.start(name, TypeString, 1)
+	if err == nil {
+		err = pw.w.writeString(v)
+	}
+	if err == nil {
+		err = pw.w.endNvPair(startByte, nvp, len(v)+1)
+	}
+	if err != nil {
+		return encodeError(err, pw.path.child(name), listValueTypes[TypeString])
+	}
+	return nil
+}
+
+// Value writes v like a struct field with the given tag options, using reflection
+func (pw *PairWriter) Value(name string, v interface{}, omitEmpty, asUint64 bool) error {
+	path := pw.path.child(name)
+	rv := reflect.ValueOf(v)
+	if omitEmpty && isEmptyValue(unpackVal(rv)) {
+		return nil
+	}
+	val, err := marshalValue(rv)
+	if err != nil {
+		return encodeError(err, path, reflect.TypeOf(v))
+	}
+	if asUint64 && val.Kind() == reflect.Bool {
+		val = reflect.ValueOf(uint64(boolToInt(val.Bool())))
+	}
+	if !val.IsValid() {
+		return nil
+	}
+	if err := pw.w.writeNvPair(name, val, path); err != nil {
+		return encodeError(err, path, val.Type())
+	}
+	return nil
+}
+
+// Extra writes the entries of the map m like a field with the extra option, using reflection.
+// Entries for which isField returns true are skipped.
+func (pw *PairWriter) Extra(m interface{}, isField func(name string) bool) error {
+	val := unpackVal(reflect.ValueOf(m))
+	if !val.IsValid() {
+		return nil
+	}
+	if !isExtraMap(val.Type()) {
+		return encodeError(ErrInvalidTag, pw.path, val.Type())
+	}
+	for _, key := range pw.w.mapKeys(val) {
+		if isField(key.String()) {
+			continue
+		}
+		if err := pw.Value(key.String(), val.MapIndex(key).Interface(), false, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PairReader gives a PairUnmarshaler access to a single nvpair. Its methods apply the same rules as
+// decoding into struct fields with reflection: values which don't fit are recorded as errors which
+// get returned after decoding has finished and make the methods return false. A PairReader is only
+// valid during the call of UnmarshalNvpair it is passed to.
+type PairReader struct {
+	r      *nvlistReader
+	nvpr   nvPairReader
+	nvp    nvpair
+	name   string
+	parent *nvPath
+	// pairPath is created on demand, most pairs never need it
+	pairPath *nvPath
+	// read is set once the value has been consumed
+	read bool
+	// err is a problem with the data which aborts decoding
+	err error
+}
+
+// path returns the path of the nvpair
+func (p *PairReader) path() *nvPath {
+	if p.pairPath == nil {
+		p.pairPath = p.parent.child(p.name)
+	}
+	return p.pairPath
+}
+
+// readPairsWith hands the pairs of an nvlist with the given nvflag to u
+func (r *nvlistReader) readPairsWith(u PairUnmarshaler, path *nvPath, flags uint32) error {
+	names := r.newNameSet(flags)
+	// A single PairReader is reused for all pairs to avoid allocations
+	p := &PairReader{r: r, parent: path}
+	for {
+		nvp, name, nvpr, err := r.readNvPairHeader()
+		if err != nil {
+			return decodeError(err, path, TypeUnknown, nil)
+		}
+		if nvp.Size == 0 {
+			if err := u.EndNvlist(flags); err != nil {
+				return decodeError(err, path, TypeNvlist, reflect.TypeOf(u))
+			}
+			return nil
+		}
+		if r.encoding == EncodingNative {
+			// Embedded nvlists follow the nvpair
+			r.currentByte = nvpr.endByte()
+		}
+		*p = PairReader{r: r, nvpr: nvpr, nvp: nvp, name: name, parent: path}
+		if !names.add(name, nvp.Type) {
+			return decodeError(ErrDuplicateName, p.path(), nvp.Type, nil)
+		}
+
+		err = u.UnmarshalNvpair(p)
+		if p.err != nil {
+			return p.err
+		}
+		if err != nil {
+			return decodeError(err, p.path(), nvp.Type, reflect.TypeOf(u))
+		}
+		if !p.read && (nvp.Type == TypeNvlist || nvp.Type == TypeNvlistArray) {
+			// Still needs to be decoded to find the end of the embedded nvlists
+			if _, err := r.readValueInto(&p.nvpr, nvp, reflect.Value{}, p.path()); err != nil {
+				return err
+			}
+		}
+
+		if r.encoding == EncodingXDR {
+			r.currentByte = p.nvpr.endByte()
+		}
+	}
+}
+
+// Name returns the name of the nvpair
+func (p *PairReader) Name() string {
+	return p.name
+}
+
+// Type returns the type of the nvpair
+func (p *PairReader) Type() Type {
+	return p.nvp.Type
+}
+
+var intTypes = map[int]reflect.Type{
+	8:  reflect.TypeOf(int8(0)),
+	16: reflect.TypeOf(int16(0)),
+	32: reflect.TypeOf(int32(0)),
+	64: reflect.TypeOf(int64(0)),
+}
+
+var uintTypes = map[int]reflect.Type{
+	8:  reflect.TypeOf(uint8(0)),
+	16: reflect.TypeOf(uint16(0)),
+	32: reflect.TypeOf(uint32(0)),
+	64: reflect.TypeOf(uint64(0)),
+}
+
+var floatTypes = map[int]reflect.Type{
+	32: reflect.TypeOf(float32(0)),
+	64: reflect.TypeOf(float64(0)),
+}
+
+// number reads the value of a numeric nvpair. If it isn't one, a type mismatch is recorded.
+func (p *PairReader) number(goType reflect.Type) (number, bool) {
+	switch p.nvp.Type {
+	case TypeInt8, TypeInt16, TypeInt32, TypeInt64, TypeHrtime, TypeByte, TypeUint8, TypeUint16, TypeUint32, TypeUint64, TypeDouble:
+	default:
+		p.r.saveTypeError(p.path(), p.nvp.Type, goType)
+		return number{}, false
+	}
+	size := nvtypeSize(p.nvp.Type)
+	raw, err := p.nvpr.readNumber(size)
+	if err != nil {
+		p.err = decodeError(err, p.path(), p.nvp.Type, nil)
+		return number{}, false
+	}
+	p.read = true
+	switch p.nvp.Type {
+	case TypeInt8, TypeInt16, TypeInt32, TypeInt64, TypeHrtime:
+		return number{kind: reflect.Int64, i: signExtend(raw, size)}, true
+	case TypeDouble:
+		return number{kind: reflect.Float64, f: math.Float64frombits(raw)}, true
+	}
+	return number{kind: reflect.Uint64, u: raw}, true
+}
+
+// Int decodes a numeric nvpair into a signed integer of the given size in bits, 0 means the size
+// of int
+func (p *PairReader) Int(size int) (int64, bool) {
+	if size == 0 {
+		size = bits.UintSize
+	}
+	goType := intTypes[size]
+	n, ok := p.number(goType)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.toInt(size, p.r.strict)
+	if err != nil {
+		p.r.saveValueError(err, p.path(), p.nvp.Type, goType)
+		return 0, false
+	}
+	return i, true
+}
+
+// Uint decodes a numeric nvpair into an unsigned integer of the given size in bits, 0 means the
+// size of uint
+func (p *PairReader) Uint(size int) (uint64, bool) {
+	if size == 0 {
+		size = bits.UintSize
+	}
+	goType := uintTypes[size]
+	n, ok := p.number(goType)
+	if !ok {
+		return 0, false
+	}
+	u, err := n.toUint(size, p.r.strict)
+	if err != nil {
+		p.r.saveValueError(err, p.path(), p.nvp.Type, goType)
+		return 0, false
+	}
+	return u, true
+}
+
+// Float decodes a numeric nvpair into a floating point number of the given size in bits
+func (p *PairReader) Float(size int) (float64, bool) {
+	goType := floatTypes[size]
+	n, ok := p.number(goType)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.toFloat(size, p.r.strict)
+	if err != nil {
+		p.r.saveValueError(err, p.path(), p.nvp.Type, goType)
+		return 0, false
+	}
+	return f, true
+}
+
+// Bool decodes a boolean or boolean_value
+func (p *PairReader) Bool() (bool, bool) {
+	switch p.nvp.Type {
+	case TypeBoolean:
+		p.read = true
+		return true, true
+	case TypeBooleanValue:
+		b, err := p.nvpr.readBool()
+		if err != nil {
+			p.err = decodeError(err, p.path(), p.nvp.Type, nil)
+			return false, false
+		}
+		p.read = true
+		return b, true
+	}
+	p.r.saveTypeError(p.path(), p.nvp.Type, reflect.TypeOf(false))
+	return false, false
+}
+
+// String decodes a string
+func (p *PairReader) String() (string, bool) {
+	if p.nvp.Type != TypeString {
+		p.r.saveTypeError(p.path(), p.nvp.Type, listValueTypes[TypeString])
+		return "", false
+	}
+	s, err := p.nvpr.readString()
+	if err != nil {
+		p.err = decodeError(err, p.path(), p.nvp.Type, nil)
+		return "", false
+	}
+	p.read = true
+	return s, true
+}
+
+// Decode decodes the nvpair into dst, which needs to be a non-nil pointer, like into a struct field
+// with the given tag options using reflection. The returned error is a problem with the data, type
+// mismatches are recorded like for the other methods.
+func (p *PairReader) Decode(dst interface{}, asUint64 bool) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return decodeError(ErrInvalidValue, p.path(), p.nvp.Type, reflect.TypeOf(dst))
+	}
+	target := v.Elem()
+	if asUint64 && p.nvp.Type == TypeUint64 && unpackType(target.Type()).Kind() == reflect.Bool {
+		if u, ok := p.Uint(64); ok {
+			indirect(target).SetBool(u != 0)
+		}
+		return p.err
+	}
+	p.read = true
+	_, err := p.r.readValueInto(&p.nvpr, p.nvp, target, p.path())
+	return err
+}
+
+// DecodeExtra decodes the nvpair into the map m points to like into a field with the extra option
+func (p *PairReader) DecodeExtra(m interface{}) error {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Ptr || v.IsNil() || !isExtraMap(v.Type().Elem()) {
+		return decodeError(ErrInvalidTag, p.path(), p.nvp.Type, reflect.TypeOf(m))
+	}
+	extra := v.Elem()
+	target := reflect.New(extra.Type().Elem()).Elem()
+	p.read = true
+	stored, err := p.r.readValueInto(&p.nvpr, p.nvp, target, p.path())
+	if err != nil || !stored {
+		return err
+	}
+	if extra.IsNil() {
+		extra.Set(reflect.MakeMap(extra.Type()))
+	}
+	extra.SetMapIndex(reflect.ValueOf(p.name).Convert(extra.Type().Key()), target)
+	return nil
+}
+
+// Unknown handles an nvpair without corresponding field. In strict mode it returns
+// ErrUnknownField, otherwise the nvpair is skipped.
+func (p *PairReader) Unknown() error {
+	if p.r.strict {
+		return decodeError(ErrUnknownField, p.path(), p.nvp.Type, nil)
+	}
+	return nil
+}
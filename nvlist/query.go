@@ -0,0 +1,363 @@
+package nvlist
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned inside a QueryError if there is no value at a path
+var ErrNotFound = errors.New("no value at the path")
+
+// ErrAmbiguousPath is returned inside a QueryError by Get if a path with wildcards matches several
+// values
+var ErrAmbiguousPath = errors.New("the path matches more than one value")
+
+// ErrInvalidPath is returned inside a QueryError if a path cannot be parsed
+var ErrInvalidPath = errors.New("invalid path")
+
+// QueryError describes why Get or GetAll failed
+type QueryError struct {
+	// Query is the path passed to Get or GetAll
+	Query string
+	// Path of the affected value with all wildcards resolved, for example vdev_tree.children[2].path.
+	// Empty if the problem is not specific to a value.
+	Path string
+	// GoType is the type of the affected value, nil if there is none
+	GoType reflect.Type
+	// Want is the requested type if the value has a different one
+	Want reflect.Type
+	// Err is the underlying error
+	Err error
+}
+
+func (e *QueryError) Error() string {
+	var b strings.Builder
+	b.WriteString("nvlist: cannot get ")
+	b.WriteString(e.Query)
+	if e.Path != "" && e.Path != e.Query {
+		b.WriteString(" at ")
+		b.WriteString(e.Path)
+	}
+	if e.GoType != nil {
+		b.WriteString(" from Go value of type ")
+		b.WriteString(e.GoType.String())
+	}
+	if e.Want != nil {
+		b.WriteString(" as ")
+		b.WriteString(e.Want.String())
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Get returns the value at path inside tree, which is typically the result of decoding an nvlist
+// into a map[string]interface{}, an empty interface or a List. It can also be a struct, which is
+// accessed with the names of its nvlist tags, or a RawMessage, which is decoded on the way.
+//
+// A path consists of pair names separated by dots and array indices in brackets, like
+// vdev_tree.children[0].path. Names containing dots or brackets can be given as quoted Go strings
+// in brackets, like props["org.example:prop"]. An empty path returns tree itself. The wildcards *
+// and [*] match all pairs of an nvlist and all elements of an array, but the path needs to match
+// exactly one value, otherwise ErrAmbiguousPath is returned.
+//
+// The value needs to have the type T, pointers and interfaces are followed to find it. Values are
+// never converted, numbers need to be requested with the type they were decoded as. All errors are
+// of type *QueryError.
+func Get[T any](tree interface{}, path string) (T, error) {
+	var zero T
+	q, err := runQuery(tree, path)
+	if err != nil {
+		return zero, err
+	}
+	switch len(q.matches) {
+	case 0:
+		return zero, &QueryError{Query: path, Err: ErrNotFound}
+	case 1:
+		return matchAs[T](q.matches[0], path)
+	default:
+		return zero, &QueryError{Query: path, Err: ErrAmbiguousPath}
+	}
+}
+
+// GetAll returns all values matched by a path with wildcards in their order. Maps are traversed in
+// the order of their keys. Like Get it fails if the part of the path before the first wildcard
+// doesn't lead to a value, but values matched by a wildcard which don't contain the rest of the path
+// are skipped. All matched values need to have the type T.
+func GetAll[T any](tree interface{}, path string) ([]T, error) {
+	q, err := runQuery(tree, path)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]T, 0, len(q.matches))
+	for _, m := range q.matches {
+		val, err := matchAs[T](m, path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+// matchAs returns the matched value as a T
+func matchAs[T any](m queryMatch, query string) (T, error) {
+	for v := m.val; v.IsValid() && v.CanInterface(); v = v.Elem() {
+		if val, ok := v.Interface().(T); ok {
+			return val, nil
+		}
+		if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface || v.IsNil() {
+			break
+		}
+	}
+	var zero T
+	want := reflect.TypeOf(&zero).Elem()
+	v := m.val
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if (!v.IsValid() || v.Kind() == reflect.Interface) && want.Kind() == reflect.Interface {
+		return zero, nil
+	}
+	e := &QueryError{Query: query, Path: m.path.String(), Want: want, Err: ErrTypeMismatch}
+	if v.IsValid() {
+		e.GoType = v.Type()
+	}
+	return zero, e
+}
+
+// queryStep is a single element of a path, which selects pairs by name or array elements by index
+type queryStep struct {
+	element  bool
+	wildcard bool
+	name     string
+	index    int
+}
+
+// parsePath splits a path into its steps
+func parsePath(path string) ([]queryStep, error) {
+	var steps []queryStep
+	for i := 0; i < len(path); {
+		var s queryStep
+		switch {
+		case path[i] == '[' && strings.HasPrefix(path[i+1:], "\""):
+			quoted, err := strconv.QuotedPrefix(path[i+1:])
+			if err != nil {
+				return nil, ErrInvalidPath
+			}
+			s.name, _ = strconv.Unquote(quoted)
+			i += 1 + len(quoted)
+			if !strings.HasPrefix(path[i:], "]") {
+				return nil, ErrInvalidPath
+			}
+			i++
+		case path[i] == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, ErrInvalidPath
+			}
+			s.element = true
+			if index := path[i+1 : i+end]; index == "*" {
+				s.wildcard = true
+			} else {
+				n, err := strconv.ParseUint(index, 10, 31)
+				if err != nil {
+					return nil, ErrInvalidPath
+				}
+				s.index = int(n)
+			}
+			i += end + 1
+		default:
+			if len(steps) > 0 {
+				if path[i] != '.' {
+					return nil, ErrInvalidPath
+				}
+				i++
+			}
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			if end == 0 {
+				return nil, ErrInvalidPath
+			}
+			s.name = path[i : i+end]
+			s.wildcard = s.name == "*"
+			i += end
+		}
+		steps = append(steps, s)
+	}
+	return steps, nil
+}
+
+// queryMatch is a value matched by a path
+type queryMatch struct {
+	path *nvPath
+	val  reflect.Value
+}
+
+type query struct {
+	query   string
+	matches []queryMatch
+}
+
+// runQuery collects all values matched by path inside tree
+func runQuery(tree interface{}, path string) (*query, error) {
+	q := &query{query: path}
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, &QueryError{Query: path, Err: err}
+	}
+	if err := q.walk(reflect.ValueOf(tree), nil, steps, false); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// walk follows steps starting at v, which is located at path. Below a wildcard, values which don't
+// contain the remaining steps are skipped instead of failing the query.
+func (q *query) walk(v reflect.Value, path *nvPath, steps []queryStep, wildcard bool) error {
+	if len(steps) == 0 {
+		q.matches = append(q.matches, queryMatch{path: path, val: v})
+		return nil
+	}
+	v, err := q.node(v, path)
+	if err != nil {
+		return err
+	}
+	s := steps[0]
+	rest := steps[1:]
+	// below is set if the current step is below a wildcard
+	below := wildcard
+	wildcard = wildcard || s.wildcard
+
+	if s.element {
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array || v.Type() == rawMessageType {
+			return q.mismatch(v, path, below)
+		}
+		if s.wildcard {
+			for i := 0; i < v.Len(); i++ {
+				if err := q.walk(v.Index(i), path.element(i), rest, wildcard); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if s.index >= v.Len() {
+			return q.notFound(path.element(s.index), below)
+		}
+		return q.walk(v.Index(s.index), path.element(s.index), rest, wildcard)
+	}
+
+	switch {
+	case v.IsValid() && v.Type() == reflect.PtrTo(listType):
+		l := v.Interface().(*List)
+		var pairs []*Pair
+		if s.wildcard {
+			for i := range l.Pairs {
+				pairs = append(pairs, &l.Pairs[i])
+			}
+		} else if pairs = l.GetAll(s.name); len(pairs) == 0 {
+			return q.notFound(path.child(s.name), below)
+		}
+		for _, p := range pairs {
+			val := reflect.ValueOf(p.Value)
+			if p.Type == TypeBoolean {
+				val = reflect.ValueOf(true)
+			}
+			if err := q.walk(val, path.child(p.Name), rest, wildcard); err != nil {
+				return err
+			}
+		}
+		return nil
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if s.wildcard {
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, key := range keys {
+				if err := q.walk(v.MapIndex(key), path.child(key.String()), rest, wildcard); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		val := v.MapIndex(reflect.ValueOf(s.name).Convert(v.Type().Key()))
+		if !val.IsValid() {
+			return q.notFound(path.child(s.name), below)
+		}
+		return q.walk(val, path.child(s.name), rest, wildcard)
+	case v.Kind() == reflect.Struct:
+		for _, f := range cachedStructPlan(v.Type()).fields {
+			if f.extra || f.nvflag || !s.wildcard && f.name != s.name {
+				continue
+			}
+			val, ok := fieldByIndex(v, f.index)
+			if !ok {
+				continue
+			}
+			if err := q.walk(val, path.child(f.name), rest, wildcard); err != nil {
+				return err
+			}
+			if !s.wildcard {
+				return nil
+			}
+		}
+		if s.wildcard {
+			return nil
+		}
+		return q.notFound(path.child(s.name), below)
+	}
+	return q.mismatch(v, path, below)
+}
+
+// node follows pointers and interfaces to the value at path and decodes raw messages
+func (q *query) node(v reflect.Value, path *nvPath) (reflect.Value, error) {
+	for (v.Kind() == reflect.Ptr && v.Type() != reflect.PtrTo(listType) || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return reflect.Value{}, nil
+	}
+	if !v.IsValid() {
+		return v, nil
+	}
+	switch v.Type() {
+	case listType:
+		l := v.Interface().(List)
+		return reflect.ValueOf(&l), nil
+	case rawMessageType:
+		l := new(List)
+		if err := Unmarshal(v.Bytes(), l); err != nil {
+			return v, &QueryError{Query: q.query, Path: path.String(), GoType: v.Type(), Err: err}
+		}
+		return reflect.ValueOf(l), nil
+	}
+	return v, nil
+}
+
+// notFound reports a missing value at path unless it is below a wildcard
+func (q *query) notFound(path *nvPath, wildcard bool) error {
+	if wildcard {
+		return nil
+	}
+	return &QueryError{Query: q.query, Path: path.String(), Err: ErrNotFound}
+}
+
+// mismatch reports that v at path is no nvlist or array unless it is below a wildcard
+func (q *query) mismatch(v reflect.Value, path *nvPath, wildcard bool) error {
+	if wildcard {
+		return nil
+	}
+	e := &QueryError{Query: q.query, Path: path.String(), Err: ErrTypeMismatch}
+	if v.IsValid() {
+		e.GoType = v.Type()
+	}
+	return e
+}
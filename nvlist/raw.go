@@ -0,0 +1,124 @@
+package nvlist
+
+import "reflect"
+
+// RawMessage is a complete encoded nvlist. It can be used to pass an embedded nvlist through
+// without changing it or to delay decoding it.
+//
+// When decoding an embedded nvlist into a RawMessage, it receives a standalone nvlist with the
+// encoding and byte order of the surrounding one, so it can be decoded later with Unmarshal. Arrays
+// of nvlists can be decoded into a []RawMessage. When encoding, the pairs of a RawMessage are
+// copied verbatim if its encoding and byte order match, otherwise it is transcoded without changing
+// the types or order of its pairs. An empty RawMessage is encoded as an empty nvlist.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// rawHeaderSize is the size of the header of a standalone nvlist, consisting of the encoding, the
+// byte order, two reserved bytes, the version and the nvflag
+const rawHeaderSize = 12
+
+// readRawPairs skips over the pairs of an nvlist with the given nvflag and returns them as a
+// standalone nvlist in the encoding of the one being read
+func (r *nvlistReader) readRawPairs(path *nvPath, flags uint32) (RawMessage, error) {
+	startByte := r.currentByte
+	if err := r.skipPairs(); err != nil {
+		return nil, decodeError(err, path, TypeNvlist, nil)
+	}
+	m := make(RawMessage, rawHeaderSize, rawHeaderSize+r.currentByte-startByte)
+	copy(m, r.nvlist[:4])
+	r.endianness.PutUint32(m[4:], uint32(r.version))
+	r.endianness.PutUint32(m[8:], flags)
+	return append(m, r.nvlist[startByte:r.currentByte]...), nil
+}
+
+// skipPairs skips over the pairs of an nvlist and all nvlists embedded into them without decoding
+// any values
+func (r *nvlistReader) skipPairs() error {
+	for {
+		nvp, _, nvpr, err := r.readNvPairHeader()
+		if err != nil {
+			return err
+		}
+		if nvp.Size == 0 {
+			return nil
+		}
+		r.currentByte = nvpr.endByte()
+		if r.encoding != EncodingNative {
+			// Embedded nvlists are part of the nvpair in XDR encoding
+			continue
+		}
+		var embedded int
+		switch nvp.Type {
+		case TypeNvlist:
+			embedded = 1
+		case TypeNvlistArray:
+			embedded = int(nvp.Value_elem)
+		}
+		if embedded == 0 {
+			continue
+		}
+		if r.depth >= r.maxDepth {
+			return ErrLimitExceeded
+		}
+		r.depth++
+		for i := 0; i < embedded; i++ {
+			if err := r.skipPairs(); err != nil {
+				return err
+			}
+		}
+		r.depth--
+	}
+}
+
+// rawReader checks that m is a well-formed nvlist and returns a reader positioned after its header
+func rawReader(m RawMessage) (*nvlistReader, error) {
+	r := &nvlistReader{
+		nvlist:       m,
+		maxDepth:     DefaultMaxDepth,
+		maxArrayLen:  DefaultMaxArrayLen,
+		maxStringLen: DefaultMaxStringLen,
+	}
+	if err := r.readNvHeader(); err != nil {
+		return nil, err
+	}
+	if err := r.skipPairs(); err != nil {
+		return nil, err
+	}
+	if r.currentByte != len(m) {
+		return nil, ErrInvalidData
+	}
+	r.currentByte = rawHeaderSize
+	return r, nil
+}
+
+// rawFlags returns the nvflag stored in the header of m
+func rawFlags(m RawMessage) (uint32, bool) {
+	r := nvlistReader{nvlist: m}
+	if err := r.readNvHeader(); err != nil {
+		return 0, false
+	}
+	return r.flags, true
+}
+
+// writeRawPairs writes the pairs of m, copying them if m has the same encoding and byte order as
+// the nvlist being written
+func (w *nvlistWriter) writeRawPairs(m RawMessage, path *nvPath) error {
+	if len(m) == 0 {
+		w.writeNvlistTrailer()
+		return nil
+	}
+	r, err := rawReader(m)
+	if err != nil {
+		return encodeError(err, path, rawMessageType)
+	}
+	if r.encoding == w.encoding && (r.encoding == EncodingXDR || r.endianness == w.endianness) {
+		w.nvlist = append(w.nvlist, m[rawHeaderSize:]...)
+		return nil
+	}
+	var l List
+	if err := r.readList(&l, path, r.flags); err != nil {
+		return encodeError(err, path, rawMessageType)
+	}
+	return w.writeList(&l, path)
+}
@@ -0,0 +1,161 @@
+package nvlist
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Encoder writes nvlists to an output stream
+type Encoder struct {
+	w    io.Writer
+	opts EncoderOptions
+}
+
+// NewEncoder returns a new encoder that writes to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// SetOptions sets the options used for all following calls to Encode
+func (e *Encoder) SetOptions(opts EncoderOptions) {
+	e.opts = opts
+}
+
+// Encode writes the nvlist encoding of val to the stream
+func (e *Encoder) Encode(val interface{}) error {
+	return marshalPooled(val, e.opts, func(data []byte) error {
+		_, err := e.w.Write(data)
+		return err
+	})
+}
+
+// Decoder reads nvlists from an input stream. It never reads past the end of the current nvlist,
+// so other data can follow it in the stream. Since it reads in small pieces, r should be buffered
+// if it isn't already.
+type Decoder struct {
+	r    io.Reader
+	opts DecoderOptions
+	buf  []byte
+}
+
+// NewDecoder returns a new decoder that reads from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// SetOptions sets the options used for all following calls to Decode
+func (d *Decoder) SetOptions(opts DecoderOptions) {
+	d.opts = opts
+}
+
+// Decode reads the next nvlist from the stream and stores it in val like Unmarshal. At the end of
+// the stream io.EOF is returned, an nvlist cut short results in io.ErrUnexpectedEOF. Other errors
+// of the underlying reader are returned as-is, problems with the data as *DecodeError.
+func (d *Decoder) Decode(val interface{}) error {
+	data, err := d.readNvlist()
+	if err != nil {
+		return err
+	}
+	return UnmarshalWithOptions(data, val, d.opts)
+}
+
+// read appends the next n bytes of the stream to the buffer and returns them
+func (d *Decoder) read(n int) ([]byte, error) {
+	if len(d.buf)+n > limit(d.opts.MaxTotalSize, DefaultMaxTotalSize) {
+		return nil, &DecodeError{Err: ErrLimitExceeded}
+	}
+	start := len(d.buf)
+	d.buf = append(d.buf, make([]byte, n)...)
+	if _, err := io.ReadFull(d.r, d.buf[start:]); err != nil {
+		if err == io.EOF && start != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return d.buf[start:], nil
+}
+
+// readNvlist reads exactly one nvlist from the stream without decoding it. Only the sizes of the
+// nvpairs are looked at to find its end.
+func (d *Decoder) readNvlist() ([]byte, error) {
+	// Decoded values can reference the buffer, so it can't be reused
+	d.buf = nil
+	header, err := d.read(4)
+	if err != nil {
+		return nil, err
+	}
+	var endianness binary.ByteOrder
+	switch header[1] {
+	case bigEndian:
+		endianness = binary.BigEndian
+	case littleEndian:
+		endianness = binary.LittleEndian
+	default:
+		return nil, &DecodeError{Err: ErrInvalidEndianess}
+	}
+	switch Encoding(header[0]) {
+	case EncodingNative:
+	case EncodingXDR:
+		endianness = binary.BigEndian
+	default:
+		return nil, &DecodeError{Err: ErrInvalidEncoding}
+	}
+	if _, err := d.read(8); err != nil { // Version and flags
+		return nil, err
+	}
+
+	if Encoding(header[0]) == EncodingXDR {
+		// Embedded nvlists are part of their nvpair, so only the sizes of the top-level nvpairs
+		// need to be followed.
+		for {
+			sizes, err := d.read(8)
+			if err != nil {
+				return nil, err
+			}
+			encodedSize := endianness.Uint32(sizes[0:4])
+			decodedSize := endianness.Uint32(sizes[4:8])
+			if encodedSize == 0 && decodedSize == 0 {
+				return d.buf, nil
+			}
+			if encodedSize < 8 || encodedSize > 1<<31-1 {
+				return nil, &DecodeError{Err: ErrInvalidData}
+			}
+			if _, err := d.read(int(encodedSize) - 8); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Embedded nvlists follow their nvpair, every nvpair of type nvlist or nvlist array adds
+	// nvlists which need to be read before the outer one continues.
+	openLists := 1
+	for openLists > 0 {
+		rawSize, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		size := int32(endianness.Uint32(rawSize))
+		if size == 0 {
+			openLists--
+			continue
+		}
+		if size < nvlistHeaderSize {
+			return nil, &DecodeError{Err: ErrInvalidData}
+		}
+		pair, err := d.read(int(size) - 4)
+		if err != nil {
+			return nil, err
+		}
+		nelem := int32(endianness.Uint32(pair[4:8]))
+		switch Type(endianness.Uint32(pair[8:12])) {
+		case TypeNvlist:
+			openLists++
+		case TypeNvlistArray:
+			if nelem < 0 {
+				return nil, &DecodeError{Err: ErrInvalidData}
+			}
+			openLists += int(nelem)
+		}
+	}
+	return d.buf, nil
+}
@@ -0,0 +1,311 @@
+package nvlist
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidTag is returned if the nvlist tag of a struct field cannot be applied to it
+var ErrInvalidTag = errors.New("the nvlist struct tag is invalid for this field")
+
+// field describes a struct field as configured by its nvlist tag. The tag consists of the name of
+// the nvpair followed by comma-separated options in any order:
+//
+//	omitempty  don't encode the field if it has its zero value
+//	ro         read-only, the field is decoded but never encoded
+//	extra      the field is a map[string]T which receives all nvpairs without a corresponding field
+//	           and whose entries are encoded as nvpairs, the name should be "-"
+//	asuint64   encode a bool as a uint64 with value 0 or 1 instead of a boolean flag
+//	default=x  set the field to x when decoding if the nvpair is missing
+//	nvflag     the field is an unsigned integer which receives the nvflag of the nvlist and is used
+//	           as its nvflag when encoding, the name should be "-"
+//
+// A name of "-" without the extra or nvflag option skips the field, an empty name defaults to the
+// field name.
+//
+// The fields of embedded structs and struct pointers are promoted into the nvlist of the outer struct
+// like in encoding/json, unless the tag of the embedded field sets a name.
+type field struct {
+	name string
+	// index is the index sequence of the field for reflect.Value.FieldByIndex
+	index []int
+	typ   reflect.Type
+	// tagged is set if the name comes from the tag
+	tagged bool
+
+	omitEmpty    bool
+	readOnly     bool
+	extra        bool
+	asUint64     bool
+	nvflag       bool
+	hasDefault   bool
+	defaultValue string
+}
+
+// parseTag parses the nvlist tag of the given struct field. It returns false if the field should be
+// skipped.
+func parseTag(sf reflect.StructField, index []int) (field, bool) {
+	f := field{name: sf.Name, index: index, typ: sf.Type}
+	tag, ok := sf.Tag.Lookup("nvlist")
+	if !ok {
+		return f, true
+	}
+	parts := strings.Split(tag, ",")
+	if parts[0] != "" {
+		f.name = parts[0]
+		f.tagged = true
+	}
+	for _, opt := range parts[1:] {
+		switch {
+		case opt == "omitempty":
+			f.omitEmpty = true
+		case opt == "ro":
+			f.readOnly = true
+		case opt == "extra":
+			f.extra = true
+		case opt == "asuint64":
+			f.asUint64 = true
+		case opt == "nvflag":
+			f.nvflag = true
+		case strings.HasPrefix(opt, "default="):
+			f.hasDefault = true
+			f.defaultValue = strings.TrimPrefix(opt, "default=")
+		}
+	}
+	if parts[0] == "-" && !f.extra && !f.nvflag {
+		return f, false
+	}
+	return f, true
+}
+
+// structFields returns all fields of the struct type t which take part in encoding and decoding,
+// including the promoted fields of embedded structs
+func structFields(t reflect.Type) []field {
+	fields := appendFields(nil, t, nil, map[reflect.Type]bool{t: true})
+	return dominantFields(fields)
+}
+
+// appendFields appends the fields of the struct type t, which is embedded at index, and those promoted
+// from its embedded structs to fields. outer contains the struct types t is embedded in to break
+// cycles of embedded pointers.
+func appendFields(fields []field, t reflect.Type, index []int, outer map[reflect.Type]bool) []field {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fieldIndex := append(index[:len(index):len(index)], i)
+		if sf.Anonymous {
+			et := sf.Type
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if sf.PkgPath != "" && (sf.Type.Kind() == reflect.Ptr || et.Kind() != reflect.Struct) {
+				// Only the fields of unexported embedded structs are accessible, and only if they
+				// don't need to be allocated
+				continue
+			}
+			name := strings.SplitN(sf.Tag.Get("nvlist"), ",", 2)[0]
+			if et.Kind() == reflect.Struct && name == "" {
+				if !outer[et] {
+					outer[et] = true
+					fields = appendFields(fields, et, fieldIndex, outer)
+					delete(outer, et)
+				}
+				continue
+			}
+		} else if sf.PkgPath != "" { // unexported
+			continue
+		}
+		if f, ok := parseTag(sf, fieldIndex); ok {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// fieldKey groups fields which conflict with each other
+type fieldKey struct {
+	name   string
+	extra  bool
+	nvflag bool
+}
+
+func (f *field) key() fieldKey {
+	if f.extra || f.nvflag {
+		return fieldKey{extra: f.extra, nvflag: f.nvflag}
+	}
+	return fieldKey{name: f.name}
+}
+
+// dominantFields resolves conflicts between fields with the same name using the rules of
+// encoding/json: promoted fields are hidden by fields at a shallower depth, and of the promoted fields
+// at the same depth the one with a name from its tag wins. If that doesn't decide it, all of them are
+// dropped. Conflicting fields of the outer struct itself are all kept as before, the last one
+// receives the nvpair when decoding. Extra and nvflag fields conflict with their own kind.
+func dominantFields(fields []field) []field {
+	byKey := make(map[fieldKey][]int)
+	for i := range fields {
+		k := fields[i].key()
+		byKey[k] = append(byKey[k], i)
+	}
+	keep := make([]bool, len(fields))
+	for k, candidates := range byKey {
+		depth := len(fields[candidates[0]].index)
+		for _, i := range candidates {
+			if len(fields[i].index) < depth {
+				depth = len(fields[i].index)
+			}
+		}
+		var shallowest, tagged []int
+		for _, i := range candidates {
+			if len(fields[i].index) == depth {
+				shallowest = append(shallowest, i)
+				if fields[i].tagged {
+					tagged = append(tagged, i)
+				}
+			}
+		}
+		switch {
+		case depth == 1 || k.extra || k.nvflag:
+			for _, i := range shallowest {
+				keep[i] = true
+			}
+		case len(tagged) == 1:
+			keep[tagged[0]] = true
+		case len(tagged) == 0 && len(shallowest) == 1:
+			keep[shallowest[0]] = true
+		}
+	}
+	var out []field
+	for i, f := range fields {
+		if keep[i] {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// fieldByIndex returns the field of the struct v with the given index. It returns false if the field
+// is promoted through a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc returns the field of the struct v with the given index, allocating nil pointers
+// to embedded structs on the way
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// structPlan contains everything derived from the tags of a struct type, it is computed once per type
+type structPlan struct {
+	fields []field
+	// byName maps nvpair names to indices into fields, extra and nvflag fields are not included
+	byName map[string]int
+}
+
+var structPlans sync.Map // map[reflect.Type]*structPlan
+
+// cachedStructPlan returns the plan for the struct type t
+func cachedStructPlan(t reflect.Type) *structPlan {
+	if p, ok := structPlans.Load(t); ok {
+		return p.(*structPlan)
+	}
+	fields := structFields(t)
+	p := &structPlan{fields: fields, byName: make(map[string]int, len(fields))}
+	for i, f := range fields {
+		if !f.extra && !f.nvflag {
+			p.byName[f.name] = i
+		}
+	}
+	actual, _ := structPlans.LoadOrStore(t, p)
+	return actual.(*structPlan)
+}
+
+// isExtraMap checks if t can be used for a field with the extra option
+func isExtraMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.String
+}
+
+// isFlagsField checks if t can be used for a field with the nvflag option
+func isFlagsField(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// setDefault sets v to the value given in the default option of its tag. Integers also accept
+// true and false, which are stored as 1 and 0.
+func setDefault(v reflect.Value, value string) error {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return ErrInvalidTag
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 0, v.Type().Bits())
+		if err != nil {
+			b, boolErr := strconv.ParseBool(value)
+			if boolErr != nil {
+				return ErrInvalidTag
+			}
+			i = boolToInt(b)
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 0, v.Type().Bits())
+		if err != nil {
+			b, boolErr := strconv.ParseBool(value)
+			if boolErr != nil {
+				return ErrInvalidTag
+			}
+			u = uint64(boolToInt(b))
+		}
+		v.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return ErrInvalidTag
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return ErrInvalidTag
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,570 @@
+package nvlist
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PrintFormat is one of the text formats libnvpair prints nvlists in
+type PrintFormat int
+
+const (
+	// FormatNvlistPrint is the format of nvlist_print(), which writes every pair as "name = value"
+	// with hexadecimal unsigned numbers and delimits embedded nvlists with "(end name)" lines
+	FormatNvlistPrint PrintFormat = iota
+	// FormatDumpNvlist is the format of dump_nvlist(), which zdb uses for pool configurations. It
+	// writes "name: value" with decimal numbers and quoted strings, embedded nvlists are indented by
+	// four spaces. Like libnvpair it doesn't support hrtime and double pairs.
+	FormatDumpNvlist
+)
+
+// PrintOptions configures how nvlists are printed
+type PrintOptions struct {
+	Format PrintFormat
+	// Indent is the indentation of the top-level nvlist, in tabs for FormatNvlistPrint and in spaces
+	// for FormatDumpNvlist. zdb -C prints configurations with an indentation of 8.
+	Indent int
+}
+
+// Fprint decodes the nvlist in data and prints it to w in a text format of libnvpair
+func Fprint(w io.Writer, data []byte, opts PrintOptions) error {
+	var l List
+	if err := Unmarshal(data, &l); err != nil {
+		return err
+	}
+	return l.Fprint(w, opts)
+}
+
+// Fprint prints l to w in a text format of libnvpair
+func (l *List) Fprint(w io.Writer, opts PrintOptions) error {
+	var buf bytes.Buffer
+	var err error
+	switch opts.Format {
+	case FormatNvlistPrint:
+		err = printNvlist(&buf, l, opts.Indent, nil)
+	case FormatDumpNvlist:
+		err = dumpNvlist(&buf, l, opts.Indent, nil)
+	default:
+		return fmt.Errorf("nvlist: unknown print format %d", opts.Format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// printValue returns the value of p after checking that it has the Go type required by its type
+func printValue(p *Pair, path *nvPath) (reflect.Value, error) {
+	if p.Type == TypeBoolean {
+		return reflect.Value{}, nil
+	}
+	expected, ok := listValueTypes[p.Type]
+	if !ok {
+		return reflect.Value{}, encodeError(ErrUnsupportedType, path, nil)
+	}
+	val := reflect.ValueOf(p.Value)
+	if !val.IsValid() || val.Type() != expected {
+		return reflect.Value{}, encodeError(ErrTypeMismatch, path, reflect.TypeOf(p.Value))
+	}
+	return val, nil
+}
+
+// printNvlist writes l like nvlist_print() with the given number of tabs
+func printNvlist(buf *bytes.Buffer, l *List, indent int, path *nvPath) error {
+	tabs := strings.Repeat("\t", indent)
+	// The version of nvlists is always 0
+	fmt.Fprintf(buf, "%vnvlist version: 0\n", tabs)
+	for i := range l.Pairs {
+		p := &l.Pairs[i]
+		pairPath := path.child(p.Name)
+		val, err := printValue(p, pairPath)
+		if err != nil {
+			return err
+		}
+		switch p.Type {
+		case TypeNvlist:
+			fmt.Fprintf(buf, "%v\t%v = (embedded nvlist)\n", tabs, p.Name)
+			if err := printNvlist(buf, p.Value.(*List), indent+1, pairPath); err != nil {
+				return err
+			}
+			fmt.Fprintf(buf, "%v\t(end %v)\n", tabs, p.Name)
+		case TypeNvlistArray:
+			fmt.Fprintf(buf, "%v\t%v = (array of embedded nvlists)\n", tabs, p.Name)
+			for j, nested := range p.Value.([]*List) {
+				fmt.Fprintf(buf, "%v\t(start %v[%d])\n", tabs, p.Name, j)
+				if err := printNvlist(buf, nested, indent+1, pairPath.element(j)); err != nil {
+					return err
+				}
+				fmt.Fprintf(buf, "%v\t(end %v[%d])\n", tabs, p.Name, j)
+			}
+		default:
+			if val.Kind() != reflect.Slice {
+				fmt.Fprintf(buf, "%v\t%v = %v", tabs, p.Name, printScalar(p.Type, val))
+			} else if val.Len() > 0 {
+				// Empty arrays only leave the end of line
+				elems := make([]string, val.Len())
+				for j := range elems {
+					elems[j] = printScalar(p.Type, val.Index(j))
+				}
+				fmt.Fprintf(buf, "%v\t%v = %v", tabs, p.Name, strings.Join(elems, " "))
+			}
+		}
+		// libnvpair ends every pair with a newline, which also leaves an empty line after nvlists
+		buf.WriteString("\n")
+	}
+	return nil
+}
+
+// printScalar formats a single value or array element like nvlist_print()
+func printScalar(t Type, v reflect.Value) string {
+	switch t {
+	case TypeBoolean:
+		return "1"
+	case TypeBooleanValue, TypeBooleanArray:
+		if v.Bool() {
+			return "1"
+		}
+		return "0"
+	case TypeByte, TypeByteArray:
+		return fmt.Sprintf("0x%2.2x", v.Uint())
+	case TypeHrtime:
+		return "0x" + strconv.FormatUint(uint64(v.Int()), 16)
+	case TypeDouble:
+		return "0x" + formatCFloat(v.Float())
+	case TypeString, TypeStringArray:
+		return v.String()
+	}
+	switch v.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	default:
+		return "0x" + strconv.FormatUint(v.Uint(), 16)
+	}
+}
+
+// formatCFloat formats f like %f in C
+func formatCFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', 6, 64)
+}
+
+// dumpNvlist writes l like dump_nvlist() with the given number of spaces
+func dumpNvlist(buf *bytes.Buffer, l *List, indent int, path *nvPath) error {
+	spaces := strings.Repeat(" ", indent)
+	for i := range l.Pairs {
+		p := &l.Pairs[i]
+		pairPath := path.child(p.Name)
+		val, err := printValue(p, pairPath)
+		if err != nil {
+			return err
+		}
+		switch p.Type {
+		case TypeBoolean:
+			fmt.Fprintf(buf, "%v%v\n", spaces, p.Name)
+		case TypeBooleanValue:
+			fmt.Fprintf(buf, "%v%v: %v\n", spaces, p.Name, val.Bool())
+		case TypeBooleanArray:
+			elems := make([]string, val.Len())
+			for j := range elems {
+				elems[j] = strconv.FormatBool(val.Index(j).Bool())
+			}
+			fmt.Fprintf(buf, "%v%v: [%v]\n", spaces, p.Name, strings.Join(elems, ", "))
+		case TypeNvlist:
+			fmt.Fprintf(buf, "%v%v:\n", spaces, p.Name)
+			if err := dumpNvlist(buf, p.Value.(*List), indent+4, pairPath); err != nil {
+				return err
+			}
+		case TypeNvlistArray:
+			for j, nested := range p.Value.([]*List) {
+				fmt.Fprintf(buf, "%v%v[%d]:\n", spaces, p.Name, j)
+				if err := dumpNvlist(buf, nested, indent+4, pairPath.element(j)); err != nil {
+					return err
+				}
+			}
+		case TypeHrtime, TypeDouble:
+			fmt.Fprintf(buf, "bad config type %d for %v\n", p.Type, p.Name)
+		default:
+			if val.Kind() != reflect.Slice {
+				fmt.Fprintf(buf, "%v%v: %v\n", spaces, p.Name, dumpScalar(val))
+				continue
+			}
+			for j := 0; j < val.Len(); j++ {
+				fmt.Fprintf(buf, "%v%v[%d]: %v\n", spaces, p.Name, j, dumpScalar(val.Index(j)))
+			}
+		}
+	}
+	return nil
+}
+
+// dumpScalar formats a single value or array element like dump_nvlist()
+func dumpScalar(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return "'" + v.String() + "'"
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	default:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+}
+
+// ParseText parses an nvlist printed by nvlist_print() or dump_nvlist() of libnvpair, for example the
+// output of zdb -C, and returns it as a List. The format is detected automatically.
+//
+// The text formats don't preserve the exact nvpair types, so they are inferred: numbers become
+// uint64 or, if they are signed, int64 values, numbers with a fraction become doubles and everything
+// else becomes a string. Embedded nvlists and their arrays are recognized, other arrays are only
+// recognized in the output of dump_nvlist(); nvlist_print() writes their elements separated by
+// spaces like a string, so they are only detected if all elements are numbers. Booleans printed by
+// dump_nvlist() become boolean or boolean_value pairs, nvlist_print() prints them as numbers.
+// Decoding a parsed List into a struct converts the numbers into the types of its fields.
+func ParseText(text []byte) (*List, error) {
+	p := &textParser{}
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	scanner.Buffer(nil, DefaultMaxTotalSize)
+	for scanner.Scan() {
+		p.lines = append(p.lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for p.pos < len(p.lines) && strings.TrimSpace(p.lines[p.pos]) == "" {
+		p.pos++
+	}
+	if p.pos == len(p.lines) {
+		return nil, fmt.Errorf("nvlist: no nvlist in text")
+	}
+	var l *List
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(p.lines[p.pos]), "nvlist version: ") {
+		l, err = p.parseNvlistPrint("")
+	} else {
+		l, err = p.parseDumpNvlist(indentation(p.lines[p.pos]))
+	}
+	if err != nil {
+		return nil, err
+	}
+	for ; p.pos < len(p.lines); p.pos++ {
+		if strings.TrimSpace(p.lines[p.pos]) != "" {
+			return nil, p.errorf("trailing text after the nvlist")
+		}
+	}
+	return l, nil
+}
+
+// textParser holds the lines of a printed nvlist and the index of the next one to parse
+type textParser struct {
+	lines []string
+	pos   int
+}
+
+func (p *textParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("nvlist: line %d: %v", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// parseNvlistPrint parses an nvlist printed by nvlist_print() starting with its version line, end is
+// the line terminating it for embedded nvlists
+func (p *textParser) parseNvlistPrint(end string) (*List, error) {
+	if p.pos == len(p.lines) || !strings.HasPrefix(strings.TrimSpace(p.lines[p.pos]), "nvlist version: ") {
+		return nil, p.errorf("expected an nvlist version")
+	}
+	p.pos++
+	l := NewList()
+	for ; p.pos < len(p.lines); p.pos++ {
+		// Values can end with spaces
+		line := strings.TrimLeft(p.lines[p.pos], "\t")
+		if line == "" {
+			continue
+		}
+		if end != "" && line == end {
+			return l, nil
+		}
+		i := strings.Index(line, " = ")
+		if i < 0 {
+			return nil, p.errorf("expected name = value, got %q", line)
+		}
+		name, value := line[:i], line[i+3:]
+		switch value {
+		case "(embedded nvlist)":
+			p.pos++
+			nested, err := p.parseNvlistPrint("(end " + name + ")")
+			if err != nil {
+				return nil, err
+			}
+			l.Add(name, TypeNvlist, nested)
+		case "(array of embedded nvlists)":
+			var lists []*List
+			for {
+				p.pos++
+				for p.pos < len(p.lines) && strings.TrimSpace(p.lines[p.pos]) == "" {
+					p.pos++
+				}
+				elem := fmt.Sprintf("%v[%d])", name, len(lists))
+				if p.pos == len(p.lines) || strings.TrimSpace(p.lines[p.pos]) != "(start "+elem {
+					p.pos--
+					break
+				}
+				p.pos++
+				nested, err := p.parseNvlistPrint("(end " + elem)
+				if err != nil {
+					return nil, err
+				}
+				lists = append(lists, nested)
+			}
+			l.Add(name, TypeNvlistArray, lists)
+		default:
+			t, v := parsePrintedValue(value)
+			l.Add(name, t, v)
+		}
+	}
+	if end != "" {
+		return nil, p.errorf("missing %q", end)
+	}
+	return l, nil
+}
+
+// parsePrintedValue infers the type of a value printed by nvlist_print()
+func parsePrintedValue(value string) (Type, interface{}) {
+	fields := strings.Split(value, " ")
+	if len(fields) == 1 {
+		if u, ok := parseHex(value); ok {
+			return TypeUint64, u
+		}
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return TypeInt64, i
+		}
+		if strings.HasPrefix(value, "0x") {
+			if f, err := strconv.ParseFloat(value[2:], 64); err == nil && strings.Contains(value, ".") {
+				return TypeDouble, f
+			}
+		}
+		return TypeString, value
+	}
+	uints := make([]uint64, len(fields))
+	for i, field := range fields {
+		u, ok := parseHex(field)
+		if !ok {
+			uints = nil
+			break
+		}
+		uints[i] = u
+	}
+	if uints != nil {
+		return TypeUint64Array, uints
+	}
+	ints := make([]int64, len(fields))
+	for i, field := range fields {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return TypeString, value
+		}
+		ints[i] = n
+	}
+	return TypeInt64Array, ints
+}
+
+// parseHex parses an unsigned number printed with 0x%x
+func parseHex(s string) (uint64, bool) {
+	if !strings.HasPrefix(s, "0x") {
+		return 0, false
+	}
+	u, err := strconv.ParseUint(s[2:], 16, 64)
+	return u, err == nil
+}
+
+// indentation returns the number of leading spaces of line
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// parseDumpNvlist parses the pairs of an nvlist printed by dump_nvlist() which are indented by indent
+// spaces
+func (p *textParser) parseDumpNvlist(indent int) (*List, error) {
+	l := NewList()
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			p.pos++
+			continue
+		}
+		if i := indentation(line); i < indent {
+			break
+		} else if i > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		line = line[indent:]
+		p.pos++
+		if strings.HasPrefix(line, "bad config type ") {
+			return nil, p.errorf("%v", line)
+		}
+
+		var name, value string
+		isList := false
+		switch {
+		case strings.HasSuffix(line, ":"):
+			name = line[:len(line)-1]
+			isList = true
+		case strings.HasSuffix(line, "'") && strings.Contains(line, ": '"):
+			i := strings.Index(line, ": '")
+			name, value = line[:i], line[i+2:]
+		case strings.Contains(line, ": "):
+			i := strings.LastIndex(line, ": ")
+			name, value = line[:i], line[i+2:]
+		default:
+			l.AddFlag(line)
+			continue
+		}
+		base, index, isElem := splitArrayElem(name)
+		if isList {
+			nested := NewList()
+			if p.pos < len(p.lines) && indentation(p.lines[p.pos]) > indent {
+				var err error
+				if nested, err = p.parseDumpNvlist(indentation(p.lines[p.pos])); err != nil {
+					return nil, err
+				}
+			}
+			if !isElem {
+				l.Add(name, TypeNvlist, nested)
+				continue
+			}
+			if err := p.appendElem(l, base, index, TypeNvlistArray, nested); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		t, v, err := parseDumpedValue(value)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if !isElem || t == TypeBooleanArray {
+			l.Add(name, t, v)
+			continue
+		}
+		if err := p.appendElem(l, base, index, t, v); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// splitArrayElem splits the name of an array element printed as name[index]
+func splitArrayElem(name string) (string, int, bool) {
+	if !strings.HasSuffix(name, "]") {
+		return name, 0, false
+	}
+	i := strings.LastIndex(name, "[")
+	if i <= 0 {
+		return name, 0, false
+	}
+	index, err := strconv.Atoi(name[i+1 : len(name)-1])
+	if err != nil || index < 0 {
+		return name, 0, false
+	}
+	return name[:i], index, true
+}
+
+// parseDumpedValue infers the type of a single value printed by dump_nvlist()
+func parseDumpedValue(value string) (Type, interface{}, error) {
+	switch {
+	case value == "true" || value == "false":
+		return TypeBooleanValue, value == "true", nil
+	case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) >= 2:
+		return TypeString, value[1 : len(value)-1], nil
+	case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+		var bools []bool
+		if inner := value[1 : len(value)-1]; inner != "" {
+			for _, elem := range strings.Split(inner, ", ") {
+				b, err := strconv.ParseBool(elem)
+				if err != nil {
+					return TypeUnknown, nil, fmt.Errorf("invalid boolean array %v", value)
+				}
+				bools = append(bools, b)
+			}
+		}
+		return TypeBooleanArray, bools, nil
+	case strings.HasPrefix(value, "-"):
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return TypeUnknown, nil, fmt.Errorf("invalid value %v", value)
+		}
+		return TypeInt64, i, nil
+	}
+	u, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return TypeUnknown, nil, fmt.Errorf("invalid value %v", value)
+	}
+	return TypeUint64, u, nil
+}
+
+// appendElem appends the array element with the given index to the array pair name, which has to
+// be the last pair of l unless index is 0
+func (p *textParser) appendElem(l *List, name string, index int, t Type, v interface{}) error {
+	if index == 0 {
+		switch t {
+		case TypeNvlistArray:
+			l.Add(name, t, []*List{v.(*List)})
+		case TypeString:
+			l.Add(name, TypeStringArray, []string{v.(string)})
+		case TypeInt64:
+			l.Add(name, TypeInt64Array, []int64{v.(int64)})
+		case TypeUint64:
+			l.Add(name, TypeUint64Array, []uint64{v.(uint64)})
+		default:
+			return p.errorf("invalid array element type %v", t)
+		}
+		return nil
+	}
+	var last *Pair
+	if len(l.Pairs) > 0 {
+		last = &l.Pairs[len(l.Pairs)-1]
+	}
+	if last == nil || last.Name != name || !isArrayType(last.Type) || reflect.ValueOf(last.Value).Len() != index {
+		return p.errorf("unexpected element %v[%d]", name, index)
+	}
+	switch {
+	case last.Type == TypeNvlistArray && t == TypeNvlistArray:
+		last.Value = append(last.Value.([]*List), v.(*List))
+	case last.Type == TypeStringArray && t == TypeString:
+		last.Value = append(last.Value.([]string), v.(string))
+	case last.Type == TypeUint64Array && t == TypeUint64:
+		last.Value = append(last.Value.([]uint64), v.(uint64))
+	case last.Type == TypeInt64Array && t == TypeInt64:
+		last.Value = append(last.Value.([]int64), v.(int64))
+	case last.Type == TypeUint64Array && t == TypeInt64:
+		// Signed elements turn the whole array signed
+		uints := last.Value.([]uint64)
+		ints := make([]int64, len(uints), len(uints)+1)
+		for i, u := range uints {
+			if u > math.MaxInt64 {
+				return p.errorf("array %v mixes negative numbers and numbers above 2^63", name)
+			}
+			ints[i] = int64(u)
+		}
+		last.Type, last.Value = TypeInt64Array, append(ints, v.(int64))
+	case last.Type == TypeInt64Array && t == TypeUint64 && v.(uint64) <= math.MaxInt64:
+		last.Value = append(last.Value.([]int64), int64(v.(uint64)))
+	default:
+		return p.errorf("element %v[%d] doesn't match the array type %v", name, index, last.Type)
+	}
+	return nil
+}
+
+// isArrayType checks if pairs of type t contain a slice
+func isArrayType(t Type) bool {
+	return listValueTypes[t] != nil && listValueTypes[t].Kind() == reflect.Slice
+}
@@ -8,7 +8,7 @@ type nvpair struct {
 	Name_sz    int16
 	Reserve    int16
 	Value_elem int32
-	Type       nvtype
+	Type       Type
 }
 type nvlist struct {
 	Version int32
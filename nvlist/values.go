@@ -0,0 +1,29 @@
+package nvlist
+
+import (
+	"reflect"
+	"time"
+)
+
+// Flag is a boolean encoded as an nvpair of type boolean, which only consists of its name and has
+// no value. A false Flag is not encoded at all. This is the default for bool.
+type Flag bool
+
+// BoolValue is a boolean encoded as an nvpair of type boolean_value, which has an explicit true or
+// false value. Like flags, pairs of type boolean_value are decoded as bool into empty interfaces,
+// decoding them into a BoolValue keeps their type.
+type BoolValue bool
+
+var boolValueType = reflect.TypeOf(BoolValue(false))
+
+// Hrtime is a high-resolution time in nanoseconds (hrtime_t) as found for example in ZFS events. It
+// is encoded as an nvpair of type hrtime, all other integers are encoded according to their size.
+type Hrtime int64
+
+var hrtimeType = reflect.TypeOf(Hrtime(0))
+
+// Duration returns the hrtime as a time.Duration. hrtimes are usually relative to an arbitrary
+// point like the boot of the system, not to the Unix epoch.
+func (h Hrtime) Duration() time.Duration {
+	return time.Duration(h)
+}